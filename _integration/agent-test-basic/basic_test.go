@@ -61,7 +61,7 @@ func watchLogs(agentURL string, id string) func() {
 		panic("can't connect to agent to watch events")
 	}
 
-	logs, _, err := c.Log(id, 10)
+	logs, _, err := c.Log(id, agent.LogQuery{History: 10})
 	if err != nil {
 		panic("can't watch logs")
 	}
@@ -71,11 +71,11 @@ func watchLogs(agentURL string, id string) func() {
 	go func() {
 		for {
 			select {
-			case line := <-logs:
-				if line == "" {
+			case entry := <-logs:
+				if entry.Line == "" {
 					continue
 				}
-				fmt.Printf("LOG: %s", line)
+				fmt.Printf("LOG: [%s] %s\n", entry.Stream, entry.Line)
 			case <-stopc:
 				return
 			}
@@ -30,7 +30,7 @@ func main() {
 		Capabilities: []string{
 			"CHOWN",
 			"DAC_OVERRIDE",
-			// FOWNER is necessary for tar to set file utimes.
+			// FOWNER is necessary for extracting artifacts, to set file utimes.
 			"FOWNER",
 			// KILL is necessary for stopping containers.
 			"KILL",
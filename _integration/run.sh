@@ -61,15 +61,6 @@ if [ $KEEP_ARTIFACTS -eq 0 ]; then
   trap "shutdown $HTTPD_PID && rm -rf $httpdir && sudo rm -rf $rootfs" EXIT
 fi
 
-# svlogd is necessary for collecting logs
-install -D $(which svlogd) $rootfs/bin/
-# tar is necessary for unpacking downloaded artifacts
-install -D $(which tar) $rootfs/bin/
-# tar uses these programs to uncompress files
-install -D $(which bunzip2) $rootfs/bin/
-install -D $(which gunzip) $rootfs/bin/
-install -D $(which gzip) $rootfs/bin/
-
 # Debugging tools
 if [ $KEEP_ARTIFACTS -ne 0 ]; then
   install -D $(which bash) $rootfs/bin/
@@ -89,6 +80,7 @@ GOBIN=$rootfs/srv/harpoon/bin go install github.com/soundcloud/harpoon/...
 echo "run: install harpoon libraries"
 for bin in $rootfs/srv/harpoon/bin/* $rootfs/bin/*
 do
+  [ -e "$bin" ] || continue # $rootfs/bin is empty unless debugging
   copy_dependencies $bin $rootfs ||
     abort "run: unable to install dependencies"
 done
@@ -2,10 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"mime"
 	"net/http"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -26,6 +26,7 @@ type api struct {
 	vols            volumes
 	cpu             float64
 	mem             int64
+	storage         int64
 	downloadTimeout time.Duration
 	debug           bool
 	sync.RWMutex
@@ -44,6 +45,7 @@ func newAPI(
 	vols volumes,
 	cpu float64,
 	mem int64,
+	storage int64,
 	downloadTimeout time.Duration,
 	debug bool,
 ) *api {
@@ -57,6 +59,7 @@ func newAPI(
 			vols:            vols,
 			cpu:             cpu,
 			mem:             mem,
+			storage:         storage,
 			downloadTimeout: downloadTimeout,
 			debug:           debug,
 		}
@@ -70,6 +73,8 @@ func newAPI(
 	mux.Post(agent.APIVersionPrefix+agent.APIStopContainerPath, http.HandlerFunc(api.handleStop))
 	mux.Get(agent.APIVersionPrefix+agent.APIGetContainerLogPath, http.HandlerFunc(api.handleLog))
 	mux.Get(agent.APIVersionPrefix+agent.APIGetResourcesPath, http.HandlerFunc(api.handleResources))
+	mux.Get(agent.APIVersionPrefix+agent.APIListArtifactsPath, http.HandlerFunc(api.handleArtifacts))
+	mux.Del(agent.APIVersionPrefix+agent.APIPurgeArtifactsPath, http.HandlerFunc(api.handlePurgeArtifacts))
 
 	return api
 }
@@ -90,7 +95,7 @@ func (a *api) handleGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	buf, err := json.MarshalIndent(container, "", "  ")
+	buf, err := json.MarshalIndent(container.Instance(), "", "  ")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -113,6 +118,11 @@ func (a *api) handleCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if oldID := r.URL.Query().Get("replace"); oldID != "" {
+		a.handleReplace(w, id, oldID, config)
+		return
+	}
+
 	undo := []func(){}
 	defer func() {
 		for i := len(undo) - 1; i >= 0; i-- {
@@ -143,6 +153,78 @@ func (a *api) handleCreate(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("created OK"))
 }
 
+// handleReplace creates a new container, and returns once it's been created.
+// The remainder of the replacement happens in the background; see
+// replaceContainer.
+func (a *api) handleReplace(w http.ResponseWriter, id, oldID string, config agent.ContainerConfig) {
+	if id == oldID {
+		http.Error(w, "can't replace a container with itself", http.StatusBadRequest)
+		return
+	}
+
+	old, ok := a.registry.get(oldID)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	oldInstance := old.Instance()
+
+	if status := oldInstance.ContainerStatus; status != agent.ContainerStatusRunning {
+		http.Error(w, fmt.Sprintf("container to replace is %s, not running", status), http.StatusBadRequest)
+		return
+	}
+
+	undo := []func(){}
+	defer func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}()
+
+	// Watch the old container from now on, so that its destruction during the
+	// replacement is noticed.
+	oldWatch := watchContainer(old)
+
+	undo = append(undo, func() { oldWatch.stop() })
+
+	container := newContainer(id, a.root, a.vols, config, a.debug, a.portDB, func() { a.registry.remove(id) }, a.downloadTimeout)
+
+	undo = append(undo, func() { container.Exit() })
+
+	if ok := a.registry.register(container); !ok {
+		http.Error(w, "already exists", http.StatusConflict)
+		return
+	}
+
+	undo = append(undo, func() { a.registry.remove(id) })
+
+	// Watch before creating, so that no state change is missed.
+	watch := watchContainer(container)
+
+	undo = append(undo, func() { watch.stop() })
+
+	if err := container.Create(); err != nil {
+		log.Printf("[%s] replace %s: create: %s", id, oldID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	undo = []func(){} // all good
+
+	go func() {
+		if err := replaceContainer(watch, config, oldWatch, oldInstance.ContainerConfig, a.downloadTimeout); err != nil {
+			log.Printf("[%s] replace %s: %s", id, oldID, err)
+			return
+		}
+
+		log.Printf("[%s] replace %s: OK", id, oldID)
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("replace accepted"))
+}
+
 func (a *api) handleStop(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get(":id")
 
@@ -221,7 +303,7 @@ func (a *api) handleContainerStream(_ string, enc *eventsource.Encoder, stop <-c
 	instances := a.registry.instances()
 	b, err := json.Marshal(
 		&agent.StateEvent{
-			Resources:  resources(a.registry.instances(), a.vols, a.mem, a.cpu),
+			Resources:  resources(a.registry.instances(), a.vols, a.mem, a.cpu, a.storage),
 			Containers: instances,
 		},
 	)
@@ -243,7 +325,7 @@ func (a *api) handleContainerStream(_ string, enc *eventsource.Encoder, stop <-c
 		case state := <-statec:
 			b, err := json.Marshal(
 				agent.StateEvent{
-					Resources:  resources(a.registry.instances(), a.vols, a.mem, a.cpu),
+					Resources:  resources(a.registry.instances(), a.vols, a.mem, a.cpu, a.storage),
 					Containers: map[string]agent.ContainerInstance{state.ID: state},
 				},
 			)
@@ -284,14 +366,7 @@ func isStreamAccept(accept string) bool {
 }
 
 func (a *api) handleLog(w http.ResponseWriter, r *http.Request) {
-	var (
-		id         = r.URL.Query().Get(":id")
-		rawHistory = r.URL.Query().Get("history")
-	)
-
-	if rawHistory == "" {
-		rawHistory = "10"
-	}
+	id := r.URL.Query().Get(":id")
 
 	container, ok := a.registry.get(id)
 	if !ok {
@@ -299,36 +374,76 @@ func (a *api) handleLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	history, err := strconv.Atoi(rawHistory)
+	q, err := agent.ParseLogQuery(r.URL.Query())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	h := container.Logs().last(history)
+	query, err := newLogQuery(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var lines bool
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "entries":
+	case "lines":
+		lines = true
+	default:
+		http.Error(w, fmt.Sprintf("invalid format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	h, err := container.Logs().query(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	if isStreamAccept(r.Header.Get("Accept")) {
 		eventsource.Handler(func(_ string, enc *eventsource.Encoder, stop <-chan bool) {
-			a.streamLog(h, container.Logs(), enc, stop)
+			a.streamLog(h, query, lines, container.Logs(), enc, stop)
 		}).ServeHTTP(w, r)
 		return
 	}
 
-	json.NewEncoder(w).Encode(h)
+	json.NewEncoder(w).Encode(logData(h, lines))
 }
 
-func (a *api) streamLog(history []string, current *containerLog, enc *eventsource.Encoder, stop <-chan bool) {
+// logData returns the JSON data of entries: the entries themselves, or just
+// their lines, in the format from before log entries.
+func logData(entries []agent.LogEntry, lines bool) interface{} {
+	if !lines {
+		return entries
+	}
+
+	data := make([]string, len(entries))
+	for i, entry := range entries {
+		data[i] = entry.Line
+	}
+
+	return data
+}
+
+// streamLog sends history, followed by the entries matching query that are
+// logged from then on. Queries with an end of their time range only send
+// history. Entries that couldn't be sent are reported as dropped with the next
+// entry that is sent.
+func (a *api) streamLog(history []agent.LogEntry, query logQuery, lines bool, current *containerLog, enc *eventsource.Encoder, stop <-chan bool) {
 	// logs.Notify does not write to blocked channels, so the channel has to
 	// be buffered. The capacity is chosen so that a burst of log lines won't
 	// immediately result in a loss of data during large surge of incoming log
 	// lines.
-	linec := make(chan string, logBufferSize)
+	linec := make(chan agent.LogEntry, logBufferSize)
 
 	current.notify(linec)
 	defer current.stop(linec)
 
 	if len(history) > 0 {
-		b, err := json.Marshal(history)
+		b, err := json.Marshal(logData(history, lines))
 		if err != nil {
 			log.Printf("log stream: fatal error: %s", err)
 			return
@@ -339,13 +454,29 @@ func (a *api) streamLog(history []string, current *containerLog, enc *eventsourc
 		}
 	}
 
+	if !query.Until.IsZero() {
+		return
+	}
+
+	var gaps logGaps
+
 	for {
 		select {
 		case <-stop:
 			return
 
-		case line := <-linec:
-			b, err := json.Marshal([]string{line})
+		case entry := <-linec:
+			// Entries are numbered consecutively, so entries missing from
+			// linec were dropped because the stream didn't keep up.
+			gaps.observe(entry.Seq)
+
+			if !query.match(entry.Line) {
+				continue
+			}
+
+			entry.Dropped += gaps.take()
+
+			b, err := json.Marshal(logData([]agent.LogEntry{entry}, lines))
 			if err != nil {
 				log.Printf("log stream: fatal error: %s", err)
 				return
@@ -359,7 +490,22 @@ func (a *api) streamLog(history []string, current *containerLog, enc *eventsourc
 }
 
 func (a *api) handleResources(w http.ResponseWriter, r *http.Request) {
-	json.NewEncoder(w).Encode(resources(a.registry.instances(), a.vols, a.mem, a.cpu))
+	json.NewEncoder(w).Encode(resources(a.registry.instances(), a.vols, a.mem, a.cpu, a.storage))
+}
+
+func (a *api) handleArtifacts(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(artifacts.list())
+}
+
+// handlePurgeArtifacts removes all artifacts that aren't used by any
+// container, and returns them.
+func (a *api) handlePurgeArtifacts(w http.ResponseWriter, r *http.Request) {
+	purged := artifacts.purge()
+	if purged == nil {
+		purged = []agent.Artifact{}
+	}
+
+	json.NewEncoder(w).Encode(purged)
 }
 
 func resources(
@@ -367,6 +513,7 @@ func resources(
 	vols volumes,
 	agentMem int64,
 	agentCPU float64,
+	agentStorage int64,
 ) agent.HostResources {
 	volumes := make([]string, 0, len(vols))
 
@@ -381,7 +528,7 @@ func resources(
 
 	for _, instance := range instances {
 		if instance.ContainerStatus != agent.ContainerStatusDeleted {
-			reservedMem += instance.ContainerConfig.Resources.Mem
+			reservedMem += instance.ContainerConfig.ReservedMem()
 			reservedCPU += instance.ContainerConfig.Resources.CPU
 		}
 	}
@@ -396,8 +543,8 @@ func resources(
 			Reserved: reservedCPU,
 		},
 		Storage: agent.TotalReservedInt{
-			Total:    0, // TODO bytes
-			Reserved: 0, // TODO bytes
+			Total:    uint64(agentStorage) * 1024 * 1024,
+			Reserved: reservedStorage(instances),
 		},
 		Volumes: volumes,
 	}
@@ -26,6 +26,7 @@ func TestContainerList(t *testing.T) {
 
 	var (
 		agentMem          int64   = 1000
+		agentStorage      int64   = 10000
 		agentCPU          float64 = 2
 		configuredVolumes         = map[string]struct{}{"/tmp": struct{}{}}
 		debug                     = false
@@ -33,7 +34,7 @@ func TestContainerList(t *testing.T) {
 
 		registry = newRegistry(nopServiceDiscovery{})
 		pdb      = newPortDB(lowTestPort, highTestPort)
-		api      = newAPI(testContainerRoot, registry, pdb, configuredVolumes, agentCPU, agentMem, timeout, debug)
+		api      = newAPI(testContainerRoot, registry, pdb, configuredVolumes, agentCPU, agentMem, agentStorage, timeout, debug)
 		server   = httptest.NewServer(api)
 	)
 
@@ -140,6 +141,7 @@ func TestAgentHostResources(t *testing.T) {
 
 	var (
 		agentMem          int64   = 1000
+		agentStorage      int64   = 10000
 		agentCPU          float64 = 2
 		configuredVolumes         = map[string]struct{}{"/tmp": struct{}{}}
 		debug                     = false
@@ -147,7 +149,7 @@ func TestAgentHostResources(t *testing.T) {
 
 		registry  = newRegistry(nopServiceDiscovery{})
 		pdb       = newPortDB(lowTestPort, highTestPort)
-		api       = newAPI(testContainerRoot, registry, pdb, configuredVolumes, agentCPU, agentMem, timeout, debug)
+		api       = newAPI(testContainerRoot, registry, pdb, configuredVolumes, agentCPU, agentMem, agentStorage, timeout, debug)
 		server    = httptest.NewServer(api)
 		client, _ = agent.NewClient(server.URL)
 	)
@@ -170,6 +172,10 @@ func TestAgentHostResources(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	if want, have := (agent.TotalReservedInt{Total: 10000 * 1024 * 1024, Reserved: 0}), have.Storage; want != have {
+		t.Fatalf("want storage %v, have %v", want, have)
+	}
+
 	// Create a container with some resource reservations
 
 	var (
@@ -179,6 +185,9 @@ func TestAgentHostResources(t *testing.T) {
 				Mem: 100,
 				CPU: 2,
 			},
+			Storage: agent.Storage{
+				Tmp: map[string]int{"/tmp": 50, "/var/cache": -1},
+			},
 		}
 	)
 
@@ -195,13 +204,17 @@ func TestAgentHostResources(t *testing.T) {
 
 	want = agent.HostResources{
 		CPU:     agent.TotalReserved{Total: 2.0, Reserved: 2.0},
-		Mem:     agent.TotalReservedInt{Total: 1000.0, Reserved: 100.0},
+		Mem:     agent.TotalReservedInt{Total: 1000.0, Reserved: 150.0},
 		Volumes: []string{"/tmp"},
 	}
 	if err := validateResources(want, have); err != nil {
 		t.Fatal(err)
 	}
 
+	if want, have := (agent.TotalReservedInt{Total: 10000 * 1024 * 1024, Reserved: agent.LogStorage + 50*1024*1024}), have.Storage; want != have {
+		t.Fatalf("want storage %v, have %v", want, have)
+	}
+
 	// Destroy the container
 
 	if err := client.Destroy(containerID); err != nil {
@@ -223,6 +236,10 @@ func TestAgentHostResources(t *testing.T) {
 	if err := validateResources(want, have); err != nil {
 		t.Fatal(err)
 	}
+
+	if want, have := (agent.TotalReservedInt{Total: 10000 * 1024 * 1024, Reserved: 0}), have.Storage; want != have {
+		t.Fatalf("want storage %v, have %v", want, have)
+	}
 }
 
 func TestLogAPICanTailLogs(t *testing.T) {
@@ -236,6 +253,7 @@ func TestLogAPICanTailLogs(t *testing.T) {
 
 	var (
 		agentMem          int64
+		agentStorage      int64
 		agentCPU          float64
 		configuredVolumes map[string]struct{}
 		debug             = false
@@ -243,25 +261,23 @@ func TestLogAPICanTailLogs(t *testing.T) {
 
 		registry = newRegistry(nopServiceDiscovery{})
 		pdb      = newPortDB(lowTestPort, highTestPort)
-		api      = newAPI(testContainerRoot, registry, pdb, configuredVolumes, agentCPU, agentMem, timeout, debug)
+		api      = newAPI(testContainerRoot, registry, pdb, configuredVolumes, agentCPU, agentMem, agentStorage, timeout, debug)
 		server   = httptest.NewServer(api)
 	)
 	defer pdb.exit()
 	defer server.Close()
 
-	createReceiveLogsFixture(t, registry)
-
 	c := newFakeContainer("123", "", volumes{}, agent.ContainerConfig{}, false, nil, func() {}, 0)
 	registry.register(c)
 
-	// UDP has some weirdness with processing, so we use the container log's subscription
+	// Log lines are processed asynchronously, so we use the container log's subscription
 	// mechanism to ensure that we don't run the test until all the messages have been
 	// processed.
-	linec := make(chan string, 10) // Plenty of room before anything gets dropped
+	linec := make(chan agent.LogEntry, 10) // Plenty of room before anything gets dropped
 	c.Logs().notify(linec)
 
 	// Send a log line that will be lost
-	sendLog("container[123] m1")
+	sendLog(c, "container[123] m1")
 	waitForLogLine(t, linec, time.Second)
 
 	// history=0 forces logging to ignore all previous history
@@ -287,11 +303,11 @@ func TestLogAPICanTailLogs(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			var logLines []string
-			if err := json.Unmarshal(ev.Data, &logLines); err != nil {
+			var entries []agent.LogEntry
+			if err := json.Unmarshal(ev.Data, &entries); err != nil {
 				t.Fatalf("unable to load containers json: %s", err)
 			}
-			readResultc <- logLines
+			readResultc <- logLines(entries)
 		}
 	}()
 	defer close(readStepc)
@@ -301,15 +317,15 @@ func TestLogAPICanTailLogs(t *testing.T) {
 	// Horrible, horrible hack to ensure that the eventstream.Read() has time to connect.
 	time.Sleep(time.Second)
 
-	sendLog("container[123] m2")
-	sendLog("container[123] m3")
+	sendLog(c, "container[123] m2")
+	sendLog(c, "container[123] m3")
 
-	logLines := <-readResultc
-	expectArraysEqual(t, logLines, []string{"container[123] m2"})
+	lines := <-readResultc
+	expectArraysEqual(t, lines, []string{"container[123] m2"})
 
 	readStepc <- struct{}{}
-	logLines = <-readResultc
-	expectArraysEqual(t, logLines, []string{"container[123] m3"})
+	lines = <-readResultc
+	expectArraysEqual(t, lines, []string{"container[123] m3"})
 }
 
 func TestLogAPILogTailIncludesHistory(t *testing.T) {
@@ -323,6 +339,7 @@ func TestLogAPILogTailIncludesHistory(t *testing.T) {
 
 	var (
 		agentMem          int64   = 1000
+		agentStorage      int64   = 10000
 		agentCPU          float64 = 2
 		configuredVolumes         = map[string]struct{}{"/tmp": struct{}{}}
 		debug                     = false
@@ -330,25 +347,23 @@ func TestLogAPILogTailIncludesHistory(t *testing.T) {
 
 		registry = newRegistry(nopServiceDiscovery{})
 		pdb      = newPortDB(lowTestPort, highTestPort)
-		api      = newAPI(testContainerRoot, registry, pdb, configuredVolumes, agentCPU, agentMem, timeout, debug)
+		api      = newAPI(testContainerRoot, registry, pdb, configuredVolumes, agentCPU, agentMem, agentStorage, timeout, debug)
 		server   = httptest.NewServer(api)
 	)
 	defer pdb.exit()
 	defer server.Close()
 
-	createReceiveLogsFixture(t, registry)
-
 	c := newFakeContainer("123", "", volumes{}, agent.ContainerConfig{}, false, nil, func() {}, 0)
 	registry.register(c)
 
-	// UDP has some weirdness with processing, so we use the container log's subscription
+	// Log lines are processed asynchronously, so we use the container log's subscription
 	// mechanism to ensure that we don't run the test until all the messages have been
 	// processed.
-	linec := make(chan string, 10) // Plenty of room before anything gets dropped
+	linec := make(chan agent.LogEntry, 10) // Plenty of room before anything gets dropped
 	c.Logs().notify(linec)
 
 	// Send a log line that will be lost
-	sendLog("container[123] m1")
+	sendLog(c, "container[123] m1")
 	waitForLogLine(t, linec, time.Second)
 
 	req, err := http.NewRequest("GET", server.URL+agent.APIVersionPrefix+"/containers/123/log", nil)
@@ -373,11 +388,11 @@ func TestLogAPILogTailIncludesHistory(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			var logLines []string
-			if err := json.Unmarshal(ev.Data, &logLines); err != nil {
+			var entries []agent.LogEntry
+			if err := json.Unmarshal(ev.Data, &entries); err != nil {
 				t.Fatalf("unable to load containers json: %s", err)
 			}
-			readResultc <- logLines
+			readResultc <- logLines(entries)
 		}
 	}()
 	defer close(readStepc)
@@ -386,19 +401,19 @@ func TestLogAPILogTailIncludesHistory(t *testing.T) {
 	// Horrible, horrible hack to ensure that the eventstream.Read() has time to connect.
 	time.Sleep(time.Second)
 
-	sendLog("container[123] m2")
-	sendLog("container[123] m3")
+	sendLog(c, "container[123] m2")
+	sendLog(c, "container[123] m3")
 
-	logLines := <-readResultc
-	expectArraysEqual(t, logLines, []string{"container[123] m1"})
+	lines := <-readResultc
+	expectArraysEqual(t, lines, []string{"container[123] m1"})
 
 	readStepc <- struct{}{}
-	logLines = <-readResultc
-	expectArraysEqual(t, logLines, []string{"container[123] m2"})
+	lines = <-readResultc
+	expectArraysEqual(t, lines, []string{"container[123] m2"})
 
 	readStepc <- struct{}{}
-	logLines = <-readResultc
-	expectArraysEqual(t, logLines, []string{"container[123] m3"})
+	lines = <-readResultc
+	expectArraysEqual(t, lines, []string{"container[123] m3"})
 }
 
 func TestLogAPICanRetrieveLastLines(t *testing.T) {
@@ -412,6 +427,7 @@ func TestLogAPICanRetrieveLastLines(t *testing.T) {
 
 	var (
 		agentMem          int64   = 1000
+		agentStorage      int64   = 10000
 		agentCPU          float64 = 2
 		configuredVolumes         = map[string]struct{}{"/tmp": struct{}{}}
 		debug                     = false
@@ -419,27 +435,25 @@ func TestLogAPICanRetrieveLastLines(t *testing.T) {
 
 		registry = newRegistry(nopServiceDiscovery{})
 		pdb      = newPortDB(lowTestPort, highTestPort)
-		api      = newAPI(testContainerRoot, registry, pdb, configuredVolumes, agentCPU, agentMem, timeout, debug)
+		api      = newAPI(testContainerRoot, registry, pdb, configuredVolumes, agentCPU, agentMem, agentStorage, timeout, debug)
 		server   = httptest.NewServer(api)
 	)
 	defer pdb.exit()
 	defer server.Close()
 
-	createReceiveLogsFixture(t, registry)
-
 	c := newFakeContainer("123", "", volumes{}, agent.ContainerConfig{}, false, nil, func() {}, 0)
 	registry.register(c)
 
-	// UDP has some weirdness with processing, so we use the container log's subscription
+	// Log lines are processed asynchronously, so we use the container log's subscription
 	// mechanism to ensure that we don't run the test until all the messages have been
 	// processed.
-	linec := make(chan string, 10) // Plenty of room before anything gets dropped
+	linec := make(chan agent.LogEntry, 10) // Plenty of room before anything gets dropped
 	c.Logs().notify(linec)
 
 	// Send two log messages out, wait for their reception, and then check for them in the
 	// log history.
-	sendLog("container[123] m1")
-	sendLog("container[123] m2")
+	sendLog(c, "container[123] m1")
+	sendLog(c, "container[123] m2")
 
 	waitForLogLine(t, linec, time.Second)
 	waitForLogLine(t, linec, time.Second)
@@ -448,20 +462,38 @@ func TestLogAPICanRetrieveLastLines(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unable to get log history: %s", err)
 	}
-	logLines := []string{}
-	if err = json.NewDecoder(resp.Body).Decode(&logLines); err != nil {
+	entries := []agent.LogEntry{}
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatalf("unable to read json response: %s", err)
+	}
+
+	expectArraysEqual(t, logLines(entries), []string{"container[123] m1", "container[123] m2"})
+
+	for _, entry := range entries {
+		if entry.ContainerID != "123" || entry.Stream != agent.LogStreamStdout || entry.Time.IsZero() {
+			t.Errorf("want entry of container 123 on stdout, with a timestamp, have %+v", entry)
+		}
+	}
+
+	// The format from before log entries.
+	resp, err = http.Get(server.URL + agent.APIVersionPrefix + "/containers/123/log?history=3&format=lines")
+	if err != nil {
+		t.Fatalf("unable to get log history: %s", err)
+	}
+	lines := []string{}
+	if err = json.NewDecoder(resp.Body).Decode(&lines); err != nil {
 		t.Fatalf("unable to read json response: %s", err)
 	}
 
-	expectArraysEqual(t, logLines, []string{"container[123] m1", "container[123] m2"})
+	expectArraysEqual(t, lines, []string{"container[123] m1", "container[123] m2"})
 }
 
 func TestFailedCreateDestroysContainer(t *testing.T) {
 	// There are many ways to fail:
 	//
 	// - a.registry.register fails (already exists)
-	// - container.Create fails (invalid config; can't assign ports; mkdir run/logdir fails; agent.json fails; fetch fails; symlink fails)
-	// - container.Start fails (bad initial status; supervisor log create fails; startLogger fails; supervisor create fails)
+	// - container.Create fails (invalid config; can't assign ports; mkdir run/logdir fails; log pipeline fails; agent.json fails; fetch fails; symlink fails)
+	// - container.Start fails (bad initial status; supervisor log create fails; log pipe open fails; supervisor create fails)
 	//
 	// This test just captures one of them: container.Create fails because fetch fails.
 
@@ -477,6 +509,7 @@ func TestFailedCreateDestroysContainer(t *testing.T) {
 
 	var (
 		agentMem          int64   = 1000
+		agentStorage      int64   = 10000
 		agentCPU          float64 = 2
 		configuredVolumes         = map[string]struct{}{"/tmp": struct{}{}}
 		debug                     = false
@@ -484,7 +517,7 @@ func TestFailedCreateDestroysContainer(t *testing.T) {
 
 		registry = newRegistry(nopServiceDiscovery{})
 		pdb      = newPortDB(lowTestPort, highTestPort)
-		api      = newAPI(testContainerRoot, registry, pdb, configuredVolumes, agentCPU, agentMem, timeout, debug)
+		api      = newAPI(testContainerRoot, registry, pdb, configuredVolumes, agentCPU, agentMem, agentStorage, timeout, debug)
 		server   = httptest.NewServer(api)
 		client   = agent.MustNewClient(server.URL)
 	)
@@ -0,0 +1,857 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+const artifactRoot = "/srv/harpoon/artifacts"
+
+// artifacts is the artifact cache shared by all containers of the agent.
+var artifacts = newArtifactCache(artifactRoot)
+
+// artifactCache downloads and extracts artifacts below its root, keyed by the
+// artifact URL, and the digest the artifact is pinned to, if any. Artifacts are extracted into a temporary directory, which is
+// renamed into place once complete. A manifest next to every complete
+// artifact proves its completion, so that artifacts left behind by a crash
+// are fetched again. Concurrent fetches of the same artifact share a single
+// download.
+//
+// Artifacts are referenced by the containers using them as their rootfs.
+// Once the cache grows beyond its max size, leftovers, i.e. retired artifacts
+// and unreferenced artifacts without manifest, are removed first, and then
+// unreferenced artifacts, least recently used first.
+type artifactCache struct {
+	root    string
+	maxSize uint64 // bytes; zero for unlimited
+
+	sync.Mutex
+	fetches   map[string]*artifactFetch      // path: fetch in progress
+	manifests map[string]artifactManifest    // path: manifest of a complete artifact
+	refs      map[string]map[string]struct{} // path: IDs of referencing containers
+	leftovers map[string]uint64              // path: disk usage in bytes of a leftover
+}
+
+// artifactFetch is a download in progress. done is closed once err is set.
+type artifactFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// artifactManifest records a complete artifact.
+type artifactManifest struct {
+	URL     string    `json:"url"`
+	SHA256  string    `json:"sha256"` // of the downloaded archive, or the manifest of an image
+	Size    uint64    `json:"size"`   // of the extracted artifact in bytes
+	Fetched time.Time `json:"fetched"`
+	Used    time.Time `json:"used"`
+
+	Image *ociImageConfig `json:"image,omitempty"` // of OCI images
+}
+
+func newArtifactCache(root string) *artifactCache {
+	return &artifactCache{
+		root:      root,
+		fetches:   map[string]*artifactFetch{},
+		manifests: map[string]artifactManifest{},
+		refs:      map[string]map[string]struct{}{},
+		leftovers: map[string]uint64{},
+	}
+}
+
+// fetch returns the path of the extracted artifact, downloading it unless
+// it's already complete, and records the container as referencing it. If
+// digest is given, the artifact must match it. The progress of a download is
+// reported to progress, which may be nil. Containers waiting for another
+// container's download aren't told about its progress.
+func (c *artifactCache) fetch(id, artifactURL, digest string, timeout time.Duration, progress artifactProgress) (string, error) {
+	path, err := artifactPath(c.root, artifactURL, digest)
+	if err != nil {
+		return "", err
+	}
+
+	downloaded := false
+
+	for {
+		if c.acquire(path, id, digest) {
+			if downloaded {
+				c.collect()
+			}
+
+			return path, nil
+		}
+
+		f, wait := c.begin(path)
+		if wait {
+			<-f.done
+
+			if f.err != nil {
+				return "", f.err
+			}
+
+			continue // the artifact may not match our digest
+		}
+
+		log.Printf("fetching URL %s to %s", artifactURL, path)
+
+		err := c.download(artifactURL, digest, path, timeout, &transferProgress{report: progress})
+		c.end(path, f, err)
+
+		if err != nil {
+			return "", err
+		}
+
+		downloaded = true
+	}
+}
+
+// begin registers a fetch of the artifact at path, unless one is already in
+// progress, in which case the caller should wait for it to complete.
+func (c *artifactCache) begin(path string) (f *artifactFetch, wait bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if f, ok := c.fetches[path]; ok {
+		return f, true
+	}
+
+	f = &artifactFetch{done: make(chan struct{})}
+	c.fetches[path] = f
+
+	return f, false
+}
+
+func (c *artifactCache) end(path string, f *artifactFetch, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.fetches, path)
+
+	f.err = err
+	close(f.done)
+}
+
+// acquire records the container as referencing the artifact at path, if it's
+// complete and matches the digest.
+func (c *artifactCache) acquire(path, id, digest string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	m, ok := c.manifest(path)
+	if !ok || (digest != "" && !strings.EqualFold(m.SHA256, digest)) {
+		return false
+	}
+
+	c.reference(path, id)
+
+	m.Used = time.Now()
+	if err := c.writeManifest(path, m); err != nil {
+		log.Printf("artifact %s: %s", path, err)
+	}
+
+	return true
+}
+
+// adopt records the container as referencing the artifact at path, its
+// rootfs, without fetching it. It's used for recovered containers.
+func (c *artifactCache) adopt(id, path string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.reference(path, id)
+}
+
+// release removes the container's reference to its artifact, and removes
+// unreferenced artifacts if the cache grew too large.
+func (c *artifactCache) release(id string) {
+	c.Lock()
+	for path, ids := range c.refs {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(c.refs, path)
+		}
+	}
+	c.Unlock()
+
+	c.collect()
+}
+
+// reference must be called with the lock held.
+func (c *artifactCache) reference(path, id string) {
+	if _, ok := c.refs[path]; !ok {
+		c.refs[path] = map[string]struct{}{}
+	}
+
+	c.refs[path][id] = struct{}{}
+}
+
+// manifest returns the manifest of the artifact at path, if it's complete. It
+// must be called with the lock held.
+func (c *artifactCache) manifest(path string) (artifactManifest, bool) {
+	if m, ok := c.manifests[path]; ok {
+		return m, true
+	}
+
+	buf, err := ioutil.ReadFile(manifestPath(path))
+	if err != nil {
+		return artifactManifest{}, false
+	}
+
+	var m artifactManifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		log.Printf("artifact %s: invalid manifest: %s", path, err)
+		return artifactManifest{}, false
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return artifactManifest{}, false
+	}
+
+	c.manifests[path] = m
+
+	return m, true
+}
+
+// size returns the disk usage in bytes of the complete artifact at path, or
+// zero if there is none.
+func (c *artifactCache) size(path string) uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	m, _ := c.manifest(path)
+	return m.Size
+}
+
+// image returns the config of the complete OCI image at path, if any.
+func (c *artifactCache) image(path string) (ociImageConfig, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	m, ok := c.manifest(path)
+	if !ok || m.Image == nil {
+		return ociImageConfig{}, false
+	}
+
+	return *m.Image, true
+}
+
+// list returns all complete artifacts, ordered by path.
+func (c *artifactCache) list() []agent.Artifact {
+	c.Lock()
+	defer c.Unlock()
+
+	list := make([]agent.Artifact, 0, len(c.manifests))
+
+	for path, m := range c.manifests {
+		list = append(list, c.artifact(path, m))
+	}
+
+	sort.Sort(artifactsByPath(list))
+
+	return list
+}
+
+// collect removes unreferenced artifacts, least recently used first, until
+// the cache is no larger than its max size.
+func (c *artifactCache) collect() []agent.Artifact {
+	return c.evict(false)
+}
+
+// purge removes all unreferenced artifacts.
+func (c *artifactCache) purge() []agent.Artifact {
+	return c.evict(true)
+}
+
+func (c *artifactCache) evict(all bool) []agent.Artifact {
+	var (
+		evicted []agent.Artifact
+		remove  []string
+	)
+
+	c.Lock()
+
+	var (
+		total      uint64
+		candidates []string
+		leftovers  = c.scanLeftovers()
+	)
+
+	for _, path := range leftovers {
+		total += c.leftovers[path]
+	}
+
+	for path, m := range c.manifests {
+		total += m.Size
+
+		if len(c.refs[path]) > 0 {
+			continue
+		}
+
+		if _, ok := c.fetches[path]; ok {
+			continue
+		}
+
+		candidates = append(candidates, path)
+	}
+
+	sort.Sort(leastRecentlyUsed{paths: candidates, manifests: c.manifests})
+
+	// Leftovers are never used again, so they go first.
+	for _, path := range leftovers {
+		if !all && (c.maxSize == 0 || total <= c.maxSize) {
+			break
+		}
+
+		aside, err := moveAside(path, "tmp")
+		if err != nil {
+			log.Printf("artifact %s: %s", path, err)
+			continue
+		}
+
+		log.Printf("artifact cache: removing leftover %s (%d bytes)", path, c.leftovers[path])
+
+		total -= c.leftovers[path]
+		delete(c.leftovers, path)
+		remove = append(remove, aside)
+	}
+
+	for _, path := range candidates {
+		if !all && (c.maxSize == 0 || total <= c.maxSize) {
+			break
+		}
+
+		m := c.manifests[path]
+
+		// Move the artifact out of the way, so that it may be fetched again
+		// while it's being removed.
+		aside, err := moveAside(path, "tmp")
+		if err != nil {
+			log.Printf("artifact %s: %s", path, err)
+			continue
+		}
+
+		if err := os.Remove(manifestPath(path)); err != nil && !os.IsNotExist(err) {
+			log.Printf("artifact %s: %s", path, err)
+		}
+
+		delete(c.manifests, path)
+
+		total -= m.Size
+		evicted = append(evicted, c.artifact(path, m))
+		remove = append(remove, aside)
+	}
+
+	c.Unlock()
+
+	for _, path := range remove {
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("artifact cache: %s", err)
+		}
+	}
+
+	for _, a := range evicted {
+		log.Printf("artifact cache: removed %s (%d bytes)", a.URL, a.Size)
+	}
+
+	return evicted
+}
+
+// scanLeftovers returns the leftovers below the root, i.e. retired artifacts,
+// and directories that neither are nor hold artifacts known to the cache,
+// which were extracted by earlier agents, or are incomplete. Their disk usage
+// is recorded once. It must be called with the lock held.
+func (c *artifactCache) scanLeftovers() []string {
+	var (
+		leftovers []string
+		usage     = map[string]uint64{}
+	)
+
+	filepath.Walk(c.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || path == c.root {
+			return nil
+		}
+
+		name := info.Name()
+
+		switch {
+		case strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp-"):
+			return filepath.SkipDir // download or eviction in progress
+		case strings.HasPrefix(name, ".") && strings.Contains(name, ".stale-"):
+		case strings.HasPrefix(name, "."):
+			return filepath.SkipDir
+		default:
+			if _, ok := c.manifest(path); ok {
+				return filepath.SkipDir
+			}
+
+			if _, ok := c.refs[path]; ok {
+				return filepath.SkipDir
+			}
+
+			if _, ok := c.fetches[path]; ok {
+				return filepath.SkipDir
+			}
+
+			if c.holds(path) {
+				return nil
+			}
+		}
+
+		size, ok := c.leftovers[path]
+		if !ok {
+			if size, err = diskUsage(path); err != nil {
+				log.Printf("artifact cache: %s", err)
+			}
+		}
+
+		usage[path] = size
+		leftovers = append(leftovers, path)
+
+		return filepath.SkipDir
+	})
+
+	c.leftovers = usage
+
+	return leftovers
+}
+
+// holds returns true if path is a parent of an artifact that's complete,
+// referenced, or being fetched. It must be called with the lock
+// held.
+func (c *artifactCache) holds(path string) bool {
+	within := func(p string) bool {
+		return strings.HasPrefix(p, path+string(filepath.Separator))
+	}
+
+	for p := range c.manifests {
+		if within(p) {
+			return true
+		}
+	}
+
+	for p := range c.refs {
+		if within(p) {
+			return true
+		}
+	}
+
+	for p := range c.fetches {
+		if within(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// artifact must be called with the lock held.
+func (c *artifactCache) artifact(path string, m artifactManifest) agent.Artifact {
+	containers := make([]string, 0, len(c.refs[path]))
+
+	for id := range c.refs[path] {
+		containers = append(containers, id)
+	}
+
+	sort.Strings(containers)
+
+	return agent.Artifact{
+		URL:        m.URL,
+		Path:       path,
+		SHA256:     m.SHA256,
+		Size:       m.Size,
+		Fetched:    m.Fetched,
+		Used:       m.Used,
+		Containers: containers,
+	}
+}
+
+// download downloads and extracts an artifact into a temporary directory,
+// and moves it to path once it's complete.
+func (c *artifactCache) download(artifactURL, digest, path string, timeout time.Duration, p *transferProgress) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+
+	success := false
+	defer func() {
+		if !success {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	var (
+		have  string
+		image *ociImageConfig
+	)
+
+	if strings.HasPrefix(artifactURL, agent.ArtifactImagePrefix) {
+		have, image, err = fetchImage(artifactURL, digest, tmp, timeout, p)
+	} else {
+		have, err = fetchTarball(artifactURL, tmp, timeout, p)
+	}
+	if err != nil {
+		return fmt.Errorf("artifact %s: %s", artifactURL, err)
+	}
+
+	p.phase(agent.CreationPhaseExtracting)
+
+	if digest != "" && !strings.EqualFold(digest, have) {
+		incContainerArtifactVerifyFailure(1)
+		return fmt.Errorf("artifact %s failed verification: want SHA-256 %s, have %s", artifactURL, digest, have)
+	}
+
+	size, err := diskUsage(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := c.retire(path); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	success = true
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.writeManifest(path, artifactManifest{
+		URL:     artifactURL,
+		SHA256:  have,
+		Size:    size,
+		Fetched: time.Now(),
+		Image:   image,
+	})
+}
+
+// fetchTarball extracts the tarball at the URL into dst, and returns its
+// hex-encoded SHA-256 digest.
+func fetchTarball(artifactURL, dst string, timeout time.Duration, p *transferProgress) (string, error) {
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(artifactURL)
+	if err != nil {
+		incContainerArtifactDownloadFailure(1)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		incContainerArtifactDownloadFailure(1)
+		return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	if resp.ContentLength > 0 {
+		p.total = uint64(resp.ContentLength)
+	}
+
+	var (
+		hash = sha256.New()
+		body = io.TeeReader(p.reader(resp.Body), hash)
+	)
+
+	if err := extractArtifact(body, dst); err != nil {
+		return "", err
+	}
+
+	// Extraction stops reading at the end of the archive, which may be
+	// followed by padding that's part of the digest.
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		incContainerArtifactDownloadFailure(1)
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// artifactProgress receives the progress of an artifact download.
+type artifactProgress func(agent.ContainerCreation)
+
+// progressInterval limits how often the progress of a download is reported.
+const progressInterval = time.Second
+
+// transferProgress counts the bytes of an artifact downloaded so far, and
+// reports them at most once per progressInterval. Reports are dropped if
+// there's no one to report to.
+type transferProgress struct {
+	report      artifactProgress
+	transferred uint64
+	total       uint64 // zero if unknown
+	reported    time.Time
+}
+
+// reader returns a reader counting the bytes read from r.
+func (p *transferProgress) reader(r io.Reader) io.Reader {
+	return &progressReader{Reader: r, p: p}
+}
+
+func (p *transferProgress) add(n int) {
+	p.transferred += uint64(n)
+
+	if time.Since(p.reported) < progressInterval {
+		return
+	}
+
+	p.phase(agent.CreationPhaseDownloading)
+}
+
+// phase reports the given phase, with the bytes transferred so far.
+func (p *transferProgress) phase(phase agent.CreationPhase) {
+	p.reported = time.Now()
+
+	if p.report == nil {
+		return
+	}
+
+	p.report(agent.ContainerCreation{
+		CreationPhase:    phase,
+		BytesTransferred: p.transferred,
+		BytesTotal:       p.total,
+	})
+}
+
+type progressReader struct {
+	io.Reader
+	p *transferProgress
+}
+
+func (r *progressReader) Read(buf []byte) (int, error) {
+	n, err := r.Reader.Read(buf)
+	r.p.add(n)
+	return n, err
+}
+
+// retire moves an incomplete or outdated artifact at path out of the way.
+// Artifacts referenced by containers are never replaced under them. Retired
+// artifacts are removed once the cache needs the space.
+func (c *artifactCache) retire(path string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if ids := c.refs[path]; len(ids) > 0 {
+		return fmt.Errorf("artifact %s is incomplete or outdated, but used by %d container(s)", path, len(ids))
+	}
+
+	m, complete := c.manifests[path]
+
+	delete(c.manifests, path)
+
+	if err := os.Remove(manifestPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	stale, err := moveAside(path, "stale")
+	if err != nil {
+		return err
+	}
+
+	if complete {
+		c.leftovers[stale] = m.Size
+	}
+
+	log.Printf("artifact %s: retired incomplete or outdated artifact to %s", path, stale)
+
+	return nil
+}
+
+// writeManifest atomically writes the manifest of the artifact at path. It
+// must be called with the lock held.
+func (c *artifactCache) writeManifest(path string, m artifactManifest) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp := manifestPath(path) + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, manifestPath(path)); err != nil {
+		return err
+	}
+
+	c.manifests[path] = m
+
+	return nil
+}
+
+// sweep removes temporary directories and files left behind by downloads and
+// evictions that were interrupted, e.g. by a restart of the agent, and loads
+// the manifests of all complete artifacts. It must not run while artifacts
+// are being fetched.
+func (c *artifactCache) sweep() {
+	c.Lock()
+	defer c.Unlock()
+
+	filepath.Walk(c.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		var (
+			name   = info.Name()
+			tmpDir = info.IsDir() && strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp-")
+			tmp    = !info.IsDir() && strings.HasSuffix(name, ".manifest.json.tmp")
+		)
+
+		if !info.IsDir() && strings.HasSuffix(name, ".manifest.json") {
+			c.manifest(strings.TrimSuffix(path, ".manifest.json"))
+			return nil
+		}
+
+		if !tmpDir && !tmp {
+			return nil
+		}
+
+		log.Printf("artifact cache: removing %s", path)
+
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("artifact cache: %s", err)
+		}
+
+		if tmpDir {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+}
+
+// moveAside renames path to a hidden, unique sibling of the given kind, and
+// returns the new path.
+func moveAside(path, kind string) (string, error) {
+	aside, err := ioutil.TempDir(filepath.Dir(path), "."+filepath.Base(path)+"."+kind+"-")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Remove(aside); err != nil {
+		return "", err
+	}
+
+	return aside, os.Rename(path, aside)
+}
+
+// manifestPath returns the path of the manifest of the artifact at path. It's
+// kept outside of the artifact, which becomes the container's rootfs.
+func manifestPath(path string) string {
+	return path + ".manifest.json"
+}
+
+type artifactsByPath []agent.Artifact
+
+func (a artifactsByPath) Len() int           { return len(a) }
+func (a artifactsByPath) Less(i, j int) bool { return a[i].Path < a[j].Path }
+func (a artifactsByPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// leastRecentlyUsed orders artifact paths by the time their artifacts were
+// last used, or fetched if they were never used.
+type leastRecentlyUsed struct {
+	paths     []string
+	manifests map[string]artifactManifest
+}
+
+func (a leastRecentlyUsed) Len() int      { return len(a.paths) }
+func (a leastRecentlyUsed) Swap(i, j int) { a.paths[i], a.paths[j] = a.paths[j], a.paths[i] }
+
+func (a leastRecentlyUsed) Less(i, j int) bool {
+	return a.used(a.paths[i]).Before(a.used(a.paths[j]))
+}
+
+func (a leastRecentlyUsed) used(path string) time.Time {
+	m := a.manifests[path]
+	if m.Used.IsZero() {
+		return m.Fetched
+	}
+	return m.Used
+}
+
+// artifactSuffixes are the file name suffixes of artifacts, which are removed
+// to name the directory an artifact is extracted to. The format of an
+// artifact is detected from its content.
+var artifactSuffixes = []string{
+	".tar",
+	".tar.gz", ".tgz",
+	".tar.bz2", ".tbz2", ".tbz",
+	".tar.xz", ".txz",
+	".tar.zst", ".tzst",
+}
+
+// getArtifactDetails returns the path below root that an artifact is extracted
+// to. OCI images are kept apart from tarballs, below their scheme, and images
+// selected from an image layout by ref name are named after it.
+func getArtifactDetails(root, artifactURL string) (string, error) {
+	parsed, err := url.Parse(artifactURL)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse url: %s", err)
+	}
+
+	if strings.HasPrefix(artifactURL, agent.ArtifactImagePrefix) {
+		name := strings.TrimSuffix(parsed.Path, "/")
+		for _, suffix := range artifactSuffixes {
+			name = strings.TrimSuffix(name, suffix)
+		}
+
+		if name == "" {
+			return "", fmt.Errorf("no image in artifact url: %s", artifactURL)
+		}
+
+		if parsed.Fragment != "" {
+			name += ":" + parsed.Fragment
+		}
+
+		return filepath.Join(root, parsed.Scheme, parsed.Host, name), nil
+	}
+
+	for _, suffix := range artifactSuffixes {
+		if strings.HasSuffix(parsed.Path, suffix) {
+			return filepath.Join(
+				root,
+				parsed.Host,
+				strings.TrimSuffix(parsed.Path, suffix),
+			), nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown suffix for artifact url: %s", artifactURL)
+}
+
+// artifactPath returns the path below root that an artifact pinned to digest
+// is extracted to. Artifacts pinned to different digests of the same URL are
+// kept apart, so that fetching one never replaces another one in use.
+func artifactPath(root, artifactURL, digest string) (string, error) {
+	path, err := getArtifactDetails(root, artifactURL)
+	if err != nil || digest == "" {
+		return path, err
+	}
+
+	return path + "@" + strings.ToLower(digest), nil
+}
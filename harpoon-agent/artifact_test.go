@@ -0,0 +1,529 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestArtifactCacheFetchOnce(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		archive  = newTestArchive(t, map[string]string{"hello": "world"})
+		requests int32
+		server   = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			time.Sleep(50 * time.Millisecond) // let concurrent fetches pile up
+			w.Write(archive)
+		}))
+		cache = newArtifactCache(newTestArtifactRoot(t))
+		wg    sync.WaitGroup
+	)
+
+	defer server.Close()
+	defer os.RemoveAll(cache.root)
+
+	paths := make([]string, 8)
+
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			path, err := cache.fetch("test", server.URL+"/artifact.tar", "", time.Second, nil)
+			if err != nil {
+				t.Error(err)
+			}
+
+			paths[i] = path
+		}(i)
+	}
+
+	wg.Wait()
+
+	if want, have := int32(1), atomic.LoadInt32(&requests); want != have {
+		t.Errorf("want %d download, have %d", want, have)
+	}
+
+	for _, path := range paths {
+		if want, have := paths[0], path; want != have {
+			t.Errorf("want %s, have %s", want, have)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(paths[0], "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := "world", string(buf); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+
+	if want, have := uint64(len("world")), cache.size(paths[0]); want != have {
+		t.Errorf("want size %d, have %d", want, have)
+	}
+
+	// Fetching a complete artifact doesn't download it again.
+	if _, err := cache.fetch("test", server.URL+"/artifact.tar", "", time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := int32(1), atomic.LoadInt32(&requests); want != have {
+		t.Errorf("want %d download, have %d", want, have)
+	}
+}
+
+func TestArtifactCacheVerify(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		archive = newTestArchive(t, map[string]string{"hello": "world"})
+		server  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(archive) }))
+		cache   = newArtifactCache(newTestArtifactRoot(t))
+		sum     = sha256.Sum256(archive)
+		digest  = hex.EncodeToString(sum[:])
+		bad     = hex.EncodeToString(make([]byte, sha256.Size))
+	)
+
+	defer server.Close()
+	defer os.RemoveAll(cache.root)
+
+	if _, err := cache.fetch("test", server.URL+"/artifact.tar", bad, time.Second, nil); err == nil {
+		t.Fatal("want error, have none")
+	}
+
+	path, err := artifactPath(cache.root, server.URL+"/artifact.tar", bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("want no artifact after failed verification, have %v", err)
+	}
+
+	path, err = cache.fetch("test", server.URL+"/artifact.tar", digest, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m, _ := cache.manifest(path); digest != m.SHA256 {
+		t.Errorf("want manifest digest %s, have %s", digest, m.SHA256)
+	}
+}
+
+func TestArtifactCacheDigests(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		archives = [][]byte{
+			newTestArchive(t, map[string]string{"version": "1"}),
+			newTestArchive(t, map[string]string{"version": "2"}),
+		}
+		current int32
+		server  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(archives[atomic.LoadInt32(&current)])
+		}))
+		cache = newArtifactCache(newTestArtifactRoot(t))
+		paths []string
+	)
+
+	defer server.Close()
+	defer os.RemoveAll(cache.root)
+
+	// The artifact behind the URL changes while a container uses it.
+	for i, archive := range archives {
+		atomic.StoreInt32(&current, int32(i))
+
+		sum := sha256.Sum256(archive)
+
+		path, err := cache.fetch(fmt.Sprint(i), server.URL+"/artifact.tar", hex.EncodeToString(sum[:]), time.Second, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		paths = append(paths, path)
+	}
+
+	if paths[0] == paths[1] {
+		t.Fatalf("want different paths for different digests, have %s", paths[0])
+	}
+
+	for i, path := range paths {
+		buf, err := ioutil.ReadFile(filepath.Join(path, "version"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, have := fmt.Sprint(i+1), string(buf); want != have {
+			t.Errorf("%s: want version %s, have %s", path, want, have)
+		}
+	}
+}
+
+func TestArtifactCacheRetireReferenced(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		archive = newTestArchive(t, map[string]string{"hello": "world"})
+		server  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(archive) }))
+		cache   = newArtifactCache(newTestArtifactRoot(t))
+	)
+
+	defer server.Close()
+	defer os.RemoveAll(cache.root)
+
+	path, err := artifactPath(cache.root, server.URL+"/artifact.tar", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An artifact without a manifest, e.g. extracted by an earlier agent,
+	// used by a recovered container.
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.adopt("recovered", path)
+
+	if _, err := cache.fetch("new", server.URL+"/artifact.tar", "", time.Second, nil); err == nil {
+		t.Fatal("want error, have none")
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("want %s kept, have %v", path, err)
+	}
+
+	cache.release("recovered")
+
+	if _, err := cache.fetch("new", server.URL+"/artifact.tar", "", time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArtifactCacheProgress(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		archive = newTestArchive(t, map[string]string{"hello": "world"})
+		server  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(archive) }))
+		cache   = newArtifactCache(newTestArtifactRoot(t))
+		reports []agent.ContainerCreation
+	)
+
+	defer server.Close()
+	defer os.RemoveAll(cache.root)
+
+	if _, err := cache.fetch("test", server.URL+"/artifact.tar", "", time.Second, func(c agent.ContainerCreation) {
+		reports = append(reports, c)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reports) < 2 {
+		t.Fatalf("want at least 2 reports, have %v", reports)
+	}
+
+	if want, have := agent.CreationPhaseDownloading, reports[0].CreationPhase; want != have {
+		t.Errorf("want first phase %s, have %s", want, have)
+	}
+
+	want := agent.ContainerCreation{
+		CreationPhase:    agent.CreationPhaseExtracting,
+		BytesTransferred: uint64(len(archive)),
+		BytesTotal:       uint64(len(archive)),
+	}
+
+	if have := reports[len(reports)-1]; want != have {
+		t.Errorf("want last report %+v, have %+v", want, have)
+	}
+
+	// Complete artifacts aren't downloaded, and have no progress.
+	reports = nil
+
+	if _, err := cache.fetch("test", server.URL+"/artifact.tar", "", time.Second, func(c agent.ContainerCreation) {
+		reports = append(reports, c)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reports) != 0 {
+		t.Errorf("want no reports, have %v", reports)
+	}
+}
+
+func TestArtifactCacheIncomplete(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		archive = newTestArchive(t, map[string]string{"hello": "world"})
+		server  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(archive) }))
+		cache   = newArtifactCache(newTestArtifactRoot(t))
+	)
+
+	defer server.Close()
+	defer os.RemoveAll(cache.root)
+
+	path, err := getArtifactDetails(cache.root, server.URL+"/artifact.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A half-extracted artifact, without a manifest.
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if have, err := cache.fetch("test", server.URL+"/artifact.tar", "", time.Second, nil); err != nil {
+		t.Fatal(err)
+	} else if want := path; want != have {
+		t.Fatalf("want %s, have %s", want, have)
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "hello")); err != nil {
+		t.Errorf("want artifact to be fetched again, have %v", err)
+	}
+}
+
+func TestArtifactCacheSweep(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	cache := newArtifactCache(newTestArtifactRoot(t))
+	defer os.RemoveAll(cache.root)
+
+	var (
+		tmp      = filepath.Join(cache.root, "host", ".artifact.tmp-123")
+		artifact = filepath.Join(cache.root, "host", "artifact")
+	)
+
+	for _, dir := range []string{tmp, artifact} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache.sweep()
+
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("want %s removed, have %v", tmp, err)
+	}
+
+	if _, err := os.Stat(artifact); err != nil {
+		t.Errorf("want %s kept, have %v", artifact, err)
+	}
+}
+
+func TestArtifactCacheCollect(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		archive = newTestArchive(t, map[string]string{"hello": "world"})
+		server  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(archive) }))
+		cache   = newArtifactCache(newTestArtifactRoot(t))
+		paths   = map[string]string{}
+	)
+
+	defer server.Close()
+	defer os.RemoveAll(cache.root)
+
+	fetch := func(id, name string) {
+		path, err := cache.fetch(id, server.URL+"/"+name+".tar", "", time.Second, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths[name] = path
+	}
+
+	fetch("1", "a")
+	fetch("2", "b")
+	cache.release("1")
+	cache.release("2")
+	fetch("3", "a") // a is now more recently used than b
+	cache.release("3")
+	fetch("4", "c")
+
+	if want, have := 3, len(cache.list()); want != have {
+		t.Fatalf("want %d artifacts with unlimited cache size, have %d", want, have)
+	}
+
+	// Each artifact is 5 bytes. Referenced artifacts are never evicted, and
+	// of the others, the least recently used goes first.
+	fetch("5", "c")
+	cache.maxSize = 10
+	cache.collect()
+
+	for name, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, err := os.Stat(paths[name]); want != (err == nil) {
+			t.Errorf("%s: want kept %v, have %v", name, want, err)
+		}
+	}
+
+	artifacts := cache.list()
+	if want, have := 2, len(artifacts); want != have {
+		t.Fatalf("want %d artifacts, have %d", want, have)
+	}
+
+	if want, have := []string{"4", "5"}, artifacts[1].Containers; !reflect.DeepEqual(want, have) {
+		t.Errorf("want containers %v, have %v", want, have)
+	}
+
+	// Releasing the last reference evicts c, since the cache is still full.
+	cache.maxSize = 5
+	cache.release("4")
+	cache.release("5")
+
+	if want, have := 1, len(cache.list()); want != have {
+		t.Errorf("want %d artifact, have %d", want, have)
+	}
+}
+
+func TestArtifactCacheCollectLeftovers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		archive = newTestArchive(t, map[string]string{"hello": "world"})
+		server  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(archive) }))
+		cache   = newArtifactCache(newTestArtifactRoot(t))
+	)
+
+	defer server.Close()
+	defer os.RemoveAll(cache.root)
+
+	used, err := cache.fetch("1", server.URL+"/used.tar", "", time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		host      = filepath.Dir(used)
+		stale     = filepath.Join(host, ".retired.stale-1")
+		legacy    = filepath.Join(host, "legacy")
+		recovered = filepath.Join(host, "recovered")
+	)
+
+	// A retired artifact, and artifacts extracted by an earlier agent, one of
+	// them used by a recovered container. Each is 5 bytes, like the artifact.
+	for _, path := range []string{stale, legacy, recovered} {
+		if err := os.MkdirAll(filepath.Join(path, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(path, "etc", "hello"), []byte("world"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache.adopt("2", recovered)
+
+	cache.maxSize = 10
+	cache.collect()
+
+	for path, want := range map[string]bool{stale: false, legacy: true, recovered: true, used: true} {
+		if _, err := os.Stat(path); want != (err == nil) {
+			t.Errorf("%s: want kept %v, have %v", path, want, err)
+		}
+	}
+
+	cache.maxSize = 5
+	cache.collect()
+
+	for path, want := range map[string]bool{legacy: false, recovered: true, used: true} {
+		if _, err := os.Stat(path); want != (err == nil) {
+			t.Errorf("%s: want kept %v, have %v", path, want, err)
+		}
+	}
+}
+
+func TestArtifactCachePurge(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		archive = newTestArchive(t, map[string]string{"hello": "world"})
+		server  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(archive) }))
+		cache   = newArtifactCache(newTestArtifactRoot(t))
+	)
+
+	defer server.Close()
+	defer os.RemoveAll(cache.root)
+
+	used, err := cache.fetch("1", server.URL+"/used.tar", "", time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unused, err := cache.fetch("2", server.URL+"/unused.tar", "", time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.release("2")
+
+	purged := cache.purge()
+	if want, have := 1, len(purged); want != have {
+		t.Fatalf("want %d purged artifact, have %d", want, have)
+	}
+
+	if want, have := unused, purged[0].Path; want != have {
+		t.Errorf("want %s purged, have %s", want, have)
+	}
+
+	if _, err := os.Stat(unused); !os.IsNotExist(err) {
+		t.Errorf("want %s removed, have %v", unused, err)
+	}
+
+	if _, err := os.Stat(manifestPath(unused)); !os.IsNotExist(err) {
+		t.Errorf("want manifest of %s removed, have %v", unused, err)
+	}
+
+	if _, err := os.Stat(used); err != nil {
+		t.Errorf("want %s kept, have %v", used, err)
+	}
+}
+
+func newTestArtifactRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "harpoon-agent-artifact-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return root
+}
+
+func newTestArchive(t *testing.T, files map[string]string) []byte {
+	var (
+		buf bytes.Buffer
+		w   = tar.NewWriter(&buf)
+	)
+
+	for name, contents := range files {
+		if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
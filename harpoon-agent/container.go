@@ -3,17 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"math/rand"
-	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -39,11 +35,20 @@ type container interface {
 const (
 	maxContainerIDLength       = 256 // TODO(pb): enforce this limit at creation-time
 	containerLogRingBufferSize = 10000
+
+	// failedCreationRetention is how long containers that failed to be created
+	// are kept around, before they're destroyed.
+	failedCreationRetention = time.Minute
 )
 
 type realContainer struct {
 	agent.ContainerInstance
 
+	// The loop publishes copies of the ContainerInstance, which it owns, for
+	// Instance to return.
+	instanceMtx sync.RWMutex
+	instance    agent.ContainerInstance
+
 	debug             bool
 	configuredVolumes volumes
 	containerRoot     string
@@ -51,8 +56,12 @@ type realContainer struct {
 	unregister        func()
 	downloadTimeout   time.Duration
 	logs              *containerLog
+	logPipeline       *logPipeline
 	supervisor        *supervisor
+	healthChecker     *healthChecker
 	containerStatec   chan agent.ContainerProcessState
+	healthc           chan agent.ContainerHealth
+	creationc         chan creationUpdate
 	subscribers       map[chan<- agent.ContainerInstance]struct{}
 	createc           chan createRequest
 	destroyc          chan destroyRequest
@@ -61,6 +70,7 @@ type realContainer struct {
 	subc              chan chan<- agent.ContainerInstance
 	unsubc            chan chan<- agent.ContainerInstance
 	quitc             chan chan struct{}
+	donec             chan struct{}
 }
 
 // Satisfaction guaranteed.
@@ -80,6 +90,7 @@ func newRealContainer(
 		ContainerInstance: agent.ContainerInstance{
 			ID:              id,
 			ContainerStatus: agent.ContainerStatusCreated,
+			ContainerHealth: newContainerHealth(len(config.HealthChecks)),
 			ContainerConfig: config,
 		},
 
@@ -98,9 +109,18 @@ func newRealContainer(
 		subc:              make(chan chan<- agent.ContainerInstance),
 		unsubc:            make(chan chan<- agent.ContainerInstance),
 		containerStatec:   make(chan agent.ContainerProcessState),
+		healthc:           make(chan agent.ContainerHealth),
+		creationc:         make(chan creationUpdate),
 		quitc:             make(chan chan struct{}),
+		donec:             make(chan struct{}),
 	}
 
+	c.logs.id = id
+	c.logs.product = config.Product
+	c.logs.dir = filepath.Join(logRoot, id)
+
+	c.publish()
+
 	go c.loop()
 
 	return c
@@ -126,8 +146,11 @@ func (c *realContainer) Logs() *containerLog {
 	return c.logs
 }
 
+// Instance returns the state of the container, as of the last change.
 func (c *realContainer) Instance() agent.ContainerInstance {
-	return c.ContainerInstance
+	c.instanceMtx.RLock()
+	defer c.instanceMtx.RUnlock()
+	return c.instance
 }
 
 func (c *realContainer) Start() error {
@@ -156,8 +179,11 @@ func (c *realContainer) Unsubscribe(ch chan<- agent.ContainerInstance) {
 
 func (c *realContainer) loop() {
 	defer c.logs.exit()
+	defer close(c.donec)
 
-	for {
+	// The instance is published after every iteration, rather than before,
+	// as Recover may still update it before the first one.
+	for ; ; c.publish() {
 		// All methods here must be nonblocking.
 		select {
 		case req := <-c.createc:
@@ -193,11 +219,16 @@ func (c *realContainer) loop() {
 
 		case state := <-c.containerStatec:
 			c.ContainerInstance.ContainerProcessState = state
+			c.logs.setGeneration(state.Restarts)
 			if state.Up {
+				c.startHealthChecks()
 				c.updateStatus(agent.ContainerStatusRunning)
 				continue
 			}
 
+			// Health is only meaningful for a running process.
+			c.stopHealthChecks()
+
 			if state.Restarting {
 				continue
 			}
@@ -216,10 +247,23 @@ func (c *realContainer) loop() {
 
 			c.supervisor.Exit()
 
+		case health := <-c.healthc:
+			c.ContainerInstance.ContainerHealth = health
+			c.broadcast()
+
+		case u := <-c.creationc:
+			c.ContainerInstance.ContainerCreation = u.ContainerCreation
+			if u.config != nil {
+				c.ContainerInstance.ContainerConfig = *u.config
+			}
+			c.broadcast()
+
 		case ch := <-c.unsubc:
 			delete(c.subscribers, ch)
 
 		case quitc := <-c.quitc:
+			c.stopHealthChecks()
+			c.stopLogPipeline()
 			close(quitc)
 			return
 		}
@@ -230,32 +274,33 @@ func (c *realContainer) loop() {
 func (c *realContainer) Recover() error {
 	var (
 		rundir = filepath.Join(c.containerRoot, c.ID)
-		logdir = filepath.Join("/srv/harpoon/log/", c.ID)
 	)
 
 	if err := c.validateConfig(); err != nil {
 		return err
 	}
 
-	err := c.portDB.claimPorts(c.ContainerConfig.Ports)
-	if err != nil {
-		return err
-	}
+	c.ContainerCreation = agent.ContainerCreation{CreationPhase: agent.CreationPhaseReady}
+	c.publish()
 
-	logPipe, err := startLogger(c.ID, logdir)
+	err := c.portDB.claimPorts(c.ContainerConfig.Ports)
 	if err != nil {
 		return err
 	}
-	// ensure we don't hold on to the logger
-	defer logPipe.Close()
 
-	c.supervisor = newSupervisor(c.ID, rundir, c.debug)
+	c.supervisor = newSupervisor(c.ID, rundir, c.logs, c.debug)
 
 	_, err = os.Stat(filepath.Join(rundir, "control"))
 	if err == syscall.ENOENT || err == syscall.ENOTDIR {
 		return err
 	}
 	if err == nil {
+		// Containers started by earlier agents write to svlogd, which
+		// forwards their lines to the pipeline. The supervisors of all
+		// other containers take over once they acknowledge the
+		// subscription to their logs.
+		c.logPipeline = startLogPipeline(c.logs)
+
 		exitedc := make(chan error, 1)
 		c.supervisor.attach(exitedc)
 		c.supervisor.Subscribe(c.containerStatec)
@@ -273,9 +318,7 @@ func (c *realContainer) Exit() {
 func (c *realContainer) create() error {
 	var (
 		rundir = filepath.Join(c.containerRoot, c.ID)
-		logdir = filepath.Join("/srv/harpoon/log/", c.ID)
-
-		agentJSONPath = filepath.Join(rundir, "agent.json")
+		logdir = filepath.Join(logRoot, c.ID)
 	)
 
 	if err := c.validateConfig(); err != nil {
@@ -311,65 +354,139 @@ func (c *realContainer) create() error {
 		return fmt.Errorf("mkdir all %s: %s", logdir, err)
 	}
 
-	// Write agent config file
-	agentFile, err := os.OpenFile(agentJSONPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
+	if err := writeAgentConfig(rundir, c.ContainerConfig); err != nil {
 		return err
 	}
-	defer agentFile.Close()
 
-	if err := json.NewEncoder(agentFile).Encode(c.ContainerConfig); err != nil {
-		return err
+	c.ContainerCreation = agent.ContainerCreation{CreationPhase: agent.CreationPhaseDownloading}
+
+	go c.secondPhaseCreate(c.ContainerConfig)
+
+	success = true
+	return nil
+}
+
+// secondPhaseCreate fetches the artifact of the container, and reports the
+// progress to the loop. If it fails, the container is kept around in
+// CreationPhaseFailed for failedCreationRetention, so that clients can learn
+// why, and then destroyed.
+func (c *realContainer) secondPhaseCreate(config agent.ContainerConfig) {
+	config, err := c.prepareRootfs(config)
+	if err != nil {
+		log.Printf("[%s] create failed: %s", c.ID, err)
+
+		if c.report(creationUpdate{ContainerCreation: agent.ContainerCreation{
+			CreationPhase: agent.CreationPhaseFailed,
+			Err:           err.Error(),
+		}}) {
+			c.expire()
+		} else {
+			// The container was destroyed while its artifact was fetched,
+			// which may have succeeded before the failure.
+			artifacts.release(c.ID)
+		}
+		return
 	}
 
 	if c.debug {
-		log.Printf("agent file written to: %s", agentJSONPath)
+		log.Printf("artifact successfully retrieved and unpacked")
 	}
 
-	go c.secondPhaseCreate()
-
-	success = true
-	return nil
+	if !c.report(creationUpdate{
+		ContainerCreation: agent.ContainerCreation{CreationPhase: agent.CreationPhaseReady},
+		config:            &config,
+	}) {
+		// The container was destroyed while its artifact was fetched.
+		artifacts.release(c.ID)
+	}
 }
 
-func (c *realContainer) secondPhaseCreate() {
+// prepareRootfs fetches the artifact of the container, and links it into the
+// rundir. It returns the config, completed with the defaults of an image.
+func (c *realContainer) prepareRootfs(config agent.ContainerConfig) (agent.ContainerConfig, error) {
 	var (
 		rundir = filepath.Join(c.containerRoot, c.ID)
-		logdir = filepath.Join("/srv/harpoon/log/", c.ID)
+		logdir = filepath.Join(logRoot, c.ID)
 
 		rootfsSymlinkPath = filepath.Join(rundir, "rootfs")
 		logSymlinkPath    = filepath.Join(rundir, "log")
 	)
 
-	success := false
-	defer func() {
-		if !success {
-			c.destroy()
+	rootfs, err := artifacts.fetch(c.ID, config.ArtifactURL, config.ArtifactSHA256, c.downloadTimeout, func(progress agent.ContainerCreation) {
+		c.report(creationUpdate{ContainerCreation: progress})
+	})
+	if err != nil {
+		return config, fmt.Errorf("fetch: %s", err)
+	}
+
+	if image, ok := artifacts.image(rootfs); ok {
+		config = imageDefaults(config, image)
+
+		if len(config.Command.Exec) == 0 {
+			return config, fmt.Errorf("image: neither the container nor its image declare a command")
 		}
-	}()
 
-	rootfs, err := c.fetchArtifact()
-	if err != nil {
-		log.Printf("fetch: %s", err)
-		return
+		if err := writeAgentConfig(rundir, config); err != nil {
+			return config, fmt.Errorf("image: %s", err)
+		}
 	}
 
 	if err := os.Symlink(rootfs, rootfsSymlinkPath); err != nil && !os.IsExist(err) {
-		log.Printf("symlink rootfs: %s", err)
-		return
+		return config, fmt.Errorf("symlink rootfs: %s", err)
 	}
 
 	if err := os.Symlink(logdir, logSymlinkPath); err != nil && !os.IsExist(err) {
-		log.Printf("symlink log: %s", err)
+		return config, fmt.Errorf("symlink log: %s", err)
+	}
+
+	return config, nil
+}
+
+// report sends an update of the creation to the loop, and returns false if
+// the loop exited.
+func (c *realContainer) report(u creationUpdate) bool {
+	select {
+	case c.creationc <- u:
+		return true
+	case <-c.donec:
+		return false
+	}
+}
+
+// expire destroys a container that failed to be created, once it has been
+// retained for failedCreationRetention, unless it was destroyed before.
+func (c *realContainer) expire() {
+	select {
+	case <-time.After(failedCreationRetention):
+	case <-c.donec:
 		return
 	}
 
-	if c.debug {
-		log.Printf("artifact successfully retrieved and unpacked")
+	req := destroyRequest{
+		resp: make(chan error, 1),
 	}
 
-	success = true
-	c.updateStatus(agent.ContainerStatusCreated)
+	select {
+	case c.destroyc <- req:
+		if err := <-req.resp; err != nil {
+			log.Printf("[%s] destroy after failed create: %s", c.ID, err)
+		}
+	case <-c.donec:
+	}
+}
+
+// writeAgentConfig writes the config of the container to its rundir, where the
+// supervisor, and recovery, read it.
+func writeAgentConfig(rundir string, config agent.ContainerConfig) error {
+	agentJSONPath := filepath.Join(rundir, "agent.json")
+
+	agentFile, err := os.OpenFile(agentJSONPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer agentFile.Close()
+
+	return json.NewEncoder(agentFile).Encode(config)
 }
 
 func (c *realContainer) validateConfig() error {
@@ -383,9 +500,13 @@ func (c *realContainer) validateConfig() error {
 		}
 	}
 
-	for dest, size := range c.ContainerConfig.Storage.Tmp {
-		if size != -1 {
-			return fmt.Errorf("cannot make tmpfs %q %dMB: sized tmpfs storage not yet supported", dest, size)
+	if err := c.ContainerConfig.Storage.Valid(); err != nil {
+		return err
+	}
+
+	if digest := c.ContainerConfig.ArtifactSHA256; digest != "" {
+		if err := agent.ValidSHA256(digest); err != nil {
+			return fmt.Errorf("artifact SHA-256 %q invalid: %s", digest, err)
 		}
 	}
 
@@ -416,6 +537,8 @@ func (c *realContainer) destroy() error {
 		return fmt.Errorf("can't destroy container in status %s", c.ContainerInstance.ContainerStatus)
 	}
 
+	c.stopHealthChecks()
+	c.stopLogPipeline()
 	c.updateStatus(agent.ContainerStatusDeleted)
 
 	c.portDB.releasePorts(c.ContainerConfig.Ports)
@@ -425,6 +548,8 @@ func (c *realContainer) destroy() error {
 		return err
 	}
 
+	artifacts.release(c.ID)
+
 	for subc := range c.subscribers {
 		close(subc)
 	}
@@ -435,41 +560,6 @@ func (c *realContainer) destroy() error {
 	return nil
 }
 
-func (c *realContainer) fetchArtifact() (string, error) {
-	var (
-		artifactURL                            = c.ContainerConfig.ArtifactURL
-		artifactPath, artifactCompression, err = getArtifactDetails(artifactURL)
-	)
-
-	if err != nil {
-		return "", err
-	}
-
-	log.Printf("fetching URL %s to %s", artifactURL, artifactPath)
-
-	if _, err := os.Stat(artifactPath); err == nil {
-		return artifactPath, nil
-	}
-
-	if err := os.MkdirAll(artifactPath, 0755); err != nil {
-		return "", err
-	}
-
-	client := http.Client{Timeout: c.downloadTimeout}
-	resp, err := client.Get(artifactURL)
-	if err != nil {
-		incContainerArtifactDownloadFailure(1)
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if err := extractArtifact(resp.Body, artifactPath, artifactCompression); err != nil {
-		return "", err
-	}
-
-	return artifactPath, nil
-}
-
 func (c *realContainer) start() error {
 	switch c.ContainerInstance.ContainerStatus {
 	case agent.ContainerStatusCreated, agent.ContainerStatusFinished, agent.ContainerStatusFailed:
@@ -477,9 +567,16 @@ func (c *realContainer) start() error {
 		return fmt.Errorf("can't start container with status %s", c.ContainerInstance.ContainerStatus)
 	}
 
+	switch c.ContainerInstance.CreationPhase {
+	case agent.CreationPhaseReady, "":
+	case agent.CreationPhaseFailed:
+		return fmt.Errorf("can't start container that failed to be created (%s)", c.ContainerInstance.ContainerCreation.Err)
+	default:
+		return fmt.Errorf("can't start container while %s", c.ContainerInstance.CreationPhase)
+	}
+
 	var (
 		rundir = path.Join(c.containerRoot, c.ID)
-		logdir = filepath.Join("/srv/harpoon/log/", c.ID)
 	)
 
 	supervisorLog, err := os.Create(path.Join(rundir, "supervisor.log"))
@@ -490,20 +587,16 @@ func (c *realContainer) start() error {
 	// don't hold on to this log file after exec or error
 	defer supervisorLog.Close()
 
-	logPipe, err := startLogger(c.ID, logdir)
-	if err != nil {
-		return err
-	}
-
-	// ensure we don't hold on to the logger
-	defer logPipe.Close()
-
-	s := newSupervisor(c.ID, rundir, c.debug)
+	s := newSupervisor(c.ID, rundir, c.logs, c.debug)
 
-	if err := s.Start(c.ContainerConfig, logPipe, supervisorLog); err != nil {
+	if err := s.Start(c.ContainerConfig, supervisorLog); err != nil {
 		return err
 	}
 
+	// The supervisor collects the output of the container from now on, and
+	// waits for the svlogd of its predecessor, if any, to exit.
+	c.stopLogPipeline()
+
 	s.Subscribe(c.containerStatec)
 	c.supervisor = s
 
@@ -524,81 +617,70 @@ func (c *realContainer) stop() error {
 
 func (c *realContainer) updateStatus(status agent.ContainerStatus) {
 	c.ContainerInstance.ContainerStatus = status
+	c.broadcast()
+}
+
+func (c *realContainer) broadcast() {
+	c.publish()
 
 	for subc := range c.subscribers {
 		subc <- c.ContainerInstance
 	}
 }
 
-type containerAction string
-
-const (
-	containerCreate  containerAction = "create"
-	containerDestroy                 = "destroy"
-	containerStart                   = "start"
-	containerStop                    = "stop"
-)
+// publish publishes a copy of the ContainerInstance, for Instance to return.
+func (c *realContainer) publish() {
+	c.instanceMtx.Lock()
+	defer c.instanceMtx.Unlock()
+	c.instance = c.ContainerInstance
+}
 
-type logWriter string
+// stopLogPipeline stops the log pipeline of the container, if any.
+func (c *realContainer) stopLogPipeline() {
+	if c.logPipeline == nil {
+		return
+	}
 
-func (w logWriter) Write(s []byte) (int, error) {
-	log.Printf(string(w), string(s))
-	return len(s), nil
+	c.logPipeline.stop()
+	c.logPipeline = nil
 }
 
-func extractArtifact(src io.Reader, dst string, compression string) (err error) {
-	defer func() {
-		if err != nil {
-			os.RemoveAll(dst)
-		}
-	}()
+// startHealthChecks begins executing the container's health checks, if it
+// has any and they aren't already running.
+func (c *realContainer) startHealthChecks() {
+	if c.healthChecker != nil || len(c.ContainerConfig.HealthChecks) <= 0 {
+		return
+	}
 
-	// An ID to associate stderr messages with a process. A number between [1,999] should
-	// be enough to prevent a collision while small enough to be easily readable.
-	logID := strconv.Itoa(rand.Intn(999) + 1)
-	log.Printf("extracting with cmd[%s]: tar -xv%s -C %s ", logID, compression, dst)
-	cmd := exec.Command("tar", "-xv"+compression, "-C", dst)
-	cmd.Stdin = src
-	// It's incredibly hard to debug failures in tar unless stderr is available.
-	//
-	// Sadly tar has error conditions in which it reports success even though it fails.
-	// (Seen when missing the FOWNER capability.)  Therefore we can't depend upon the
-	// error code to determine when to report stderr.
-	cmd.Stderr = logWriter("tar[" + logID + "]> %s")
+	c.healthChecker = newHealthChecker(c.ID, c.ContainerConfig.HealthChecks, c.ContainerConfig.Ports, c.healthc)
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("tar extraction failed: %s", err)
+// stopHealthChecks terminates any running health checks, and resets the
+// container's health to unknown.
+func (c *realContainer) stopHealthChecks() {
+	if c.healthChecker == nil {
+		return
 	}
 
-	return nil
+	c.healthChecker.stop()
+	c.healthChecker = nil
+
+	c.ContainerInstance.ContainerHealth = newContainerHealth(len(c.ContainerConfig.HealthChecks))
 }
 
-func getArtifactDetails(artifactURL string) (string, string, error) {
-	parsed, err := url.Parse(artifactURL)
-	if err != nil {
-		return "", "", fmt.Errorf("unable to parse url: %s", err)
-	}
-
-	path := func(suffix string) string {
-		return filepath.Join(
-			"/srv/harpoon/artifacts",
-			parsed.Host,
-			strings.TrimSuffix(parsed.Path, suffix),
-		)
-	}
-
-	switch true {
-	case strings.HasSuffix(parsed.Path, ".tar"):
-		return path(".tar"), "", nil
-	case strings.HasSuffix(parsed.Path, ".tar.gz"):
-		return path(".tar.gz"), "z", nil
-	case strings.HasSuffix(parsed.Path, ".tgz"):
-		return path(".tgz"), "z", nil
-	case strings.HasSuffix(parsed.Path, ".tar.bz2"):
-		return path(".tar.bz2"), "j", nil
-	default:
-		return "", "", fmt.Errorf("unknown suffix for artifact url: %s", artifactURL)
-	}
+type containerAction string
+
+const (
+	containerCreate  containerAction = "create"
+	containerDestroy                 = "destroy"
+	containerStart                   = "start"
+	containerStop                    = "stop"
+)
+
+// creationUpdate reports the progress of creating a container to its loop.
+type creationUpdate struct {
+	agent.ContainerCreation
+	config *agent.ContainerConfig // once ready, completed with image defaults
 }
 
 type createRequest struct {
@@ -1,41 +1,56 @@
 package main
 
 import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 )
 
 func TestValidArtifactURLs(t *testing.T) {
 	validArtifactTestCases := []struct {
-		url             string
-		wantPath        string
-		wantCompression string
+		url      string
+		wantPath string
 	}{{
 		"http://foo/bar.tar",
 		"/srv/harpoon/artifacts/foo/bar",
-		"",
 	}, {
 		"http://foo/bar.tgz",
 		"/srv/harpoon/artifacts/foo/bar",
-		"z",
 	}, {
 		"http://foo/bar.tar.gz",
 		"/srv/harpoon/artifacts/foo/bar",
-		"z",
 	}, {
 		"http://foo/bar.tar.bz2",
 		"/srv/harpoon/artifacts/foo/bar",
-		"j",
+	}, {
+		"http://foo/bar.tar.xz",
+		"/srv/harpoon/artifacts/foo/bar",
+	}, {
+		"http://foo/bar.tar.zst",
+		"/srv/harpoon/artifacts/foo/bar",
+	}, {
+		"oci+http://foo/bar.tar",
+		"/srv/harpoon/artifacts/oci+http/foo/bar",
+	}, {
+		"oci+file:///images/bar#1.0",
+		"/srv/harpoon/artifacts/oci+file/images/bar:1.0",
+	}, {
+		"oci+https://foo/v2/bar/manifests/1.0",
+		"/srv/harpoon/artifacts/oci+https/foo/v2/bar/manifests/1.0",
 	},
 	}
 
 	for _, test := range validArtifactTestCases {
-		path, compression, err := getArtifactDetails(test.url)
+		path, err := getArtifactDetails(artifactRoot, test.url)
 		if path != test.wantPath {
 			t.Errorf("artifact url %q: path %q does not equal want path %q", test.url, path, test.wantPath)
 		}
-		if compression != test.wantCompression {
-			t.Errorf("artifact url %q: path %q does not equal want compression %q", test.url, compression, test.wantCompression)
-		}
 		if err != nil {
 			t.Errorf("artifact url %q: did not expect error: %s", test.url, err)
 		}
@@ -46,15 +61,119 @@ func TestInvalidArtifactURLs(t *testing.T) {
 	invalidArtifactURLs := []string{"692734hjlk,mnasdf7o689734", "http://foo/bar.unknowncompresson"}
 
 	for _, artifactURL := range invalidArtifactURLs {
-		path, compression, err := getArtifactDetails(artifactURL)
+		path, err := getArtifactDetails(artifactRoot, artifactURL)
 		if path != "" {
 			t.Errorf("artifact url %q: want no path, but got %q", artifactURL, path)
 		}
-		if compression != "" {
-			t.Errorf("artifact url %q: want no compression, but got %q", artifactURL, compression)
-		}
 		if err == nil {
 			t.Errorf("artifact url %q: want error, but got nothing", artifactURL)
 		}
 	}
 }
+
+func TestValidateConfigTmp(t *testing.T) {
+	for tmp, valid := range map[int]bool{
+		-1:   true,
+		64:   true,
+		0:    false,
+		-2:   false,
+		1024: true,
+	} {
+		c := &realContainer{}
+		c.ContainerConfig.Storage.Tmp = map[string]int{"/tmp": tmp}
+
+		if want, have := valid, c.validateConfig() == nil; want != have {
+			t.Errorf("tmp size %d: want valid %v, have %v", tmp, want, have)
+		}
+	}
+}
+
+func TestValidateConfigArtifactSHA256(t *testing.T) {
+	for digest, valid := range map[string]bool{
+		"": true,
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855": true,
+		"E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855": true,
+		"e3b0c44298fc1c149afbf4c8996fb924":                                 false,
+		"not a digest":                                                     false,
+	} {
+		c := &realContainer{}
+		c.ContainerConfig.ArtifactSHA256 = digest
+
+		if want, have := valid, c.validateConfig() == nil; want != have {
+			t.Errorf("digest %q: want valid %v, have %v", digest, want, have)
+		}
+	}
+}
+
+func TestSecondPhaseCreateDestroyedDuringFetch(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		archive   = newTestArchive(t, map[string]string{"hello": "world"})
+		fetching  = make(chan struct{})
+		destroyed = make(chan struct{})
+		server    = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(fetching)
+			<-destroyed
+			w.Write(archive)
+		}))
+		cache = newArtifactCache(newTestArtifactRoot(t))
+	)
+
+	defer server.Close()
+	defer os.RemoveAll(cache.root)
+
+	defer func(original *artifactCache) { artifacts = original }(artifacts)
+	artifacts = cache
+
+	containerRoot, err := ioutil.TempDir("", "harpoon-agent-container-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(containerRoot)
+
+	// The rundir doesn't exist, as destroying the container removed it, so
+	// that linking the fetched artifact into it fails.
+	c := &realContainer{
+		ContainerInstance: agent.ContainerInstance{ID: "123"},
+		containerRoot:     containerRoot,
+		downloadTimeout:   time.Second,
+		creationc:         make(chan creationUpdate),
+		donec:             make(chan struct{}),
+	}
+
+	// Stand in for the loop, until the container is destroyed.
+	go func() {
+		for {
+			select {
+			case <-c.creationc:
+			case <-c.donec:
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+
+	go func() {
+		c.secondPhaseCreate(agent.ContainerConfig{ArtifactURL: server.URL + "/artifact.tar"})
+		close(done)
+	}()
+
+	<-fetching
+	close(c.donec)
+	close(destroyed)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("create didn't finish")
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	if want, have := 0, len(cache.refs); want != have {
+		t.Errorf("want %d referenced artifacts, have %d: %v", want, have, cache.refs)
+	}
+}
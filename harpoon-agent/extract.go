@@ -0,0 +1,390 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// extractArtifact extracts the tar archive read from src into dst, which must
+// exist. The archive may be compressed with gzip, bzip2, xz or zstd, which is
+// detected from its content. Entries that would escape dst, and device nodes,
+// are rejected. Ownership is preserved if the agent runs as root.
+func extractArtifact(src io.Reader, dst string) error {
+	return extract(src, dst, false)
+}
+
+// extractLayer extracts an image layer read from src into dst, on top of the
+// layers extracted before it, and applies its whiteouts.
+func extractLayer(src io.Reader, dst string) error {
+	return extract(src, dst, true)
+}
+
+func extract(src io.Reader, dst string, layer bool) error {
+	r, err := decompress(src)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	return extractTar(r, dst, layer)
+}
+
+// decompress returns the decompressed content of src, detecting the
+// compression from its first bytes. Content that's not compressed with any
+// known format is returned as is.
+func decompress(src io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(src)
+
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading archive: %s", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		r, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip stream: %s", err)
+		}
+		return r, nil
+
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+
+	case bytes.HasPrefix(magic, xzMagic):
+		r, err := xz.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid xz stream: %s", err)
+		}
+		return ioutil.NopCloser(r), nil
+
+	case bytes.HasPrefix(magic, zstdMagic):
+		r, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd stream: %s", err)
+		}
+		return r.IOReadCloser(), nil
+
+	default:
+		return ioutil.NopCloser(br), nil
+	}
+}
+
+// extractTar extracts the tar archive read from r into dst. Layers may be
+// empty, and may contain whiteouts, which remove files of earlier layers.
+func extractTar(r io.Reader, dst string, layer bool) error {
+	var (
+		tr        = tar.NewReader(r)
+		chown     = os.Geteuid() == 0
+		dirs      []*tar.Header
+		extracted = map[string]struct{}{}
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid tar archive: %s", err)
+		}
+
+		if layer && strings.HasPrefix(filepath.Base(hdr.Name), whiteoutPrefix) {
+			if err := whiteout(dst, hdr.Name, extracted); err != nil {
+				return fmt.Errorf("%s: %s", hdr.Name, err)
+			}
+			continue
+		}
+
+		if err := extractEntry(tr, hdr, dst, chown); err != nil {
+			return fmt.Errorf("%s: %s", hdr.Name, err)
+		}
+
+		// Record the entry and its parents for opaque whiteouts.
+		if path, err := entryPath(dst, hdr.Name); err == nil {
+			for ; strings.HasPrefix(path, dst+"/"); path = filepath.Dir(path) {
+				extracted[path] = struct{}{}
+			}
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+	}
+
+	if len(extracted) == 0 && !layer {
+		return errors.New("empty tar archive")
+	}
+
+	// Directories are made accessible while they're extracted into, and
+	// extracting into them changes their modification time, so their mode
+	// and times are set last, innermost first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		hdr := dirs[i]
+
+		path, err := entryPath(dst, hdr.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %s", hdr.Name, err)
+		}
+
+		// The directory may have been replaced by a later entry.
+		if fi, err := os.Lstat(path); err != nil || !fi.IsDir() {
+			continue
+		}
+
+		if err := os.Chmod(path, hdr.FileInfo().Mode()); err != nil {
+			return fmt.Errorf("%s: %s", hdr.Name, err)
+		}
+
+		if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			return fmt.Errorf("%s: %s", hdr.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dst string, chown bool) error {
+	path, err := entryPath(dst, hdr.Name)
+	if err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		return nil
+	}
+
+	if path != dst {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		if err := removeConflicting(path, hdr.Typeflag); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+
+	case tar.TypeSymlink:
+		// Symlinks may point anywhere, as they're resolved in the container.
+		// Later entries are never extracted through them.
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+
+	case tar.TypeLink:
+		target, err := entryPath(dst, hdr.Linkname)
+		if err != nil {
+			return fmt.Errorf("hard link to %s: %s", hdr.Linkname, err)
+		}
+
+		// Hard links share their target's inode, including its mode and
+		// ownership.
+		return os.Link(target, path)
+
+	case tar.TypeFifo:
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return err
+		}
+
+	case tar.TypeChar, tar.TypeBlock:
+		return errors.New("device nodes are not permitted")
+
+	default:
+		return fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+
+	// Changing ownership clears setuid and setgid bits, so it goes first. It
+	// may not be permitted in a user namespace, even for root.
+	if chown {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink, tar.TypeDir:
+		return nil // symlinks can't be changed, directories are changed last
+	}
+
+	if err := os.Chmod(path, hdr.FileInfo().Mode()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+}
+
+// entryPath returns the path below dst that an entry with the given name is
+// extracted to. Names with parent directory references, and names below
+// symlinks that were already extracted, are rejected, as they may point
+// outside of dst.
+func entryPath(dst, name string) (string, error) {
+	name = strings.TrimLeft(name, "/")
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errors.New("path escapes the archive")
+		}
+	}
+
+	path := filepath.Join(dst, name)
+	if path == dst {
+		return path, nil
+	}
+
+	rel, err := filepath.Rel(dst, filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+
+	dir := dst
+
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+
+		dir = filepath.Join(dir, part)
+
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("path traverses symlink %s", strings.TrimPrefix(dir, dst+"/"))
+		}
+	}
+
+	return path, nil
+}
+
+// removeConflicting removes an existing file at path, which is replaced by
+// a later entry of the archive, or a later layer. Existing directories are
+// kept for directory entries.
+func removeConflicting(path string, typeflag byte) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() && typeflag == tar.TypeDir {
+		return nil
+	}
+
+	return os.RemoveAll(path)
+}
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// whiteout applies the whiteout with the given name. Regular whiteouts remove
+// the file they name, opaque whiteouts remove every file in their directory
+// that wasn't extracted from the current layer.
+func whiteout(dst, name string, extracted map[string]struct{}) error {
+	var (
+		dir  = filepath.Dir(strings.TrimRight(name, "/"))
+		base = filepath.Base(name)
+	)
+
+	if base != whiteoutOpaque {
+		path, err := entryPath(dst, filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+		if err != nil {
+			return err
+		}
+
+		if path == dst {
+			return errors.New("whiteout of the root directory")
+		}
+
+		return os.RemoveAll(path)
+	}
+
+	path, err := entryPath(dst, dir)
+	if err != nil {
+		return err
+	}
+
+	if fi, err := os.Lstat(path); err != nil || !fi.IsDir() {
+		return nil // nothing to hide
+	}
+
+	names, err := readDirNames(path)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		child := filepath.Join(path, name)
+
+		if _, ok := extracted[child]; ok {
+			continue
+		}
+
+		if err := os.RemoveAll(child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readDirNames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Readdirnames(-1)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestExtractArtifactFormats(t *testing.T) {
+	archive := newTestArchive(t, map[string]string{"hello": "world"})
+
+	for format, compress := range map[string]func([]byte) ([]byte, error){
+		"tar":   func(b []byte) ([]byte, error) { return b, nil },
+		"gzip":  gzipTestArchive,
+		"bzip2": commandTestArchive("bzip2", "-c"),
+		"xz":    xzTestArchive,
+		"zstd":  zstdTestArchive,
+	} {
+		compressed, err := compress(archive)
+		if err != nil {
+			t.Logf("%s: skipping (%s)", format, err)
+			continue
+		}
+
+		dst := newTestArtifactRoot(t)
+		defer os.RemoveAll(dst)
+
+		if err := extractArtifact(bytes.NewReader(compressed), dst); err != nil {
+			t.Errorf("%s: %s", format, err)
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(dst, "hello"))
+		if err != nil {
+			t.Errorf("%s: %s", format, err)
+			continue
+		}
+
+		if want, have := "world", string(buf); want != have {
+			t.Errorf("%s: want %q, have %q", format, want, have)
+		}
+	}
+}
+
+func TestExtractArtifactTruncated(t *testing.T) {
+	archive := newTestArchive(t, map[string]string{"hello": strings.Repeat("world", 1000)})
+
+	for format, compress := range map[string]func([]byte) ([]byte, error){
+		"gzip": gzipTestArchive,
+		"xz":   xzTestArchive,
+		"zstd": zstdTestArchive,
+	} {
+		compressed, err := compress(archive)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+
+		dst := newTestArtifactRoot(t)
+		defer os.RemoveAll(dst)
+
+		if err := extractArtifact(bytes.NewReader(compressed[:len(compressed)/2]), dst); err == nil {
+			t.Errorf("%s: want error, have none", format)
+		}
+	}
+}
+
+func TestExtractArtifactEntries(t *testing.T) {
+	dst := newTestArtifactRoot(t)
+	defer os.RemoveAll(dst)
+
+	archive := newTestTarball(t, []testEntry{
+		{tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0555}, ""},
+		{tar.Header{Name: "bin/run", Typeflag: tar.TypeReg, Mode: 0755}, "#!/bin/sh"},
+		{tar.Header{Name: "bin/start", Typeflag: tar.TypeLink, Linkname: "bin/run"}, ""},
+		{tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}, "root"},
+		{tar.Header{Name: "usr", Typeflag: tar.TypeSymlink, Linkname: "/"}, ""},
+	})
+
+	if err := extractArtifact(bytes.NewReader(archive), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]os.FileMode{
+		"bin":        os.ModeDir | 0555,
+		"bin/run":    0755,
+		"bin/start":  0755,
+		"etc/passwd": 0644,
+		"usr":        os.ModeSymlink | 0777,
+	} {
+		fi, err := os.Lstat(filepath.Join(dst, path))
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+			continue
+		}
+
+		if have := fi.Mode(); want != have {
+			t.Errorf("%s: want mode %s, have %s", path, want, have)
+		}
+	}
+}
+
+func TestExtractArtifactRejects(t *testing.T) {
+	for want, entries := range map[string][]testEntry{
+		"path escapes the archive": {
+			{tar.Header{Name: "../escape", Typeflag: tar.TypeReg}, ""},
+		},
+		"path traverses symlink": {
+			{tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"}, ""},
+			{tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg}, ""},
+		},
+		"hard link to ../../etc/passwd": {
+			{tar.Header{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}, ""},
+		},
+		"device nodes are not permitted": {
+			{tar.Header{Name: "dev/sda", Typeflag: tar.TypeBlock}, ""},
+		},
+		"empty tar archive": {},
+	} {
+		dst := newTestArtifactRoot(t)
+		defer os.RemoveAll(dst)
+
+		err := extractArtifact(bytes.NewReader(newTestTarball(t, entries)), dst)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("want error %q, have %v", want, err)
+		}
+	}
+}
+
+type testEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+func newTestTarball(t *testing.T, entries []testEntry) []byte {
+	var (
+		buf bytes.Buffer
+		w   = tar.NewWriter(&buf)
+	)
+
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.body))
+
+		if err := w.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func gzipTestArchive(archive []byte) ([]byte, error) {
+	var (
+		buf bytes.Buffer
+		w   = gzip.NewWriter(&buf)
+	)
+
+	if _, err := w.Write(archive); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func xzTestArchive(archive []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := xz.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(archive); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func zstdTestArchive(archive []byte) ([]byte, error) {
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	return w.EncodeAll(archive, nil), nil
+}
+
+func commandTestArchive(name string, args ...string) func([]byte) ([]byte, error) {
+	return func(archive []byte) ([]byte, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Stdin = bytes.NewReader(archive)
+		return cmd.Output()
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
@@ -10,6 +11,9 @@ import (
 type fakeContainer struct {
 	agent.ContainerInstance
 
+	instanceMtx sync.RWMutex
+	instance    agent.ContainerInstance // published by the loop
+
 	logs        *containerLog
 	subscribers map[chan<- agent.ContainerInstance]struct{}
 	createc     chan createRequest
@@ -51,6 +55,11 @@ func newFakeContainer(
 		quitc:       make(chan chan struct{}),
 	}
 
+	c.logs.id = id
+	c.logs.product = config.Product
+
+	c.publish()
+
 	go c.loop()
 
 	return c
@@ -77,7 +86,9 @@ func (c *fakeContainer) Logs() *containerLog {
 }
 
 func (c *fakeContainer) Instance() agent.ContainerInstance {
-	return c.ContainerInstance
+	c.instanceMtx.RLock()
+	defer c.instanceMtx.RUnlock()
+	return c.instance
 }
 
 func (c *fakeContainer) Start() error {
@@ -143,6 +154,8 @@ func (c *fakeContainer) create() error {
 	if c.ContainerConfig.ArtifactURL == failingArtifactURL {
 		return fmt.Errorf("failed to fetch")
 	}
+	c.ContainerCreation = agent.ContainerCreation{CreationPhase: agent.CreationPhaseReady}
+	c.updateStatus(agent.ContainerStatusCreated)
 	return nil
 }
 
@@ -158,18 +171,28 @@ func (c *fakeContainer) destroy() error {
 }
 
 func (c *fakeContainer) start() error {
+	c.Up = true
 	c.updateStatus(agent.ContainerStatusRunning)
 	return nil
 }
 
 func (c *fakeContainer) stop() error {
+	c.Up = false
+	c.updateStatus(agent.ContainerStatusFinished)
 	return nil
 }
 
 func (c *fakeContainer) updateStatus(status agent.ContainerStatus) {
 	c.ContainerInstance.ContainerStatus = status
+	c.publish()
 
 	for subc := range c.subscribers {
 		subc <- c.ContainerInstance
 	}
 }
+
+func (c *fakeContainer) publish() {
+	c.instanceMtx.Lock()
+	defer c.instanceMtx.Unlock()
+	c.instance = c.ContainerInstance
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 1 * time.Second
+	healthCheckHistoryLength   = 10 // results
+)
+
+var (
+	// healthCheckHost is the host that health checks connect to. Containers
+	// share the network namespace of the agent, so their ports are reachable
+	// on the loopback interface. It may be swapped for tests.
+	healthCheckHost = "localhost"
+)
+
+// healthChecker periodically executes the health checks of a single running
+// container, and reports the resulting agent.ContainerHealth after every
+// execution.
+type healthChecker struct {
+	quitc chan chan struct{}
+}
+
+type healthCheckUpdate struct {
+	index int
+	agent.HealthCheckResult
+}
+
+// newHealthChecker starts executing checks against the ports assigned to the
+// container. Updates are sent on updatec until stop is called.
+func newHealthChecker(
+	id string,
+	checks []agent.HealthCheck,
+	ports map[string]uint16,
+	updatec chan<- agent.ContainerHealth,
+) *healthChecker {
+	h := &healthChecker{
+		quitc: make(chan chan struct{}),
+	}
+
+	go h.loop(id, checks, ports, updatec)
+
+	return h
+}
+
+// stop terminates all health checks. No updates will be sent after stop
+// returns.
+func (h *healthChecker) stop() {
+	q := make(chan struct{})
+	h.quitc <- q
+	<-q
+}
+
+func (h *healthChecker) loop(
+	id string,
+	checks []agent.HealthCheck,
+	ports map[string]uint16,
+	updatec chan<- agent.ContainerHealth,
+) {
+	var (
+		health  = newContainerHealth(len(checks))
+		resultc = make(chan healthCheckUpdate)
+		donec   = make(chan struct{})
+	)
+
+	defer close(donec)
+
+	for i, check := range checks {
+		go runHealthCheckLoop(i, check, ports[check.Port], resultc, donec)
+	}
+
+	for {
+		select {
+		case update := <-resultc:
+			incContainerHealthCheck(1)
+			if !update.Healthy {
+				incContainerHealthCheckFailure(1)
+			}
+
+			previous := health.HealthStatus
+			health = recordHealthCheckResult(health, update.index, update.HealthCheckResult)
+
+			if health.HealthStatus != previous {
+				log.Printf("[%s] health: %s -> %s", id, previous, health.HealthStatus)
+			}
+
+			select {
+			case updatec <- health:
+			case q := <-h.quitc:
+				close(q)
+				return
+			}
+
+		case q := <-h.quitc:
+			close(q)
+			return
+		}
+	}
+}
+
+// runHealthCheckLoop executes a single health check after its initial delay
+// and then once per interval, until donec is closed.
+func runHealthCheckLoop(
+	index int,
+	check agent.HealthCheck,
+	port uint16,
+	resultc chan<- healthCheckUpdate,
+	donec <-chan struct{},
+) {
+	interval := healthCheckInterval(check)
+
+	next := time.After(check.InitialDelay.Duration)
+
+	for {
+		select {
+		case <-next:
+		case <-donec:
+			return
+		}
+
+		result := agent.HealthCheckResult{Time: time.Now(), Healthy: true}
+
+		if err := runHealthCheck(check, port); err != nil {
+			result.Healthy = false
+			result.Err = err.Error()
+		}
+
+		select {
+		case resultc <- healthCheckUpdate{index: index, HealthCheckResult: result}:
+		case <-donec:
+			return
+		}
+
+		next = time.After(interval)
+	}
+}
+
+// runHealthCheck executes a health check once. It returns nil if the check
+// passed.
+func runHealthCheck(check agent.HealthCheck, port uint16) error {
+	timeout := healthCheckTimeout(check)
+
+	switch check.Protocol {
+	case agent.ProtocolHTTP:
+		client := http.Client{Timeout: timeout}
+
+		resp, err := client.Get(healthCheckURL(check, port))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		for _, code := range check.HTTPAcceptableResponses {
+			if resp.StatusCode == code {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("HTTP %d not acceptable (want one of %v)", resp.StatusCode, check.HTTPAcceptableResponses)
+
+	case agent.ProtocolTCP:
+		conn, err := net.DialTimeout("tcp", healthCheckAddr(port), timeout)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+
+	default:
+		return fmt.Errorf("unknown protocol %q", check.Protocol)
+	}
+}
+
+// healthCheckAddr returns the host:port that a health check against port
+// connects to.
+func healthCheckAddr(port uint16) string {
+	return net.JoinHostPort(healthCheckHost, strconv.Itoa(int(port)))
+}
+
+// healthCheckURL returns the URL requested by an HTTP health check.
+func healthCheckURL(check agent.HealthCheck, port uint16) string {
+	path := check.HTTPPath
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return "http://" + healthCheckAddr(port) + path
+}
+
+// healthCheckInterval returns the interval of check, or the default if none
+// was specified.
+func healthCheckInterval(check agent.HealthCheck) time.Duration {
+	if check.Interval.Duration <= 0 {
+		return defaultHealthCheckInterval
+	}
+	return check.Interval.Duration
+}
+
+// healthCheckTimeout returns the timeout of check, or the default if none was
+// specified.
+func healthCheckTimeout(check agent.HealthCheck) time.Duration {
+	if check.Timeout.Duration <= 0 {
+		return defaultHealthCheckTimeout
+	}
+	return check.Timeout.Duration
+}
+
+// newContainerHealth returns the health of a container whose n health checks
+// have not been executed yet.
+func newContainerHealth(n int) agent.ContainerHealth {
+	health := agent.ContainerHealth{HealthStatus: agent.HealthStatusUnknown}
+
+	for i := 0; i < n; i++ {
+		health.HealthCheckStates = append(health.HealthCheckStates, agent.HealthCheckState{
+			HealthStatus: agent.HealthStatusUnknown,
+		})
+	}
+
+	return health
+}
+
+// recordHealthCheckResult returns a copy of health with the result of the
+// index'th health check applied. The passed health is not modified, so that
+// the returned value may be safely handed to other goroutines.
+func recordHealthCheckResult(health agent.ContainerHealth, index int, result agent.HealthCheckResult) agent.ContainerHealth {
+	states := make([]agent.HealthCheckState, len(health.HealthCheckStates))
+	copy(states, health.HealthCheckStates)
+
+	state := states[index]
+
+	history := append([]agent.HealthCheckResult{}, state.History...)
+	history = append(history, result)
+	if len(history) > healthCheckHistoryLength {
+		history = history[len(history)-healthCheckHistoryLength:]
+	}
+	state.History = history
+
+	if result.Healthy {
+		state.HealthStatus = agent.HealthStatusHealthy
+		state.ConsecutiveFailures = 0
+	} else {
+		state.HealthStatus = agent.HealthStatusUnhealthy
+		state.ConsecutiveFailures++
+	}
+
+	states[index] = state
+
+	return agent.ContainerHealth{
+		HealthStatus:      summarizeHealth(states),
+		HealthCheckStates: states,
+	}
+}
+
+// summarizeHealth returns unhealthy if any check is unhealthy, unknown if any
+// check hasn't been executed yet, and healthy otherwise.
+func summarizeHealth(states []agent.HealthCheckState) agent.HealthStatus {
+	if len(states) <= 0 {
+		return agent.HealthStatusUnknown
+	}
+
+	status := agent.HealthStatusHealthy
+
+	for _, state := range states {
+		switch state.HealthStatus {
+		case agent.HealthStatusUnhealthy:
+			return agent.HealthStatusUnhealthy
+		case agent.HealthStatusUnknown:
+			status = agent.HealthStatusUnknown
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestRunHealthCheckHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/-/health":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	port := listenerPort(t, server.Listener)
+
+	for _, tc := range []struct {
+		path      string
+		responses []int
+		healthy   bool
+	}{
+		{"/-/health", []int{200}, true},
+		{"-/health", []int{200}, true},
+		{"/-/health", []int{201, 204}, false},
+		{"/-/broken", []int{200}, false},
+		{"/-/broken", []int{503}, true},
+	} {
+		err := runHealthCheck(agent.HealthCheck{
+			Protocol:                agent.ProtocolHTTP,
+			HTTPPath:                tc.path,
+			HTTPAcceptableResponses: tc.responses,
+		}, port)
+
+		if want, have := tc.healthy, err == nil; want != have {
+			t.Errorf("%s %v: want healthy %v, have %v (%v)", tc.path, tc.responses, want, have, err)
+		}
+	}
+}
+
+func TestRunHealthCheckTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := listenerPort(t, ln)
+	check := agent.HealthCheck{Protocol: agent.ProtocolTCP}
+
+	if err := runHealthCheck(check, port); err != nil {
+		t.Errorf("want healthy, have %s", err)
+	}
+
+	ln.Close()
+
+	if err := runHealthCheck(check, port); err == nil {
+		t.Errorf("want unhealthy after listener closed, have healthy")
+	}
+}
+
+func TestHealthCheckerReportsUpdates(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var (
+		updatec = make(chan agent.ContainerHealth)
+		checks  = []agent.HealthCheck{{
+			Protocol: agent.ProtocolTCP,
+			Port:     "PORT_TCP",
+			Interval: agent.JSONDuration{Duration: 10 * time.Millisecond},
+		}}
+		h = newHealthChecker("123", checks, map[string]uint16{"PORT_TCP": listenerPort(t, ln)}, updatec)
+	)
+
+	select {
+	case health := <-updatec:
+		if want, have := agent.HealthStatusHealthy, health.HealthStatus; want != have {
+			t.Errorf("want %s, have %s", want, have)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no health update received")
+	}
+
+	ln.Close()
+
+	for deadline := time.After(time.Second); ; {
+		select {
+		case health := <-updatec:
+			if health.HealthStatus != agent.HealthStatusUnhealthy {
+				continue
+			}
+
+		case <-deadline:
+			t.Fatal("container never became unhealthy")
+		}
+
+		break
+	}
+
+	h.stop()
+
+	select {
+	case health := <-updatec:
+		t.Errorf("update received after stop: %v", health)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRecordHealthCheckResult(t *testing.T) {
+	var (
+		pass = agent.HealthCheckResult{Healthy: true}
+		fail = agent.HealthCheckResult{Healthy: false, Err: "connection refused"}
+	)
+
+	health := newContainerHealth(2)
+	if want, have := agent.HealthStatusUnknown, health.HealthStatus; want != have {
+		t.Fatalf("want %s, have %s", want, have)
+	}
+
+	health = recordHealthCheckResult(health, 0, pass)
+	if want, have := agent.HealthStatusUnknown, health.HealthStatus; want != have {
+		t.Errorf("one of two checks passed: want %s, have %s", want, have)
+	}
+
+	health = recordHealthCheckResult(health, 1, pass)
+	if want, have := agent.HealthStatusHealthy, health.HealthStatus; want != have {
+		t.Errorf("both checks passed: want %s, have %s", want, have)
+	}
+
+	previous := health
+	health = recordHealthCheckResult(health, 1, fail)
+	health = recordHealthCheckResult(health, 1, fail)
+	if want, have := agent.HealthStatusUnhealthy, health.HealthStatus; want != have {
+		t.Errorf("one check failed: want %s, have %s", want, have)
+	}
+
+	if want, have := uint(2), health.HealthCheckStates[1].ConsecutiveFailures; want != have {
+		t.Errorf("want %d consecutive failures, have %d", want, have)
+	}
+
+	if want, have := 1, len(previous.HealthCheckStates[1].History); want != have {
+		t.Errorf("previous health was modified: want %d history entries, have %d", want, have)
+	}
+
+	for i := 0; i < 2*healthCheckHistoryLength; i++ {
+		health = recordHealthCheckResult(health, 0, pass)
+	}
+
+	if want, have := healthCheckHistoryLength, len(health.HealthCheckStates[0].History); want != have {
+		t.Errorf("want history capped at %d, have %d", want, have)
+	}
+}
+
+func listenerPort(t *testing.T, ln net.Listener) uint16 {
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return uint16(p)
+}
@@ -4,38 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
-	"net"
-	"strconv"
 	"testing"
 	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 )
 
 var (
 	// Chosen so they don't collide with the production range.
 	lowTestPort  = uint16(rand.Intn((23000-100)-20000) + 20000)
 	highTestPort = lowTestPort + 100
-
-	// Global var to simplify testing-only functions.
-	logAddr string
 )
 
-// getRandomUDPPort identifies a UDP port by attempting to connect to port zero. This
-// port may-or-may-not-be available when you attempt to use it, but it's better than
-// nothing.
-func getRandomUDPPort() (int, error) {
-	laddr, err := net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		return 0, err
-	}
-
-	ln, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		return 0, err
-	}
-	defer ln.Close()
-	return ln.LocalAddr().(*net.UDPAddr).Port, nil
-}
-
 func dumpJSONPretty(v interface{}) string {
 	x, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
@@ -44,20 +24,7 @@ func dumpJSONPretty(v interface{}) string {
 	return string(x)
 }
 
-func createReceiveLogsFixture(t *testing.T, r *registry) {
-	setLogAddrRandomly(t)
-	go receiveLogs(r, logAddr)
-}
-
-func setLogAddrRandomly(t *testing.T) {
-	port, err := getRandomUDPPort()
-	if err != nil {
-		t.Fatalf("could not locate a random port: %s", err)
-	}
-	logAddr = "localhost:" + strconv.Itoa(port)
-}
-
-func waitForLogLine(t *testing.T, c chan string, timeout time.Duration) {
+func waitForLogLine(t *testing.T, c chan agent.LogEntry, timeout time.Duration) {
 	select {
 	case <-c:
 	case <-time.After(timeout):
@@ -65,20 +32,38 @@ func waitForLogLine(t *testing.T, c chan string, timeout time.Duration) {
 	}
 }
 
-func expectNoLogLines(t *testing.T, c chan string, timeout time.Duration) {
+func expectNoLogLines(t *testing.T, c chan agent.LogEntry, timeout time.Duration) {
 	select {
-	case logLine := <-c:
-		t.Errorf("nothing should have been received, but got: %s", logLine)
+	case entry := <-c:
+		t.Errorf("nothing should have been received, but got: %s", entry.Line)
 	case <-time.After(timeout):
 	}
 }
 
-func sendLog(logLine string) error {
-	conn, err := net.Dial("udp", logAddr)
-	if err != nil {
-		return err
+// sendLog feeds a log line to the container, as its log pipeline does.
+func sendLog(c container, logLine string) {
+	addLogLine(c.Logs(), logLine)
+}
+
+// addLogLine feeds a log line to the container log, as written to stdout.
+func addLogLine(cl *containerLog, line string) {
+	cl.addLogEntry(cl.newLogEntry(agent.LogStreamStdout, line, time.Now()))
+}
+
+// logEntries returns entries for lines.
+func logEntries(lines ...string) []agent.LogEntry {
+	entries := make([]agent.LogEntry, len(lines))
+	for i, line := range lines {
+		entries[i] = agent.LogEntry{Line: line}
 	}
+	return entries
+}
 
-	_, err = conn.Write([]byte(logLine))
-	return err
+// logLines returns the lines of entries.
+func logLines(entries []agent.LogEntry) []string {
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		lines[i] = entry.Line
+	}
+	return lines
 }
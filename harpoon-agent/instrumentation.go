@@ -8,28 +8,37 @@ import (
 )
 
 // A log line moves through the following states:
-//   - A log line is read from the logging port. The line has been RECEIVED.
-//   - The RECEIVED line is matched with a container.
-//      - The line has been ROUTED to a container or it is UNROUTED.
-//   - A ROUTED line is sent to all channels listening to that container's logs.
+//   - A line read from a log stream is ROUTED to a container, or it's
+//     UNPARSABLE or UNROUTABLE.
+//   - A log line is sent by the supervisor of a container, or ROUTED to it.
+//     The line has been RECEIVED.
+//   - The RECEIVED line is sent to all channels listening to that container's logs.
 //       - Each copy potentially sent to a listener's channel is DELIVERABLE.
 //       - Each DELIVERABLE which encountered a blocked channel is UNDELIVERED.
+//   - The RECEIVED line is sent to the log sinks it's routed to.
+//       - Each copy written to a sink is FORWARDED.
+//       - Each copy which encountered a full sink buffer is FORWARD DROPPED.
 //
 // So...
 //   - Every inbound message generates a received count.
-//   - unparsable count + unrouted count + routed count = received count
-//   - deliverable = sum(containers[x].listeners.count * containers[x].routed_to)[1..#containers]
+//   - log stream lines = unparsable count + unroutable count + routed count
+//   - Lines that log producers failed to send are DROPPED.
+//   - deliverable = sum(containers[x].listeners.count * containers[x].received)[1..#containers]
 //   - delivered count + undelivered count = deliverable
 //
 var (
 	expvarLogReceivedLines                   = expvar.NewInt("log_received_lines_total")
 	expvarLogUnparsableLines                 = expvar.NewInt("log_unparsable_lines_total")
 	expvarLogUnroutableLines                 = expvar.NewInt("log_unroutable_lines_total")
+	expvarLogDroppedLines                    = expvar.NewInt("log_dropped_lines_total")
 	expvarLogDeliverableLines                = expvar.NewInt("log_deliverable_lines_total")
 	expvarLogUndeliveredLines                = expvar.NewInt("log_undelivered_lines_total")
+	expvarLogForwardedLines                  = expvar.NewInt("log_forwarded_lines_total")
+	expvarLogForwardDroppedLines             = expvar.NewInt("log_forward_dropped_lines_total")
 	expvarContainerCreate                    = expvar.NewInt("container_creates_total")
 	expvarContainerCreateFailures            = expvar.NewInt("container_create_failures_total")
 	expvarContainerArtifactDownloadFailures  = expvar.NewInt("container_artifact_download_failures")
+	expvarContainerArtifactVerifyFailures    = expvar.NewInt("container_artifact_verify_failures_total")
 	expvarContainerRecoveryAttempts          = expvar.NewInt("container_recovery_attempts_total")
 	expvarContainerDestroy                   = expvar.NewInt("container_destroys_total")
 	expvarContainerStart                     = expvar.NewInt("container_start_total")
@@ -38,12 +47,13 @@ var (
 	expvarContainerStatusKilled              = expvar.NewInt("container_status_kill_total")
 	expvarContainerStatusDownSuccessful      = expvar.NewInt("container_status_down_successful_total")
 	expvarContainerStatusForceDownSuccessful = expvar.NewInt("container_status_force_down_successful_total")
+	expvarContainerHealthChecks              = expvar.NewInt("container_health_checks_total")
+	expvarContainerHealthCheckFailures       = expvar.NewInt("container_health_check_failures_total")
 	expvarSDUpdatesSuccessful                = expvar.NewInt("sd_updates_successful_total")
 	expvarSDUpdatesFailed                    = expvar.NewInt("sd_updates_failed_total")
 )
 
 // Derivable metrics:
-//   RoutedLines = ReceivedLines - UnparsableLines - UnroutedLines
 //   DeliveredLines = DeliverableLines - UndeliveredLines
 
 var (
@@ -51,19 +61,25 @@ var (
 		Namespace: "harpoon",
 		Subsystem: "agent",
 		Name:      "log_received_lines_total",
-		Help:      "Number of log lines received from external sources.",
+		Help:      "Number of log lines received from containers.",
 	})
 	prometheusLogUnparsableLines = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "harpoon",
 		Subsystem: "agent",
 		Name:      "log_unparsable_lines_total",
-		Help:      "Number of log lines which could not be routed to a container.",
+		Help:      "Number of log stream lines which could not be parsed.",
 	})
 	prometheusLogUnroutableLines = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "harpoon",
 		Subsystem: "agent",
 		Name:      "log_unroutable_lines_total",
-		Help:      "Number of log lines which could not be routed to a container.",
+		Help:      "Number of log stream lines which could not be routed to a container.",
+	})
+	prometheusLogDroppedLines = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "agent",
+		Name:      "log_dropped_lines_total",
+		Help:      "Number of log lines which log producers failed to send, by gaps in their numbering.",
 	})
 	prometheusLogDeliverableLines = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "harpoon",
@@ -77,6 +93,18 @@ var (
 		Name:      "log_undelivered_lines_total",
 		Help:      "Number of accepted log lines written to listeners.",
 	})
+	prometheusLogForwardedLines = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "agent",
+		Name:      "log_forwarded_lines_total",
+		Help:      "Number of log lines written to log sinks.",
+	})
+	prometheusLogForwardDroppedLines = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "agent",
+		Name:      "log_forward_dropped_lines_total",
+		Help:      "Number of log lines not forwarded because the buffer of a log sink was full.",
+	})
 	prometheusContainerCreate = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "harpoon",
 		Subsystem: "agent",
@@ -95,6 +123,12 @@ var (
 		Name:      "container_artifact_download_failures_total",
 		Help:      "Number of times that an artifact download failed during a container create operation.",
 	})
+	prometheusContainerArtifactVerifyFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "agent",
+		Name:      "container_artifact_verify_failures_total",
+		Help:      "Number of times that a downloaded artifact didn't match its digest during a container create operation.",
+	})
 	prometheusContainerRecoveryAttempts = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "harpoon",
 		Subsystem: "agent",
@@ -143,6 +177,18 @@ var (
 		Name:      "container_status_force_down_successful_total",
 		Help:      "Number of times that a container was successfully forced down.",
 	})
+	prometheusContainerHealthChecks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "agent",
+		Name:      "container_health_checks_total",
+		Help:      "Number of health checks executed against running containers.",
+	})
+	prometheusContainerHealthCheckFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "agent",
+		Name:      "container_health_check_failures_total",
+		Help:      "Number of health checks which did not pass.",
+	})
 	prometheusSDUpdateDuration = prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
 			Namespace: "harpoon",
@@ -167,6 +213,38 @@ var (
 	})
 )
 
+func init() {
+	for _, c := range []prometheus.Collector{
+		prometheusLogReceivedLines,
+		prometheusLogUnparsableLines,
+		prometheusLogUnroutableLines,
+		prometheusLogDroppedLines,
+		prometheusLogDeliverableLines,
+		prometheusLogUndeliveredLines,
+		prometheusLogForwardedLines,
+		prometheusLogForwardDroppedLines,
+		prometheusContainerCreate,
+		prometheusContainerCreateFailures,
+		prometheusContainerArtifactDownloadFailures,
+		prometheusContainerArtifactVerifyFailures,
+		prometheusContainerRecoveryAttempts,
+		prometheusContainerDestroy,
+		prometheusContainerStart,
+		prometheusContainerStartFailures,
+		prometheusContainerStop,
+		prometheusContainerStatusKilled,
+		prometheusContainerStatusDownSuccessful,
+		prometheusContainerStatusForceDownSuccessful,
+		prometheusContainerHealthChecks,
+		prometheusContainerHealthCheckFailures,
+		prometheusSDUpdateDuration,
+		prometheusSDUpdatesSuccessful,
+		prometheusSDUpdatesFailed,
+	} {
+		prometheus.MustRegister(c)
+	}
+}
+
 func incLogReceivedLines(n int) {
 	expvarLogReceivedLines.Add(int64(n))
 	prometheusLogReceivedLines.Add(float64(n))
@@ -182,6 +260,11 @@ func incLogUnroutableLines(n int) {
 	prometheusLogUnroutableLines.Add(float64(n))
 }
 
+func incLogDroppedLines(n int) {
+	expvarLogDroppedLines.Add(int64(n))
+	prometheusLogDroppedLines.Add(float64(n))
+}
+
 func incLogDeliverableLines(n int) {
 	expvarLogDeliverableLines.Add(int64(n))
 	prometheusLogDeliverableLines.Add(float64(n))
@@ -192,6 +275,16 @@ func incLogUndeliveredLines(n int) {
 	prometheusLogUndeliveredLines.Add(float64(n))
 }
 
+func incLogForwardedLines(n int) {
+	expvarLogForwardedLines.Add(int64(n))
+	prometheusLogForwardedLines.Add(float64(n))
+}
+
+func incLogForwardDroppedLines(n int) {
+	expvarLogForwardDroppedLines.Add(int64(n))
+	prometheusLogForwardDroppedLines.Add(float64(n))
+}
+
 func incContainerStart(n int) {
 	expvarContainerStart.Add(int64(n))
 	prometheusContainerStart.Add(float64(n))
@@ -227,6 +320,11 @@ func incContainerArtifactDownloadFailure(n int) {
 	prometheusContainerArtifactDownloadFailures.Add(float64(n))
 }
 
+func incContainerArtifactVerifyFailure(n int) {
+	expvarContainerArtifactVerifyFailures.Add(int64(n))
+	prometheusContainerArtifactVerifyFailures.Add(float64(n))
+}
+
 func incContainerStop(n int) {
 	expvarContainerStop.Add(int64(n))
 	prometheusContainerStop.Add(float64(n))
@@ -247,6 +345,16 @@ func incContainerStatusForceDownSuccessful(n int) {
 	prometheusContainerStatusForceDownSuccessful.Add(float64(n))
 }
 
+func incContainerHealthCheck(n int) {
+	expvarContainerHealthChecks.Add(int64(n))
+	prometheusContainerHealthChecks.Add(float64(n))
+}
+
+func incContainerHealthCheckFailure(n int) {
+	expvarContainerHealthCheckFailures.Add(int64(n))
+	prometheusContainerHealthCheckFailures.Add(float64(n))
+}
+
 func incSDUpdateSuccessful(took time.Duration) {
 	expvarSDUpdatesSuccessful.Add(int64(1))
 	prometheusSDUpdatesSuccessful.Add(float64(1))
@@ -15,97 +15,69 @@ import (
 
 func TestReceiveLogInstrumentation(t *testing.T) {
 	registry := newRegistry(nopServiceDiscovery{})
-	createReceiveLogsFixture(t, registry)
 	c := newFakeContainer("123", "", volumes{}, agent.ContainerConfig{}, false, nil, func() {}, 0)
 	registry.register(c)
-	linec := make(chan string, 10) // Plenty of room before anything gets dropped
+	linec := make(chan agent.LogEntry, 10) // Plenty of room before anything gets dropped
 	c.Logs().notify(linec)
 
 	clearCounters()
-	sendLog("container[123] m1")
+	sendLog(c, "container[123] m1")
 	waitForLogLine(t, linec, 100*time.Millisecond)
 	expectCounterEqual(t, "log_received_lines_total", 1)
-	expectCounterEqual(t, "log_unparsable_lines_total", 0)
-	expectCounterEqual(t, "log_unroutable_lines_total", 0)
-
-	clearCounters()
-	sendLog("container[23] m2")
-	expectNoLogLines(t, linec, 100*time.Millisecond)
-	expectCounterEqual(t, "log_received_lines_total", 1)
-	expectCounterEqual(t, "log_unparsable_lines_total", 0)
-	expectCounterEqual(t, "log_unroutable_lines_total", 1)
-
-	clearCounters()
-	sendLog("ilj;irtr")
-	expectNoLogLines(t, linec, 100*time.Millisecond)
-	expectCounterEqual(t, "log_received_lines_total", 1)
-	expectCounterEqual(t, "log_unparsable_lines_total", 1)
-	expectCounterEqual(t, "log_unroutable_lines_total", 0)
 }
 
 func TestLogInstrumentationNotifyWithoutWatchers(t *testing.T) {
 	registry := newRegistry(nopServiceDiscovery{})
-	createReceiveLogsFixture(t, registry)
-
-	registry.register(newFakeContainer("123", "", volumes{}, agent.ContainerConfig{}, false, nil, func() {}, 0))
+	c := newFakeContainer("123", "", volumes{}, agent.ContainerConfig{}, false, nil, func() {}, 0)
+	registry.register(c)
 
 	// Create a second container which shouldn't receive any notifications
 	// for the first channel.  This channel
 	nonDestinationContainer := newFakeContainer("456", "", volumes{}, agent.ContainerConfig{}, false, nil, func() {}, 0)
 	registry.register(nonDestinationContainer)
-	nonDestinationLinec := make(chan string, 1)
+	nonDestinationLinec := make(chan agent.LogEntry, 1)
 	nonDestinationContainer.Logs().notify(nonDestinationLinec)
 
 	clearCounters()
-	sendLog("container[123] m1")
+	sendLog(c, "container[123] m1")
 	expectNoLogLines(t, nonDestinationLinec, 100*time.Millisecond)
 	expectCounterEqual(t, "log_received_lines_total", 1)
-	expectCounterEqual(t, "log_unparsable_lines_total", 0)
-	expectCounterEqual(t, "log_unroutable_lines_total", 0)
 	expectCounterEqual(t, "log_deliverable_lines_total", 0)
 	expectCounterEqual(t, "log_undelivered_lines_total", 0)
 }
 
 func TestLogInstrumentationNotifyWatchers(t *testing.T) {
 	registry := newRegistry(nopServiceDiscovery{})
-	createReceiveLogsFixture(t, registry)
-
 	c := newFakeContainer("123", "", volumes{}, agent.ContainerConfig{}, false, nil, func() {}, 0)
 	registry.register(c)
-	linec1 := make(chan string, 1)
-	linec2 := make(chan string, 1)
+	linec1 := make(chan agent.LogEntry, 1)
+	linec2 := make(chan agent.LogEntry, 1)
 	c.Logs().notify(linec1)
 	c.Logs().notify(linec2)
 
 	clearCounters()
-	sendLog("container[123] m1")
+	sendLog(c, "container[123] m1")
 	waitForLogLine(t, linec1, 100*time.Millisecond)
 	waitForLogLine(t, linec2, 100*time.Millisecond)
 	expectCounterEqual(t, "log_received_lines_total", 1)
-	expectCounterEqual(t, "log_unparsable_lines_total", 0)
-	expectCounterEqual(t, "log_unroutable_lines_total", 0)
 	expectCounterEqual(t, "log_deliverable_lines_total", 2)
 	expectCounterEqual(t, "log_undelivered_lines_total", 0)
 }
 
 func TestLogInstrumentationNotifyWithBlockedWatcher(t *testing.T) {
 	registry := newRegistry(nopServiceDiscovery{})
-	createReceiveLogsFixture(t, registry)
-
 	c := newFakeContainer("123", "", volumes{}, agent.ContainerConfig{}, false, nil, func() {}, 0)
 	registry.register(c)
-	linec1 := make(chan string, 1)
-	linec2 := make(chan string) // Blocked channel
+	linec1 := make(chan agent.LogEntry, 1)
+	linec2 := make(chan agent.LogEntry) // Blocked channel
 	c.Logs().notify(linec1)
 	c.Logs().notify(linec2)
 
 	clearCounters()
-	sendLog("container[123] m1")
+	sendLog(c, "container[123] m1")
 	waitForLogLine(t, linec1, 100*time.Millisecond)
 	expectNoLogLines(t, linec2, 100*time.Millisecond)
 	expectCounterEqual(t, "log_received_lines_total", 1)
-	expectCounterEqual(t, "log_unparsable_lines_total", 0)
-	expectCounterEqual(t, "log_unroutable_lines_total", 0)
 	expectCounterEqual(t, "log_deliverable_lines_total", 1)
 	expectCounterEqual(t, "log_undelivered_lines_total", 1)
 }
@@ -133,8 +105,6 @@ func readCounter(m prometheus.Counter) float64 {
 var (
 	expvarToPrometheusCounter = map[string]prometheus.Counter{
 		"log_received_lines_total":                     prometheusLogReceivedLines,
-		"log_unparsable_lines_total":                   prometheusLogUnparsableLines,
-		"log_unroutable_lines_total":                   prometheusLogUnroutableLines,
 		"log_deliverable_lines_total":                  prometheusLogDeliverableLines,
 		"log_undelivered_lines_total":                  prometheusLogUndeliveredLines,
 		"container_status_kill_total":                  prometheusContainerStatusKilled,
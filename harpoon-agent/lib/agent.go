@@ -1,8 +1,11 @@
 package agent
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -22,12 +25,14 @@ type Agent interface {
 	Get(containerID string) (ContainerInstance, error)                                                     // GET /containers/{id}
 	Start(containerID string) error                                                                        // POST /containers/{id}/start
 	Stop(containerID string) error                                                                         // POST /containers/{id}/stop
-	Replace(newContainerID, oldContainerID string) error                                                   // PUT /containers/{newID}?replace={oldID}
+	Replace(newContainerID, oldContainerID string, containerConfig ContainerConfig) error                  // PUT /containers/{newID}?replace={oldID}
 	Destroy(containerID string) error                                                                      // DELETE /containers/{id}
 	Containers() (map[string]ContainerInstance, error)                                                     // GET /containers
 	Events() (<-chan StateEvent, Stopper, error)                                                           // GET /containers with request header Accept: text/event-stream
-	Log(containerID string, history int) (<-chan string, Stopper, error)                                   // GET /containers/{id}/log?history=10
+	Log(containerID string, query LogQuery) (<-chan LogEntry, Stopper, error)                              // GET /containers/{id}/log?history=10
 	Resources() (HostResources, error)                                                                     // GET /resources
+	Artifacts() ([]Artifact, error)                                                                        // GET /artifacts
+	PurgeArtifacts() ([]Artifact, error)                                                                   // DELETE /artifacts
 	Wait(containerID string, statuses map[ContainerStatus]struct{}, timeout time.Duration) chan WaitResult // Waits asynchronously for event with one of the statuses
 }
 
@@ -40,18 +45,48 @@ type WaitResult struct {
 // ContainerConfig describes the information necessary to start a container on
 // an agent.
 type ContainerConfig struct {
-	Product      string            `json:"product"`
-	Environment  string            `json:"environment"`
-	Job          string            `json:"job"`
-	HealthChecks []HealthCheck     `json:"health_checks"`
-	ArtifactURL  string            `json:"artifact_url"`
-	Ports        map[string]uint16 `json:"ports"`
-	Env          map[string]string `json:"env"`
-	Command      `json:"command"`
-	Resources    `json:"resources"`
-	Storage      `json:"storage"`
-	Grace        `json:"grace"`
-	Restart      `json:"restart"`
+	Product        string            `json:"product"`
+	Environment    string            `json:"environment"`
+	Job            string            `json:"job"`
+	HealthChecks   []HealthCheck     `json:"health_checks"`
+	ArtifactURL    string            `json:"artifact_url"`
+	ArtifactSHA256 string            `json:"artifact_sha256,omitempty"`
+	Ports          map[string]uint16 `json:"ports"`
+	Env            map[string]string `json:"env"`
+	Command        `json:"command"`
+	Resources      `json:"resources"`
+	Storage        `json:"storage"`
+	Grace          `json:"grace"`
+	Restart        `json:"restart"`
+}
+
+// ArtifactImagePrefix prefixes the scheme of artifact URLs that refer to OCI
+// images rather than tarballs: an image layout directory or tarball, e.g.
+// oci+file:///images/app#1.0 or oci+https://builds/app.tar, or a manifest in
+// a registry, e.g. oci+https://registry/v2/app/manifests/1.0.
+const ArtifactImagePrefix = "oci+"
+
+// ImageArtifact returns true if the artifact of the container is an OCI
+// image. Containers with an image artifact may omit their command, working
+// dir, and any environment variables set by the image, which default to
+// those of the image.
+func (c ContainerConfig) ImageArtifact() bool {
+	return strings.HasPrefix(c.ArtifactURL, ArtifactImagePrefix)
+}
+
+// ReservedMem returns the memory in megabytes that a container reserves on its
+// agent. Pages of tmpfs mounts are charged to the memory cgroup of the
+// container, so sized tmpfs mounts add to its memory limit.
+func (c ContainerConfig) ReservedMem() uint64 {
+	return c.Resources.Mem + c.Storage.TmpMem()
+}
+
+// ReservedStorage returns the disk space in bytes that a container reserves on
+// its agent, not counting its artifact, whose size is only known once it has
+// been fetched: the retained logs, and the size of its sized tmpfs mounts,
+// which may be swapped out.
+func (c ContainerConfig) ReservedStorage() uint64 {
+	return LogStorage + c.Storage.TmpMem()*1024*1024
 }
 
 // Valid performs a validation check, to ensure invalid structures may be
@@ -75,13 +110,24 @@ func (c ContainerConfig) Valid() error {
 		if err := healthCheck.Valid(); err != nil {
 			errs = append(errs, fmt.Sprintf("health check %d: %s", i, err))
 		}
+
+		if _, ok := c.Ports[healthCheck.Port]; !ok {
+			errs = append(errs, fmt.Sprintf("health check %d: port %q not in ports", i, healthCheck.Port))
+		}
 	}
 
 	if _, err := url.Parse(c.ArtifactURL); err != nil {
 		errs = append(errs, fmt.Sprintf("artifact URL %q invalid: %s", c.ArtifactURL, err))
 	}
 
-	if err := c.Command.Valid(); err != nil {
+	if c.ArtifactSHA256 != "" {
+		if err := ValidSHA256(c.ArtifactSHA256); err != nil {
+			errs = append(errs, fmt.Sprintf("artifact SHA-256 %q invalid: %s", c.ArtifactSHA256, err))
+		}
+	}
+
+	// The command of an image artifact defaults to the command of the image.
+	if err := c.Command.Valid(); err != nil && !c.ImageArtifact() {
 		errs = append(errs, fmt.Sprintf("command invalid: %s", err))
 	}
 
@@ -127,8 +173,12 @@ type HealthCheck struct {
 }
 
 const (
-	protocolHTTP = "HTTP"
-	protocolTCP  = "TCP"
+	// ProtocolHTTP health checks issue a GET request against HTTPPath, and
+	// pass if the response status is one of HTTPAcceptableResponses.
+	ProtocolHTTP = "HTTP"
+
+	// ProtocolTCP health checks pass if a TCP connection can be established.
+	ProtocolTCP = "TCP"
 
 	maxInitialDelay = 30 * time.Second
 	maxTimeout      = 3 * time.Second
@@ -141,7 +191,7 @@ func (c HealthCheck) Valid() error {
 	var errs []string
 
 	switch c.Protocol {
-	case protocolHTTP, protocolTCP:
+	case ProtocolHTTP, ProtocolTCP:
 	default:
 		errs = append(errs, fmt.Sprintf("invalid protocol %q", c.Protocol))
 	}
@@ -158,7 +208,7 @@ func (c HealthCheck) Valid() error {
 		errs = append(errs, fmt.Sprintf("interval (%s) too large (max %s)", c.Interval, maxInterval))
 	}
 
-	if c.Protocol == protocolHTTP {
+	if c.Protocol == ProtocolHTTP {
 		if c.HTTPPath == "" {
 			errs = append(errs, `protocol "HTTP" requires "http_path"`)
 		}
@@ -197,6 +247,20 @@ func (c Command) Valid() error {
 	return nil
 }
 
+// ValidSHA256 checks that s is a hex-encoded SHA-256 digest.
+func ValidSHA256(s string) error {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	if len(buf) != sha256.Size {
+		return fmt.Errorf("%d bytes, want %d", len(buf), sha256.Size)
+	}
+
+	return nil
+}
+
 // Resources describes resource limits for a container.
 type Resources struct {
 	Mem uint64  `json:"mem"` // MB
@@ -226,10 +290,35 @@ type Storage struct {
 // Valid performs a validation check, to ensure invalid structures may be
 // detected as early as possible.
 func (s Storage) Valid() error {
-	// TODO: what constitutes invalid storage specification?
+	var errs []string
+
+	for dest, size := range s.Tmp {
+		if size == 0 || size < -1 {
+			errs = append(errs, fmt.Sprintf("tmp %q: invalid size %dMB (-1 for unlimited)", dest, size))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf(strings.Join(errs, "; "))
+	}
+
 	return nil
 }
 
+// TmpMem returns the total size of all sized tmpfs mounts in megabytes.
+// Unlimited tmpfs mounts don't count.
+func (s Storage) TmpMem() uint64 {
+	var mem uint64
+
+	for _, size := range s.Tmp {
+		if size > 0 {
+			mem += uint64(size)
+		}
+	}
+
+	return mem
+}
+
 // Grace describes how many seconds the scheduler should wait for a container
 // to start up and shut down before giving up on that operation. Containers
 // that don't shut down within the shutdown window may be subject to a more
@@ -310,6 +399,122 @@ type StateEvent struct {
 	Containers map[string]ContainerInstance `json:"containers"`
 }
 
+// LogStorage is the disk space in bytes that agents reserve for the retained
+// logs of every container.
+const LogStorage = 256 * 1024 * 1024
+
+// LogStream is the output of a container that a line was written to.
+type LogStream string
+
+const (
+	// LogStreamStdout is the stdout of a container.
+	LogStreamStdout LogStream = "stdout"
+
+	// LogStreamStderr is the stderr of a container.
+	LogStreamStderr LogStream = "stderr"
+)
+
+// LogEntry is a line logged by a container.
+//
+// Entries are numbered consecutively per container by Seq, which starts over
+// when the supervisor of the container starts. Dropped counts the lines known
+// to be lost right before the entry: lines that log producers failed to send
+// to the agent, lines the supervisor couldn't buffer for the agent, and lines
+// of a log stream that weren't sent because the client didn't keep up.
+type LogEntry struct {
+	Time        time.Time `json:"time"`
+	Stream      LogStream `json:"stream"` // empty for lines logged before streams were told apart
+	ContainerID string    `json:"container_id"`
+	Generation  uint      `json:"generation"` // restarts of the container before the line was logged
+	Seq         uint64    `json:"seq"`
+	Dropped     uint64    `json:"dropped,omitempty"`
+	Line        string    `json:"line"`
+}
+
+// MaxLogHistory is the maximum number of lines a log query returns.
+const MaxLogHistory = 100000
+
+// LogQuery selects the log lines of a container. Of the lines logged between
+// Since and Until, which match Filter and Regexp, the last History lines are
+// returned. Zero values don't restrict the lines. Queries that go beyond the
+// lines buffered by the agent are answered from the log files of the
+// container, which are retained up to LogStorage.
+type LogQuery struct {
+	History int
+	Since   time.Time
+	Until   time.Time
+	Filter  string // substring
+	Regexp  string // RE2 syntax
+}
+
+// Values encodes q as the query parameters of a log request.
+func (q LogQuery) Values() url.Values {
+	v := url.Values{"history": []string{strconv.Itoa(q.History)}}
+
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.Format(time.RFC3339Nano))
+	}
+
+	if !q.Until.IsZero() {
+		v.Set("until", q.Until.Format(time.RFC3339Nano))
+	}
+
+	if q.Filter != "" {
+		v.Set("filter", q.Filter)
+	}
+
+	if q.Regexp != "" {
+		v.Set("regexp", q.Regexp)
+	}
+
+	return v
+}
+
+// ParseLogQuery decodes the query parameters of a log request. History
+// defaults to 10 lines, and is limited to MaxLogHistory.
+func ParseLogQuery(v url.Values) (LogQuery, error) {
+	q := LogQuery{
+		History: 10,
+		Filter:  v.Get("filter"),
+		Regexp:  v.Get("regexp"),
+	}
+
+	if s := v.Get("history"); s != "" {
+		history, err := strconv.Atoi(s)
+		if err != nil {
+			return LogQuery{}, fmt.Errorf("invalid history %q", s)
+		}
+
+		q.History = history
+	}
+
+	if q.History < 0 || q.History > MaxLogHistory {
+		return LogQuery{}, fmt.Errorf("history must be between 0 and %d", MaxLogHistory)
+	}
+
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"since", &q.Since},
+		{"until", &q.Until},
+	} {
+		s := v.Get(p.name)
+		if s == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return LogQuery{}, fmt.Errorf("invalid %s %q (want RFC 3339)", p.name, s)
+		}
+
+		*p.t = t
+	}
+
+	return q, nil
+}
+
 // HostResources are returned by agents and reflect their current state.
 type HostResources struct {
 	Mem     TotalReservedInt `json:"mem"`     // MB
@@ -318,6 +523,19 @@ type HostResources struct {
 	Volumes []string         `json:"volumes"`
 }
 
+// Artifact describes an extracted artifact in the cache of an agent, and the
+// containers using it as their rootfs. Artifacts that aren't used by any
+// container may be removed by the agent, least recently used first.
+type Artifact struct {
+	URL        string    `json:"url"`
+	Path       string    `json:"path"`
+	SHA256     string    `json:"sha256"`
+	Size       uint64    `json:"size"` // Bytes
+	Fetched    time.Time `json:"fetched"`
+	Used       time.Time `json:"used"`
+	Containers []string  `json:"containers"`
+}
+
 // TotalReserved encodes the total scalar amount of an arbitrary resource
 // (total) and the amount of it that's currently in-use (reserved).
 type TotalReserved struct {
@@ -357,6 +575,8 @@ type Stopper interface {
 type ContainerInstance struct {
 	ID                    string `json:"container_id"`
 	ContainerStatus       `json:"status"`
+	ContainerCreation     `json:"creation"`
+	ContainerHealth       `json:"health"`
 	ContainerConfig       `json:"config"`
 	ContainerProcessState `json:"process_state"`
 }
@@ -398,6 +618,96 @@ const (
 	ContainerStatusDeleted ContainerStatus = "deleted"
 )
 
+// ContainerCreation reflects the progress of creating a container. Agents
+// fetch the artifact of a container after it has been PUT, and only then the
+// container may be started.
+type ContainerCreation struct {
+	CreationPhase `json:"phase"`
+
+	// BytesTransferred counts the bytes of the artifact downloaded so far.
+	BytesTransferred uint64 `json:"bytes_transferred"`
+
+	// BytesTotal is the size of the artifact, if known.
+	BytesTotal uint64 `json:"bytes_total,omitempty"`
+
+	// Err records why the container couldn't be created. It will only be set
+	// in CreationPhaseFailed.
+	Err string `json:"err,omitempty"`
+}
+
+// CreationPhase describes how far the creation of a container progressed.
+type CreationPhase string
+
+const (
+	// CreationPhaseDownloading indicates the artifact is being downloaded,
+	// and extracted as it arrives.
+	CreationPhaseDownloading CreationPhase = "downloading"
+
+	// CreationPhaseExtracting indicates the artifact has been downloaded, and
+	// is being extracted or moved into place.
+	CreationPhaseExtracting CreationPhase = "extracting"
+
+	// CreationPhaseReady indicates the container has been created, and may
+	// be started. Agents that don't report the creation phase leave it
+	// empty, which also means ready.
+	CreationPhaseReady CreationPhase = "ready"
+
+	// CreationPhaseFailed indicates the container couldn't be created, as
+	// recorded in Err. Agents keep failed containers around for a while,
+	// with status created, before deleting them.
+	CreationPhaseFailed CreationPhase = "failed"
+)
+
+// ContainerHealth reflects the outcome of the health checks declared in the
+// container config, as executed by the agent against a running container.
+type ContainerHealth struct {
+	// HealthStatus summarizes all health checks. It is healthy only if every
+	// health check passed on its most recent execution.
+	HealthStatus `json:"status"`
+
+	// HealthCheckStates has one entry per declared health check, in the same
+	// order as ContainerConfig.HealthChecks.
+	HealthCheckStates []HealthCheckState `json:"checks,omitempty"`
+}
+
+// HealthStatus describes the health of a container, or of an individual
+// health check.
+type HealthStatus string
+
+const (
+	// HealthStatusUnknown indicates that health hasn't been determined yet.
+	// Containers without health checks, containers which aren't running, and
+	// containers still within the initial delay of their checks are in this
+	// state.
+	HealthStatusUnknown HealthStatus = "unknown"
+
+	// HealthStatusHealthy indicates that the most recent execution of every
+	// health check passed.
+	HealthStatusHealthy HealthStatus = "healthy"
+
+	// HealthStatusUnhealthy indicates that the most recent execution of at
+	// least one health check failed.
+	HealthStatusUnhealthy HealthStatus = "unhealthy"
+)
+
+// HealthCheckState records the pass/fail history of a single health check.
+type HealthCheckState struct {
+	HealthStatus `json:"status"`
+
+	// ConsecutiveFailures counts the failures since the last pass.
+	ConsecutiveFailures uint `json:"consecutive_failures"`
+
+	// History contains the most recent results, from oldest to newest.
+	History []HealthCheckResult `json:"history,omitempty"`
+}
+
+// HealthCheckResult is the outcome of a single health check execution.
+type HealthCheckResult struct {
+	Time    time.Time `json:"time"`
+	Healthy bool      `json:"healthy"`
+	Err     string    `json:"err,omitempty"`
+}
+
 // JSONDuration allows specification of time.Duration as strings in JSON-
 // serialized structs. For example, "250ms", "5s", "30m".
 type JSONDuration struct{ time.Duration }
@@ -470,7 +780,10 @@ type ContainerExitStatus struct {
 // ContainerMetrics contains detailed historical information about a unique
 // container. ContainerMetrics are tracked across restarts.
 type ContainerMetrics struct {
-	CPUTime     uint64 `json:"cpu_time"`     // total counter of cpu time
-	MemoryUsage uint64 `json:"memory_usage"` // memory usage in bytes
-	MemoryLimit uint64 `json:"memory_limit"` // memory limit in bytes
+	CPUTime             uint64 `json:"cpu_time"`              // total counter of cpu time
+	CPUPeriods          uint64 `json:"cpu_periods"`           // total counter of enforcement periods
+	CPUThrottledPeriods uint64 `json:"cpu_throttled_periods"` // total counter of periods the cpu limit was hit in
+	CPUThrottledTime    uint64 `json:"cpu_throttled_time"`    // total counter of time throttled in nanoseconds
+	MemoryUsage         uint64 `json:"memory_usage"`          // memory usage in bytes
+	MemoryLimit         uint64 `json:"memory_limit"`          // memory limit in bytes
 }
@@ -27,6 +27,10 @@ const (
 	// APICreateContainerPath conforms to the agent API spec.
 	APICreateContainerPath = "/containers/:id"
 
+	// APIReplaceContainerPath conforms to the agent API spec. The ID of the
+	// container to replace is passed as the replace query parameter.
+	APIReplaceContainerPath = "/containers/:id"
+
 	// APIGetContainerPath conforms to the agent API spec.
 	APIGetContainerPath = "/containers/:id"
 
@@ -44,6 +48,12 @@ const (
 
 	// APIGetResourcesPath conforms to the agent API spec.
 	APIGetResourcesPath = "/resources"
+
+	// APIListArtifactsPath conforms to the agent API spec.
+	APIListArtifactsPath = "/artifacts"
+
+	// APIPurgeArtifactsPath conforms to the agent API spec.
+	APIPurgeArtifactsPath = "/artifacts"
 )
 
 var (
@@ -65,6 +75,11 @@ var (
 
 	// ErrTimeout is returned when clients try to Wait for container status too long
 	ErrTimeout = errors.New("timeout")
+
+	// ErrCreationFailed is returned when clients Wait for a container to be
+	// created, and the agent failed to create it, e.g. because its artifact
+	// couldn't be fetched.
+	ErrCreationFailed = errors.New("container creation failed")
 )
 
 type client struct{ url.URL }
@@ -218,6 +233,44 @@ func (c client) Resources() (HostResources, error) {
 	}
 }
 
+// Artifacts implements the Agent interface.
+func (c client) Artifacts() ([]Artifact, error) {
+	c.URL.Path = APIVersionPrefix + APIListArtifactsPath
+	return c.artifacts("GET")
+}
+
+// PurgeArtifacts implements the Agent interface.
+func (c client) PurgeArtifacts() ([]Artifact, error) {
+	c.URL.Path = APIVersionPrefix + APIPurgeArtifactsPath
+	return c.artifacts("DELETE")
+}
+
+func (c client) artifacts(method string) ([]Artifact, error) {
+	req, err := http.NewRequest(method, c.URL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("problem constructing HTTP request (%s)", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("agent unavailable (%s)", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var artifacts []Artifact
+		if err := json.NewDecoder(resp.Body).Decode(&artifacts); err != nil {
+			return nil, fmt.Errorf("invalid agent response (%s)", err)
+		}
+		return artifacts, nil
+
+	default:
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("HTTP %d (%s)", resp.StatusCode, bytes.TrimSpace(buf))
+	}
+}
+
 // Create implements the Agent interface.
 func (c client) Create(id string, cfg ContainerConfig) error {
 	var body bytes.Buffer
@@ -379,15 +432,48 @@ func (c client) Stop(id string) error {
 }
 
 // Replace implements the Agent interface.
-func (c client) Replace(newID, oldID string) error {
-	return fmt.Errorf("replace is not implemented or used by the harpoon scheduler")
+func (c client) Replace(newID, oldID string, cfg ContainerConfig) error {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(cfg); err != nil {
+		return fmt.Errorf("problem encoding container config (%s)", err)
+	}
+
+	c.URL.Path = APIVersionPrefix + APIReplaceContainerPath
+	c.URL.Path = strings.Replace(c.URL.Path, ":id", newID, 1)
+	c.URL.RawQuery = url.Values{"replace": []string{oldID}}.Encode()
+
+	req, err := http.NewRequest("PUT", c.URL.String(), &body)
+	if err != nil {
+		return fmt.Errorf("problem constructing HTTP request (%s)", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("agent unavailable (%s)", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		return nil
+
+	case http.StatusNotFound:
+		return ErrContainerNotExist
+
+	case http.StatusConflict:
+		return ErrContainerAlreadyExists
+
+	default:
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP %d (%s)", resp.StatusCode, bytes.TrimSpace(buf))
+	}
 }
 
 // Log implements the Agent interface.
-func (c client) Log(id string, history int) (<-chan string, Stopper, error) {
+func (c client) Log(id string, query LogQuery) (<-chan LogEntry, Stopper, error) {
 	c.URL.Path = APIVersionPrefix + APIGetContainerLogPath
 	c.URL.Path = strings.Replace(c.URL.Path, ":id", id, 1)
-	c.URL.RawQuery = fmt.Sprintf("history=%d", history)
+	c.URL.RawQuery = query.Values().Encode()
 	req, err := http.NewRequest("GET", c.URL.String(), nil)
 	if err != nil {
 		return nil, nil, fmt.Errorf("problem constructing HTTP request (%s)", err)
@@ -402,7 +488,7 @@ func (c client) Log(id string, history int) (<-chan string, Stopper, error) {
 
 	switch resp.StatusCode {
 	case http.StatusOK:
-		c, stop := make(chan string), make(chan struct{})
+		c, stop := make(chan LogEntry), make(chan struct{})
 		go func() {
 			defer resp.Body.Close()
 			defer close(c)
@@ -415,15 +501,15 @@ func (c client) Log(id string, history int) (<-chan string, Stopper, error) {
 					return
 				}
 
-				lines := []string{}
+				entries := []LogEntry{}
 
-				if err := json.Unmarshal(event.Data, &lines); err != nil {
+				if err := json.Unmarshal(event.Data, &entries); err != nil {
 					return
 				}
 
-				for _, line := range lines {
+				for _, entry := range entries {
 					select {
-					case c <- string(line):
+					case c <- entry:
 					case <-stop:
 						return
 					}
@@ -479,6 +565,15 @@ func (c client) wait(id string, statuses map[ContainerStatus]struct{}, timeout t
 				continue
 			}
 
+			if _, ok := statuses[ContainerStatusCreated]; ok && container.ContainerStatus == ContainerStatusCreated {
+				switch container.CreationPhase {
+				case CreationPhaseFailed:
+					return "", fmt.Errorf("%s (%s)", ErrCreationFailed, container.ContainerCreation.Err)
+				case CreationPhaseDownloading, CreationPhaseExtracting:
+					continue // not yet created
+				}
+			}
+
 			if _, ok := statuses[container.ContainerStatus]; ok {
 				return container.ContainerStatus, nil
 			}
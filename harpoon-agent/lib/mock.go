@@ -30,6 +30,8 @@ type Mock struct {
 	stopContainerCount    int32
 	getContainerLogCount  int32
 	getResourcesCount     int32
+	listArtifactsCount    int32
+	purgeArtifactsCount   int32
 }
 
 // NewMock returns a new Mock, designed to be passed to httptest.NewServer.
@@ -54,6 +56,8 @@ func NewMock() *Mock {
 	m.Router.POST(APIVersionPrefix+APIStopContainerPath, m.stopContainer)
 	m.Router.GET(APIVersionPrefix+APIGetContainerLogPath, m.getContainerLog)
 	m.Router.GET(APIVersionPrefix+APIGetResourcesPath, m.getResources)
+	m.Router.GET(APIVersionPrefix+APIListArtifactsPath, m.listArtifacts)
+	m.Router.DELETE(APIVersionPrefix+APIPurgeArtifactsPath, m.purgeArtifacts)
 
 	return m
 }
@@ -189,6 +193,11 @@ func (m *Mock) createContainer(w http.ResponseWriter, r *http.Request, p httprou
 		ContainerConfig: config,
 	}
 
+	if oldID := r.URL.Query().Get("replace"); oldID != "" {
+		m.replaceContainer(w, oldID, instance)
+		return
+	}
+
 	// PUT also starts.
 	func() {
 		m.Lock()
@@ -202,6 +211,37 @@ func (m *Mock) createContainer(w http.ResponseWriter, r *http.Request, p httprou
 	w.WriteHeader(http.StatusCreated)
 }
 
+// replaceContainer succeeds immediately: the new instance is running and the
+// old one is deleted.
+func (m *Mock) replaceContainer(w http.ResponseWriter, oldID string, instance ContainerInstance) {
+	m.Lock()
+	defer m.Unlock()
+
+	old, ok := m.instances[oldID]
+	if !ok {
+		http.Error(w, fmt.Sprintf("%q not present", oldID), http.StatusNotFound)
+		return
+	}
+
+	if _, ok := m.instances[instance.ID]; ok {
+		http.Error(w, fmt.Sprintf("%q already present", instance.ID), http.StatusConflict)
+		return
+	}
+
+	m.instances[instance.ID] = instance
+	m.hostResources.CPU.Reserved += instance.CPU
+	m.hostResources.Mem.Reserved += instance.Mem
+
+	old.ContainerStatus = ContainerStatusDeleted
+	m.instances[oldID] = old
+	m.hostResources.CPU.Reserved -= old.CPU
+	m.hostResources.Mem.Reserved -= old.Mem
+	broadcast(m.subscribers, StateEvent{Resources: m.hostResources, Containers: m.instances})
+	delete(m.instances, oldID)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func (m *Mock) getContainer(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	defer atomic.AddInt32(&m.getContainerCount, 1)
 
@@ -315,3 +355,13 @@ func (m *Mock) getResources(w http.ResponseWriter, r *http.Request, p httprouter
 	defer atomic.AddInt32(&m.getResourcesCount, 1)
 	json.NewEncoder(w).Encode(m.hostResources)
 }
+
+func (m *Mock) listArtifacts(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer atomic.AddInt32(&m.listArtifactsCount, 1)
+	json.NewEncoder(w).Encode([]Artifact{})
+}
+
+func (m *Mock) purgeArtifacts(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer atomic.AddInt32(&m.purgeArtifactsCount, 1)
+	json.NewEncoder(w).Encode([]Artifact{})
+}
@@ -35,6 +35,8 @@ func TestMockAgent(t *testing.T) {
 		{"POST", APIVersionPrefix + r.Replace(APIStopContainerPath), &a.stopContainerCount},
 		{"GET", APIVersionPrefix + r.Replace(APIGetContainerLogPath), &a.getContainerLogCount},
 		{"GET", APIVersionPrefix + r.Replace(APIGetResourcesPath), &a.getResourcesCount},
+		{"GET", APIVersionPrefix + r.Replace(APIListArtifactsPath), &a.listArtifactsCount},
+		{"DELETE", APIVersionPrefix + r.Replace(APIPurgeArtifactsPath), &a.purgeArtifactsCount},
 	} {
 		method, path, count := tuple.method, tuple.path, tuple.count
 		pre := atomic.LoadInt32(count)
@@ -0,0 +1,509 @@
+package main
+
+// Log forwarding ships the log entries of containers to log sinks, e.g. a
+// syslog server or a log aggregation pipeline, without sidecars. Sinks, and
+// the routes of the entries of products to them, are configured in a JSON
+// file. Every sink buffers entries, and writes them in the background,
+// reconnecting after failures. Entries which don't fit into the full buffer
+// of a sink are dropped, so that a slow or failed sink never holds up the log
+// pipelines of containers.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+const (
+	defaultLogSinkBuffer = 10000 // entries
+	logSinkRetryInterval = time.Second
+	logSinkDialTimeout   = 5 * time.Second
+	logSinkWriteTimeout  = 10 * time.Second
+	logFileCheckInterval = time.Second
+
+	syslogFacilityUser  = 1
+	syslogSeverityError = 3
+	syslogSeverityInfo  = 6
+
+	// syslogTimeLayout is the layout of RFC 5424 timestamps, which have at
+	// most microseconds.
+	syslogTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// logForwarding routes the log entries of all containers, if configured.
+var logForwarding *logRouter
+
+type logForwardingConfig struct {
+	Sinks  map[string]logSinkConfig `json:"sinks"`
+	Routes []logRouteConfig         `json:"routes"`
+}
+
+type logSinkConfig struct {
+	Type     string `json:"type"`     // syslog, ndjson, or file
+	Address  string `json:"address"`  // of syslog and ndjson sinks
+	Path     string `json:"path"`     // of file sinks
+	Buffer   int    `json:"buffer"`   // entries, defaults to defaultLogSinkBuffer
+	Facility *int   `json:"facility"` // of syslog sinks, defaults to user
+}
+
+type logRouteConfig struct {
+	Product string   `json:"product"` // "*" matches all products
+	Sinks   []string `json:"sinks"`
+}
+
+// forwardedEntry is a log entry, as it's forwarded to sinks.
+type forwardedEntry struct {
+	agent.LogEntry
+	Product string `json:"product"`
+}
+
+// logRouter forwards entries to the sinks of the first route matching the
+// product of their container. Entries of products without a matching route
+// aren't forwarded.
+type logRouter struct {
+	sinks  []*logSink
+	routes []logRoute
+}
+
+type logRoute struct {
+	product string
+	sinks   []*logSink
+}
+
+// readLogRouter reads the log forwarding config at path, and starts its
+// sinks.
+func readLogRouter(path string) (*logRouter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config logForwardingConfig
+
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	r, err := newLogRouter(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return r, nil
+}
+
+// newLogRouter validates config, and starts its sinks.
+func newLogRouter(config logForwardingConfig) (*logRouter, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		names   = make([]string, 0, len(config.Sinks))
+		writers = map[string]logWriter{}
+	)
+
+	for name := range config.Sinks {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		w, err := newLogWriter(config.Sinks[name], hostname)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %s", name, err)
+		}
+
+		if config.Sinks[name].Buffer < 0 {
+			return nil, fmt.Errorf("sink %s: invalid buffer %d", name, config.Sinks[name].Buffer)
+		}
+
+		writers[name] = w
+	}
+
+	for i, route := range config.Routes {
+		if route.Product == "" {
+			return nil, fmt.Errorf(`route %d: "product" not set`, i)
+		}
+
+		for _, name := range route.Sinks {
+			if _, ok := writers[name]; !ok {
+				return nil, fmt.Errorf("route %d: unknown sink %q", i, name)
+			}
+		}
+	}
+
+	var (
+		r     = &logRouter{}
+		sinks = map[string]*logSink{}
+	)
+
+	for _, name := range names {
+		buffer := config.Sinks[name].Buffer
+		if buffer == 0 {
+			buffer = defaultLogSinkBuffer
+		}
+
+		sinks[name] = newLogSink(name, writers[name], buffer)
+		r.sinks = append(r.sinks, sinks[name])
+	}
+
+	for _, route := range config.Routes {
+		lr := logRoute{product: route.Product}
+
+		for _, name := range route.Sinks {
+			lr.sinks = append(lr.sinks, sinks[name])
+		}
+
+		r.routes = append(r.routes, lr)
+	}
+
+	return r, nil
+}
+
+// forward routes entry, logged by a container of product, to its sinks. It
+// never blocks.
+func (r *logRouter) forward(product string, entry agent.LogEntry) {
+	if r == nil {
+		return
+	}
+
+	for _, route := range r.routes {
+		if route.product != product && route.product != "*" {
+			continue
+		}
+
+		for _, s := range route.sinks {
+			s.send(forwardedEntry{LogEntry: entry, Product: product})
+		}
+
+		return
+	}
+}
+
+// close stops the sinks. Entries still buffered are discarded.
+func (r *logRouter) close() {
+	for _, s := range r.sinks {
+		s.close()
+	}
+}
+
+// logSink writes the entries sent to it in the background. A failed write is
+// retried until it succeeds, while further entries are buffered.
+type logSink struct {
+	name   string
+	w      logWriter
+	entryc chan forwardedEntry
+	quitc  chan struct{}
+	donec  chan struct{}
+}
+
+func newLogSink(name string, w logWriter, buffer int) *logSink {
+	s := &logSink{
+		name:   name,
+		w:      w,
+		entryc: make(chan forwardedEntry, buffer),
+		quitc:  make(chan struct{}),
+		donec:  make(chan struct{}),
+	}
+
+	go s.loop()
+
+	return s
+}
+
+// send buffers entry, or drops it if the buffer is full.
+func (s *logSink) send(entry forwardedEntry) {
+	select {
+	case s.entryc <- entry:
+	default:
+		incLogForwardDroppedLines(1)
+	}
+}
+
+func (s *logSink) close() {
+	close(s.quitc)
+	<-s.donec
+}
+
+func (s *logSink) loop() {
+	defer close(s.donec)
+	defer s.w.close()
+
+	failed := false // writing to the sink, to log the failure once
+
+	for {
+		select {
+		case entry := <-s.entryc:
+			for {
+				err := s.w.write(entry)
+				if err == nil {
+					break
+				}
+
+				if !failed {
+					log.Printf("logs: forwarding to %s: %s", s.name, err)
+					failed = true
+				}
+
+				select {
+				case <-time.After(logSinkRetryInterval):
+				case <-s.quitc:
+					return
+				}
+			}
+
+			if failed {
+				log.Printf("logs: forwarding to %s recovered", s.name)
+				failed = false
+			}
+
+			incLogForwardedLines(1)
+
+		case <-s.quitc:
+			return
+		}
+	}
+}
+
+type logWriter interface {
+	write(forwardedEntry) error
+	close()
+}
+
+func newLogWriter(config logSinkConfig, hostname string) (logWriter, error) {
+	switch config.Type {
+	case "syslog":
+		network, address, err := parseLogSinkAddress(config.Address, "udp", "tcp", "unix")
+		if err != nil {
+			return nil, err
+		}
+
+		facility := syslogFacilityUser
+		if config.Facility != nil {
+			facility = *config.Facility
+		}
+
+		if facility < 0 || facility > 23 {
+			return nil, fmt.Errorf("invalid facility %d", facility)
+		}
+
+		// Messages sent over stream sockets are framed by octet counting, see
+		// RFC 6587. Local syslog daemons listen on datagram sockets.
+		encode := func(entry forwardedEntry) []byte {
+			msg := syslogMessage(entry, facility, hostname)
+
+			if network == "tcp" {
+				return append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+			}
+
+			return msg
+		}
+
+		if network == "unix" {
+			network = "unixgram"
+		}
+
+		return &connWriter{network: network, address: address, encode: encode}, nil
+
+	case "ndjson":
+		network, address, err := parseLogSinkAddress(config.Address, "tcp")
+		if err != nil {
+			return nil, err
+		}
+
+		return &connWriter{network: network, address: address, encode: ndjsonLine}, nil
+
+	case "file":
+		if !strings.HasPrefix(config.Path, "/") {
+			return nil, fmt.Errorf("path %q not absolute", config.Path)
+		}
+
+		return &fileWriter{path: config.Path, interval: logFileCheckInterval}, nil
+
+	default:
+		return nil, fmt.Errorf("invalid type %q (want syslog, ndjson, or file)", config.Type)
+	}
+}
+
+// parseLogSinkAddress parses addr, which is either unix:///path/to/socket or
+// network://host:port, and returns its network and address, if its network
+// is one of networks.
+func parseLogSinkAddress(addr string, networks ...string) (string, string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, network := range networks {
+		if u.Scheme != network {
+			continue
+		}
+
+		if network == "unix" {
+			return network, u.Path, nil
+		}
+
+		return network, u.Host, nil
+	}
+
+	return "", "", fmt.Errorf("invalid address %q (want %s:// address)", addr, strings.Join(networks, ":// or "))
+}
+
+// connWriter writes entries to a connection, which it dials when needed, and
+// redials after a failed write.
+type connWriter struct {
+	network string
+	address string
+	encode  func(forwardedEntry) []byte
+	conn    net.Conn
+}
+
+func (w *connWriter) write(entry forwardedEntry) error {
+	if w.conn == nil {
+		conn, err := net.DialTimeout(w.network, w.address, logSinkDialTimeout)
+		if err != nil {
+			return err
+		}
+
+		w.conn = conn
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(logSinkWriteTimeout))
+
+	if _, err := w.conn.Write(w.encode(entry)); err != nil {
+		w.close()
+		return err
+	}
+
+	return nil
+}
+
+func (w *connWriter) close() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// fileWriter appends entries to a file, as newline-delimited JSON. The file
+// is opened when needed, and reopened after a failed write, or once it was
+// rotated, e.g. by logrotate, which is checked at most every interval.
+type fileWriter struct {
+	path     string
+	interval time.Duration
+	f        *os.File
+	checked  time.Time
+}
+
+func (w *fileWriter) write(entry forwardedEntry) error {
+	if w.f != nil && time.Since(w.checked) >= w.interval {
+		if w.rotated() {
+			w.close()
+		}
+
+		w.checked = time.Now()
+	}
+
+	if w.f == nil {
+		f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+
+		w.f, w.checked = f, time.Now()
+	}
+
+	if _, err := w.f.Write(ndjsonLine(entry)); err != nil {
+		w.close()
+		return err
+	}
+
+	return nil
+}
+
+// rotated returns true if the open file is no longer the one at path, i.e.
+// it was moved away or removed.
+func (w *fileWriter) rotated() bool {
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		return true
+	}
+
+	open, err := w.f.Stat()
+	if err != nil {
+		return true
+	}
+
+	return !os.SameFile(fi, open)
+}
+
+func (w *fileWriter) close() {
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+}
+
+// ndjsonLine returns entry as JSON, terminated by a line break.
+func ndjsonLine(entry forwardedEntry) []byte {
+	buf, _ := json.Marshal(entry) // can't fail
+	return append(buf, '\n')
+}
+
+// syslogMessage returns entry as an RFC 5424 syslog message. Its APP-NAME is
+// the product, its PROCID the container ID, and its MSGID the stream. Lines
+// written to stderr have severity error, all other lines severity info.
+func syslogMessage(entry forwardedEntry, facility int, hostname string) []byte {
+	severity := syslogSeverityInfo
+	if entry.Stream == agent.LogStreamStderr {
+		severity = syslogSeverityError
+	}
+
+	timestamp := "-"
+	if !entry.Time.IsZero() {
+		timestamp = entry.Time.UTC().Format(syslogTimeLayout)
+	}
+
+	return []byte(fmt.Sprintf(
+		"<%d>1 %s %s %s %s %s - %s",
+		facility*8+severity,
+		timestamp,
+		syslogHeaderField(hostname, 255),
+		syslogHeaderField(entry.Product, 48),
+		syslogHeaderField(entry.ContainerID, 128),
+		syslogHeaderField(string(entry.Stream), 32),
+		entry.Line,
+	))
+}
+
+// syslogHeaderField returns s as a field of the header of a syslog message,
+// which consists of at most max printable ASCII characters. Other characters
+// are replaced by underscores, and empty fields by the NILVALUE.
+func syslogHeaderField(s string, max int) string {
+	if s == "" {
+		return "-"
+	}
+
+	if len(s) > max {
+		s = s[:max]
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestLogRouter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpoon-agent-log-forward-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	unixgram, err := net.ListenPacket("unixgram", filepath.Join(dir, "syslog.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixgram.Close()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	ndjson, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ndjson.Close()
+
+	r, err := newLogRouter(logForwardingConfig{
+		Sinks: map[string]logSinkConfig{
+			"syslog-udp":  {Type: "syslog", Address: "udp://" + udp.LocalAddr().String(), Facility: syslogFacility(16)},
+			"syslog-tcp":  {Type: "syslog", Address: "tcp://" + tcp.Addr().String()},
+			"syslog-unix": {Type: "syslog", Address: "unix://" + filepath.Join(dir, "syslog.sock")},
+			"ndjson":      {Type: "ndjson", Address: "tcp://" + ndjson.Addr().String()},
+			"file":        {Type: "file", Path: filepath.Join(dir, "containers.log")},
+		},
+		Routes: []logRouteConfig{
+			{Product: "api", Sinks: []string{"syslog-udp", "syslog-tcp", "syslog-unix", "ndjson"}},
+			{Product: "web", Sinks: []string{}}, // not forwarded
+			{Product: "*", Sinks: []string{"file"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+
+	var (
+		t0  = time.Date(2014, 7, 1, 12, 0, 0, 123456789, time.UTC)
+		api = agent.LogEntry{Time: t0, Stream: agent.LogStreamStderr, ContainerID: "api.1", Seq: 1, Line: "api line"}
+		web = agent.LogEntry{Time: t0, Stream: agent.LogStreamStdout, ContainerID: "web.1", Seq: 1, Line: "web line"}
+		db  = agent.LogEntry{Time: t0, Stream: agent.LogStreamStdout, ContainerID: "db.1", Seq: 1, Line: "db line"}
+	)
+
+	r.forward("api", api)
+	r.forward("web", web)
+	r.forward("db", db)
+
+	hostname, _ := os.Hostname()
+	want := fmt.Sprintf("1 2014-07-01T12:00:00.123456Z %s api api.1 stderr - api line", hostname)
+
+	if have := readDatagram(t, udp); "<131>"+want != have {
+		t.Errorf("UDP: want %q, have %q", "<131>"+want, have)
+	}
+
+	if have := readDatagram(t, unixgram); "<11>"+want != have {
+		t.Errorf("Unix: want %q, have %q", "<11>"+want, have)
+	}
+
+	conn := accept(t, tcp)
+	defer conn.Close()
+
+	var (
+		br  = bufio.NewReader(conn)
+		n   int
+		msg = make([]byte, len("<11>"+want))
+	)
+
+	if _, err := fmt.Fscanf(br, "%d ", &n); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := len(msg), n; want != have {
+		t.Fatalf("TCP: want message length %d, have %d", want, have)
+	}
+
+	if _, err := io.ReadFull(br, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if have := string(msg); "<11>"+want != have {
+		t.Errorf("TCP: want %q, have %q", "<11>"+want, have)
+	}
+
+	conn = accept(t, ndjson)
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entry forwardedEntry
+
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := (forwardedEntry{LogEntry: api, Product: "api"}), entry; !want.Time.Equal(have.Time) || want.LogEntry.Line != have.LogEntry.Line || want.Product != have.Product || want.ContainerID != have.ContainerID {
+		t.Errorf("ndjson: want %+v, have %+v", want, have)
+	}
+
+	var buf []byte
+
+	for deadline := time.Now().Add(time.Second); len(buf) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		buf, _ = ioutil.ReadFile(filepath.Join(dir, "containers.log"))
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+
+	if want, have := 1, len(lines); want != have {
+		t.Fatalf("file: want %d lines, have %d", want, have)
+	}
+
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := "db line", entry.LogEntry.Line; want != have {
+		t.Errorf("file: want %q, have %q", want, have)
+	}
+
+	if want, have := "db", entry.Product; want != have {
+		t.Errorf("file: want product %q, have %q", want, have)
+	}
+}
+
+func TestLogSinkDropsEntries(t *testing.T) {
+	w := &blockingLogWriter{writec: make(chan forwardedEntry), releasec: make(chan struct{})}
+
+	s := newLogSink("test", w, 1)
+	defer s.close()
+	defer close(w.releasec)
+
+	dropped := expvarLogForwardDroppedLines.Value()
+
+	s.send(forwardedEntry{Product: "1"})
+	<-w.writec // being written, blocking the sink
+
+	s.send(forwardedEntry{Product: "2"}) // buffered
+	s.send(forwardedEntry{Product: "3"}) // dropped
+
+	if want, have := dropped+1, expvarLogForwardDroppedLines.Value(); want != have {
+		t.Errorf("want %d dropped lines, have %d", want, have)
+	}
+
+	w.releasec <- struct{}{}
+
+	if want, have := "2", (<-w.writec).Product; want != have {
+		t.Errorf("want entry %s, have %s", want, have)
+	}
+}
+
+func TestNewLogRouterInvalidConfig(t *testing.T) {
+	for i, config := range []logForwardingConfig{
+		{Sinks: map[string]logSinkConfig{"a": {Type: "gelf", Address: "udp://localhost:12201"}}},
+		{Sinks: map[string]logSinkConfig{"a": {Type: "syslog", Address: "localhost:514"}}},
+		{Sinks: map[string]logSinkConfig{"a": {Type: "syslog", Address: "udp://localhost:514", Facility: syslogFacility(24)}}},
+		{Sinks: map[string]logSinkConfig{"a": {Type: "syslog", Address: "udp://localhost:514", Facility: syslogFacility(-1)}}},
+		{Sinks: map[string]logSinkConfig{"a": {Type: "ndjson", Address: "udp://localhost:5170"}}},
+		{Sinks: map[string]logSinkConfig{"a": {Type: "file", Path: "containers.log"}}},
+		{Sinks: map[string]logSinkConfig{"a": {Type: "file", Path: "/tmp/containers.log", Buffer: -1}}},
+		{Routes: []logRouteConfig{{Product: "api", Sinks: []string{"a"}}}},
+		{Routes: []logRouteConfig{{Sinks: []string{}}}},
+	} {
+		if _, err := newLogRouter(config); err == nil {
+			t.Errorf("%d: want error, have none", i)
+		}
+	}
+}
+
+func TestSyslogFacility(t *testing.T) {
+	entry := forwardedEntry{LogEntry: agent.LogEntry{Stream: agent.LogStreamStdout, Line: "hello world"}}
+
+	for facility, want := range map[*int]string{
+		nil:                "<14>",
+		syslogFacility(0):  "<6>", // kern
+		syslogFacility(23): "<190>",
+	} {
+		w, err := newLogWriter(logSinkConfig{Type: "syslog", Address: "udp://localhost:514", Facility: facility}, "host")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have := string(w.(*connWriter).encode(entry)); !strings.HasPrefix(have, want) {
+			t.Errorf("want message starting with %q, have %q", want, have)
+		}
+	}
+}
+
+func TestFileWriterReopensRotatedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpoon-agent-log-forward-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		path = filepath.Join(dir, "containers.log")
+		w    = &fileWriter{path: path} // checks for rotation on every write
+	)
+
+	defer w.close()
+
+	for i, rotate := range []func() error{
+		func() error { return nil },
+		func() error { return os.Rename(path, path+".1") },
+		func() error { return os.Remove(path) },
+	} {
+		if err := rotate(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.write(forwardedEntry{LogEntry: agent.LogEntry{Line: fmt.Sprintf("line %d", i)}}); err != nil {
+			t.Fatal(err)
+		}
+
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var entry forwardedEntry
+
+		if err := json.Unmarshal(buf, &entry); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+
+		if want, have := fmt.Sprintf("line %d", i), entry.Line; want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	entry := forwardedEntry{
+		LogEntry: agent.LogEntry{
+			Time:        time.Date(2014, 7, 1, 14, 0, 0, 5e8, time.FixedZone("CEST", 7200)),
+			Stream:      agent.LogStreamStdout,
+			ContainerID: "api.1",
+			Line:        "hello world",
+		},
+		Product: "my product",
+	}
+
+	if want, have := "<14>1 2014-07-01T12:00:00.500000Z host my_product api.1 stdout - hello world", string(syslogMessage(entry, syslogFacilityUser, "host")); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+
+	entry.Time, entry.Product = time.Time{}, ""
+
+	if want, have := "<14>1 - host - api.1 stdout - hello world", string(syslogMessage(entry, syslogFacilityUser, "host")); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func syslogFacility(n int) *int {
+	return &n
+}
+
+// blockingLogWriter passes entries to writec, and blocks until released.
+type blockingLogWriter struct {
+	writec   chan forwardedEntry
+	releasec chan struct{}
+}
+
+func (w *blockingLogWriter) write(entry forwardedEntry) error {
+	w.writec <- entry
+	<-w.releasec
+	return nil
+}
+
+func (w *blockingLogWriter) close() {}
+
+func readDatagram(t *testing.T, c net.PacketConn) string {
+	buf := make([]byte, 65536)
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf[:n])
+}
+
+func accept(t *testing.T, ln net.Listener) net.Conn {
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
@@ -0,0 +1,72 @@
+package main
+
+// Containers started by agents which collected their output with svlogd keep
+// writing it to svlogd until they're restarted. svlogd keeps writing their
+// log files, and forwards every line to the agent over UDP, prefixed with the
+// container ID. The agent adds the forwarded lines to their logs through log
+// pipelines. Once such a container is restarted, its supervisor collects its
+// output, once its svlogd has exited.
+
+import (
+	"log"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+const averageLogLineLength = 120 // chars
+
+// svlogdPrefix matches the prefix svlogd was configured to prepend to the
+// lines it forwards, which names the container.
+var svlogdPrefix = regexp.MustCompile(`^container\[([^\]]+)\]:?`)
+
+// receiveLegacyLogs reads the lines forwarded by svlogd from conn, and routes
+// them to the containers in r, until conn is closed.
+func receiveLegacyLogs(conn net.PacketConn, r *registry) {
+	if uc, ok := conn.(*net.UDPConn); ok {
+		uc.SetReadBuffer(logBufferSize * averageLogLineLength)
+	}
+
+	buf := make([]byte, maxLogLineLength+maxContainerIDLength+len("container[]:")+len(logTimeLayout)+1)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("logs: while reading from port: %s", err)
+			return
+		}
+
+		msg := string(buf[:n])
+
+		matches := svlogdPrefix.FindStringSubmatch(msg)
+		if len(matches) != 2 {
+			incLogUnparsableLines(1)
+			log.Printf("logs: %s: message to unknown container: %s", addr, msg)
+			continue
+		}
+
+		c, ok := r.get(matches[1])
+		if !ok {
+			incLogUnroutableLines(1)
+			log.Printf("logs: %s: message to unknown container: %s", addr, msg)
+			continue
+		}
+
+		line := msg[len(matches[0]):]
+
+		t, rest, ok := splitLogTimestamp(line)
+		if ok {
+			line = rest
+		} else {
+			t = time.Now().UTC()
+		}
+
+		logs := c.Logs()
+
+		if !logs.ingest(logs.newLogEntry(agent.LogStreamStdout, line, t)) {
+			incLogUnroutableLines(1)
+		}
+	}
+}
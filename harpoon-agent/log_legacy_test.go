@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestRecoverLegacyContainer(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	containerRoot, err := ioutil.TempDir("", "harpoon-agent-log-legacy-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(containerRoot)
+
+	rundir := filepath.Join(containerRoot, "legacy")
+
+	if err := os.MkdirAll(rundir, 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	// The supervisor of the container, started by an earlier agent, whose
+	// output is collected by svlogd.
+	control, err := net.Listen("unix", filepath.Join(rundir, "control"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+
+	go func() {
+		for {
+			conn, err := control.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	var (
+		registry = newRegistry(nopServiceDiscovery{})
+		pdb      = newPortDB(lowTestPort, highTestPort)
+		c        = newRealContainer("legacy", containerRoot, volumes{}, agent.ContainerConfig{}, false, pdb, func() {}, time.Second)
+		linec    = make(chan agent.LogEntry, 10)
+	)
+
+	c.Logs().notify(linec)
+
+	if err := c.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Exit()
+
+	registry.register(c)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go receiveLegacyLogs(conn, registry)
+
+	svlogd, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svlogd.Close()
+
+	unroutable := expvarLogUnroutableLines.Value()
+
+	for _, msg := range []string{
+		"container[legacy]:m1",
+		"container[unknown]:x",
+		"container[legacy]:2014-07-01_12:00:00.12345 m2",
+	} {
+		if _, err := svlogd.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var entries []agent.LogEntry
+
+	for i := 0; i < 2; i++ {
+		select {
+		case entry := <-linec:
+			entries = append(entries, entry)
+		case <-time.After(time.Second):
+			t.Fatalf("want 2 entries, have %v", entries)
+		}
+	}
+
+	expectArraysEqual(t, logLines(entries), []string{"m1", "m2"})
+
+	for i, want := range []agent.LogEntry{
+		{Stream: agent.LogStreamStdout, Seq: 1},
+		{Stream: agent.LogStreamStdout, Seq: 2, Time: time.Date(2014, 7, 1, 12, 0, 0, 123450000, time.UTC)},
+	} {
+		have := entries[i]
+
+		if want.Stream != have.Stream || want.Seq != have.Seq || (!want.Time.IsZero() && !want.Time.Equal(have.Time)) {
+			t.Errorf("entry %d: want %+v, have %+v", i, want, have)
+		}
+	}
+
+	if want, have := unroutable+1, expvarLogUnroutableLines.Value(); want != have {
+		t.Errorf("want %d unroutable lines, have %d", want, have)
+	}
+}
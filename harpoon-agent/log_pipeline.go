@@ -0,0 +1,148 @@
+package main
+
+// Supervisors collect the output of their containers, see
+// harpoon-supervisor, whether or not the agent runs: they write it to the
+// log files in the logdir of the container, and stream it to the agent once
+// it subscribes. The agent adds every entry streamed to the container's log,
+// and forwards it to log sinks, see log_forward.go. Log producers may send
+// further lines to the log of a container, see log_stream.go, which the
+// agent sends on to the supervisor. Supervisors of containers started by
+// earlier agents don't collect the output, which svlogd collects instead, see
+// log_legacy.go. The lines of these containers are logged by a log pipeline.
+
+import (
+	"bufio"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+const (
+	maxLogLineLength = 50000
+
+	// maxLogEntryLength is the maximum length of a line of a log file. Lines
+	// are escaped in JSON, which takes at most six bytes per byte.
+	maxLogEntryLength = 6*maxLogLineLength + 4096
+
+	// logTimeLayout is the layout of the timestamps of lines in log files
+	// written before they contained entries.
+	logTimeLayout = "2006-01-02_15:04:05.00000"
+)
+
+// logPipeline numbers the entries ingested into the log of a container whose
+// supervisor doesn't collect its output, and logs them.
+type logPipeline struct {
+	logs   *containerLog
+	entryc chan agent.LogEntry
+	quitc  chan struct{}
+	done   chan struct{}
+}
+
+// startLogPipeline starts a pipeline, which takes the entries ingested into
+// logs until a supervisor takes over.
+func startLogPipeline(logs *containerLog) *logPipeline {
+	p := &logPipeline{
+		logs:   logs,
+		entryc: make(chan agent.LogEntry),
+		quitc:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go p.loop()
+
+	logs.setPipeline(p)
+
+	return p
+}
+
+// stop stops the pipeline, once the entry it's logging, if any, is logged.
+func (p *logPipeline) stop() {
+	p.logs.unsetPipeline(p)
+	close(p.quitc)
+	<-p.done
+}
+
+// ingest feeds an entry sent by a log producer to the pipeline, and blocks
+// until the pipeline has taken it. The entry's Dropped counts the lines the
+// producer lost before it. It returns false if the pipeline has been
+// stopped.
+func (p *logPipeline) ingest(entry agent.LogEntry) bool {
+	select {
+	case p.entryc <- entry:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+func (p *logPipeline) loop() {
+	defer close(p.done)
+
+	var seq uint64
+
+	for {
+		select {
+		case <-p.quitc:
+			return
+
+		case entry := <-p.entryc:
+			seq++
+			entry.Seq = seq
+
+			p.logs.log(entry)
+		}
+	}
+}
+
+// logGaps counts the lines missing from a sequence of line numbers.
+type logGaps struct {
+	last    uint64 // line number observed last
+	missing uint64 // since the last take
+}
+
+// observe notes line number n. Numbers that don't follow the last one start
+// the sequence over, e.g. after a restart. Unnumbered lines, 0, are ignored.
+func (g *logGaps) observe(n uint64) {
+	if n == 0 {
+		return
+	}
+
+	if g.last > 0 && n > g.last+1 {
+		g.missing += n - g.last - 1
+	}
+
+	g.last = n
+}
+
+// take returns the number of missing lines, and starts counting over.
+func (g *logGaps) take() uint64 {
+	missing := g.missing
+	g.missing = 0
+	return missing
+}
+
+// readLogLine returns the next line read from r, without its line break.
+// Lines longer than the buffer of r are truncated.
+func readLogLine(r *bufio.Reader) (string, error) {
+	buf, err := r.ReadSlice('\n')
+
+	switch err {
+	case nil:
+		return string(buf[:len(buf)-1]), nil
+
+	case bufio.ErrBufferFull:
+		line := string(buf)
+
+		for err == bufio.ErrBufferFull {
+			_, err = r.ReadSlice('\n')
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		return line, nil
+
+	default:
+		return "", err
+	}
+}
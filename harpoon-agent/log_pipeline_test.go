@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestLogPipeline(t *testing.T) {
+	var (
+		logs    = newContainerLog(10)
+		linec   = make(chan agent.LogEntry, 10)
+		dropped = expvarLogDroppedLines.Value()
+	)
+	defer logs.exit()
+
+	logs.id = "123"
+	logs.notify(linec)
+
+	p := startLogPipeline(logs)
+
+	for i, entry := range []agent.LogEntry{
+		logs.newLogEntry(agent.LogStreamStdout, "m1", time.Now()),
+		logs.newLogEntry(agent.LogStreamStderr, "e1", time.Now()),
+		logs.newLogEntry(agent.LogStreamStdout, "m2", time.Now()),
+	} {
+		if i == 2 {
+			entry.Dropped = 2
+		}
+
+		if !logs.ingest(entry) {
+			t.Fatalf("entry %d: want ingested", i)
+		}
+
+		waitForLogLine(t, linec, time.Second)
+	}
+
+	p.stop()
+
+	if logs.ingest(logs.newLogEntry(agent.LogStreamStdout, "x", time.Now())) {
+		t.Error("want no entries ingested once stopped")
+	}
+
+	entries := logs.last(3)
+
+	expectArraysEqual(t, logLines(entries), []string{"m1", "e1", "m2"})
+
+	for i, want := range []agent.LogEntry{
+		{Stream: agent.LogStreamStdout, ContainerID: "123", Seq: 1},
+		{Stream: agent.LogStreamStderr, ContainerID: "123", Seq: 2},
+		{Stream: agent.LogStreamStdout, ContainerID: "123", Seq: 3, Dropped: 2},
+	} {
+		have := entries[i]
+
+		if want.Stream != have.Stream || want.ContainerID != have.ContainerID || want.Seq != have.Seq || want.Dropped != have.Dropped {
+			t.Errorf("entry %d: want %+v, have %+v", i, want, have)
+		}
+	}
+
+	if want, have := dropped+2, expvarLogDroppedLines.Value(); want != have {
+		t.Errorf("want %d dropped lines, have %d", want, have)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+// Log queries select entries from the log of a container. Plain queries for the
+// last lines are answered from the ring buffer of the container log. Queries
+// for a time range, or for matching lines, or for more lines than the ring
+// buffer holds, are answered from the log files in the logdir of the
+// container, which go back much further.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+type logQuery struct {
+	agent.LogQuery
+	re *regexp.Regexp
+}
+
+func newLogQuery(q agent.LogQuery) (logQuery, error) {
+	lq := logQuery{LogQuery: q}
+
+	if q.Regexp != "" {
+		re, err := regexp.Compile(q.Regexp)
+		if err != nil {
+			return logQuery{}, fmt.Errorf("invalid regexp (%s)", err)
+		}
+
+		lq.re = re
+	}
+
+	return lq, nil
+}
+
+// ranged returns whether the query selects lines by the time they were
+// logged.
+func (q logQuery) ranged() bool {
+	return !q.Since.IsZero() || !q.Until.IsZero()
+}
+
+// filtered returns whether the query selects lines by their contents.
+func (q logQuery) filtered() bool {
+	return q.Filter != "" || q.re != nil
+}
+
+// match returns whether line is selected by the filters of the query.
+func (q logQuery) match(line string) bool {
+	if q.Filter != "" && !strings.Contains(line, q.Filter) {
+		return false
+	}
+
+	if q.re != nil && !q.re.MatchString(line) {
+		return false
+	}
+
+	return true
+}
+
+// query returns the entries of the container log selected by q, from oldest
+// to newest.
+func (cl *containerLog) query(q logQuery) ([]agent.LogEntry, error) {
+	if !q.ranged() && !q.filtered() && q.History <= cl.size {
+		return cl.last(q.History), nil
+	}
+
+	entries, err := readLogFiles(cl.dir, q)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		entries[i].ContainerID = cl.id
+	}
+
+	return entries, nil
+}
+
+// readLogFiles returns the entries selected by q from the log files in dir,
+// from oldest to newest.
+func readLogFiles(dir string, q logQuery) ([]agent.LogEntry, error) {
+	if q.History <= 0 || dir == "" {
+		return []agent.LogEntry{}, nil
+	}
+
+	names, err := logFileNames(dir, q.Since)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := newLastEntries(q.History)
+
+	for _, name := range names {
+		done, err := readLogFile(filepath.Join(dir, name), q, entries)
+		if err != nil {
+			return nil, err
+		}
+
+		if done {
+			break
+		}
+	}
+
+	return entries.get(), nil
+}
+
+// logFileNames returns the names of the log files in dir, from oldest to
+// newest, skipping rotated logs which were rotated before since.
+func logFileNames(dir string, since time.Time) ([]string, error) {
+	names, err := readDirNames(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var rotated []string
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, "@") || !(strings.HasSuffix(name, ".s") || strings.HasSuffix(name, ".u")) {
+			continue
+		}
+
+		if t, ok := parseTAI64N(name[:len(name)-len(".s")]); ok && t.Before(since) {
+			continue
+		}
+
+		rotated = append(rotated, name)
+	}
+
+	sort.Strings(rotated) // oldest first
+
+	return append(rotated, "current"), nil
+}
+
+// readLogFile adds the entries selected by q from the log file at path to
+// entries. It returns true if the log file contains entries logged after
+// q.Until, so that later log files don't need to be read.
+func readLogFile(path string, q logQuery, entries *lastEntries) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 4096), maxLogEntryLength)
+
+	for s.Scan() {
+		entry := parseLogFileLine(s.Text())
+
+		if !q.Since.IsZero() && entry.Time.Before(q.Since) {
+			continue
+		}
+
+		if !q.Until.IsZero() && entry.Time.After(q.Until) {
+			return true, nil
+		}
+
+		if q.match(entry.Line) {
+			entries.add(entry)
+		}
+	}
+
+	return false, s.Err()
+}
+
+// parseLogFileLine parses a line of a log file. Log files written before
+// they contained entries have lines prefixed with a timestamp, and lines
+// without a valid timestamp have the zero time.
+func parseLogFileLine(s string) agent.LogEntry {
+	var entry agent.LogEntry
+
+	if strings.HasPrefix(s, "{") && json.Unmarshal([]byte(s), &entry) == nil {
+		return entry
+	}
+
+	t, line, ok := splitLogTimestamp(s)
+	if !ok {
+		return agent.LogEntry{Line: s}
+	}
+
+	return agent.LogEntry{Time: t, Line: line}
+}
+
+// splitLogTimestamp splits the timestamp svlogd prefixed s with from the
+// line, if s has one.
+func splitLogTimestamp(s string) (time.Time, string, bool) {
+	if len(s) <= len(logTimeLayout) || s[len(logTimeLayout)] != ' ' {
+		return time.Time{}, s, false
+	}
+
+	t, err := time.Parse(logTimeLayout, s[:len(logTimeLayout)])
+	if err != nil {
+		return time.Time{}, s, false
+	}
+
+	return t, s[len(logTimeLayout)+1:], true
+}
+
+// parseTAI64N parses an external TAI64N label, which names rotated logs.
+func parseTAI64N(label string) (time.Time, bool) {
+	if len(label) != 25 || label[0] != '@' {
+		return time.Time{}, false
+	}
+
+	sec, err := strconv.ParseUint(label[1:17], 16, 64)
+	if err != nil || sec < 0x400000000000000a {
+		return time.Time{}, false
+	}
+
+	nsec, err := strconv.ParseUint(label[17:], 16, 32)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(sec-0x400000000000000a), int64(nsec)), true
+}
+
+// lastEntries retains the last n entries added to it.
+type lastEntries struct {
+	n       int
+	entries []agent.LogEntry
+}
+
+func newLastEntries(n int) *lastEntries {
+	return &lastEntries{n: n}
+}
+
+func (l *lastEntries) add(entry agent.LogEntry) {
+	if len(l.entries) >= 2*l.n {
+		l.entries = append(l.entries[:0], l.entries[len(l.entries)-l.n+1:]...)
+	}
+
+	l.entries = append(l.entries, entry)
+}
+
+func (l *lastEntries) get() []agent.LogEntry {
+	if len(l.entries) > l.n {
+		return l.entries[len(l.entries)-l.n:]
+	}
+
+	if l.entries == nil {
+		return []agent.LogEntry{}
+	}
+
+	return l.entries
+}
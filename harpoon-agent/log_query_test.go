@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestReadLogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpoon-agent-log-query-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Lines are spread over several rotated logs, and the current log.
+	var (
+		base    = time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC)
+		entries []agent.LogEntry
+	)
+
+	for i := 0; i < 10; i++ {
+		entries = append(entries, agent.LogEntry{Time: base.Add(time.Duration(i) * time.Second), Line: fmt.Sprintf("line %d", i)})
+	}
+
+	writeLogFiles(t, dir, entries, 3)
+
+	for i, test := range []struct {
+		query agent.LogQuery
+		want  []string
+	}{
+		{
+			query: agent.LogQuery{History: 3},
+			want:  []string{"line 7", "line 8", "line 9"},
+		},
+		{
+			query: agent.LogQuery{History: 100, Since: base.Add(2 * time.Second), Until: base.Add(4 * time.Second)},
+			want:  []string{"line 2", "line 3", "line 4"},
+		},
+		{
+			query: agent.LogQuery{History: 2, Until: base.Add(4 * time.Second)},
+			want:  []string{"line 3", "line 4"},
+		},
+		{
+			query: agent.LogQuery{History: 100, Since: base.Add(8 * time.Second)},
+			want:  []string{"line 8", "line 9"},
+		},
+		{
+			query: agent.LogQuery{History: 100, Filter: "line 1"},
+			want:  []string{"line 1"},
+		},
+		{
+			query: agent.LogQuery{History: 100, Regexp: `[2468]$`},
+			want:  []string{"line 2", "line 4", "line 6", "line 8"},
+		},
+		{
+			query: agent.LogQuery{History: 100, Since: base.Add(time.Hour)},
+			want:  []string{},
+		},
+	} {
+		q, err := newLogQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := readLogFiles(dir, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have := logLines(entries); !reflect.DeepEqual(test.want, have) {
+			t.Errorf("%d: want %v, have %v", i, test.want, have)
+		}
+	}
+}
+
+func TestContainerLogQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpoon-agent-log-query-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		cl      = newContainerLog(2)
+		linec   = make(chan agent.LogEntry, 10)
+		entries []agent.LogEntry
+	)
+	defer cl.exit()
+
+	cl.id = "123"
+	cl.dir = dir
+	cl.notify(linec)
+
+	for _, line := range []string{"m1", "m2", "m3"} {
+		entry := cl.newLogEntry(agent.LogStreamStdout, line, time.Now())
+		entries = append(entries, entry)
+
+		cl.addLogEntry(entry)
+		waitForLogLine(t, linec, time.Second)
+	}
+
+	writeLogFiles(t, dir, entries, len(entries))
+
+	for i, test := range []struct {
+		query agent.LogQuery
+		want  []string
+	}{
+		{agent.LogQuery{History: 1}, []string{"m3"}},                // ring buffer
+		{agent.LogQuery{History: 3}, []string{"m1", "m2", "m3"}},    // beyond the ring buffer
+		{agent.LogQuery{History: 10, Filter: "2"}, []string{"m2"}},  // filtered
+		{agent.LogQuery{History: 0, Since: time.Now()}, []string{}}, // no history
+		{agent.LogQuery{History: 10, Regexp: "^x"}, []string{}},     // no matches
+	} {
+		q, err := newLogQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := cl.query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have := logLines(entries); !reflect.DeepEqual(test.want, have) {
+			t.Errorf("%d: want %v, have %v", i, test.want, have)
+		}
+
+		for _, entry := range entries {
+			if want, have := "123", entry.ContainerID; want != have {
+				t.Errorf("%d: want container %s, have %s", i, want, have)
+			}
+		}
+	}
+
+	if _, err := newLogQuery(agent.LogQuery{Regexp: "("}); err == nil {
+		t.Errorf("want error for invalid regexp, have none")
+	}
+}
+
+// writeLogFiles writes entries to the log files in dir, n per file, the way
+// supervisors write them: the last ones to the current log, all others to
+// logs named after the time they were rotated at.
+func writeLogFiles(t *testing.T, dir string, entries []agent.LogEntry, n int) {
+	for len(entries) > 0 {
+		var (
+			name  = "current"
+			chunk = entries
+		)
+
+		if len(entries) > n {
+			chunk, entries = entries[:n], entries[n:]
+
+			rotated := entries[0].Time
+			name = fmt.Sprintf("@%016x%08x.s", uint64(0x400000000000000a)+uint64(rotated.Unix()), rotated.Nanosecond())
+		} else {
+			entries = nil
+		}
+
+		var buf bytes.Buffer
+
+		for _, entry := range chunk {
+			if err := json.NewEncoder(&buf).Encode(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseLogFileLine(t *testing.T) {
+	for line, want := range map[string]agent.LogEntry{
+		`{"time":"2014-07-01T12:00:00Z","stream":"stderr","container_id":"123","generation":2,"line":"hello"}`: {
+			Time:        time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC),
+			Stream:      agent.LogStreamStderr,
+			ContainerID: "123",
+			Generation:  2,
+			Line:        "hello",
+		},
+
+		// Log files written before they contained entries.
+		"2014-07-01_12:00:00.50000 hello": {
+			Time: time.Date(2014, 7, 1, 12, 0, 0, 5e8, time.UTC),
+			Line: "hello",
+		},
+		"{not json": {Line: "{not json"},
+		"hello":     {Line: "hello"},
+	} {
+		have := parseLogFileLine(line)
+
+		if !want.Time.Equal(have.Time) || want.Stream != have.Stream || want.ContainerID != have.ContainerID || want.Generation != have.Generation || want.Line != have.Line {
+			t.Errorf("%s: want %+v, have %+v", line, want, have)
+		}
+	}
+}
+
+func TestLogQueryValues(t *testing.T) {
+	want := agent.LogQuery{
+		History: 42,
+		Since:   time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC),
+		Until:   time.Date(2014, 7, 1, 13, 0, 0, 500, time.UTC),
+		Filter:  "GET /",
+		Regexp:  "status=5..",
+	}
+
+	have, err := agent.ParseLogQuery(want.Values())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+
+	if have, err := agent.ParseLogQuery(nil); err != nil {
+		t.Fatal(err)
+	} else if want := 10; want != have.History {
+		t.Errorf("want default history %d, have %d", want, have.History)
+	}
+
+	for _, s := range []string{"history=-1", "history=1000000", "history=x", "since=yesterday"} {
+		v, _ := url.ParseQuery(s)
+
+		if _, err := agent.ParseLogQuery(v); err == nil {
+			t.Errorf("%s: want error, have none", s)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+// Log streams are an alternative way for log producers to send the log lines
+// of containers to the agent, other than writing them to the stdout or
+// stderr of the containers. Producers connect to the log stream listener, a
+// Unix or TCP socket, and send one JSON object per line, addressed to a
+// container by its ID. The agent reads a connection no faster than the log
+// pipeline of the container takes the lines, so producers are slowed down
+// instead of losing lines. Producers that number the lines they send to a
+// container over a connection let the agent detect lines they lost
+// nonetheless, which are reported as dropped with the next line.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// logMessage is a line sent by a log producer.
+type logMessage struct {
+	ContainerID string          `json:"container_id"`
+	Stream      agent.LogStream `json:"stream"` // defaults to stdout
+	Time        time.Time       `json:"time"`   // defaults to when it's received
+	Seq         uint64          `json:"seq"`    // counts the lines sent to the container over the connection, if not 0
+	Line        string          `json:"line"`
+}
+
+// listenLogStream listens on addr, which is either unix:///path/to/socket or
+// tcp://host:port. Stale Unix sockets are removed.
+func listenLogStream(addr string) (net.Listener, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		if err := os.Remove(u.Path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		return net.Listen("unix", u.Path)
+
+	case "tcp":
+		return net.Listen("tcp", u.Host)
+
+	default:
+		return nil, fmt.Errorf("%s: want unix:// or tcp:// address", addr)
+	}
+}
+
+// receiveLogStream accepts connections from log producers, and routes the
+// lines they send to the containers in r, until ln is closed.
+func receiveLogStream(ln net.Listener, r *registry) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+
+			log.Printf("logs: %s", err)
+			return
+		}
+
+		go handleLogStream(conn, r)
+	}
+}
+
+func handleLogStream(conn net.Conn, r *registry) {
+	defer conn.Close()
+
+	var (
+		br   = bufio.NewReaderSize(conn, maxLogEntryLength)
+		gaps = map[string]*logGaps{} // container ID: of the lines sent to it
+	)
+
+	for {
+		buf, err := readLogLine(br)
+		if err != nil {
+			return
+		}
+
+		var msg logMessage
+
+		if err := json.Unmarshal([]byte(buf), &msg); err != nil {
+			incLogUnparsableLines(1)
+			continue
+		}
+
+		switch msg.Stream {
+		case "":
+			msg.Stream = agent.LogStreamStdout
+		case agent.LogStreamStdout, agent.LogStreamStderr:
+		default:
+			incLogUnparsableLines(1)
+			continue
+		}
+
+		if msg.Time.IsZero() {
+			msg.Time = time.Now().UTC()
+		}
+
+		if len(msg.Line) > maxLogLineLength {
+			msg.Line = msg.Line[:maxLogLineLength]
+		}
+
+		c, ok := r.get(msg.ContainerID)
+		if !ok {
+			incLogUnroutableLines(1)
+			continue
+		}
+
+		g, ok := gaps[msg.ContainerID]
+		if !ok {
+			g = &logGaps{}
+			gaps[msg.ContainerID] = g
+		}
+
+		g.observe(msg.Seq)
+
+		var (
+			logs  = c.Logs()
+			entry = logs.newLogEntry(msg.Stream, msg.Line, msg.Time)
+		)
+
+		entry.Dropped = g.take()
+
+		if !logs.ingest(entry) {
+			incLogUnroutableLines(1)
+		}
+	}
+}
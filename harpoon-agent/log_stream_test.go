@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestLogStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpoon-agent-log-stream-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		registry = newRegistry(nopServiceDiscovery{})
+		c        = newFakeContainer("123", "", volumes{}, agent.ContainerConfig{}, false, nil, func() {}, 0)
+		linec    = make(chan agent.LogEntry, 10)
+	)
+
+	registry.register(c)
+	c.Logs().notify(linec)
+
+	p := startLogPipeline(c.Logs())
+	defer p.stop()
+
+	ln, err := listenLogStream("unix://" + filepath.Join(dir, "log.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go receiveLogStream(ln, registry)
+
+	conn := dialLogStream(t, filepath.Join(dir, "log.sock"))
+	defer conn.Close()
+
+	var (
+		unparsable = expvarLogUnparsableLines.Value()
+		unroutable = expvarLogUnroutableLines.Value()
+	)
+
+	for _, msg := range []string{
+		`{"container_id":"123","seq":1,"line":"m1"}`,
+		`{"container_id":"123","stream":"stderr","seq":4,"line":"m2"}`, // 2 and 3 were lost
+		`not json`,
+		`{"container_id":"123","stream":"stdin","line":"x"}`,
+		`{"container_id":"456","line":"x"}`,
+		`{"container_id":"123","line":"m3"}`, // unnumbered
+	} {
+		if _, err := fmt.Fprintln(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var entries []agent.LogEntry
+
+	for i := 0; i < 3; i++ {
+		select {
+		case entry := <-linec:
+			entries = append(entries, entry)
+		case <-time.After(time.Second):
+			t.Fatalf("want 3 entries, have %v", entries)
+		}
+	}
+
+	expectArraysEqual(t, logLines(entries), []string{"m1", "m2", "m3"})
+
+	for i, want := range []agent.LogEntry{
+		{Stream: agent.LogStreamStdout, Seq: 1},
+		{Stream: agent.LogStreamStderr, Seq: 2, Dropped: 2},
+		{Stream: agent.LogStreamStdout, Seq: 3},
+	} {
+		have := entries[i]
+
+		if want.Stream != have.Stream || want.Seq != have.Seq || want.Dropped != have.Dropped || have.ContainerID != "123" {
+			t.Errorf("entry %d: want %+v, have %+v", i, want, have)
+		}
+	}
+
+	if want, have := unparsable+2, expvarLogUnparsableLines.Value(); want != have {
+		t.Errorf("want %d unparsable lines, have %d", want, have)
+	}
+
+	if want, have := unroutable+1, expvarLogUnroutableLines.Value(); want != have {
+		t.Errorf("want %d unroutable lines, have %d", want, have)
+	}
+
+	a := dialLogStream(t, filepath.Join(dir, "log.sock"))
+	defer a.Close()
+
+	b := dialLogStream(t, filepath.Join(dir, "log.sock"))
+	defer b.Close()
+
+	// Every producer numbers its lines on its own, so interleaving them
+	// mustn't look like lost lines.
+	for i, test := range []struct {
+		conn    net.Conn
+		seq     uint64
+		dropped uint64
+	}{
+		{a, 1, 0},
+		{b, 5, 0},
+		{a, 2, 0},
+		{b, 6, 0},
+		{b, 8, 1},
+		{a, 3, 0},
+	} {
+		if _, err := fmt.Fprintf(test.conn, `{"container_id":"123","seq":%d,"line":"m%d"}`+"\n", test.seq, i); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case entry := <-linec:
+			if want, have := fmt.Sprintf("m%d", i), entry.Line; want != have {
+				t.Fatalf("line %d: want %q, have %q", i, want, have)
+			}
+
+			if want, have := test.dropped, entry.Dropped; want != have {
+				t.Errorf("line %d: want %d dropped, have %d", i, want, have)
+			}
+
+		case <-time.After(time.Second):
+			t.Fatalf("line %d: not logged", i)
+		}
+	}
+}
+
+func TestLogGaps(t *testing.T) {
+	var g logGaps
+
+	for _, test := range []struct {
+		seq  uint64
+		want uint64
+	}{
+		{1, 0},
+		{2, 0},
+		{5, 2},
+		{0, 0}, // unnumbered
+		{6, 0},
+		{1, 0}, // starts over
+		{3, 1},
+	} {
+		g.observe(test.seq)
+
+		if have := g.take(); test.want != have {
+			t.Errorf("after %d: want %d missing, have %d", test.seq, test.want, have)
+		}
+	}
+}
+
+func dialLogStream(t *testing.T, path string) net.Conn {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
@@ -10,22 +10,29 @@ package main
 
 import (
 	"container/ring"
-	"log"
-	"net"
-	"regexp"
 	"sync"
-)
+	"sync/atomic"
+	"time"
 
-const (
-	logBufferSize        = 10000 // lines
-	averageLogLineLength = 120   // chars
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 )
 
+const logBufferSize = 10000 // lines
+
 type containerLog struct {
-	addc    chan string
+	size       int    // of the ring buffer
+	id         string // of the container
+	product    string // of the container, to route its entries to log sinks
+	dir        string // of the log files, if any
+	generation uint64 // restarts of the container, accessed atomically
+
+	pipelineMtx sync.Mutex
+	pipeline    logIngester // collecting the output of the container, if any
+
+	addc    chan agent.LogEntry
 	lastc   chan logLast
-	notifyc chan chan string
-	stopc   chan chan string
+	notifyc chan chan agent.LogEntry
+	stopc   chan chan agent.LogEntry
 	quitc   chan chan struct{}
 }
 
@@ -33,22 +40,29 @@ type containerLog struct {
 // a single active container.
 func newContainerLog(bufferSize int) *containerLog {
 	cl := &containerLog{
-		addc:    make(chan string),
+		size:    bufferSize,
+		addc:    make(chan agent.LogEntry),
 		lastc:   make(chan logLast),
-		notifyc: make(chan chan string),
-		stopc:   make(chan chan string),
+		notifyc: make(chan chan agent.LogEntry),
+		stopc:   make(chan chan agent.LogEntry),
 		quitc:   make(chan chan struct{}),
 	}
 	go cl.loop(bufferSize)
 	return cl
 }
 
+// logIngester takes the entries log producers send to a container, see
+// logPipeline and supervisor.
+type logIngester interface {
+	ingest(agent.LogEntry) bool
+}
+
 type logLast struct {
-	count int           // supplied by caller
-	last  chan []string // passes result to caller
+	count int                   // supplied by caller
+	last  chan []agent.LogEntry // passes result to caller
 }
 
-// addLogLine feeds a log entry into a log buffer and notifies all listeners.
+// addLogEntry feeds a log entry into a log buffer and notifies all listeners.
 //
 // METRICS:
 //  # number lines received
@@ -58,28 +72,84 @@ type logLast struct {
 //
 // If the number of dropped notifications goes up then a listener is not
 // consuming notifications fast enough. Look for a stalled listener.
-func (cl *containerLog) addLogLine(line string) {
-	cl.addc <- line
+func (cl *containerLog) addLogEntry(entry agent.LogEntry) {
+	cl.addc <- entry
+}
+
+// log adds an entry collected by the pipeline or the supervisor to the log,
+// and forwards it to log sinks.
+func (cl *containerLog) log(entry agent.LogEntry) {
+	if entry.Dropped > 0 {
+		incLogDroppedLines(int(entry.Dropped))
+	}
+
+	cl.addLogEntry(entry)
+	logForwarding.forward(cl.product, entry)
+}
+
+// newLogEntry returns an entry for line, written to stream at t, by the
+// current generation of the container.
+func (cl *containerLog) newLogEntry(stream agent.LogStream, line string, t time.Time) agent.LogEntry {
+	return agent.LogEntry{
+		Time:        t,
+		Stream:      stream,
+		ContainerID: cl.id,
+		Generation:  uint(atomic.LoadUint64(&cl.generation)),
+		Line:        line,
+	}
+}
+
+// setGeneration sets the number of restarts of the container, which tags the
+// entries logged from then on.
+func (cl *containerLog) setGeneration(restarts uint) {
+	atomic.StoreUint64(&cl.generation, uint64(restarts))
+}
+
+// setPipeline sets the pipeline collecting the output of the container.
+func (cl *containerLog) setPipeline(p logIngester) {
+	cl.pipelineMtx.Lock()
+	defer cl.pipelineMtx.Unlock()
+	cl.pipeline = p
+}
+
+// unsetPipeline unsets the pipeline collecting the output of the container,
+// if it's still p.
+func (cl *containerLog) unsetPipeline(p logIngester) {
+	cl.pipelineMtx.Lock()
+	defer cl.pipelineMtx.Unlock()
+	if cl.pipeline == p {
+		cl.pipeline = nil
+	}
 }
 
-// last retrieves the n last log lines from containerID, returning them in the
-// order from oldest to newest, i.e. []string{oldest, newer, ..., newest}. The
-// call is is idempotent.
-func (cl *containerLog) last(n int) []string {
-	msg := logLast{count: n, last: make(chan []string)}
+// ingest feeds an entry sent by a log producer to the pipeline collecting the
+// output of the container. It returns false if there's no pipeline.
+func (cl *containerLog) ingest(entry agent.LogEntry) bool {
+	cl.pipelineMtx.Lock()
+	p := cl.pipeline
+	cl.pipelineMtx.Unlock()
+
+	return p != nil && p.ingest(entry)
+}
+
+// last retrieves the n last log entries from containerID, returning them in
+// the order from oldest to newest, i.e. []agent.LogEntry{oldest, newer, ...,
+// newest}. The call is is idempotent.
+func (cl *containerLog) last(n int) []agent.LogEntry {
+	msg := logLast{count: n, last: make(chan []agent.LogEntry)}
 	cl.lastc <- msg
 	return <-msg.last
 }
 
-// notify subscribes a listener to a container. New log lines are sent to all
-// linecs in the notifications set. A linec does not receive messages
+// notify subscribes a listener to a container. New log entries are sent to
+// all linecs in the notifications set. A linec does not receive messages
 // while it is blocked. All of those messages are lost like tears in the rain.
-func (cl *containerLog) notify(linec chan string) {
+func (cl *containerLog) notify(linec chan agent.LogEntry) {
 	cl.notifyc <- linec
 }
 
 // stop removes the linec from the notifications set.
-func (cl *containerLog) stop(linec chan string) {
+func (cl *containerLog) stop(linec chan agent.LogEntry) {
 	cl.stopc <- linec
 }
 
@@ -94,15 +164,16 @@ func (cl *containerLog) exit() {
 func (cl *containerLog) loop(bufferSize int) {
 	var (
 		entries       = newRingBuffer(bufferSize)
-		notifications = make(map[chan string]struct{})
+		notifications = make(map[chan agent.LogEntry]struct{})
 	)
 	for {
 		select {
-		case line := <-cl.addc:
-			entries.insert(line)
+		case entry := <-cl.addc:
+			incLogReceivedLines(1)
+			entries.insert(entry)
 			for linec := range notifications {
 				select {
-				case linec <- line:
+				case linec <- entry:
 					incLogDeliverableLines(1)
 				default:
 					incLogUndeliveredLines(1)
@@ -125,55 +196,6 @@ func (cl *containerLog) loop(bufferSize int) {
 	}
 }
 
-// receiveLogs opens udp port 3334, listens for incoming log messages, and
-// then feeds these into the appropriate buffers.
-func receiveLogs(r *registry, logAddr string) {
-	laddr, err := net.ResolveUDPAddr("udp", logAddr)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	ln, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer ln.Close()
-
-	ln.SetReadBuffer(logBufferSize * averageLogLineLength)
-
-	var buf = make([]byte, maxLogLineLength+maxContainerIDLength)
-
-	// All log lines should start with the pattern container[FOO] where FOO
-	// is the container ID.
-	containsPtrn := regexp.MustCompile(`container\[([^\]]+)]`)
-
-	for {
-		n, addr, err := ln.ReadFromUDP(buf)
-		if err != nil {
-			log.Printf("logs: while reading from port: %s", err)
-			return
-		}
-		incLogReceivedLines(1)
-
-		line := string(buf[:n])
-		matches := containsPtrn.FindStringSubmatch(line)
-		if len(matches) != 2 {
-			incLogUnparsableLines(1)
-			log.Printf("logs: %s: message to unknown container: %s", addr, line)
-			continue
-		}
-
-		container, ok := r.get(matches[1])
-		if !ok {
-			incLogUnroutableLines(1)
-			log.Printf("logs: %s: message to unknown container: %s", addr, line)
-			continue
-		}
-
-		container.Logs().addLogLine(line)
-	}
-}
-
 // ringBuffer that allows you to retrieve the last n records. Retrieval calls are idempotent.
 type ringBuffer struct {
 	sync.Mutex
@@ -187,7 +209,7 @@ func newRingBuffer(size int) *ringBuffer {
 }
 
 // insert a message into the ring buffer.
-func (b *ringBuffer) insert(x string) {
+func (b *ringBuffer) insert(x agent.LogEntry) {
 	b.Lock()
 	defer b.Unlock()
 	b.elements.Value = x
@@ -195,13 +217,14 @@ func (b *ringBuffer) insert(x string) {
 }
 
 // Last returns the last count entries from the ring buffer. These
-// are returned from oldest to newest, i.e. []string{oldest, ..., newest}.
+// are returned from oldest to newest, i.e. []agent.LogEntry{oldest, ...,
+// newest}.
 // It will never return more entries than the ringBuffer can hold, although
 // it may return fewer if the ring buffer has fewer entries than were
 // requested.
-func (b *ringBuffer) last(count int) []string {
+func (b *ringBuffer) last(count int) []agent.LogEntry {
 	count = min(count, b.length)
-	results := make([]string, 0, count)
+	results := make([]agent.LogEntry, 0, count)
 
 	b.Lock()
 	defer b.Unlock()
@@ -212,14 +235,14 @@ func (b *ringBuffer) last(count int) []string {
 		if prev.Value == nil {
 			break
 		}
-		results = append(results, prev.Value.(string))
+		results = append(results, prev.Value.(agent.LogEntry))
 	}
 
 	return reverse(results)
 }
 
 // reverse reverses the oder of a slice destructively.
-func reverse(x []string) []string {
+func reverse(x []agent.LogEntry) []agent.LogEntry {
 	for i := 0; i < len(x)/2; i++ {
 		x[i], x[len(x)-i-1] = x[len(x)-i-1], x[i]
 	}
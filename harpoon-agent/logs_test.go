@@ -6,15 +6,17 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 )
 
 func TestLastRetrievesLastLogLines(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 
 	cl := newContainerLog(3)
-	cl.addLogLine("m1")
+	addLogLine(cl, "m1")
 
-	expectArraysEqual(t, cl.last(1), []string{"m1"})
+	expectArraysEqual(t, logLines(cl.last(1)), []string{"m1"})
 }
 
 func TestListenersReceiveMessages(t *testing.T) {
@@ -22,11 +24,11 @@ func TestListenersReceiveMessages(t *testing.T) {
 
 	var (
 		cl      = newContainerLog(3)
-		logSink = make(chan string, 1) // can't block
+		logSink = make(chan agent.LogEntry, 1) // can't block
 	)
 
 	cl.notify(logSink)
-	cl.addLogLine("m1")
+	addLogLine(cl, "m1")
 
 	expectMessage(t, logSink, "m1")
 }
@@ -36,11 +38,11 @@ func TestBlockedChannelsAreSkipped(t *testing.T) {
 
 	var (
 		cl      = newContainerLog(3)
-		logSink = make(chan string)
+		logSink = make(chan agent.LogEntry)
 	)
 
 	cl.notify(logSink)
-	cl.addLogLine("m1")
+	addLogLine(cl, "m1")
 
 	expectNoMessage(t, logSink)
 }
@@ -50,12 +52,12 @@ func TestListenerShouldReceivesAllMessagesOnChannel(t *testing.T) {
 
 	var (
 		cl      = newContainerLog(3)
-		logSink = make(chan string, 2)
+		logSink = make(chan agent.LogEntry, 2)
 	)
 
 	cl.notify(logSink)
-	cl.addLogLine("m1")
-	cl.addLogLine("m2")
+	addLogLine(cl, "m1")
+	addLogLine(cl, "m2")
 
 	expectMessage(t, logSink, "m1")
 	expectMessage(t, logSink, "m2")
@@ -66,13 +68,13 @@ func TestMessagesShouldBroadcastToAllListeners(t *testing.T) {
 
 	var (
 		cl       = newContainerLog(3)
-		logSink1 = make(chan string, 2)
-		logSink2 = make(chan string, 2)
+		logSink1 = make(chan agent.LogEntry, 2)
+		logSink2 = make(chan agent.LogEntry, 2)
 	)
 
 	cl.notify(logSink1)
 	cl.notify(logSink2)
-	cl.addLogLine("m1")
+	addLogLine(cl, "m1")
 
 	expectMessage(t, logSink1, "m1")
 	expectMessage(t, logSink2, "m1")
@@ -83,14 +85,14 @@ func TestRemovedListenersDoNotReceiveMessages(t *testing.T) {
 
 	var (
 		cl       = newContainerLog(3)
-		logSink1 = make(chan string, 2)
-		logSink2 = make(chan string, 2)
+		logSink1 = make(chan agent.LogEntry, 2)
+		logSink2 = make(chan agent.LogEntry, 2)
 	)
 
 	cl.notify(logSink1)
 	cl.notify(logSink2)
 	cl.stop(logSink2)
-	cl.addLogLine("m1")
+	addLogLine(cl, "m1")
 
 	expectMessage(t, logSink1, "m1")
 	expectNoMessage(t, logSink2)
@@ -101,7 +103,7 @@ func TestKillingContainerUnblocksListeners(t *testing.T) {
 
 	var (
 		cl                 = newContainerLog(3)
-		logSink            = make(chan string, 1)
+		logSink            = make(chan agent.LogEntry, 1)
 		receiverTerminated = make(chan struct{})
 	)
 
@@ -124,17 +126,17 @@ func TestKillingContainerUnblocksListeners(t *testing.T) {
 	}
 }
 
-func expectMessage(t *testing.T, logSink chan string, want string) {
-	msg := <-logSink
+func expectMessage(t *testing.T, logSink chan agent.LogEntry, want string) {
+	msg := (<-logSink).Line
 	if msg != want {
 		t.Errorf("Received %q when expecting %q", msg, want)
 	}
 }
 
-func expectNoMessage(t *testing.T, logSink chan string) {
+func expectNoMessage(t *testing.T, logSink chan agent.LogEntry) {
 	select {
-	case logLine := <-logSink:
-		if logLine != "" {
+	case entry := <-logSink:
+		if logLine := entry.Line; logLine != "" {
 			t.Errorf("Received log line %q when we should have received nothing", logLine)
 		}
 	default:
@@ -144,68 +146,68 @@ func expectNoMessage(t *testing.T, logSink chan string) {
 
 func TestEmptyRingBufferHasNoLastElements(t *testing.T) {
 	rb := newRingBuffer(3)
-	expectArraysEqual(t, rb.last(2), []string{})
+	expectArraysEqual(t, logLines(rb.last(2)), []string{})
 }
 
 func TestRingBufferWithSomethingReturnsSomething(t *testing.T) {
 	rb := newRingBuffer(3)
-	rb.insert("m1")
-	expectArraysEqual(t, rb.last(1), []string{"m1"})
+	rb.insert(agent.LogEntry{Line: "m1"})
+	expectArraysEqual(t, logLines(rb.last(1)), []string{"m1"})
 }
 
 func TestRingBufferOnlyReturnsNumberOfResultsPresent(t *testing.T) {
 	// Checks that nil was used to limit number returned.
 	rb := newRingBuffer(3)
-	rb.insert("m1")
-	expectArraysEqual(t, rb.last(2), []string{"m1"})
+	rb.insert(agent.LogEntry{Line: "m1"})
+	expectArraysEqual(t, logLines(rb.last(2)), []string{"m1"})
 }
 
 func TestLastOnlyReturnsTheRequestedNumberOfElements(t *testing.T) {
 	// Checks that index was used to limit number returned.
 	rb := newRingBuffer(3)
-	rb.insert("m1")
-	rb.insert("m2")
-	expectArraysEqual(t, rb.last(1), []string{"m2"})
+	rb.insert(agent.LogEntry{Line: "m1"})
+	rb.insert(agent.LogEntry{Line: "m2"})
+	expectArraysEqual(t, logLines(rb.last(1)), []string{"m2"})
 }
 
 func TestLastReturnsResultsFromOldestToNewest(t *testing.T) {
 	rb := newRingBuffer(3)
-	rb.insert("m1")
-	rb.insert("m2")
-	expectArraysEqual(t, rb.last(2), []string{"m1", "m2"})
+	rb.insert(agent.LogEntry{Line: "m1"})
+	rb.insert(agent.LogEntry{Line: "m2"})
+	expectArraysEqual(t, logLines(rb.last(2)), []string{"m1", "m2"})
 }
 
 func TestRingBufferWithCapacityNReallyHoldsNRecords(t *testing.T) {
 	rb := newRingBuffer(3)
-	rb.insert("m1")
-	rb.insert("m2")
-	rb.insert("m3")
-	expectArraysEqual(t, rb.last(3), []string{"m1", "m2", "m3"})
+	rb.insert(agent.LogEntry{Line: "m1"})
+	rb.insert(agent.LogEntry{Line: "m2"})
+	rb.insert(agent.LogEntry{Line: "m3"})
+	expectArraysEqual(t, logLines(rb.last(3)), []string{"m1", "m2", "m3"})
 }
 
 func TestRingBufferWithCapacityNReallyHoldsOnlyNRecords(t *testing.T) {
 	rb := newRingBuffer(3)
-	rb.insert("m1")
-	rb.insert("m2")
-	rb.insert("m3")
-	rb.insert("m4")
-	expectArraysEqual(t, rb.last(3), []string{"m2", "m3", "m4"})
+	rb.insert(agent.LogEntry{Line: "m1"})
+	rb.insert(agent.LogEntry{Line: "m2"})
+	rb.insert(agent.LogEntry{Line: "m3"})
+	rb.insert(agent.LogEntry{Line: "m4"})
+	expectArraysEqual(t, logLines(rb.last(3)), []string{"m2", "m3", "m4"})
 }
 
 func TestLastLimitsRetrievalToTheRingBufferSize(t *testing.T) {
 	rb := newRingBuffer(3)
-	rb.insert("m1")
-	rb.insert("m2")
-	rb.insert("m3")
-	rb.insert("m4")
-	expectArraysEqual(t, rb.last(4), []string{"m2", "m3", "m4"})
+	rb.insert(agent.LogEntry{Line: "m1"})
+	rb.insert(agent.LogEntry{Line: "m2"})
+	rb.insert(agent.LogEntry{Line: "m3"})
+	rb.insert(agent.LogEntry{Line: "m4"})
+	expectArraysEqual(t, logLines(rb.last(4)), []string{"m2", "m3", "m4"})
 }
 
 func TestReverse(t *testing.T) {
-	expectArraysEqual(t, reverse([]string{}), []string{})
-	expectArraysEqual(t, reverse([]string{"1"}), []string{"1"})
-	expectArraysEqual(t, reverse([]string{"1", "2"}), []string{"2", "1"})
-	expectArraysEqual(t, reverse([]string{"1", "2", "3"}), []string{"3", "2", "1"})
+	expectArraysEqual(t, logLines(reverse(logEntries())), []string{})
+	expectArraysEqual(t, logLines(reverse(logEntries("1"))), []string{"1"})
+	expectArraysEqual(t, logLines(reverse(logEntries("1", "2"))), []string{"2", "1"})
+	expectArraysEqual(t, logLines(reverse(logEntries("1", "2", "3"))), []string{"3", "2", "1"})
 }
 
 func TestMin(t *testing.T) {
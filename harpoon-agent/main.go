@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 )
 
@@ -30,14 +33,18 @@ func main() {
 		configuredVolumes = volumes{}
 		agentCPU          = flag.Float64("cpu", systemCPU(), "CPU resources to make available")
 		agentMem          = flag.Int64("mem", systemMem(), "memory (MB) resources to make available")
+		agentStorage      = flag.Int64("storage", 0, "storage (MB) resources to make available (0 for the capacity of the run, artifact, and log filesystems)")
 		debug             = flag.Bool("debug", false, "debug logging")
-		logAddr           = flag.String("log.addr", ":3334", "address for log communications")
 		showVersion       = flag.Bool("version", false, "print version")
 		containerRoot     = flag.String("run", "/run/harpoon", "filesytem root for packages")
 		addr              = flag.String("addr", ":3333", "address to listen on")
+		logAddr           = flag.String("log.addr", ":3334", "address to receive the logs of containers started by earlier agents from svlogd on (empty to disable)")
+		logListen         = flag.String("log.listen", "", "address to receive log streams on, unix:///path/to/socket or tcp://host:port (empty to disable)")
+		logForward        = flag.String("log.forward", "", "JSON file configuring the sinks and routes to forward container logs to (empty to disable)")
 		portsStart        = flag.Uint64("ports.start", 30000, "starting of port allocation range")
 		portsEnd          = flag.Uint64("ports.end", 32767, "ending of port allocation range")
 		downloadTimeout   = flag.Duration("download.timeout", agent.DefaultDownloadTimeout, "max artifact download time")
+		artifactsMax      = flag.Uint64("artifacts.max", 0, "max size (MB) of the artifact cache; unused artifacts are removed least recently used first (0 for unlimited)")
 		sdFilename        = flag.String("sd.filename", "", "file to write service information")
 		sdReload          = flag.String("sd.reload", "", "command to execute after writing -sd.filename")
 	)
@@ -75,13 +82,53 @@ func main() {
 
 	r := newRegistry(sd)
 
+	if *logAddr != "" {
+		conn, err := net.ListenPacket("udp", *logAddr)
+		if err != nil {
+			log.Fatalf("unable to listen for svlogd: %s", err)
+		}
+		defer conn.Close()
+
+		go receiveLegacyLogs(conn, r)
+	}
+
+	if *logListen != "" {
+		ln, err := listenLogStream(*logListen)
+		if err != nil {
+			log.Fatalf("unable to listen for log streams: %s", err)
+		}
+		defer ln.Close()
+
+		log.Printf("receiving log streams on %s", *logListen)
+		go receiveLogStream(ln, r)
+	}
+
+	if *logForward != "" {
+		router, err := readLogRouter(*logForward)
+		if err != nil {
+			log.Fatalf("unable to configure log forwarding: %s", err)
+		}
+		defer router.close()
+
+		log.Printf("forwarding logs as configured in %s", *logForward)
+		logForwarding = router
+	}
+
 	pdb := newPortDB(portsStart16, portsEnd16)
 	defer pdb.exit()
 
-	api := newAPI(*containerRoot, r, pdb, configuredVolumes, *agentCPU, *agentMem, *downloadTimeout, *debug)
+	if *agentStorage <= 0 {
+		*agentStorage = systemStorage(*containerRoot, artifactRoot, logRoot)
+	}
+
+	api := newAPI(*containerRoot, r, pdb, configuredVolumes, *agentCPU, *agentMem, *agentStorage, *downloadTimeout, *debug)
+
+	artifacts.maxSize = *artifactsMax * 1024 * 1024
+	artifacts.sweep()
 
-	go receiveLogs(r, *logAddr)
+	prometheus.MustRegister(newContainerCollector(r.instances))
 
+	http.Handle("/metrics", prometheus.Handler())
 	http.Handle("/", api)
 
 	go func() {
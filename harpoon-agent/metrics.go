@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+var containerLabels = []string{"product", "environment", "job", "container_id"}
+
+var (
+	containerMemoryUsageDesc = prometheus.NewDesc(
+		"harpoon_agent_container_memory_usage_bytes",
+		"Memory used by the container.",
+		containerLabels, nil,
+	)
+	containerMemoryLimitDesc = prometheus.NewDesc(
+		"harpoon_agent_container_memory_limit_bytes",
+		"Memory limit of the container.",
+		containerLabels, nil,
+	)
+	containerCPUTimeDesc = prometheus.NewDesc(
+		"harpoon_agent_container_cpu_seconds_total",
+		"CPU time consumed by the container, across restarts.",
+		containerLabels, nil,
+	)
+	containerRestartsDesc = prometheus.NewDesc(
+		"harpoon_agent_container_restarts_total",
+		"Number of times the container has been restarted.",
+		containerLabels, nil,
+	)
+	containerOOMsDesc = prometheus.NewDesc(
+		"harpoon_agent_container_ooms_total",
+		"Number of times the container has been killed for exceeding its memory limit.",
+		containerLabels, nil,
+	)
+)
+
+// containerCollector exports the metrics of every container known to the
+// agent, as reported by its supervisor, at the time of the scrape.
+type containerCollector struct {
+	instances func() map[string]agent.ContainerInstance
+}
+
+func newContainerCollector(instances func() map[string]agent.ContainerInstance) *containerCollector {
+	return &containerCollector{instances: instances}
+}
+
+// Describe implements prometheus.Collector.
+func (c *containerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- containerMemoryUsageDesc
+	ch <- containerMemoryLimitDesc
+	ch <- containerCPUTimeDesc
+	ch <- containerRestartsDesc
+	ch <- containerOOMsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *containerCollector) Collect(ch chan<- prometheus.Metric) {
+	for id, instance := range c.instances() {
+		var (
+			labels  = []string{instance.Product, instance.Environment, instance.Job, id}
+			metrics = instance.ContainerMetrics
+		)
+
+		ch <- prometheus.MustNewConstMetric(containerMemoryUsageDesc, prometheus.GaugeValue, float64(metrics.MemoryUsage), labels...)
+		ch <- prometheus.MustNewConstMetric(containerMemoryLimitDesc, prometheus.GaugeValue, float64(metrics.MemoryLimit), labels...)
+		ch <- prometheus.MustNewConstMetric(containerCPUTimeDesc, prometheus.CounterValue, float64(metrics.CPUTime)/1e9, labels...) // ns -> s
+		ch <- prometheus.MustNewConstMetric(containerRestartsDesc, prometheus.CounterValue, float64(instance.Restarts), labels...)
+		ch <- prometheus.MustNewConstMetric(containerOOMsDesc, prometheus.CounterValue, float64(instance.OOMs), labels...)
+	}
+}
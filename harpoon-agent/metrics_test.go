@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestContainerCollector(t *testing.T) {
+	var (
+		instance = agent.ContainerInstance{
+			ContainerConfig: agent.ContainerConfig{Product: "web", Environment: "prod", Job: "api"},
+			ContainerProcessState: agent.ContainerProcessState{
+				Restarts: 2,
+				OOMs:     1,
+				ContainerMetrics: agent.ContainerMetrics{
+					CPUTime:     3e9,
+					MemoryUsage: 64,
+					MemoryLimit: 128,
+				},
+			},
+		}
+		collector = newContainerCollector(func() map[string]agent.ContainerInstance {
+			return map[string]agent.ContainerInstance{"api.1": instance}
+		})
+		ch = make(chan prometheus.Metric, 16)
+	)
+
+	collector.Collect(ch)
+	close(ch)
+
+	have := map[string]float64{}
+
+	for metric := range ch {
+		var m dto.Metric
+		metric.Write(&m)
+
+		labels := map[string]string{}
+		for _, pair := range m.Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+
+		if want := map[string]string{"product": "web", "environment": "prod", "job": "api", "container_id": "api.1"}; len(want) != len(labels) {
+			t.Errorf("want labels %v, have %v", want, labels)
+		} else {
+			for k, v := range want {
+				if labels[k] != v {
+					t.Errorf("want label %s=%q, have %q", k, v, labels[k])
+				}
+			}
+		}
+
+		switch {
+		case m.Gauge != nil:
+			have[metric.Desc().String()] = m.Gauge.GetValue()
+		case m.Counter != nil:
+			have[metric.Desc().String()] = m.Counter.GetValue()
+		}
+	}
+
+	for desc, want := range map[*prometheus.Desc]float64{
+		containerMemoryUsageDesc: 64,
+		containerMemoryLimitDesc: 128,
+		containerCPUTimeDesc:     3,
+		containerRestartsDesc:    2,
+		containerOOMsDesc:        1,
+	} {
+		if have := have[desc.String()]; want != have {
+			t.Errorf("%s: want %v, have %v", desc, want, have)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+const (
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+	maxManifestSize      = 4 * 1024 * 1024
+)
+
+// ociManifestMediaTypes are accepted from registries, in order of preference.
+var ociManifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// ociDescriptor refers to a blob of an image by its digest.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+// ociPlatform is the platform an image manifest in an index is built for.
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// ociDocument is an image index, or an image manifest. Docker manifest lists
+// and manifests share their structure.
+type ociDocument struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"` // index
+	Config    ociDescriptor   `json:"config"`    // manifest
+	Layers    []ociDescriptor `json:"layers"`    // manifest
+}
+
+// ociImageConfig is the part of the configuration of an image that the
+// command and environment of containers default to.
+type ociImageConfig struct {
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+}
+
+// ociSource reads the manifests and blobs of an image.
+type ociSource interface {
+	manifest(d ociDescriptor) ([]byte, error)
+	blob(d ociDescriptor) (io.ReadCloser, error)
+}
+
+// fetchImage unpacks the layers of the OCI image referred to by the artifact
+// URL into dst, in order, and returns the hex-encoded SHA-256 digest of its
+// manifest or index, and its config. If digest is given, the image must match
+// it, which is checked before any layer is fetched. The layout tarball, or the
+// layers fetched from a registry, count towards the progress.
+func fetchImage(artifactURL, digest, dst string, timeout time.Duration, p *transferProgress) (string, *ociImageConfig, error) {
+	u, err := url.Parse(strings.TrimPrefix(artifactURL, agent.ArtifactImagePrefix))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var (
+		client   = &http.Client{Timeout: timeout}
+		src      ociSource
+		top      ociDescriptor
+		buf      []byte
+		progress *transferProgress // of the layers
+	)
+
+	if r, reference, ok := registryImage(client, u); ok {
+		src, progress = r, p
+		top, buf, err = r.resolve(reference)
+	} else {
+		layout := u.Path
+
+		// Image layout tarballs are extracted to a temporary sibling of dst,
+		// which the sweep of the artifact cache removes if we don't.
+		if fi, err := os.Stat(u.Path); u.Scheme != "file" || err != nil || !fi.IsDir() {
+			if layout, err = ioutil.TempDir(filepath.Dir(dst), filepath.Base(dst)+"-layout"); err != nil {
+				return "", nil, err
+			}
+			defer os.RemoveAll(layout)
+
+			if err := fetchLayout(client, u, layout, p); err != nil {
+				return "", nil, err
+			}
+		}
+
+		src = ociLayout(layout)
+		top, buf, err = openLayout(ociLayout(layout), u.Fragment)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	have := strings.TrimPrefix(top.Digest, "sha256:")
+
+	if digest != "" && !strings.EqualFold(digest, have) {
+		incContainerArtifactVerifyFailure(1)
+		return "", nil, fmt.Errorf("image failed verification: want SHA-256 %s, have %s", digest, have)
+	}
+
+	manifest, err := resolveManifest(src, top, buf)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var image struct {
+		Config ociImageConfig `json:"config"`
+	}
+
+	if buf, err = readBlob(src, manifest.Config); err != nil {
+		return "", nil, fmt.Errorf("image config: %s", err)
+	}
+
+	if err := json.Unmarshal(buf, &image); err != nil {
+		return "", nil, fmt.Errorf("image config: %s", err)
+	}
+
+	if progress != nil {
+		for _, layer := range manifest.Layers {
+			progress.total += uint64(layer.Size)
+		}
+	}
+
+	for i, layer := range manifest.Layers {
+		if err := unpackLayer(src, layer, dst, progress); err != nil {
+			return "", nil, fmt.Errorf("layer %d (%s): %s", i, layer.Digest, err)
+		}
+	}
+
+	return have, &image.Config, nil
+}
+
+// registryImage returns the registry and the tag or digest of the image, if
+// the URL refers to a manifest in a registry, i.e. has a path of the form
+// [prefix]/v2/{name}/manifests/{reference}.
+func registryImage(client *http.Client, u *url.URL) (ociRegistry, string, bool) {
+	i, j := strings.Index(u.Path, "/v2/"), strings.LastIndex(u.Path, "/manifests/")
+	if u.Scheme == "file" || i < 0 || j <= i {
+		return ociRegistry{}, "", false
+	}
+
+	r := ociRegistry{
+		client: client,
+		base:   (&url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host, Path: u.Path[:i]}).String(),
+		name:   u.Path[i+len("/v2/") : j],
+	}
+
+	return r, u.Path[j+len("/manifests/"):], true
+}
+
+// fetchLayout extracts the image layout tarball at the URL into dst.
+func fetchLayout(client *http.Client, u *url.URL, dst string, p *transferProgress) error {
+	var body io.ReadCloser
+
+	if u.Scheme == "file" {
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return err
+		}
+		body = f
+	} else {
+		resp, err := client.Get((&url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host, Path: u.Path, RawQuery: u.RawQuery}).String())
+		if err != nil {
+			incContainerArtifactDownloadFailure(1)
+			return err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			incContainerArtifactDownloadFailure(1)
+			return fmt.Errorf("image layout: HTTP %d", resp.StatusCode)
+		}
+		body = resp.Body
+
+		if resp.ContentLength > 0 {
+			p.total = uint64(resp.ContentLength)
+		}
+	}
+	defer body.Close()
+
+	if err := extractArtifact(p.reader(body), dst); err != nil {
+		return fmt.Errorf("image layout: %s", err)
+	}
+
+	return nil
+}
+
+// openLayout selects the image with the given ref name from the index of the
+// layout, or the first image for this platform if ref is empty.
+func openLayout(layout ociLayout, ref string) (ociDescriptor, []byte, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(string(layout), "index.json"))
+	if err != nil {
+		return ociDescriptor{}, nil, fmt.Errorf("image layout: %s", err)
+	}
+
+	var index ociDocument
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return ociDescriptor{}, nil, fmt.Errorf("image layout: invalid index: %s", err)
+	}
+
+	d, err := selectManifest(index.Manifests, ref)
+	if err != nil {
+		return ociDescriptor{}, nil, fmt.Errorf("image layout: %s", err)
+	}
+
+	if buf, err = layout.manifest(d); err != nil {
+		return ociDescriptor{}, nil, err
+	}
+
+	return d, buf, nil
+}
+
+// resolveManifest returns the image manifest for this platform, descending
+// through image indexes.
+func resolveManifest(src ociSource, d ociDescriptor, buf []byte) (ociDocument, error) {
+	for depth := 0; depth < 8; depth++ {
+		var doc ociDocument
+		if err := json.Unmarshal(buf, &doc); err != nil {
+			return ociDocument{}, fmt.Errorf("%s: invalid manifest: %s", d.Digest, err)
+		}
+
+		switch {
+		case doc.Config.Digest != "":
+			return doc, nil
+
+		case len(doc.Manifests) > 0:
+			next, err := selectManifest(doc.Manifests, "")
+			if err != nil {
+				return ociDocument{}, fmt.Errorf("%s: %s", d.Digest, err)
+			}
+
+			if buf, err = src.manifest(next); err != nil {
+				return ociDocument{}, err
+			}
+
+			d = next
+
+		default:
+			return ociDocument{}, fmt.Errorf("%s: unsupported manifest %q", d.Digest, doc.MediaType)
+		}
+	}
+
+	return ociDocument{}, fmt.Errorf("%s: image indexes nested too deeply", d.Digest)
+}
+
+// selectManifest returns the first descriptor with the ref name, if given,
+// for this platform, if declared.
+func selectManifest(manifests []ociDescriptor, ref string) (ociDescriptor, error) {
+	for _, d := range manifests {
+		if ref != "" && d.Annotations[ociRefNameAnnotation] != ref {
+			continue
+		}
+
+		if d.Platform != nil && (d.Platform.OS != runtime.GOOS || d.Platform.Architecture != runtime.GOARCH) {
+			continue
+		}
+
+		return d, nil
+	}
+
+	if ref != "" {
+		return ociDescriptor{}, fmt.Errorf("no image %q for %s/%s", ref, runtime.GOOS, runtime.GOARCH)
+	}
+
+	return ociDescriptor{}, fmt.Errorf("no image for %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// unpackLayer extracts a layer into dst, counting it towards the progress, if
+// given.
+func unpackLayer(src ociSource, d ociDescriptor, dst string, p *transferProgress) error {
+	if strings.Contains(d.MediaType, "encrypted") {
+		return fmt.Errorf("unsupported media type %q", d.MediaType)
+	}
+
+	rc, err := src.blob(d)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var blob io.Reader = rc
+	if p != nil {
+		blob = p.reader(rc)
+	}
+
+	r, err := newVerifyingReader(blob, d)
+	if err != nil {
+		return err
+	}
+
+	if err := extractLayer(r, dst); err != nil {
+		return err
+	}
+
+	// Extraction stops reading at the end of the archive.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+
+	return r.verify()
+}
+
+// readBlob returns the verified content of a small blob, such as a config or
+// manifest.
+func readBlob(src ociSource, d ociDescriptor) ([]byte, error) {
+	rc, err := src.blob(d)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	r, err := newVerifyingReader(io.LimitReader(rc, maxManifestSize), d)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, r.verify()
+}
+
+// ociLayout is the root directory of an OCI image layout.
+type ociLayout string
+
+func (l ociLayout) manifest(d ociDescriptor) ([]byte, error) {
+	return readBlob(l, d)
+}
+
+func (l ociLayout) blob(d ociDescriptor) (io.ReadCloser, error) {
+	path, err := l.path(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+func (l ociLayout) path(d ociDescriptor) (string, error) {
+	hex, err := digestHex(d.Digest)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(string(l), "blobs", "sha256", hex), nil
+}
+
+// ociRegistry reads an image from a registry implementing the distribution
+// API, without authentication.
+type ociRegistry struct {
+	client *http.Client
+	base   string
+	name   string
+}
+
+// resolve returns the descriptor and content of the manifest or index with
+// the given tag or digest.
+func (r ociRegistry) resolve(reference string) (ociDescriptor, []byte, error) {
+	resp, err := r.get("manifests", reference, strings.Join(ociManifestMediaTypes, ", "))
+	if err != nil {
+		return ociDescriptor{}, nil, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return ociDescriptor{}, nil, err
+	}
+
+	sum := sha256.Sum256(buf)
+
+	d := ociDescriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(buf)),
+	}
+
+	if strings.HasPrefix(reference, "sha256:") && reference != d.Digest {
+		return ociDescriptor{}, nil, fmt.Errorf("manifest %s: have digest %s", reference, d.Digest)
+	}
+
+	return d, buf, nil
+}
+
+func (r ociRegistry) manifest(d ociDescriptor) ([]byte, error) {
+	if _, err := digestHex(d.Digest); err != nil {
+		return nil, err
+	}
+
+	_, buf, err := r.resolve(d.Digest)
+	return buf, err
+}
+
+func (r ociRegistry) blob(d ociDescriptor) (io.ReadCloser, error) {
+	if _, err := digestHex(d.Digest); err != nil {
+		return nil, err
+	}
+
+	resp, err := r.get("blobs", d.Digest, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (r ociRegistry) get(kind, reference, accept string) (*http.Response, error) {
+	u := r.base + "/v2/" + r.name + "/" + kind + "/" + reference
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		incContainerArtifactDownloadFailure(1)
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		incContainerArtifactDownloadFailure(1)
+		return nil, fmt.Errorf("%s: HTTP %d", u, resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+// verifyingReader checks the content it reads against the size and digest of
+// a descriptor.
+type verifyingReader struct {
+	io.Reader
+	hash hash.Hash
+	d    ociDescriptor
+	want string
+	n    int64
+}
+
+func newVerifyingReader(r io.Reader, d ociDescriptor) (*verifyingReader, error) {
+	want, err := digestHex(d.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+
+	return &verifyingReader{Reader: io.TeeReader(r, h), hash: h, d: d, want: want}, nil
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// verify must be called once all content has been read.
+func (r *verifyingReader) verify() error {
+	if r.d.Size > 0 && r.n != r.d.Size {
+		return fmt.Errorf("%s: want %d bytes, have %d", r.d.Digest, r.d.Size, r.n)
+	}
+
+	if have := hex.EncodeToString(r.hash.Sum(nil)); have != r.want {
+		incContainerArtifactVerifyFailure(1)
+		return fmt.Errorf("%s: failed verification, have SHA-256 %s", r.d.Digest, have)
+	}
+
+	return nil
+}
+
+// digestHex returns the hex-encoded SHA-256 digest of a descriptor digest.
+// Other algorithms aren't supported.
+func digestHex(digest string) (string, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+
+	hex := strings.TrimPrefix(digest, "sha256:")
+
+	if err := agent.ValidSHA256(hex); err != nil {
+		return "", fmt.Errorf("invalid digest %q: %s", digest, err)
+	}
+
+	return strings.ToLower(hex), nil
+}
+
+// imageDefaults returns the config with its command, working dir, and
+// environment defaulted to those of the image. The command of the image is
+// its entrypoint followed by its cmd. Variables in the command of the image
+// aren't expanded.
+func imageDefaults(config agent.ContainerConfig, image ociImageConfig) agent.ContainerConfig {
+	if len(config.Command.Exec) == 0 {
+		config.Command.Exec = append(append([]string{}, image.Entrypoint...), image.Cmd...)
+	}
+
+	if config.Command.WorkingDir == "" {
+		config.Command.WorkingDir = image.WorkingDir
+	}
+
+	if config.Command.WorkingDir == "" {
+		config.Command.WorkingDir = "/"
+	}
+
+	env := make(map[string]string, len(config.Env)+len(image.Env))
+
+	for _, kv := range image.Env {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	for k, v := range config.Env {
+		env[k] = v
+	}
+
+	config.Env = env
+
+	return config
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestFetchImage(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	image := newTestImage(t)
+	defer os.RemoveAll(image.layout)
+
+	var (
+		requests int32
+		server   = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+
+			switch {
+			case r.URL.Path == "/images/app.tar":
+				w.Write(image.tarball(t))
+
+			case r.URL.Path == "/v2/app/manifests/1.0":
+				w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+				w.Write(image.blobs[image.index])
+
+			case strings.HasPrefix(r.URL.Path, "/v2/app/manifests/"):
+				w.Write(image.blobs[strings.TrimPrefix(r.URL.Path, "/v2/app/manifests/")])
+
+			case strings.HasPrefix(r.URL.Path, "/v2/app/blobs/"):
+				w.Write(image.blobs[strings.TrimPrefix(r.URL.Path, "/v2/app/blobs/")])
+
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	)
+	defer server.Close()
+
+	// The image layout and registry refer to the image by the digest of its
+	// manifest, and its index, respectively.
+	for artifactURL, digest := range map[string]string{
+		"oci+file://" + image.layout + "#1.0":         image.manifest,
+		"oci+" + server.URL + "/images/app.tar#1.0":   image.manifest,
+		"oci+" + server.URL + "/v2/app/manifests/1.0": image.index,
+	} {
+		dst := newTestArtifactRoot(t)
+		defer os.RemoveAll(dst)
+
+		have, config, err := fetchImage(artifactURL, "", dst, time.Second, &transferProgress{})
+		if err != nil {
+			t.Errorf("%s: %s", artifactURL, err)
+			continue
+		}
+
+		if want := strings.TrimPrefix(digest, "sha256:"); want != have {
+			t.Errorf("%s: want digest %s, have %s", artifactURL, want, have)
+		}
+
+		if want, have := []string{"/bin/app"}, config.Entrypoint; !reflect.DeepEqual(want, have) {
+			t.Errorf("%s: want entrypoint %v, have %v", artifactURL, want, have)
+		}
+
+		for path, want := range map[string]bool{
+			"bin/app":      true,  // layer 1
+			"etc/removed":  false, // layer 1, whited out by layer 2
+			"var/old":      false, // layer 1, hidden by the opaque whiteout of layer 2
+			"var/new":      true,  // layer 2
+			"etc/.wh.gone": false, // whiteouts aren't extracted
+		} {
+			if _, err := os.Lstat(filepath.Join(dst, path)); want != (err == nil) {
+				t.Errorf("%s: %s: want present %v, have %v", artifactURL, path, want, err)
+			}
+		}
+	}
+
+	// A mismatching digest fails before any layer is fetched.
+	pre := atomic.LoadInt32(&requests)
+
+	dst := newTestArtifactRoot(t)
+	defer os.RemoveAll(dst)
+
+	if _, _, err := fetchImage("oci+"+server.URL+"/v2/app/manifests/1.0", hex.EncodeToString(make([]byte, sha256.Size)), dst, time.Second, &transferProgress{}); err == nil {
+		t.Errorf("want verification error, have none")
+	}
+
+	if want, have := int32(1), atomic.LoadInt32(&requests)-pre; want != have {
+		t.Errorf("want %d request, have %d", want, have)
+	}
+}
+
+func TestImageDefaults(t *testing.T) {
+	image := ociImageConfig{
+		Entrypoint: []string{"/bin/app"},
+		Cmd:        []string{"-v"},
+		WorkingDir: "/srv",
+		Env:        []string{"PATH=/bin", "MODE=image"},
+	}
+
+	config := imageDefaults(agent.ContainerConfig{Env: map[string]string{"MODE": "container"}}, image)
+
+	if want, have := []string{"/bin/app", "-v"}, config.Command.Exec; !reflect.DeepEqual(want, have) {
+		t.Errorf("want exec %v, have %v", want, have)
+	}
+
+	if want, have := "/srv", config.Command.WorkingDir; want != have {
+		t.Errorf("want working dir %q, have %q", want, have)
+	}
+
+	if want, have := map[string]string{"PATH": "/bin", "MODE": "container"}, config.Env; !reflect.DeepEqual(want, have) {
+		t.Errorf("want env %v, have %v", want, have)
+	}
+
+	config = imageDefaults(agent.ContainerConfig{Command: agent.Command{Exec: []string{"./run"}, WorkingDir: "/"}}, image)
+
+	if want, have := []string{"./run"}, config.Command.Exec; !reflect.DeepEqual(want, have) {
+		t.Errorf("want exec %v, have %v", want, have)
+	}
+
+	if want, have := "/", config.Command.WorkingDir; want != have {
+		t.Errorf("want working dir %q, have %q", want, have)
+	}
+}
+
+// testImage is an OCI image layout, with an index for this platform.
+type testImage struct {
+	layout   string
+	blobs    map[string][]byte // digest: content
+	manifest string            // digest
+	index    string            // digest
+}
+
+func newTestImage(t *testing.T) *testImage {
+	layout, err := ioutil.TempDir("", "harpoon-agent-oci-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := &testImage{layout: layout, blobs: map[string][]byte{}}
+
+	config := image.blob(t, "application/vnd.oci.image.config.v1+json", mustMarshal(t, map[string]interface{}{
+		"config": ociImageConfig{Entrypoint: []string{"/bin/app"}, Env: []string{"PATH=/bin"}},
+	}))
+
+	layer1 := image.blob(t, "application/vnd.oci.image.layer.v1.tar", newTestTarball(t, []testEntry{
+		{tar.Header{Name: "bin/app", Typeflag: tar.TypeReg, Mode: 0755}, "#!/bin/sh"},
+		{tar.Header{Name: "etc/removed", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+		{tar.Header{Name: "var/old", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+	}))
+
+	layer2Tar := newTestTarball(t, []testEntry{
+		{tar.Header{Name: "etc/.wh.removed", Typeflag: tar.TypeReg}, ""},
+		{tar.Header{Name: "etc/.wh.gone", Typeflag: tar.TypeReg}, ""},
+		{tar.Header{Name: "var/new", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+		{tar.Header{Name: "var/.wh..wh..opq", Typeflag: tar.TypeReg}, ""},
+	})
+
+	layer2Gzip, err := gzipTestArchive(layer2Tar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer2 := image.blob(t, "application/vnd.oci.image.layer.v1.tar+gzip", layer2Gzip)
+
+	manifest := image.blob(t, "application/vnd.oci.image.manifest.v1+json", mustMarshal(t, ociDocument{
+		MediaType: "application/vnd.oci.image.manifest.v1+json",
+		Config:    config,
+		Layers:    []ociDescriptor{layer1, layer2},
+	}))
+	image.manifest = manifest.Digest
+
+	platform := manifest
+	platform.Platform = &ociPlatform{runtime.GOARCH, runtime.GOOS}
+
+	other := manifest
+	other.Digest = "sha256:" + hex.EncodeToString(make([]byte, sha256.Size))
+	other.Platform = &ociPlatform{"unknown", "unknown"}
+
+	index := image.blob(t, "application/vnd.oci.image.index.v1+json", mustMarshal(t, ociDocument{
+		MediaType: "application/vnd.oci.image.index.v1+json",
+		Manifests: []ociDescriptor{other, platform},
+	}))
+	image.index = index.Digest
+
+	manifest.Annotations = map[string]string{ociRefNameAnnotation: "1.0"}
+
+	if err := ioutil.WriteFile(filepath.Join(layout, "index.json"), mustMarshal(t, ociDocument{
+		Manifests: []ociDescriptor{manifest},
+	}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return image
+}
+
+func (i *testImage) blob(t *testing.T, mediaType string, content []byte) ociDescriptor {
+	var (
+		sum    = sha256.Sum256(content)
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+		dir    = filepath.Join(i.layout, "blobs", "sha256")
+	)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, hex.EncodeToString(sum[:])), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	i.blobs[digest] = content
+
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(content))}
+}
+
+// tarball returns the image layout as a tarball.
+func (i *testImage) tarball(t *testing.T) []byte {
+	var entries []testEntry
+
+	filepath.Walk(i.layout, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, testEntry{
+			tar.Header{Name: strings.TrimPrefix(path, i.layout+"/"), Typeflag: tar.TypeReg, Mode: 0644},
+			string(buf),
+		})
+
+		return nil
+	})
+
+	return newTestTarball(t, entries)
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.TrimSpace(buf)
+}
@@ -63,6 +63,18 @@ func recoverContainer(id string, containerRoot string, r *registry, pdb *portDB,
 		return err
 	}
 
+	// The rootfs links to the artifact the container was created from, which
+	// may not be the one its URL names today.
+	if rootfs, err := os.Readlink(filepath.Join(containerRoot, id, "rootfs")); err == nil {
+		if !filepath.IsAbs(rootfs) {
+			rootfs = filepath.Join(containerRoot, id, rootfs)
+		}
+
+		artifacts.adopt(id, filepath.Clean(rootfs))
+	} else {
+		log.Printf("container %q: artifact not adopted: %s", id, err)
+	}
+
 	r.register(c)
 
 	return nil
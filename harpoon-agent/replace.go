@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// replaceContainer completes the replacement of the old container by the new
+// one, after the new one has been successfully created. It waits for the
+// artifact of the new container to be fetched, starts it, and waits for it to
+// be running and, if it declares health checks, healthy. Only then is the old
+// container stopped and destroyed.
+//
+// If the new container doesn't become ready within its startup grace period,
+// it's stopped and destroyed, and the old container is left untouched.
+//
+// The state of both containers is only taken from their watches, which must
+// have been started before the new container was created. The configs are
+// the ones the containers were created with.
+func replaceContainer(
+	newWatch *containerWatch,
+	newConfig agent.ContainerConfig,
+	oldWatch *containerWatch,
+	oldConfig agent.ContainerConfig,
+	downloadTimeout time.Duration,
+) error {
+	defer oldWatch.stop()
+
+	if instance, err := startReplacement(newWatch, newConfig, downloadTimeout); err != nil {
+		if rerr := rollbackReplacement(newWatch, instance, newConfig.Grace.Shutdown.Duration); rerr != nil {
+			return fmt.Errorf("%s; rollback failed: %s", err, rerr)
+		}
+
+		return fmt.Errorf("rolled back: %s", err)
+	}
+
+	newWatch.stop()
+
+	// A destroyed container no longer accepts any requests.
+	if oldWatch.destroyed() {
+		return fmt.Errorf("old container was destroyed during replacement")
+	}
+
+	if err := oldWatch.Stop(); err != nil {
+		return fmt.Errorf("stop old container: %s", err)
+	}
+
+	if _, err := oldWatch.wait(2*oldConfig.Grace.Shutdown.Duration, isStopped); err != nil {
+		return fmt.Errorf("when waiting for old container to stop: %s", err)
+	}
+
+	if err := oldWatch.Destroy(); err != nil {
+		return fmt.Errorf("destroy old container: %s", err)
+	}
+
+	return nil
+}
+
+// startReplacement starts the new container once it has been created, and
+// waits for it to become ready. It returns the last state of the container
+// it observed.
+func startReplacement(w *containerWatch, config agent.ContainerConfig, downloadTimeout time.Duration) (agent.ContainerInstance, error) {
+	// The artifact is fetched asynchronously after Create returns; the
+	// container reports its creation phase as ready once it may be started.
+	instance, err := w.wait(downloadTimeout, func(instance agent.ContainerInstance) (bool, error) {
+		switch instance.ContainerStatus {
+		case agent.ContainerStatusCreated:
+			switch instance.CreationPhase {
+			case agent.CreationPhaseReady, "":
+				return true, nil
+			case agent.CreationPhaseFailed:
+				return false, fmt.Errorf("new container could not be created: %s", instance.ContainerCreation.Err)
+			}
+		case agent.ContainerStatusDeleted:
+			return false, fmt.Errorf("new container could not be created")
+		}
+		return false, nil
+	})
+	if err != nil {
+		return instance, err
+	}
+
+	if err := w.Start(); err != nil {
+		return instance, fmt.Errorf("start new container: %s", err)
+	}
+
+	if instance, err = w.wait(config.Grace.Startup.Duration, isReady); err != nil {
+		return instance, fmt.Errorf("when waiting for new container to become ready: %s", err)
+	}
+
+	return instance, nil
+}
+
+// rollbackReplacement stops and destroys the new container, whose last
+// observed state is instance. It stops the watch, unless the container has
+// been destroyed.
+func rollbackReplacement(w *containerWatch, instance agent.ContainerInstance, shutdown time.Duration) error {
+	if w.destroyed() {
+		return nil
+	}
+
+	if instance.ContainerStatus == agent.ContainerStatusRunning {
+		if err := w.Stop(); err != nil {
+			w.stop()
+			return fmt.Errorf("stop: %s", err)
+		}
+
+		if _, err := w.wait(2*shutdown, isStopped); err != nil {
+			w.stop()
+			return fmt.Errorf("when waiting for container to stop: %s", err)
+		}
+	}
+
+	if w.destroyed() {
+		return nil
+	}
+
+	if err := w.Destroy(); err != nil {
+		w.stop()
+		return fmt.Errorf("destroy: %s", err)
+	}
+
+	return nil
+}
+
+// isReady returns true if the container is up, and healthy if it declares
+// health checks. It returns an error if the container went down.
+func isReady(instance agent.ContainerInstance) (bool, error) {
+	switch instance.ContainerStatus {
+	case agent.ContainerStatusFailed, agent.ContainerStatusFinished, agent.ContainerStatusDeleted:
+		return false, fmt.Errorf("container %s", instance.ContainerStatus)
+
+	case agent.ContainerStatusRunning:
+		if !instance.Up && instance.Restarting {
+			return false, fmt.Errorf("container exited during startup (restarts: %d)", instance.Restarts)
+		}
+
+		if len(instance.HealthChecks) > 0 && instance.HealthStatus != agent.HealthStatusHealthy {
+			return false, nil
+		}
+
+		return instance.Up, nil
+	}
+
+	return false, nil
+}
+
+// isStopped returns true if the container has exited.
+func isStopped(instance agent.ContainerInstance) (bool, error) {
+	switch instance.ContainerStatus {
+	case agent.ContainerStatusFailed, agent.ContainerStatusFinished:
+		return true, nil
+	case agent.ContainerStatusDeleted:
+		return false, fmt.Errorf("container deleted")
+	}
+
+	return false, nil
+}
+
+// containerWatch follows the state changes of a single container. It always
+// consumes updates from the container, so that the container is never
+// blocked by a slow watcher, and only retains the most recent state.
+type containerWatch struct {
+	container
+
+	inc        chan agent.ContainerInstance
+	outc       chan agent.ContainerInstance
+	destroyedc chan struct{}
+	quitc      chan struct{}
+}
+
+// watchContainer subscribes to the container. Callers must invoke stop when
+// they're done watching a container that hasn't been destroyed.
+func watchContainer(c container) *containerWatch {
+	w := &containerWatch{
+		container:  c,
+		inc:        make(chan agent.ContainerInstance),
+		outc:       make(chan agent.ContainerInstance),
+		destroyedc: make(chan struct{}),
+		quitc:      make(chan struct{}),
+	}
+
+	c.Subscribe(w.inc)
+
+	go w.loop()
+
+	return w
+}
+
+// wait blocks until ok returns true or an error for the most recent state of
+// the container, the container is destroyed, or the timeout elapses. It
+// returns the most recent state it observed.
+func (w *containerWatch) wait(
+	timeout time.Duration,
+	ok func(agent.ContainerInstance) (bool, error),
+) (agent.ContainerInstance, error) {
+	var (
+		timeoutc = time.After(timeout)
+		latest   agent.ContainerInstance
+	)
+
+	for {
+		select {
+		case instance := <-w.outc:
+			latest = instance
+
+			done, err := ok(instance)
+			if err != nil {
+				return instance, err
+			}
+
+			if done {
+				return instance, nil
+			}
+
+		case <-w.destroyedc:
+			return latest, fmt.Errorf("container destroyed")
+
+		case <-timeoutc:
+			// Don't miss a state change which raced the timeout.
+			select {
+			case latest = <-w.outc:
+			default:
+			}
+
+			return latest, fmt.Errorf("timeout (%s) exceeded", timeout)
+		}
+	}
+}
+
+// destroyed returns true if the container has been destroyed.
+func (w *containerWatch) destroyed() bool {
+	select {
+	case <-w.destroyedc:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop unsubscribes from the container.
+func (w *containerWatch) stop() {
+	unsubscribed := make(chan struct{})
+
+	// The loop keeps consuming updates until we're unsubscribed.
+	go func() {
+		w.container.Unsubscribe(w.inc)
+		close(unsubscribed)
+	}()
+
+	select {
+	case <-unsubscribed:
+	case <-w.destroyedc:
+	}
+
+	close(w.quitc)
+}
+
+func (w *containerWatch) loop() {
+	var (
+		latest agent.ContainerInstance
+		outc   chan agent.ContainerInstance // nil until there's an update
+	)
+
+	for {
+		select {
+		case instance, ok := <-w.inc:
+			if !ok {
+				close(w.destroyedc)
+				return
+			}
+
+			latest, outc = instance, w.outc
+
+		case outc <- latest:
+			outc = nil
+
+		case <-w.quitc:
+			return
+		}
+	}
+}
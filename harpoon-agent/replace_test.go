@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+var testGrace = agent.Grace{
+	Startup:  agent.JSONDuration{Duration: 250 * time.Millisecond},
+	Shutdown: agent.JSONDuration{Duration: 250 * time.Millisecond},
+}
+
+func TestReplace(t *testing.T) {
+	client, cleanup := newReplaceTestClient(t)
+	defer cleanup()
+
+	startContainer(t, client, "old", agent.ContainerConfig{Grace: testGrace})
+
+	if err := client.Replace("new", "old", agent.ContainerConfig{Grace: testGrace}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForStatus(t, client, "old", agent.ContainerStatusDeleted)
+	waitForStatus(t, client, "new", agent.ContainerStatusRunning)
+}
+
+func TestReplaceRollsBackUnhealthyContainer(t *testing.T) {
+	client, cleanup := newReplaceTestClient(t)
+	defer cleanup()
+
+	startContainer(t, client, "old", agent.ContainerConfig{Grace: testGrace})
+
+	// The fake container never executes its health checks, so it never
+	// becomes healthy.
+	if err := client.Replace("new", "old", agent.ContainerConfig{
+		Ports:        map[string]uint16{"PORT_TCP": 0},
+		Grace:        testGrace,
+		HealthChecks: []agent.HealthCheck{{Protocol: agent.ProtocolTCP, Port: "PORT_TCP"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForStatus(t, client, "new", agent.ContainerStatusDeleted)
+	waitForStatus(t, client, "old", agent.ContainerStatusRunning)
+}
+
+func TestReplaceRejectsInvalidRequests(t *testing.T) {
+	client, cleanup := newReplaceTestClient(t)
+	defer cleanup()
+
+	if want, have := agent.ErrContainerNotExist, client.Replace("new", "old", agent.ContainerConfig{}); want != have {
+		t.Errorf("missing old container: want %v, have %v", want, have)
+	}
+
+	startContainer(t, client, "old", agent.ContainerConfig{Grace: testGrace})
+
+	if err := client.Replace("old", "old", agent.ContainerConfig{}); err == nil {
+		t.Errorf("replacing a container with itself: want error, have none")
+	}
+
+	startContainer(t, client, "other", agent.ContainerConfig{})
+
+	if want, have := agent.ErrContainerAlreadyExists, client.Replace("other", "old", agent.ContainerConfig{}); want != have {
+		t.Errorf("existing new container: want %v, have %v", want, have)
+	}
+}
+
+func newReplaceTestClient(t *testing.T) (agent.Agent, func()) {
+	log.SetOutput(ioutil.Discard)
+
+	// If we don't do this, newRealContainer will try to mutate the
+	// /srv/harpoon filesystem, which doesn't necessarily exist.
+	newContainer = newFakeContainer
+
+	testContainerRoot, err := ioutil.TempDir(os.TempDir(), "harpoon-agent-replace-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		registry = newRegistry(nopServiceDiscovery{})
+		pdb      = newPortDB(lowTestPort, highTestPort)
+		api      = newAPI(testContainerRoot, registry, pdb, volumes{}, 2, 1000, 10000, time.Second, false)
+		server   = httptest.NewServer(api)
+	)
+
+	return agent.MustNewClient(server.URL), func() {
+		server.Close()
+		pdb.exit()
+		os.RemoveAll(testContainerRoot)
+	}
+}
+
+func startContainer(t *testing.T, client agent.Agent, id string, config agent.ContainerConfig) {
+	if err := client.Create(id, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Start(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitForStatus(t *testing.T, client agent.Agent, id string, status agent.ContainerStatus) {
+	deadline := time.Now().Add(time.Second)
+
+	for {
+		instance, err := client.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if instance.ContainerStatus == status {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: want %s, have %s", id, status, instance.ContainerStatus)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
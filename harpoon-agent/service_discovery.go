@@ -103,10 +103,19 @@ func writeInstances(filename string, instances map[string]agent.ContainerInstanc
 }
 
 type service struct {
-	ID   string
-	Name string
-	Port int
-	Tags []string
+	ID     string
+	Name   string
+	Port   int
+	Tags   []string
+	Checks []check `json:",omitempty"`
+}
+
+// check is a Consul check definition, executed by Consul itself.
+type check struct {
+	HTTP     string `json:",omitempty"`
+	TCP      string `json:",omitempty"`
+	Interval string
+	Timeout  string `json:",omitempty"`
 }
 
 func instancesToServices(instances map[string]agent.ContainerInstance) []service {
@@ -114,17 +123,23 @@ func instancesToServices(instances map[string]agent.ContainerInstance) []service
 	for _, instance := range instances {
 		switch instance.ContainerStatus {
 		case agent.ContainerStatusRunning: // obviously should be exported
-		case agent.ContainerStatusFailed: // might be flapping; export it, to be safe
-		case agent.ContainerStatusCreated, agent.ContainerStatusFinished, agent.ContainerStatusDeleted:
-			continue // not possible to be discovered
+		default:
+			continue // not possible to be discovered, or not serving traffic
+		}
+
+		if instance.Restarting && !instance.Up {
+			continue // crashed, and waiting to be restarted
 		}
 
+		checks := healthChecksToChecks(instance.ContainerConfig)
+
 		for portName, port := range instance.ContainerConfig.Ports {
 			services = append(services, service{
-				ID:   fmt.Sprintf("harpoon:%s:%s", hostname(), instance.ID),
-				Name: instance.ContainerConfig.Product,
-				Port: int(port),
-				Tags: configToTags(instance.ContainerConfig, portName),
+				ID:     fmt.Sprintf("harpoon:%s:%s", hostname(), instance.ID),
+				Name:   instance.ContainerConfig.Product,
+				Port:   int(port),
+				Tags:   configToTags(instance.ContainerConfig, portName),
+				Checks: checks,
 			})
 		}
 	}
@@ -132,6 +147,41 @@ func instancesToServices(instances map[string]agent.ContainerInstance) []service
 	return services
 }
 
+// healthChecksToChecks translates the health checks of a container into
+// Consul check definitions. Every service of a container carries all of its
+// checks, as they describe the health of the container as a whole.
+//
+// Consul HTTP checks pass on any 2xx response, so HTTPAcceptableResponses
+// can't be expressed, and are ignored.
+func healthChecksToChecks(c agent.ContainerConfig) []check {
+	var checks []check
+
+	for _, hc := range c.HealthChecks {
+		var (
+			port = c.Ports[hc.Port]
+			chk  = check{
+				Interval: healthCheckInterval(hc).String(),
+				Timeout:  healthCheckTimeout(hc).String(),
+			}
+		)
+
+		switch hc.Protocol {
+		case agent.ProtocolHTTP:
+			chk.HTTP = healthCheckURL(hc, port)
+
+		case agent.ProtocolTCP:
+			chk.TCP = healthCheckAddr(port)
+
+		default:
+			continue
+		}
+
+		checks = append(checks, chk)
+	}
+
+	return checks
+}
+
 func configToTags(c agent.ContainerConfig, portName string) []string {
 	return []string{
 		"glimpse:provider=harpoon",
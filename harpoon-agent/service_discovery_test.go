@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 
@@ -53,7 +54,9 @@ func TestConfigToTags(t *testing.T) {
 
 func TestInstancesToServices(t *testing.T) {
 	instance := agent.ContainerInstance{
-		ID: "my-request-processor-1",
+		ID:                    "my-request-processor-1",
+		ContainerStatus:       agent.ContainerStatusRunning,
+		ContainerProcessState: agent.ContainerProcessState{Up: true, Restarting: true},
 		ContainerConfig: agent.ContainerConfig{
 			Job:         "request-processor",
 			Environment: "prod",
@@ -78,11 +81,84 @@ func TestInstancesToServices(t *testing.T) {
 	}
 }
 
+func TestInstancesToServicesSkipsUnavailable(t *testing.T) {
+	config := agent.ContainerConfig{
+		Job:         "request-processor",
+		Environment: "prod",
+		Product:     "android",
+		Ports:       map[string]uint16{"PORT_HTTP": 31234},
+	}
+
+	instances := map[string]agent.ContainerInstance{
+		"created": {
+			ContainerStatus: agent.ContainerStatusCreated,
+			ContainerConfig: config,
+		},
+		"failed": {
+			ContainerStatus:       agent.ContainerStatusFailed,
+			ContainerProcessState: agent.ContainerProcessState{Err: "boom"},
+			ContainerConfig:       config,
+		},
+		"finished": {
+			ContainerStatus: agent.ContainerStatusFinished,
+			ContainerConfig: config,
+		},
+		"restarting": {
+			ContainerStatus:       agent.ContainerStatusRunning,
+			ContainerProcessState: agent.ContainerProcessState{Up: false, Restarting: true},
+			ContainerConfig:       config,
+		},
+	}
+
+	if have := instancesToServices(instances); len(have) != 0 {
+		t.Errorf("want no services, have \n\t%#v", have)
+	}
+}
+
+func TestHealthChecksToChecks(t *testing.T) {
+	c := agent.ContainerConfig{
+		Ports: map[string]uint16{"PORT_HTTP": 31234, "PORT_ADMIN": 31235},
+		HealthChecks: []agent.HealthCheck{
+			{
+				Protocol:                agent.ProtocolHTTP,
+				Port:                    "PORT_ADMIN",
+				Interval:                agent.JSONDuration{Duration: 5 * time.Second},
+				Timeout:                 agent.JSONDuration{Duration: 2 * time.Second},
+				HTTPPath:                "/-/health",
+				HTTPAcceptableResponses: []int{200},
+			},
+			{
+				Protocol: agent.ProtocolTCP,
+				Port:     "PORT_HTTP",
+			},
+		},
+	}
+
+	want := []check{
+		{
+			HTTP:     "http://" + healthCheckHost + ":31235/-/health",
+			Interval: "5s",
+			Timeout:  "2s",
+		},
+		{
+			TCP:      healthCheckHost + ":31234",
+			Interval: defaultHealthCheckInterval.String(),
+			Timeout:  defaultHealthCheckTimeout.String(),
+		},
+	}
+
+	if have := healthChecksToChecks(c); !reflect.DeepEqual(want, have) {
+		t.Errorf("want\n\t%#v, have \n\t%#v", want, have)
+	}
+}
+
 func TestWriteInstances(t *testing.T) {
 	filename := "test-write-service-discovery.json"
 
 	instance := agent.ContainerInstance{
-		ID: "my-request-processor-1",
+		ID:                    "my-request-processor-1",
+		ContainerStatus:       agent.ContainerStatusRunning,
+		ContainerProcessState: agent.ContainerProcessState{Up: true, Restarting: true},
 		ContainerConfig: agent.ContainerConfig{
 			Job:         "request-processor",
 			Environment: "prod",
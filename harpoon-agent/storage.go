@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+const logRoot = "/srv/harpoon/log"
+
+// reservedStorage returns the storage in bytes reserved by the containers:
+// the logs and sized tmpfs mounts of every container, plus every distinct
+// artifact they've extracted. Containers share artifacts with the same URL.
+func reservedStorage(instances map[string]agent.ContainerInstance) uint64 {
+	var (
+		reserved uint64
+		seen     = map[string]struct{}{}
+	)
+
+	for _, instance := range instances {
+		if instance.ContainerStatus == agent.ContainerStatusDeleted {
+			continue
+		}
+
+		reserved += instance.ContainerConfig.ReservedStorage()
+
+		path, err := getArtifactDetails(artifacts.root, instance.ContainerConfig.ArtifactURL)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := seen[path]; ok {
+			continue
+		}
+
+		seen[path] = struct{}{}
+		reserved += artifacts.size(path)
+	}
+
+	return reserved
+}
+
+// diskUsage returns the total size in bytes of all regular files below path.
+func diskUsage(path string) (uint64, error) {
+	var size uint64
+
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+// systemStorage returns the combined capacity in MB of the filesystems
+// holding the given paths. Paths on the same filesystem are only counted
+// once, and paths that don't exist are ignored.
+func systemStorage(paths ...string) int64 {
+	var (
+		total   uint64
+		devices = map[uint64]struct{}{}
+	)
+
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			if _, ok := devices[uint64(st.Dev)]; ok {
+				continue
+			}
+
+			devices[uint64(st.Dev)] = struct{}{}
+		}
+
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(path, &fs); err != nil {
+			log.Printf("statfs %s: %s", path, err)
+			continue
+		}
+
+		total += uint64(fs.Blocks) * uint64(fs.Bsize)
+	}
+
+	return int64(total / 1024 / 1024)
+}
@@ -19,6 +19,7 @@ import (
 type supervisor struct {
 	ID     string
 	rundir string
+	logs   *containerLog
 	debug  bool
 
 	exitc        chan chan error
@@ -26,27 +27,31 @@ type supervisor struct {
 	subscribec   chan chan<- agent.ContainerProcessState
 	unsubscribec chan chan<- agent.ContainerProcessState
 	statec       chan agent.ContainerProcessState
+	ingestc      chan agent.LogEntry
 
 	exited chan struct{}
 }
 
-func newSupervisor(id string, rundir string, debug bool) *supervisor {
+func newSupervisor(id string, rundir string, logs *containerLog, debug bool) *supervisor {
 	return &supervisor{
 		ID:           id,
 		rundir:       rundir,
+		logs:         logs,
 		debug:        debug,
 		exitc:        make(chan chan error),
 		stopc:        make(chan time.Duration),
 		subscribec:   make(chan chan<- agent.ContainerProcessState),
 		unsubscribec: make(chan chan<- agent.ContainerProcessState),
 		statec:       make(chan agent.ContainerProcessState),
+		ingestc:      make(chan agent.LogEntry),
 		exited:       make(chan struct{}),
 	}
 }
 
 // Start starts the supervisor and connects to its control socket. If an error
-// is returned, the supervisor was not started.
-func (s *supervisor) Start(config agent.ContainerConfig, stdout, stderr io.Writer) error {
+// is returned, the supervisor was not started. The supervisor collects the
+// output of the container, and writes its own log to stderr.
+func (s *supervisor) Start(config agent.ContainerConfig, stderr io.Writer) error {
 	args := []string{"--hostname", systemHostname(), "--id", s.ID}
 	args = append(args, "--")
 	args = append(args, config.Command.Exec...)
@@ -56,7 +61,7 @@ func (s *supervisor) Start(config agent.ContainerConfig, stdout, stderr io.Write
 	}
 	cmd := exec.Command("harpoon-supervisor", args...)
 
-	cmd.Stdout = stdout
+	cmd.Stdout = stderr
 	cmd.Stderr = stderr
 	cmd.Dir = s.rundir
 
@@ -173,18 +178,44 @@ func (s *supervisor) readLoop(r io.Reader) error {
 			return err
 		}
 
-		// Ignore unknown events
-		if event.Type != "state" {
-			continue
-		}
+		switch event.Type {
+		case "state":
+			var state agent.ContainerProcessState
 
-		var state agent.ContainerProcessState
+			if err := json.Unmarshal(event.Data, &state); err != nil {
+				return err
+			}
 
-		if err := json.Unmarshal(event.Data, &state); err != nil {
-			return err
+			s.statec <- state
+
+		case "logs":
+			// The supervisor collects the output of the container, and
+			// takes the entries log producers send, too.
+			s.logs.setPipeline(s)
+
+		case "log":
+			var entry agent.LogEntry
+
+			if err := json.Unmarshal(event.Data, &entry); err != nil {
+				return err
+			}
+
+			s.logs.log(entry)
+
+		default: // ignore unknown events
 		}
+	}
+}
 
-		s.statec <- state
+// ingest sends an entry sent by a log producer to the supervisor, which logs
+// it like the output of the container. It returns false if the supervisor
+// exited.
+func (s *supervisor) ingest(entry agent.LogEntry) bool {
+	select {
+	case s.ingestc <- entry:
+		return true
+	case <-s.exited:
+		return false
 	}
 }
 
@@ -218,6 +249,7 @@ func (s *supervisor) loop(rwc io.ReadWriteCloser) {
 
 	defer close(s.exited)
 	defer rwc.Close()
+	defer s.logs.unsetPipeline(s)
 
 	defer func() {
 		if killTimer != nil {
@@ -232,6 +264,13 @@ func (s *supervisor) loop(rwc io.ReadWriteCloser) {
 
 	enc := eventsource.NewEncoder(rwc)
 
+	// Supervisors which collect the output of their containers acknowledge
+	// the subscription, and send the entries buffered while the agent was
+	// down. Supervisors started by earlier agents ignore it.
+	enc.Encode(eventsource.Event{
+		Type: "logs",
+	})
+
 	for {
 		select {
 		case err := <-errc:
@@ -275,6 +314,18 @@ func (s *supervisor) loop(rwc io.ReadWriteCloser) {
 		case c := <-s.unsubscribec:
 			delete(subscribers, c)
 
+		case entry := <-s.ingestc:
+			buf, err := json.Marshal(entry)
+			if err != nil {
+				log.Printf("logs: %s: %s", s.ID, err)
+				continue
+			}
+
+			enc.Encode(eventsource.Event{
+				Type: "log",
+				Data: buf,
+			})
+
 		case grace := <-s.stopc:
 			enc.Encode(eventsource.Event{
 				Type: "stop",
@@ -197,11 +197,14 @@ func TestSupervisor(t *testing.T) {
 
 	var (
 		debug    = false
-		s        = newSupervisor("arbitraryID", tmpdir, debug)
+		logs     = newContainerLog(10)
+		s        = newSupervisor("arbitraryID", tmpdir, logs, debug)
 		done     = make(chan struct{})
 		exitErrc = make(chan error)
 	)
 
+	defer logs.exit()
+
 	ln, err := net.Listen("unix", controlPath)
 	if err != nil {
 		t.Fatal(err)
@@ -228,6 +231,10 @@ func TestSupervisor(t *testing.T) {
 	}
 	defer conn.Close()
 
+	if ev := receiveControlEvent(t, conn, 15*time.Millisecond); ev != "logs" {
+		t.Fatalf("want logs event, got %q", ev)
+	}
+
 	var statec = make(chan agent.ContainerProcessState)
 	s.Subscribe(statec)
 
@@ -348,11 +355,14 @@ func TestSupervisorKillAfterGrace(t *testing.T) {
 
 	var (
 		debug    = false
-		s        = newSupervisor("arbitraryID", tmpdir, debug)
+		logs     = newContainerLog(10)
+		s        = newSupervisor("arbitraryID", tmpdir, logs, debug)
 		done     = make(chan struct{})
 		exitErrc = make(chan error)
 	)
 
+	defer logs.exit()
+
 	ln, err := net.Listen("unix", controlPath)
 	if err != nil {
 		t.Fatal(err)
@@ -379,6 +389,10 @@ func TestSupervisorKillAfterGrace(t *testing.T) {
 	}
 	defer conn.Close()
 
+	if ev := receiveControlEvent(t, conn, 15*time.Millisecond); ev != "logs" {
+		t.Fatalf("want logs event, got %q", ev)
+	}
+
 	var statec = make(chan agent.ContainerProcessState)
 	s.Subscribe(statec)
 
@@ -447,6 +461,115 @@ func TestSupervisorKillAfterGrace(t *testing.T) {
 	}
 }
 
+func TestSupervisorLogs(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "harpoon-agent-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdir)
+
+	controlPath := tmpdir + "/control"
+
+	var (
+		logs  = newContainerLog(10)
+		s     = newSupervisor("arbitraryID", tmpdir, logs, false)
+		linec = make(chan agent.LogEntry, 10)
+		done  = make(chan struct{})
+	)
+
+	defer logs.exit()
+
+	logs.notify(linec)
+
+	ln, err := net.Listen("unix", controlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		rwc, err := s.connect(controlPath, nil)
+		if err != nil {
+			panic(err)
+		}
+
+		s.loop(rwc)
+
+		close(done)
+	}()
+
+	ln.(*net.UnixListener).SetDeadline(time.Now().Add(100 * time.Millisecond))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if ev := receiveControlEvent(t, conn, 15*time.Millisecond); ev != "logs" {
+		t.Fatalf("want logs event, got %q", ev)
+	}
+
+	// Until the supervisor acknowledges the subscription, it doesn't take
+	// the entries of log producers.
+	if logs.ingest(agent.LogEntry{Line: "x"}) {
+		t.Fatal("want entry not ingested before the subscription is acknowledged")
+	}
+
+	enc := eventsource.NewEncoder(conn)
+
+	if err := enc.Encode(eventsource.Event{Type: "logs"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := enc.Encode(eventsource.Event{Type: "log", Data: []byte(`{"container_id":"arbitraryID","seq":1,"dropped":2,"line":"m1"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case entry := <-linec:
+		if entry.Line != "m1" || entry.Seq != 1 || entry.Dropped != 2 {
+			t.Errorf("want entry m1, have %+v", entry)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("entry sent by the supervisor not logged")
+	}
+
+	// Entries of log producers are sent to the supervisor.
+	go logs.ingest(agent.LogEntry{Stream: agent.LogStreamStderr, Line: "p1"})
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	var ev eventsource.Event
+
+	if err := eventsource.NewDecoder(conn).Decode(&ev); err != nil || ev.Type != "log" {
+		t.Fatalf("want log event, have %q (%v)", ev.Type, err)
+	}
+
+	var entry agent.LogEntry
+
+	if err := json.Unmarshal(ev.Data, &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := "p1", entry.Line; want != have {
+		t.Errorf("want line %q, have %q", want, have)
+	}
+
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("supervisor loop did not shut down after the connection closed")
+	}
+
+	if logs.ingest(agent.LogEntry{Line: "x"}) {
+		t.Error("want entry not ingested once the supervisor exited")
+	}
+}
+
 func sendControlState(t *testing.T, conn net.Conn, state agent.ContainerProcessState, d time.Duration) {
 	data, err := json.Marshal(state)
 	if err != nil {
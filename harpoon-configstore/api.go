@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/bmizerany/pat"
+
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+)
+
+// store is the backend of the config store API. Put reports whether the
+// config was stored before, in which case it's left as is.
+type store interface {
+	Get(ref string) (configstore.JobConfig, error)
+	Put(configstore.JobConfig) (ref string, existed bool, err error)
+	configstore.VersionLister
+}
+
+type api struct {
+	http.Handler
+	store
+}
+
+func newAPI(s store) *api {
+	var (
+		mux = pat.New()
+		api = &api{
+			Handler: mux,
+			store:   s,
+		}
+	)
+
+	mux.Put(configstore.APIVersionPrefix+configstore.APIPutConfigPath, http.HandlerFunc(api.handlePut))
+	mux.Get(configstore.APIVersionPrefix+configstore.APIGetConfigPath, http.HandlerFunc(api.handleGet))
+	mux.Get(configstore.APIVersionPrefix+configstore.APIListVersionsPath, http.HandlerFunc(api.handleList))
+
+	return api
+}
+
+func (a *api) handlePut(w http.ResponseWriter, r *http.Request) {
+	var config configstore.JobConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, fmt.Sprintf("invalid job config (%s)", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := config.Valid(); err != nil {
+		http.Error(w, fmt.Sprintf("invalid job config (%s)", err), http.StatusBadRequest)
+		return
+	}
+
+	ref, existed, err := a.store.Put(config)
+	if err != nil {
+		log.Printf("put %s: %s", config.Hash(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	code := http.StatusCreated
+	if existed {
+		code = http.StatusOK // configs are immutable; storing one twice is a no-op
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(configstore.Version{
+		Ref:         ref,
+		Product:     config.Product,
+		Environment: config.Environment,
+		Job:         config.Job,
+	})
+}
+
+func (a *api) handleGet(w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get(":ref")
+
+	config, err := a.store.Get(ref)
+	if err == configstore.ErrNotFound {
+		http.Error(w, fmt.Sprintf("%q not present", ref), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+func (a *api) handleList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	versions, err := a.store.Versions(query.Get("product"), query.Get("environment"), query.Get("job"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if versions == nil {
+		versions = []configstore.Version{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
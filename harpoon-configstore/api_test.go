@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+)
+
+func TestPutGet(t *testing.T) {
+	client, cleanup := newTestClient(t)
+	defer cleanup()
+
+	config := newTestJobConfig("web", 2)
+
+	ref, err := client.Put(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := config.Hash(), ref; want != have {
+		t.Errorf("want ref %q, have %q", want, have)
+	}
+
+	// Configs are immutable; putting the same config again is harmless.
+	if ref, err = client.Put(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := config.Hash(), ref; want != have {
+		t.Errorf("second put: want ref %q, have %q", want, have)
+	}
+
+	stored, err := client.Get(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := config.Hash(), stored.Hash(); want != have {
+		t.Errorf("want stored config %q, have %q", want, have)
+	}
+
+	if want, have := configstore.ErrNotFound, getErr(client, "web-0000000"); want != have {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	if want, have := configstore.ErrNotFound, getErr(client, ".."); want != have {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestPutConcurrently(t *testing.T) {
+	root, err := ioutil.TempDir(os.TempDir(), "harpoon-configstore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s, err := newFileStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(newTestJobConfig("web", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		api   = newAPI(s)
+		codes = make(chan int, 8)
+		wg    sync.WaitGroup
+	)
+
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, err := http.NewRequest("PUT", configstore.APIVersionPrefix+configstore.APIPutConfigPath, bytes.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, req)
+			codes <- w.Code
+		}()
+	}
+
+	wg.Wait()
+	close(codes)
+
+	have := map[int]int{}
+	for code := range codes {
+		have[code]++
+	}
+
+	// Only one of the puts stored the config.
+	if want := fmt.Sprint(map[int]int{http.StatusCreated: 1, http.StatusOK: cap(codes) - 1}); want != fmt.Sprint(have) {
+		t.Errorf("want status codes %s, have %v", want, have)
+	}
+}
+
+func TestPutInvalid(t *testing.T) {
+	client, cleanup := newTestClient(t)
+	defer cleanup()
+
+	if _, err := client.Put(configstore.JobConfig{}); err == nil {
+		t.Errorf("want error, have none")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	client, cleanup := newTestClient(t)
+	defer cleanup()
+
+	var refs []string
+	for _, config := range []configstore.JobConfig{
+		newTestJobConfig("web", 1),
+		newTestJobConfig("worker", 1),
+		newTestJobConfig("web", 2),
+	} {
+		ref, err := client.Put(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+
+	versions, err := client.Versions("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := 3, len(versions); want != have {
+		t.Fatalf("want %d version(s), have %d", want, have)
+	}
+
+	versions, err = client.Versions("product", "testing", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := 2, len(versions); want != have {
+		t.Fatalf("want %d version(s), have %d", want, have)
+	}
+
+	for _, v := range versions {
+		if want, have := "web", v.Job; want != have {
+			t.Errorf("want job %q, have %q", want, have)
+		}
+	}
+
+	if versions, err = client.Versions("other", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := 0, len(versions); want != have {
+		t.Errorf("want %d version(s), have %d", want, have)
+	}
+}
+
+func newTestClient(t *testing.T) (configstore.Client, func()) {
+	root, err := ioutil.TempDir(os.TempDir(), "harpoon-configstore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newFileStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(newAPI(s))
+
+	return configstore.MustNewClient(server.URL), func() {
+		server.Close()
+		os.RemoveAll(root)
+	}
+}
+
+func newTestJobConfig(job string, scale int) configstore.JobConfig {
+	return configstore.JobConfig{
+		Scale: scale,
+		ContainerConfig: agent.ContainerConfig{
+			Product:     "product",
+			Environment: "testing",
+			Job:         job,
+			ArtifactURL: "http://example.com/artifact.tar.gz",
+			Command:     agent.Command{WorkingDir: "/", Exec: []string{"./run"}},
+			Resources:   agent.Resources{CPU: 0.1, Mem: 64},
+			Grace: agent.Grace{
+				Startup:  agent.JSONDuration{Duration: time.Second},
+				Shutdown: agent.JSONDuration{Duration: time.Second},
+			},
+			Restart: agent.NoRestart,
+		},
+	}
+}
+
+func getErr(client configstore.ConfigStore, ref string) error {
+	_, err := client.Get(ref)
+	return err
+}
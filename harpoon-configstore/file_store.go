@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+)
+
+// fileStore keeps every job config in its own file, named by its ref, in a
+// single directory. Files are never modified once written.
+type fileStore struct {
+	root string
+	sync.Mutex
+}
+
+func newFileStore(root string) (*fileStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("create config store root: %s", err)
+	}
+
+	return &fileStore{root: root}, nil
+}
+
+func (s *fileStore) Get(ref string) (configstore.JobConfig, error) {
+	// Refs are used as filenames, and must not escape the root.
+	if ref == "" || strings.ContainsAny(ref, `/\`) || strings.HasPrefix(ref, ".") {
+		return configstore.JobConfig{}, configstore.ErrNotFound
+	}
+
+	f, err := os.Open(s.filename(ref))
+	if os.IsNotExist(err) {
+		return configstore.JobConfig{}, configstore.ErrNotFound
+	} else if err != nil {
+		return configstore.JobConfig{}, err
+	}
+	defer f.Close()
+
+	var config configstore.JobConfig
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return configstore.JobConfig{}, fmt.Errorf("%s: %s", ref, err)
+	}
+
+	return config, nil
+}
+
+// Put stores config, unless it's already stored, and returns its ref, and
+// whether it was stored before.
+func (s *fileStore) Put(config configstore.JobConfig) (string, bool, error) {
+	ref := config.Hash()
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, err := os.Stat(s.filename(ref)); err == nil {
+		return ref, true, nil
+	}
+
+	f, err := ioutil.TempFile(s.root, ".tmp-")
+	if err != nil {
+		return "", false, err
+	}
+
+	if err := json.NewEncoder(f).Encode(config); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", false, err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", false, err
+	}
+
+	if err := os.Rename(f.Name(), s.filename(ref)); err != nil {
+		os.Remove(f.Name())
+		return "", false, err
+	}
+
+	return ref, false, nil
+}
+
+func (s *fileStore) Versions(product, environment, job string) ([]configstore.Version, error) {
+	infos, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []configstore.Version
+
+	for _, info := range infos {
+		name := info.Name()
+
+		if info.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+
+		ref := strings.TrimSuffix(name, ".json")
+
+		config, err := s.Get(ref)
+		if err != nil {
+			return nil, err
+		}
+
+		if (product != "" && product != config.Product) ||
+			(environment != "" && environment != config.Environment) ||
+			(job != "" && job != config.Job) {
+			continue
+		}
+
+		versions = append(versions, configstore.Version{
+			Ref:         ref,
+			Product:     config.Product,
+			Environment: config.Environment,
+			Job:         config.Job,
+			Stored:      info.ModTime(),
+		})
+	}
+
+	sort.Sort(byStored(versions))
+
+	return versions, nil
+}
+
+func (s *fileStore) filename(ref string) string {
+	return filepath.Join(s.root, ref+".json")
+}
+
+type byStored []configstore.Version
+
+func (a byStored) Len() int      { return len(a) }
+func (a byStored) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byStored) Less(i, j int) bool {
+	if a[i].Stored.Equal(a[j].Stored) {
+		return a[i].Ref < a[j].Ref
+	}
+	return a[i].Stored.Before(a[j].Stored)
+}
@@ -0,0 +1,194 @@
+package configstore
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// hashPrefix identifies version 1 of the canonical encoding, hashed with
+	// SHA-256.
+	hashPrefix = "harpoon-jobconfig-v1 sha256"
+
+	// hashVersion marks the hashes computed with hashPrefix.
+	hashVersion = "v1"
+)
+
+// encodeCanonical writes a canonical, JSON-like encoding of v to w. Struct
+// fields are named by their JSON tag and, like map keys, written in sorted
+// order. Untagged embedded structs are flattened into their parent, as with
+// encoding/json. Fields with empty values, including nil and empty maps and
+// slices, are omitted, so that adding a field doesn't change the encoding of
+// values that don't use it. Integers are written in decimal, so durations are
+// written as nanoseconds, and floats are written in their shortest exact
+// representation.
+func encodeCanonical(w io.Writer, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		fields := map[string]reflect.Value{}
+		collectFields(v, fields)
+
+		names := make([]string, 0, len(fields))
+		for name, field := range fields {
+			if isEmpty(field) {
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		io.WriteString(w, "{")
+		for i, name := range names {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, "%s:", strconv.Quote(name))
+			if err := encodeCanonical(w, fields[name]); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		io.WriteString(w, "}")
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map key type %s", v.Type().Key())
+		}
+
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+
+		io.WriteString(w, "{")
+		for i, k := range keys {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, "%s:", strconv.Quote(k))
+			if err := encodeCanonical(w, v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))); err != nil {
+				return fmt.Errorf("%s: %s", k, err)
+			}
+		}
+		io.WriteString(w, "}")
+
+	case reflect.Slice, reflect.Array:
+		io.WriteString(w, "[")
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			if err := encodeCanonical(w, v.Index(i)); err != nil {
+				return fmt.Errorf("%d: %s", i, err)
+			}
+		}
+		io.WriteString(w, "]")
+
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			io.WriteString(w, "null")
+			return nil
+		}
+		return encodeCanonical(w, v.Elem())
+
+	case reflect.String:
+		io.WriteString(w, strconv.Quote(v.String()))
+
+	case reflect.Bool:
+		io.WriteString(w, strconv.FormatBool(v.Bool()))
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		io.WriteString(w, strconv.FormatInt(v.Int(), 10))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		io.WriteString(w, strconv.FormatUint(v.Uint(), 10))
+
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("unsupported float value %v", f)
+		}
+		if f == 0 {
+			f = 0 // normalize negative zero
+		}
+		io.WriteString(w, strconv.FormatFloat(f, 'g', -1, v.Type().Bits()))
+
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// collectFields gathers the exported fields of the struct v into fields,
+// indexed by their JSON name.
+func collectFields(v reflect.Value, fields map[string]reflect.Value) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		if f.PkgPath != "" && !f.Anonymous {
+			continue // unexported
+		}
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		if name == "" && f.Anonymous && f.Type.Kind() == reflect.Struct {
+			collectFields(v.Field(i), fields)
+			continue
+		}
+
+		if f.PkgPath != "" {
+			continue // unexported embedded non-struct
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fields[name] = v.Field(i)
+	}
+}
+
+// isEmpty returns true if v is the zero value of its type, or an empty map or
+// slice, or a struct of empty fields.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !isEmpty(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.String:
+		return v.Len() == 0
+
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+
+	case reflect.Bool:
+		return !v.Bool()
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	}
+
+	return false
+}
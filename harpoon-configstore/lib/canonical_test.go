@@ -0,0 +1,115 @@
+package configstore
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestHashStable(t *testing.T) {
+	config := JobConfig{
+		Scale: 2,
+		ContainerConfig: agent.ContainerConfig{
+			Product:     "product",
+			Environment: "testing",
+			Job:         "web",
+			ArtifactURL: "http://example.com/artifact.tar.gz",
+			Ports:       map[string]uint16{"HTTP": 0, "ADMIN": 0},
+			Env:         map[string]string{"A": "1", "B": "2", "C": "3"},
+			Command:     agent.Command{WorkingDir: "/", Exec: []string{"./run", "-v"}},
+			Resources:   agent.Resources{CPU: 0.1, Mem: 64},
+			Storage:     agent.Storage{Tmp: map[string]int{"/tmp": -1}},
+			Grace: agent.Grace{
+				Startup:  agent.JSONDuration{Duration: time.Second},
+				Shutdown: agent.JSONDuration{Duration: 1500 * time.Millisecond},
+			},
+			Restart: agent.OnFailureRestart,
+		},
+	}
+
+	// A change to this value changes the hash of every scheduled job
+	// config, and must come with a new hash prefix and version.
+	if want, have := "web-v1a22ca50", config.Hash(); want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
+
+func TestHashIgnoresRepresentation(t *testing.T) {
+	var (
+		a = JobConfig{ContainerConfig: agent.ContainerConfig{Job: "web", Resources: agent.Resources{CPU: 0.3}}}
+		b = JobConfig{ContainerConfig: agent.ContainerConfig{
+			Job:          "web",
+			Resources:    agent.Resources{CPU: 0.3},
+			Env:          map[string]string{},
+			HealthChecks: []agent.HealthCheck{},
+			Storage:      agent.Storage{Volumes: map[string]string{}},
+		}}
+	)
+
+	if want, have := a.Hash(), b.Hash(); want != have {
+		t.Errorf("nil and empty maps: want %s, have %s", want, have)
+	}
+}
+
+func TestHashDistinguishesFields(t *testing.T) {
+	base := JobConfig{ContainerConfig: agent.ContainerConfig{Job: "web"}}
+
+	for name, config := range map[string]JobConfig{
+		"scale":   {Scale: 1, ContainerConfig: agent.ContainerConfig{Job: "web"}},
+		"env":     {ContainerConfig: agent.ContainerConfig{Job: "web", Env: map[string]string{"A": ""}}},
+		"grace":   {ContainerConfig: agent.ContainerConfig{Job: "web", Grace: agent.Grace{Startup: agent.JSONDuration{Duration: time.Second}}}},
+		"exec":    {ContainerConfig: agent.ContainerConfig{Job: "web", Command: agent.Command{Exec: []string{""}}}},
+		"restart": {ContainerConfig: agent.ContainerConfig{Job: "web", Restart: agent.AlwaysRestart}},
+	} {
+		if base.Hash() == config.Hash() {
+			t.Errorf("%s: want different hashes, have %s", name, config.Hash())
+		}
+	}
+}
+
+func TestEncodeCanonicalOmitsEmptyFields(t *testing.T) {
+	type before struct {
+		A string `json:"a"`
+	}
+
+	type after struct {
+		A string            `json:"a"`
+		B map[string]string `json:"b"`
+		C struct{ D int }   `json:"c"`
+	}
+
+	var have, want bytes.Buffer
+
+	if err := encodeCanonical(&want, reflect.ValueOf(before{A: "x"})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := encodeCanonical(&have, reflect.ValueOf(after{A: "x"})); err != nil {
+		t.Fatal(err)
+	}
+
+	if want.String() != have.String() {
+		t.Errorf("want %s, have %s", want.String(), have.String())
+	}
+}
+
+func TestIsLegacyHash(t *testing.T) {
+	config := JobConfig{Scale: 1, ContainerConfig: agent.ContainerConfig{Job: "web-v1"}}
+
+	for hash, want := range map[string]bool{
+		config.Hash():       false,
+		config.LegacyHash(): true,
+		"web-abcdef0":       true,
+		"web-v1abcdef0":     false,
+		"web-v1-abcdef0":    true, // job web-v1
+		"web-ABCDEF0":       false,
+		"web-abcdef":        false,
+	} {
+		if have := IsLegacyHash(hash); want != have {
+			t.Errorf("%s: want %v, have %v", hash, want, have)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package configstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// APIVersionPrefix identifies the version of the API that this code
+	// serves and expects. Non-backwards-compatible API changes should
+	// increment the version.
+	APIVersionPrefix = "/api/v0"
+
+	// APIPutConfigPath stores a JobConfig, and returns its ref.
+	APIPutConfigPath = "/configs"
+
+	// APIGetConfigPath returns the JobConfig stored under a ref.
+	APIGetConfigPath = "/configs/:ref"
+
+	// APIListVersionsPath returns the versions of the stored JobConfigs,
+	// optionally filtered by the product, environment and job query
+	// parameters.
+	APIListVersionsPath = "/configs"
+)
+
+// Client is a config store accessed over HTTP.
+type Client interface {
+	ConfigStore
+	VersionLister
+	Endpoint() string
+}
+
+type client struct{ url.URL }
+
+var _ Client = client{}
+
+// NewClient produces a Client that proxies requests to the remote config
+// store at endpoint.
+func NewClient(endpoint string) (Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return client{}, err
+	}
+
+	return client{URL: *u}, nil
+}
+
+// MustNewClient returns a new Client representing the remote endpoint, or
+// panics if the endpoint URL is invalid.
+func MustNewClient(endpoint string) Client {
+	c, err := NewClient(endpoint)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (c client) Endpoint() string { return c.URL.String() }
+
+// Get implements the ConfigStore interface.
+func (c client) Get(ref string) (JobConfig, error) {
+	c.URL.Path = APIVersionPrefix + APIGetConfigPath
+	c.URL.Path = strings.Replace(c.URL.Path, ":ref", ref, 1)
+
+	resp, err := http.Get(c.URL.String())
+	if err != nil {
+		return JobConfig{}, fmt.Errorf("config store unavailable (%s)", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var config JobConfig
+		if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+			return JobConfig{}, fmt.Errorf("invalid config store response (%s)", err)
+		}
+		return config, nil
+
+	case http.StatusNotFound:
+		return JobConfig{}, ErrNotFound
+
+	default:
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return JobConfig{}, fmt.Errorf("HTTP %d (%s)", resp.StatusCode, bytes.TrimSpace(buf))
+	}
+}
+
+// Put implements the ConfigStore interface.
+func (c client) Put(config JobConfig) (string, error) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(config); err != nil {
+		return "", fmt.Errorf("problem encoding job config (%s)", err)
+	}
+
+	c.URL.Path = APIVersionPrefix + APIPutConfigPath
+
+	req, err := http.NewRequest("PUT", c.URL.String(), &body)
+	if err != nil {
+		return "", fmt.Errorf("problem constructing HTTP request (%s)", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("config store unavailable (%s)", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var v Version
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			return "", fmt.Errorf("invalid config store response (%s)", err)
+		}
+		return v.Ref, nil
+
+	default:
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("HTTP %d (%s)", resp.StatusCode, bytes.TrimSpace(buf))
+	}
+}
+
+// Versions implements the VersionLister interface.
+func (c client) Versions(product, environment, job string) ([]Version, error) {
+	c.URL.Path = APIVersionPrefix + APIListVersionsPath
+	c.URL.RawQuery = url.Values{
+		"product":     []string{product},
+		"environment": []string{environment},
+		"job":         []string{job},
+	}.Encode()
+
+	resp, err := http.Get(c.URL.String())
+	if err != nil {
+		return nil, fmt.Errorf("config store unavailable (%s)", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var versions []Version
+		if err := json.NewDecoder(resp.Body).Decode(&versions); err != nil {
+			return nil, fmt.Errorf("invalid config store response (%s)", err)
+		}
+		return versions, nil
+
+	default:
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("HTTP %d (%s)", resp.StatusCode, bytes.TrimSpace(buf))
+	}
+}
@@ -2,9 +2,13 @@ package configstore
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 )
@@ -15,6 +19,27 @@ type ConfigStore interface {
 	Put(JobConfig) (ref string, err error)
 }
 
+// VersionLister is implemented by config stores that can enumerate the
+// versions of a job which they store.
+type VersionLister interface {
+	// Versions returns the stored versions of every JobConfig matching the
+	// product, environment and job, ordered from oldest to newest. Empty
+	// parameters match everything.
+	Versions(product, environment, job string) ([]Version, error)
+}
+
+// Version describes a single JobConfig held by a config store.
+type Version struct {
+	Ref         string    `json:"ref"`
+	Product     string    `json:"product"`
+	Environment string    `json:"environment"`
+	Job         string    `json:"job"`
+	Stored      time.Time `json:"stored"`
+}
+
+// ErrNotFound is returned when a ref isn't present in a config store.
+var ErrNotFound = errors.New("config not found")
+
 // JobConfig defines a configuration for a job, which is a collection of
 // identical tasks. JobConfigs are declared by the user and stored in the
 // config store. JobConfigs are maintained and persisted by the scheduler when
@@ -44,15 +69,58 @@ func (c JobConfig) Valid() error {
 	return nil
 }
 
-// Hash produces a short and unique content-addressable string.
+// Hash produces a short and unique content-addressable string. It's computed
+// over the canonical encoding of the JobConfig, so it doesn't depend on the
+// order of map keys, the representation of durations and floats, or the
+// version of the encoding/json package.
+//
+// Hashes have the form job-v1abcdef0: the job, and the digest prefixed by the
+// version of the hash, which tells them apart from legacy hashes.
 func (c JobConfig) Hash() string {
-	h := md5.New()
+	h := sha256.New()
 
-	// JSON isn't a good encoding, because it's not stable.
+	// The prefix identifies the encoding and hash algorithm. Any change to
+	// either must change the prefix, and the version of the hash, so that no
+	// two versions of the hash produce the same value for different configs.
+	fmt.Fprintf(h, "%s\n", hashPrefix)
 
-	if err := json.NewEncoder(h).Encode(c); err != nil {
+	if err := encodeCanonical(h, reflect.ValueOf(c)); err != nil {
 		panic(fmt.Sprintf("JobConfig Hash error: %s", err))
 	}
 
+	return fmt.Sprintf("%s-%s%s", c.Job, hashVersion, fmt.Sprintf("%x", h.Sum(nil))[:7])
+}
+
+// LegacyHash produces the hash used before Hash was made stable. It md5s the
+// JSON encoding of the JobConfig, which isn't stable across Go versions and
+// client libraries. It's only used to recognize job configs persisted with
+// their legacy hash. Legacy hashes have the form job-abcdef0, without a
+// version; see IsLegacyHash.
+func (c JobConfig) LegacyHash() string {
+	h := md5.New()
+
+	if err := json.NewEncoder(h).Encode(c); err != nil {
+		panic(fmt.Sprintf("JobConfig LegacyHash error: %s", err))
+	}
+
 	return fmt.Sprintf("%s-%s", c.Job, fmt.Sprintf("%x", h.Sum(nil))[:7])
 }
+
+// IsLegacyHash returns true if hash was produced by LegacyHash, rather than
+// by Hash. The digest of legacy hashes, after the last dash, consists of seven
+// hex digits, while the digest of other hashes is prefixed by their version.
+func IsLegacyHash(hash string) bool {
+	digest := hash[strings.LastIndex(hash, "-")+1:]
+
+	if len(digest) != 7 {
+		return false
+	}
+
+	for _, r := range digest {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+
+	return true
+}
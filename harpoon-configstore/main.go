@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+var (
+	// Version is a state variable, written at the link stage. See Makefile.
+	Version string
+
+	// CommitID is a state variable, written at the link stage. See Makefile.
+	CommitID string
+
+	// ExternalReleaseVersion is a state variable, written at the link stage.
+	// See Makefile.
+	ExternalReleaseVersion string
+)
+
+func main() {
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
+
+	var (
+		listen  = flag.String("listen", ":4445", "HTTP listen address")
+		root    = flag.String("root", "/srv/harpoon/configs", "directory to store job configs")
+		version = flag.Bool("version", false, "print version")
+	)
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("version %s (%s) %s\n", Version, CommitID, ExternalReleaseVersion)
+		os.Exit(0)
+	}
+
+	s, err := newFileStore(*root)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	http.Handle("/api/v0/", newAPI(s))
+	http.Handle("/favicon.ico", http.NotFoundHandler())
+
+	log.Printf("storing job configs in %s", *root)
+	log.Printf("listening on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
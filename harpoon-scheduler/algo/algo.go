@@ -76,7 +76,8 @@ func RandomFit(
 		if task.Schedule {
 			r := resources[task.Endpoint]
 			r.CPU.Reserved += task.ContainerConfig.CPU
-			r.Mem.Reserved += task.ContainerConfig.Mem
+			r.Mem.Reserved += task.ContainerConfig.ReservedMem()
+			r.Storage.Reserved += task.ContainerConfig.ReservedStorage()
 			resources[task.Endpoint] = r
 		}
 	}
@@ -103,7 +104,8 @@ func RandomFit(
 		// Adjust the resources
 		r := resources[chosen]
 		r.CPU.Reserved += config.CPU
-		r.Mem.Reserved += config.Mem
+		r.Mem.Reserved += config.ReservedMem()
+		r.Storage.Reserved += config.ReservedStorage()
 		resources[chosen] = r
 	}
 
@@ -138,7 +140,8 @@ func LeastUsed(
 		if task.Schedule {
 			r := resources[task.Endpoint]
 			r.CPU.Reserved += task.ContainerConfig.CPU
-			r.Mem.Reserved += task.ContainerConfig.Mem
+			r.Mem.Reserved += task.ContainerConfig.ReservedMem()
+			r.Storage.Reserved += task.ContainerConfig.ReservedStorage()
 			resources[task.Endpoint] = r
 		}
 		e2c[task.Endpoint]++
@@ -168,7 +171,8 @@ func LeastUsed(
 		// Adjust the resources
 		r := resources[chosen]
 		r.CPU.Reserved += config.CPU
-		r.Mem.Reserved += config.Mem
+		r.Mem.Reserved += config.ReservedMem()
+		r.Storage.Reserved += config.ReservedStorage()
 		resources[chosen] = r
 
 		e2c[chosen]++
@@ -196,10 +200,21 @@ func match(c agent.ContainerConfig, r agent.HostResources) bool {
 		return false
 	}
 
-	if want, have := c.Mem, r.Mem.Total-r.Mem.Reserved; want > have {
+	if want, have := c.ReservedMem(), r.Mem.Total-r.Mem.Reserved; want > have {
 		return false
 	}
 
+	// Agents that don't report their storage aren't constrained by it.
+	if r.Storage.Total > 0 {
+		if r.Storage.Reserved > r.Storage.Total {
+			return false
+		}
+
+		if want, have := c.ReservedStorage(), r.Storage.Total-r.Storage.Reserved; want > have {
+			return false
+		}
+	}
+
 	m := map[string]struct{}{}
 	for _, v := range r.Volumes {
 		m[v] = struct{}{}
@@ -29,6 +29,41 @@ func TestMatch(t *testing.T) {
 			agent.HostResources{Mem: agent.TotalReservedInt{Total: 1024, Reserved: 1}},
 			false,
 		},
+		{
+			agent.ContainerConfig{Resources: agent.Resources{Mem: 512}, Storage: agent.Storage{Tmp: map[string]int{"/tmp": 512}}},
+			agent.HostResources{Mem: agent.TotalReservedInt{Total: 1024, Reserved: 0}},
+			true,
+		},
+		{
+			agent.ContainerConfig{Resources: agent.Resources{Mem: 512}, Storage: agent.Storage{Tmp: map[string]int{"/tmp": 513}}},
+			agent.HostResources{Mem: agent.TotalReservedInt{Total: 1024, Reserved: 0}},
+			false,
+		},
+		{
+			agent.ContainerConfig{Resources: agent.Resources{Mem: 512}, Storage: agent.Storage{Tmp: map[string]int{"/tmp": -1}}},
+			agent.HostResources{Mem: agent.TotalReservedInt{Total: 1024, Reserved: 512}},
+			true,
+		},
+		{
+			agent.ContainerConfig{},
+			agent.HostResources{Storage: agent.TotalReservedInt{Total: agent.LogStorage, Reserved: 0}},
+			true,
+		},
+		{
+			agent.ContainerConfig{},
+			agent.HostResources{Storage: agent.TotalReservedInt{Total: agent.LogStorage, Reserved: 1}},
+			false,
+		},
+		{
+			agent.ContainerConfig{Storage: agent.Storage{Tmp: map[string]int{"/tmp": 1}}},
+			agent.HostResources{Storage: agent.TotalReservedInt{Total: 2 * agent.LogStorage, Reserved: agent.LogStorage}},
+			false,
+		},
+		{
+			agent.ContainerConfig{},
+			agent.HostResources{Storage: agent.TotalReservedInt{Total: agent.LogStorage, Reserved: 2 * agent.LogStorage}},
+			false,
+		},
 		{
 			agent.ContainerConfig{Resources: agent.Resources{CPU: 4.0}},
 			agent.HostResources{CPU: agent.TotalReserved{Total: 16.0, Reserved: 0.0}},
@@ -7,30 +7,50 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/bernerdschaefer/eventsource"
+
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/registry"
 )
 
 const (
 	// APIVersionPrefix for all API endpoints.
-	APIVersionPrefix = "/api/v0"
+	APIVersionPrefix = scheduler.APIVersionPrefix
 
-	// APISchedulePath for schedule calls.
-	APISchedulePath = "/schedule"
+	// APISchedulePath for schedule calls. Job configs are passed in the
+	// request body, or fetched from the config store when the ref query
+	// parameter is given.
+	APISchedulePath = scheduler.APISchedulePath
 
 	// APIUnschedulePath for schedule calls.
-	APIUnschedulePath = "/unschedule"
+	APIUnschedulePath = scheduler.APIUnschedulePath
 
-	// APIProxyPath to get the actual state of the scheduling domain.
-	APIProxyPath = "/proxy"
+	// APIProxyPath to get the actual state of the scheduling domain, or a
+	// stream of it when requested with Accept: text/event-stream.
+	APIProxyPath = scheduler.APIProxyPath
 
 	// APIRegistryPath to get the desired state of the scheduling domain.
-	APIRegistryPath = "/registry"
+	APIRegistryPath = scheduler.APIRegistryPath
+
+	// APIEventsPath to stream changes of the desired and actual state of the
+	// scheduling domain as typed events.
+	APIEventsPath = scheduler.APIEventsPath
+
+	// APIMigratePath to start migrations (PUT) and get their progress (GET).
+	// Running migrations are aborted with DELETE APIMigratePath/{job}.
+	APIMigratePath = "/migrate"
+
+	// APIRefsPath to get the config store references of scheduled job
+	// configs.
+	APIRefsPath = "/refs"
 )
 
 type handler struct {
 	Proxy
 	JobScheduler
+	configstore.ConfigStore
 }
 
 // Proxy captures the methods to get the actual state of the scheduling
@@ -39,6 +59,21 @@ type Proxy interface {
 	Snapshot() map[string]agent.StateEvent
 }
 
+// ProxyBroadcaster captures the methods to subscribe to changes of the actual
+// state of the scheduling domain. Proxies may optionally implement it.
+type ProxyBroadcaster interface {
+	Subscribe(chan<- map[string]agent.StateEvent)
+	Unsubscribe(chan<- map[string]agent.StateEvent)
+}
+
+// DesireBroadcaster captures the methods to subscribe to changes of the
+// desired state of the scheduling domain. JobSchedulers may optionally
+// implement it.
+type DesireBroadcaster interface {
+	Subscribe(chan<- map[string]configstore.JobConfig)
+	Unsubscribe(chan<- map[string]configstore.JobConfig)
+}
+
 // JobScheduler captures job schedule and unschedule methods, and a way to
 // introspect the desired state of the scheduling domain.
 type JobScheduler interface {
@@ -47,11 +82,39 @@ type JobScheduler interface {
 	Snapshot() map[string]configstore.JobConfig
 }
 
-// NewHandler returns a http.Handler that serves the API endpoints.
-func NewHandler(p Proxy, s JobScheduler) *handler {
+// JobMigrator captures the methods to migrate a scheduled job to a new
+// configuration, and to introspect the progress of migrations. JobSchedulers
+// may optionally implement it.
+type JobMigrator interface {
+	Migrate(from string, to configstore.JobConfig, maxSurge, maxUnavailable int) error
+	AbortMigration(job string) error
+	Migrations() map[string]registry.Migration
+}
+
+// JobRefScheduler captures the methods to schedule job configs fetched from
+// the config store, recording the reference they were fetched from.
+// JobSchedulers may optionally implement it.
+type JobRefScheduler interface {
+	ScheduleRef(ref string, c configstore.JobConfig) error
+	Refs() map[string]string
+}
+
+// MigrateRequest is the body of a migrate request.
+type MigrateRequest struct {
+	From           string                `json:"from"` // hash of the scheduled job config
+	To             configstore.JobConfig `json:"to"`
+	MaxSurge       int                   `json:"max_surge"`
+	MaxUnavailable int                   `json:"max_unavailable"`
+}
+
+// NewHandler returns a http.Handler that serves the API endpoints. The
+// config store may be nil, in which case jobs can't be scheduled by
+// reference.
+func NewHandler(p Proxy, s JobScheduler, c configstore.ConfigStore) *handler {
 	return &handler{
 		Proxy:        p,
 		JobScheduler: s,
+		ConfigStore:  c,
 	}
 }
 
@@ -66,12 +129,27 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handleProxy(w, r)
 	case r.Method == "GET" && r.URL.Path == APIVersionPrefix+APIRegistryPath:
 		h.handleRegistry(w, r)
+	case r.Method == "GET" && r.URL.Path == APIVersionPrefix+APIEventsPath:
+		h.handleEvents(w, r)
+	case r.Method == "GET" && r.URL.Path == APIVersionPrefix+APIRefsPath:
+		h.handleRefs(w, r)
+	case r.Method == "PUT" && r.URL.Path == APIVersionPrefix+APIMigratePath:
+		h.handleMigrate(w, r)
+	case r.Method == "GET" && r.URL.Path == APIVersionPrefix+APIMigratePath:
+		h.handleMigrations(w, r)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, APIVersionPrefix+APIMigratePath+"/"):
+		h.handleAbortMigration(w, r)
 	default:
 		http.NotFoundHandler().ServeHTTP(w, r)
 	}
 }
 
 func (h *handler) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	if ref := r.URL.Query().Get("ref"); ref != "" {
+		h.handleScheduleRef(w, r, ref)
+		return
+	}
+
 	var c configstore.JobConfig
 	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
 		writeResponse(w, http.StatusBadRequest, err.Error())
@@ -91,6 +169,48 @@ func (h *handler) handleSchedule(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, http.StatusAccepted, fmt.Sprintf("request to schedule %q (%s) has been accepted", c.Job, c.Hash()))
 }
 
+func (h *handler) handleScheduleRef(w http.ResponseWriter, r *http.Request, ref string) {
+	s, ok := h.JobScheduler.(JobRefScheduler)
+	if !ok || h.ConfigStore == nil {
+		writeResponse(w, http.StatusNotImplemented, "scheduling by reference not supported")
+		return
+	}
+
+	c, err := h.ConfigStore.Get(ref)
+	if err == configstore.ErrNotFound {
+		writeResponse(w, http.StatusNotFound, fmt.Sprintf("%s not found in config store", ref))
+		return
+	} else if err != nil {
+		writeResponse(w, http.StatusBadGateway, fmt.Sprintf("config store: %s", err))
+		return
+	}
+
+	// Refs are the hashes of the configs they refer to, or their legacy
+	// hashes. A config that doesn't match its ref is corrupt or stale, and
+	// not the one that was requested.
+	hash := c.Hash()
+	if configstore.IsLegacyHash(ref) {
+		hash = c.LegacyHash()
+	}
+
+	if ref != hash {
+		writeResponse(w, http.StatusBadGateway, fmt.Sprintf("config store: %s refers to a config with hash %s", ref, hash))
+		return
+	}
+
+	if err := c.Valid(); err != nil {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("%s: %s", ref, err))
+		return
+	}
+
+	if err := s.ScheduleRef(ref, c); err != nil {
+		writeResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeResponse(w, http.StatusAccepted, fmt.Sprintf("request to schedule %q (%s) from %s has been accepted", c.Job, c.Hash(), ref))
+}
+
 func (h *handler) handleUnschedule(w http.ResponseWriter, r *http.Request) {
 	var (
 		hash string
@@ -126,16 +246,234 @@ func (h *handler) handleUnschedule(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, http.StatusAccepted, fmt.Sprintf("request to unschedule %s (%s) has been accepted", job, hash))
 }
 
+func (h *handler) handleMigrate(w http.ResponseWriter, r *http.Request) {
+	m, ok := h.JobScheduler.(JobMigrator)
+	if !ok {
+		writeResponse(w, http.StatusNotImplemented, "migrations not supported")
+		return
+	}
+
+	var req MigrateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := req.To.Valid(); err != nil {
+		writeResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := m.Migrate(req.From, req.To, req.MaxSurge, req.MaxUnavailable); err != nil {
+		writeResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeResponse(w, http.StatusAccepted, fmt.Sprintf("request to migrate %q from %s to %s has been accepted", req.To.Job, req.From, req.To.Hash()))
+}
+
+func (h *handler) handleAbortMigration(w http.ResponseWriter, r *http.Request) {
+	m, ok := h.JobScheduler.(JobMigrator)
+	if !ok {
+		writeResponse(w, http.StatusNotImplemented, "migrations not supported")
+		return
+	}
+
+	job := strings.TrimPrefix(r.URL.Path, APIVersionPrefix+APIMigratePath+"/")
+	if job == "" {
+		writeResponse(w, http.StatusBadRequest, "no job specified")
+		return
+	}
+
+	if err := m.AbortMigration(job); err != nil {
+		writeResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeResponse(w, http.StatusAccepted, fmt.Sprintf("request to abort migration of %q has been accepted", job))
+}
+
+func (h *handler) handleMigrations(w http.ResponseWriter, r *http.Request) {
+	m, ok := h.JobScheduler.(JobMigrator)
+	if !ok {
+		writeResponse(w, http.StatusNotImplemented, "migrations not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(m.Migrations())
+}
+
 func (h *handler) handleProxy(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		h.handleProxyEvents(w, r)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(h.Proxy.Snapshot())
 }
 
+func (h *handler) handleProxyEvents(w http.ResponseWriter, r *http.Request) {
+	b, ok := h.Proxy.(ProxyBroadcaster)
+	if !ok {
+		writeResponse(w, http.StatusNotImplemented, "event stream not supported")
+		return
+	}
+
+	eventsource.Handler(func(lastID string, enc *eventsource.Encoder, stop <-chan bool) {
+		var (
+			donec   = make(chan struct{})
+			updatec = make(chan map[string]agent.StateEvent)
+			latestc = make(chan map[string]agent.StateEvent, 1)
+		)
+
+		go drainActual(updatec, latestc, donec)
+
+		defer close(donec)
+		b.Subscribe(updatec)
+		defer b.Unsubscribe(updatec)
+
+		for {
+			select {
+			case <-stop:
+				return
+
+			case state := <-latestc:
+				if err := encodeEvent(enc, "", state); err != nil {
+					return
+				}
+			}
+		}
+	}).ServeHTTP(w, r)
+}
+
+func (h *handler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	desire, ok := h.JobScheduler.(DesireBroadcaster)
+	if !ok {
+		writeResponse(w, http.StatusNotImplemented, "event stream not supported")
+		return
+	}
+
+	actual, ok := h.Proxy.(ProxyBroadcaster)
+	if !ok {
+		writeResponse(w, http.StatusNotImplemented, "event stream not supported")
+		return
+	}
+
+	eventsource.Handler(func(lastID string, enc *eventsource.Encoder, stop <-chan bool) {
+		var (
+			donec    = make(chan struct{})
+			desirec  = make(chan map[string]configstore.JobConfig)
+			desiredc = make(chan map[string]configstore.JobConfig, 1)
+			updatec  = make(chan map[string]agent.StateEvent)
+			actualc  = make(chan map[string]agent.StateEvent, 1)
+		)
+
+		go drainDesired(desirec, desiredc, donec)
+		go drainActual(updatec, actualc, donec)
+
+		// Deferred calls run in reverse order, so both subscriptions are
+		// cancelled while the drains are still consuming.
+		defer close(donec)
+
+		desire.Subscribe(desirec)
+		defer desire.Unsubscribe(desirec)
+
+		actual.Subscribe(updatec)
+		defer actual.Unsubscribe(updatec)
+
+		for {
+			var err error
+
+			select {
+			case <-stop:
+				return
+
+			case desired := <-desiredc:
+				err = encodeEvent(enc, scheduler.EventTypeDesired, desired)
+
+			case state := <-actualc:
+				err = encodeEvent(enc, scheduler.EventTypeActual, state)
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}).ServeHTTP(w, r)
+}
+
+// drainDesired consumes desired state updates until done is closed, retaining
+// only the most recent one in latestc. The registry doesn't close the
+// channels of its subscribers.
+func drainDesired(updatec <-chan map[string]configstore.JobConfig, latestc chan map[string]configstore.JobConfig, donec <-chan struct{}) {
+	for {
+		select {
+		case <-donec:
+			return
+
+		case desired := <-updatec:
+			select {
+			case <-latestc:
+			default:
+			}
+			latestc <- desired
+		}
+	}
+}
+
+// drainActual consumes actual state updates until the update channel is
+// closed or done is closed, retaining only the most recent one in latestc.
+// The proxy requires its subscribers to be fast, and closes their channels
+// when they unsubscribe.
+func drainActual(updatec <-chan map[string]agent.StateEvent, latestc chan map[string]agent.StateEvent, donec <-chan struct{}) {
+	for {
+		select {
+		case <-donec:
+			return
+
+		case state, ok := <-updatec:
+			if !ok {
+				return
+			}
+
+			select {
+			case <-latestc:
+			default:
+			}
+			latestc <- state
+		}
+	}
+}
+
+// encodeEvent writes v as the JSON-encoded data of an event of the given type.
+// Values that can't be encoded are skipped.
+func encodeEvent(enc *eventsource.Encoder, typ string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	return enc.Encode(eventsource.Event{Type: typ, Data: buf})
+}
+
 func (h *handler) handleRegistry(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(h.JobScheduler.Snapshot())
 }
 
+func (h *handler) handleRefs(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.JobScheduler.(JobRefScheduler)
+	if !ok {
+		writeResponse(w, http.StatusNotImplemented, "scheduling by reference not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.Refs())
+}
+
 func writeResponse(w http.ResponseWriter, code int, msg string) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(code)
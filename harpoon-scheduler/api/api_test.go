@@ -3,13 +3,16 @@ package api_test
 import (
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-scheduler/api"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
 )
 
 // https://github.com/soundcloud/harpoon/pull/107
@@ -20,7 +23,7 @@ func TestUnscheduleFailed(t *testing.T) {
 		e = agent.StateEvent{Containers: c}
 		p = fakeProxy{"foo": e}
 		s = &fakeJobScheduler{}
-		h = api.NewHandler(p, s)
+		h = api.NewHandler(p, s, nil)
 	)
 
 	w := httptest.NewRecorder()
@@ -39,6 +42,131 @@ func TestUnscheduleFailed(t *testing.T) {
 	}
 }
 
+func TestScheduleRef(t *testing.T) {
+	var (
+		c = configstore.JobConfig{
+			Scale: 1,
+			ContainerConfig: agent.ContainerConfig{
+				Product:     "product",
+				Environment: "testing",
+				Job:         "table",
+				Command:     agent.Command{WorkingDir: "/", Exec: []string{"./run"}},
+				Resources:   agent.Resources{CPU: 0.1, Mem: 64},
+				Grace: agent.Grace{
+					Startup:  agent.JSONDuration{Duration: time.Second},
+					Shutdown: agent.JSONDuration{Duration: time.Second},
+				},
+				Restart: agent.NoRestart,
+			},
+		}
+		s      = &fakeJobRefScheduler{refs: map[string]string{}}
+		legacy = c
+		stale  = c
+	)
+
+	legacy.Scale, stale.Scale = 2, 3
+
+	h := api.NewHandler(fakeProxy{}, s, fakeConfigStore{
+		c.Hash():            c,
+		legacy.LegacyHash(): legacy,
+		"table-v1abcdef0":   stale, // refers to another config
+		"table-abcdef0":     stale, // refers to another config
+	})
+
+	for ref, want := range map[string]int{
+		c.Hash():            http.StatusAccepted,
+		legacy.LegacyHash(): http.StatusAccepted,
+		"table-v1abcdef0":   http.StatusBadGateway,
+		"table-abcdef0":     http.StatusBadGateway,
+		"table-v11234567":   http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("PUT", "http://cats.biz"+api.APIVersionPrefix+api.APISchedulePath+"?ref="+ref, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.ServeHTTP(w, r)
+
+		if have := w.Code; want != have {
+			t.Errorf("%s: want HTTP %d, have %d (%s)", ref, want, have, w.Body.String())
+		}
+	}
+
+	if want, have := map[string]string{c.Hash(): c.Hash(), legacy.Hash(): legacy.LegacyHash()}, s.refs; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	var (
+		c = configstore.JobConfig{ContainerConfig: agent.ContainerConfig{Job: "table"}}
+		e = agent.StateEvent{Containers: map[string]agent.ContainerInstance{
+			c.Hash() + "-0": agent.ContainerInstance{ContainerStatus: agent.ContainerStatusRunning},
+		}}
+		p = &fakeBroadcastingProxy{fakeProxy: fakeProxy{"agent:3333": e}}
+		s = &fakeBroadcastingJobScheduler{scheduled: map[string]configstore.JobConfig{c.Hash(): c}}
+	)
+
+	server := httptest.NewServer(api.NewHandler(p, s, nil))
+	defer server.Close()
+
+	events, stopper, err := scheduler.MustNewClient(server.URL).Stream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopper.Stop()
+
+	var (
+		timeout = time.After(time.Second)
+		desired = map[string]configstore.JobConfig{}
+		actual  = map[string]agent.StateEvent{}
+	)
+
+	for len(desired) == 0 || len(actual) == 0 {
+		select {
+		case event := <-events:
+			switch event.Type {
+			case scheduler.EventTypeDesired:
+				desired = event.Desired
+			case scheduler.EventTypeActual:
+				actual = event.Actual
+			default:
+				t.Fatalf("unexpected event type %q", event.Type)
+			}
+
+		case <-timeout:
+			t.Fatal("timeout waiting for events")
+		}
+	}
+
+	if want, have := s.scheduled, desired; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	if want, have := map[string]agent.StateEvent(p.fakeProxy), actual; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestEventsNotSupported(t *testing.T) {
+	var (
+		h = api.NewHandler(fakeProxy{}, &fakeJobScheduler{}, nil)
+		w = httptest.NewRecorder()
+	)
+
+	r, err := http.NewRequest("GET", "http://cats.biz"+api.APIVersionPrefix+api.APIEventsPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.ServeHTTP(w, r)
+
+	if want, have := http.StatusNotImplemented, w.Code; want != have {
+		t.Errorf("want HTTP %d, have %d", want, have)
+	}
+}
+
 type fakeProxy map[string]agent.StateEvent
 
 func (p fakeProxy) Snapshot() map[string]agent.StateEvent {
@@ -65,3 +193,59 @@ func (s fakeJobScheduler) Snapshot() map[string]configstore.JobConfig {
 	atomic.AddInt32(&s.snapshots, 1)
 	return map[string]configstore.JobConfig{}
 }
+
+type fakeJobRefScheduler struct {
+	fakeJobScheduler
+	refs map[string]string
+}
+
+func (s *fakeJobRefScheduler) ScheduleRef(ref string, c configstore.JobConfig) error {
+	s.refs[c.Hash()] = ref
+	return nil
+}
+
+func (s *fakeJobRefScheduler) Refs() map[string]string {
+	return s.refs
+}
+
+type fakeConfigStore map[string]configstore.JobConfig
+
+func (s fakeConfigStore) Get(ref string) (configstore.JobConfig, error) {
+	c, ok := s[ref]
+	if !ok {
+		return configstore.JobConfig{}, configstore.ErrNotFound
+	}
+	return c, nil
+}
+
+func (s fakeConfigStore) Put(c configstore.JobConfig) (string, error) {
+	s[c.Hash()] = c
+	return c.Hash(), nil
+}
+
+// fakeBroadcastingProxy sends its snapshot to every subscriber, and closes
+// their channels when they unsubscribe, like the reprproxy.
+type fakeBroadcastingProxy struct {
+	fakeProxy
+}
+
+func (p *fakeBroadcastingProxy) Subscribe(c chan<- map[string]agent.StateEvent) {
+	go func() { c <- p.Snapshot() }()
+}
+
+func (p *fakeBroadcastingProxy) Unsubscribe(c chan<- map[string]agent.StateEvent) {
+	close(c)
+}
+
+// fakeBroadcastingJobScheduler sends its scheduled jobs to every subscriber,
+// like the registry.
+type fakeBroadcastingJobScheduler struct {
+	fakeJobScheduler
+	scheduled map[string]configstore.JobConfig
+}
+
+func (s *fakeBroadcastingJobScheduler) Subscribe(c chan<- map[string]configstore.JobConfig) {
+	go func() { c <- s.scheduled }()
+}
+
+func (s *fakeBroadcastingJobScheduler) Unsubscribe(c chan<- map[string]configstore.JobConfig) {}
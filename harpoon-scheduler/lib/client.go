@@ -0,0 +1,438 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bernerdschaefer/eventsource"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+)
+
+const (
+	// APIVersionPrefix identifies the version of the API that this code
+	// serves and expects. Non-backwards-compatible API changes should
+	// increment the version.
+	APIVersionPrefix = "/api/v0"
+
+	// APISchedulePath conforms to the scheduler API spec. Job configs are
+	// passed in the request body, or fetched from the config store when the
+	// ref query parameter is given.
+	APISchedulePath = "/schedule"
+
+	// APIUnschedulePath conforms to the scheduler API spec. Job configs are
+	// passed in the request body, or identified by their hash as an
+	// additional path element.
+	APIUnschedulePath = "/unschedule"
+
+	// APIProxyPath conforms to the scheduler API spec. It returns the actual
+	// state of the scheduling domain, or a stream of it when requested with
+	// Accept: text/event-stream.
+	APIProxyPath = "/proxy"
+
+	// APIRegistryPath conforms to the scheduler API spec. It returns the
+	// desired state of the scheduling domain.
+	APIRegistryPath = "/registry"
+
+	// APIEventsPath conforms to the scheduler API spec. It streams typed
+	// events for changes of the desired and the actual state of the
+	// scheduling domain, when requested with Accept: text/event-stream.
+	APIEventsPath = "/events"
+)
+
+// ErrTimeout is returned when clients Wait for tasks too long.
+var ErrTimeout = errors.New("timeout")
+
+type client struct{ url.URL }
+
+var _ Scheduler = client{}
+
+// NewClient produces a Scheduler that proxies requests to the remote
+// scheduler at endpoint.
+func NewClient(endpoint string) (Scheduler, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return client{}, err
+	}
+
+	return client{URL: *u}, nil
+}
+
+// MustNewClient returns a new Scheduler representing the remote endpoint, or
+// panics if the endpoint URL is invalid.
+func MustNewClient(endpoint string) Scheduler {
+	scheduler, err := NewClient(endpoint)
+	if err != nil {
+		panic(err)
+	}
+	return scheduler
+}
+
+func (c client) Endpoint() string { return c.URL.String() }
+
+// Schedule implements the Scheduler interface. It returns the hash of the
+// scheduled job config.
+func (c client) Schedule(cfg configstore.JobConfig) (string, error) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(cfg); err != nil {
+		return "", fmt.Errorf("problem encoding job config (%s)", err)
+	}
+
+	c.URL.Path = APIVersionPrefix + APISchedulePath
+
+	if err := c.rpc("PUT", &body); err != nil {
+		return "", err
+	}
+
+	return cfg.Hash(), nil
+}
+
+// ScheduleRef implements the Scheduler interface.
+func (c client) ScheduleRef(ref string) error {
+	c.URL.Path = APIVersionPrefix + APISchedulePath
+	c.URL.RawQuery = url.Values{"ref": []string{ref}}.Encode()
+
+	return c.rpc("PUT", nil)
+}
+
+// Unschedule implements the Scheduler interface. It returns the hash of the
+// unscheduled job config.
+func (c client) Unschedule(cfg configstore.JobConfig) (string, error) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(cfg); err != nil {
+		return "", fmt.Errorf("problem encoding job config (%s)", err)
+	}
+
+	c.URL.Path = APIVersionPrefix + APIUnschedulePath
+
+	if err := c.rpc("PUT", &body); err != nil {
+		return "", err
+	}
+
+	return cfg.Hash(), nil
+}
+
+// UnscheduleHash implements the Scheduler interface.
+func (c client) UnscheduleHash(jobConfigHash string) error {
+	c.URL.Path = APIVersionPrefix + APIUnschedulePath + "/" + jobConfigHash
+
+	return c.rpc("PUT", nil)
+}
+
+// rpc issues an RPC-style request, which succeeds with 202 Accepted.
+func (c client) rpc(method string, body io.Reader) error {
+	req, err := http.NewRequest(method, c.URL.String(), body)
+	if err != nil {
+		return fmt.Errorf("problem constructing HTTP request (%s)", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("scheduler unavailable (%s)", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		return nil
+
+	default:
+		buf, _ := ioutil.ReadAll(resp.Body)
+
+		var r response
+		if err := json.Unmarshal(buf, &r); err == nil && r.Message != "" {
+			return fmt.Errorf("HTTP %d (%s)", resp.StatusCode, r.Message)
+		}
+
+		return fmt.Errorf("HTTP %d (%s)", resp.StatusCode, bytes.TrimSpace(buf))
+	}
+}
+
+// Registry implements the Scheduler interface.
+func (c client) Registry() (map[string]configstore.JobConfig, error) {
+	c.URL.Path = APIVersionPrefix + APIRegistryPath
+
+	var registry map[string]configstore.JobConfig
+	if err := c.get(&registry); err != nil {
+		return map[string]configstore.JobConfig{}, err
+	}
+
+	return registry, nil
+}
+
+// Proxy implements the Scheduler interface.
+func (c client) Proxy() (map[string]agent.StateEvent, error) {
+	c.URL.Path = APIVersionPrefix + APIProxyPath
+
+	var state map[string]agent.StateEvent
+	if err := c.get(&state); err != nil {
+		return map[string]agent.StateEvent{}, err
+	}
+
+	return state, nil
+}
+
+func (c client) get(v interface{}) error {
+	req, err := http.NewRequest("GET", c.URL.String(), nil)
+	if err != nil {
+		return fmt.Errorf("problem constructing HTTP request (%s)", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("scheduler unavailable (%s)", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return fmt.Errorf("invalid scheduler response (%s)", err)
+		}
+		return nil
+
+	default:
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP %d (%s)", resp.StatusCode, bytes.TrimSpace(buf))
+	}
+}
+
+// Events implements the Scheduler interface.
+func (c client) Events() (<-chan map[string]agent.StateEvent, agent.Stopper, error) {
+	c.URL.Path = APIVersionPrefix + APIProxyPath
+
+	req, err := http.NewRequest("GET", c.URL.String(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("problem constructing HTTP request (%s)", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("scheduler unavailable (%s)", err)
+	}
+	// Because we're streaming, we close the body in a different way.
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return nil, nil, fmt.Errorf("HTTP %d (%s)", resp.StatusCode, bytes.TrimSpace(buf))
+	}
+
+	var (
+		statec = make(chan map[string]agent.StateEvent)
+		stopc  = make(chan struct{})
+	)
+
+	go func() {
+		<-stopc
+		resp.Body.Close()
+	}()
+
+	go func() {
+		defer close(statec)
+
+		dec := eventsource.NewDecoder(resp.Body)
+
+		for {
+			var event eventsource.Event
+
+			if err := dec.Decode(&event); err != nil {
+				select {
+				case <-stopc:
+				default:
+					log.Printf("%s: decode: %s", c.URL.String(), err)
+				}
+				return
+			}
+
+			var state map[string]agent.StateEvent
+
+			if err := json.Unmarshal(event.Data, &state); err != nil {
+				log.Printf("%s: unmarshal: %s", c.URL.String(), err)
+				continue
+			}
+
+			select {
+			case statec <- state:
+			case <-stopc:
+				return
+			}
+		}
+	}()
+
+	return statec, stopperChan(stopc), nil
+}
+
+// Stream implements the Scheduler interface.
+func (c client) Stream() (<-chan Event, agent.Stopper, error) {
+	c.URL.Path = APIVersionPrefix + APIEventsPath
+
+	req, err := http.NewRequest("GET", c.URL.String(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("problem constructing HTTP request (%s)", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("scheduler unavailable (%s)", err)
+	}
+	// Because we're streaming, we close the body in a different way.
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return nil, nil, fmt.Errorf("HTTP %d (%s)", resp.StatusCode, bytes.TrimSpace(buf))
+	}
+
+	var (
+		eventc = make(chan Event)
+		stopc  = make(chan struct{})
+	)
+
+	go func() {
+		<-stopc
+		resp.Body.Close()
+	}()
+
+	go func() {
+		defer close(eventc)
+
+		dec := eventsource.NewDecoder(resp.Body)
+
+		for {
+			var event eventsource.Event
+
+			if err := dec.Decode(&event); err != nil {
+				select {
+				case <-stopc:
+				default:
+					log.Printf("%s: decode: %s", c.URL.String(), err)
+				}
+				return
+			}
+
+			e := Event{Type: event.Type}
+
+			switch event.Type {
+			case EventTypeDesired:
+				err = json.Unmarshal(event.Data, &e.Desired)
+			case EventTypeActual:
+				err = json.Unmarshal(event.Data, &e.Actual)
+			default:
+				continue // unknown event types are ignored
+			}
+
+			if err != nil {
+				log.Printf("%s: unmarshal: %s", c.URL.String(), err)
+				continue
+			}
+
+			select {
+			case eventc <- e:
+			case <-stopc:
+				return
+			}
+		}
+	}()
+
+	return eventc, stopperChan(stopc), nil
+}
+
+// Wait waits asynchronously until exactly n tasks of the job config exist in
+// the scheduling domain, all with one of the statuses. To wait until all
+// tasks of an unscheduled job config are gone, pass n of 0. It does not wait
+// for its results to be read.
+func (c client) Wait(jobConfigHash string, n int, statuses map[agent.ContainerStatus]struct{}, timeout time.Duration) chan WaitResult {
+	rc := make(chan WaitResult, 1)
+	go func() {
+		tasks, err := c.wait(jobConfigHash, n, statuses, timeout)
+		rc <- WaitResult{Tasks: tasks, Err: err}
+	}()
+	return rc
+}
+
+// wait waits synchronously for n tasks of the job config.
+func (c client) wait(jobConfigHash string, n int, statuses map[agent.ContainerStatus]struct{}, timeout time.Duration) (map[string]agent.ContainerInstance, error) {
+	events, stopper, err := c.Events()
+	if err != nil {
+		return nil, err
+	}
+	defer stopper.Stop()
+
+	timeoutc := time.After(timeout)
+
+	for {
+		select {
+		case state, ok := <-events:
+			if !ok {
+				return nil, fmt.Errorf("event stream closed")
+			}
+
+			tasks := Tasks(state, jobConfigHash)
+			if len(tasks) != n {
+				continue
+			}
+
+			done := true
+			for _, instance := range tasks {
+				if _, ok := statuses[instance.ContainerStatus]; !ok {
+					done = false
+					break
+				}
+			}
+
+			if done {
+				return tasks, nil
+			}
+
+		case <-timeoutc:
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// Tasks returns the tasks of the job config in the actual state of the
+// scheduling domain, indexed by container ID.
+func Tasks(state map[string]agent.StateEvent, jobConfigHash string) map[string]agent.ContainerInstance {
+	tasks := map[string]agent.ContainerInstance{}
+
+	for _, event := range state {
+		for id, instance := range event.Containers {
+			if !strings.HasPrefix(id, jobConfigHash+"-") {
+				continue
+			}
+
+			if _, err := strconv.Atoi(strings.TrimPrefix(id, jobConfigHash+"-")); err != nil {
+				continue
+			}
+
+			tasks[id] = instance
+		}
+	}
+
+	return tasks
+}
+
+type response struct {
+	StatusCode int    `json:"status_code"`
+	Message    string `json:"msg"`
+}
+
+type stopperChan chan struct{}
+
+func (c stopperChan) Stop() { close(c) }
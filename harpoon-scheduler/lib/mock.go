@@ -0,0 +1,290 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bernerdschaefer/eventsource"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+)
+
+// MockAgentEndpoint is the endpoint of the single agent in the scheduling
+// domain of the Mock.
+const MockAgentEndpoint = "http://mock-agent:3333"
+
+// Mock implements an in-memory Scheduler for tests. Scheduled tasks are
+// immediately running on a single agent, and unscheduled tasks are
+// immediately gone.
+type Mock struct {
+	*httprouter.Router
+
+	sync.RWMutex
+	registry    map[string]configstore.JobConfig
+	containers  map[string]agent.ContainerInstance
+	subscribers map[*mockSubscriber]struct{}
+
+	scheduleCount   int32
+	unscheduleCount int32
+	registryCount   int32
+	proxyCount      int32
+	eventsCount     int32
+}
+
+// mockSubscriber only ever holds the most recent desired and actual state.
+type mockSubscriber struct {
+	desiredc chan map[string]configstore.JobConfig
+	actualc  chan map[string]agent.StateEvent
+}
+
+// NewMock returns a new Mock, designed to be passed to httptest.NewServer.
+func NewMock() *Mock {
+	m := &Mock{
+		Router:      httprouter.New(),
+		registry:    map[string]configstore.JobConfig{},
+		containers:  map[string]agent.ContainerInstance{},
+		subscribers: map[*mockSubscriber]struct{}{},
+	}
+
+	m.Router.PUT(APIVersionPrefix+APISchedulePath, m.schedule)
+	m.Router.PUT(APIVersionPrefix+APIUnschedulePath, m.unschedule)
+	m.Router.PUT(APIVersionPrefix+APIUnschedulePath+"/:hash", m.unschedule)
+	m.Router.GET(APIVersionPrefix+APIRegistryPath, m.getRegistry)
+	m.Router.GET(APIVersionPrefix+APIProxyPath, m.getProxy)
+	m.Router.GET(APIVersionPrefix+APIEventsPath, m.getEvents)
+
+	return m
+}
+
+func (m *Mock) subscribe() *mockSubscriber {
+	m.Lock()
+	defer m.Unlock()
+
+	s := &mockSubscriber{
+		desiredc: make(chan map[string]configstore.JobConfig, 1),
+		actualc:  make(chan map[string]agent.StateEvent, 1),
+	}
+
+	m.subscribers[s] = struct{}{}
+	s.desiredc <- m.desired()
+	s.actualc <- m.state()
+
+	return s
+}
+
+func (m *Mock) unsubscribe(s *mockSubscriber) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.subscribers, s)
+}
+
+// desired must be called with the lock held.
+func (m *Mock) desired() map[string]configstore.JobConfig {
+	registry := make(map[string]configstore.JobConfig, len(m.registry))
+
+	for hash, cfg := range m.registry {
+		registry[hash] = cfg
+	}
+
+	return registry
+}
+
+// state must be called with the lock held.
+func (m *Mock) state() map[string]agent.StateEvent {
+	containers := make(map[string]agent.ContainerInstance, len(m.containers))
+
+	for id, instance := range m.containers {
+		containers[id] = instance
+	}
+
+	return map[string]agent.StateEvent{
+		MockAgentEndpoint: agent.StateEvent{Containers: containers},
+	}
+}
+
+// broadcast must be called with the lock held. Subscribers only ever receive
+// the most recent state.
+func (m *Mock) broadcast() {
+	var (
+		desired = m.desired()
+		state   = m.state()
+	)
+
+	for s := range m.subscribers {
+		select {
+		case <-s.desiredc:
+		default:
+		}
+
+		s.desiredc <- desired
+
+		select {
+		case <-s.actualc:
+		default:
+		}
+
+		s.actualc <- state
+	}
+}
+
+func (m *Mock) schedule(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer atomic.AddInt32(&m.scheduleCount, 1)
+
+	if r.URL.Query().Get("ref") != "" {
+		writeResponse(w, http.StatusNotImplemented, "scheduling by reference not supported")
+		return
+	}
+
+	var cfg configstore.JobConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		writeResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := cfg.Valid(); err != nil {
+		writeResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hash := cfg.Hash()
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.registry[hash]; ok {
+		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("%s already scheduled", hash))
+		return
+	}
+
+	m.registry[hash] = cfg
+
+	for i := 0; i < cfg.Scale; i++ {
+		id := fmt.Sprintf("%s-%d", hash, i)
+
+		m.containers[id] = agent.ContainerInstance{
+			ID:              id,
+			ContainerStatus: agent.ContainerStatusRunning,
+			ContainerConfig: cfg.ContainerConfig,
+		}
+	}
+
+	m.broadcast()
+
+	writeResponse(w, http.StatusAccepted, fmt.Sprintf("request to schedule %q (%s) has been accepted", cfg.Job, hash))
+}
+
+func (m *Mock) unschedule(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer atomic.AddInt32(&m.unscheduleCount, 1)
+
+	hash := p.ByName("hash")
+
+	if hash == "" {
+		var cfg configstore.JobConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			writeResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		hash = cfg.Hash()
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.registry[hash]; !ok {
+		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("%s not scheduled", hash))
+		return
+	}
+
+	delete(m.registry, hash)
+
+	for id := range m.containers {
+		if strings.HasPrefix(id, hash+"-") {
+			delete(m.containers, id)
+		}
+	}
+
+	m.broadcast()
+
+	writeResponse(w, http.StatusAccepted, fmt.Sprintf("request to unschedule %s has been accepted", hash))
+}
+
+func (m *Mock) getRegistry(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer atomic.AddInt32(&m.registryCount, 1)
+
+	m.RLock()
+	defer m.RUnlock()
+
+	json.NewEncoder(w).Encode(m.registry)
+}
+
+func (m *Mock) getProxy(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer atomic.AddInt32(&m.proxyCount, 1)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		eventsource.Handler(func(lastID string, enc *eventsource.Encoder, stop <-chan bool) {
+			s := m.subscribe()
+			defer m.unsubscribe(s)
+
+			for {
+				select {
+				case <-stop:
+					log.Printf("mockScheduler getProxy: HTTP request closed")
+					return
+
+				case state := <-s.actualc:
+					buf, _ := json.Marshal(state)
+					enc.Encode(eventsource.Event{Data: buf})
+				}
+			}
+		}).ServeHTTP(w, r)
+		return
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	json.NewEncoder(w).Encode(m.state())
+}
+
+func (m *Mock) getEvents(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer atomic.AddInt32(&m.eventsCount, 1)
+
+	eventsource.Handler(func(lastID string, enc *eventsource.Encoder, stop <-chan bool) {
+		s := m.subscribe()
+		defer m.unsubscribe(s)
+
+		for {
+			select {
+			case <-stop:
+				log.Printf("mockScheduler getEvents: HTTP request closed")
+				return
+
+			case desired := <-s.desiredc:
+				buf, _ := json.Marshal(desired)
+				enc.Encode(eventsource.Event{Type: EventTypeDesired, Data: buf})
+
+			case actual := <-s.actualc:
+				buf, _ := json.Marshal(actual)
+				enc.Encode(eventsource.Event{Type: EventTypeActual, Data: buf})
+			}
+		}
+	}).ServeHTTP(w, r)
+}
+
+func writeResponse(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response{
+		StatusCode: code,
+		Message:    msg,
+	})
+}
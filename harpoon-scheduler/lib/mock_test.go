@@ -0,0 +1,191 @@
+package scheduler
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+)
+
+func TestMockScheduler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		m = NewMock()
+		s = httptest.NewServer(m)
+	)
+
+	defer s.Close()
+
+	for _, tuple := range []struct {
+		method, path string
+		count        *int32
+	}{
+		{"PUT", APIVersionPrefix + APISchedulePath, &m.scheduleCount},
+		{"PUT", APIVersionPrefix + APIUnschedulePath, &m.unscheduleCount},
+		{"PUT", APIVersionPrefix + APIUnschedulePath + "/foobar", &m.unscheduleCount},
+		{"GET", APIVersionPrefix + APIRegistryPath, &m.registryCount},
+		{"GET", APIVersionPrefix + APIProxyPath, &m.proxyCount},
+	} {
+		method, path, count := tuple.method, tuple.path, tuple.count
+		pre := atomic.LoadInt32(count)
+
+		req, err := http.NewRequest(method, s.URL+path, nil)
+		if err != nil {
+			t.Errorf("%s %s: %s", method, path, err)
+			continue
+		}
+
+		if _, err = http.DefaultClient.Do(req); err != nil {
+			t.Errorf("%s %s: %s", method, path, err)
+			continue
+		}
+
+		post := atomic.LoadInt32(count)
+
+		if delta := post - pre; delta != 1 {
+			t.Errorf("%s %s: handler didn't get called (pre-count %d, post-count %d)", method, path, pre, post)
+		}
+	}
+}
+
+func TestClientScheduleUnschedule(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		s      = httptest.NewServer(NewMock())
+		client = MustNewClient(s.URL)
+		cfg    = configstore.JobConfig{
+			Scale: 2,
+			ContainerConfig: agent.ContainerConfig{
+				Product:     "product",
+				Environment: "testing",
+				Job:         "web",
+				Command:     agent.Command{WorkingDir: "/", Exec: []string{"./run"}},
+				Resources:   agent.Resources{CPU: 0.1, Mem: 64},
+				Grace: agent.Grace{
+					Startup:  agent.JSONDuration{Duration: time.Second},
+					Shutdown: agent.JSONDuration{Duration: time.Second},
+				},
+				Restart: agent.NoRestart,
+			},
+		}
+		running = map[agent.ContainerStatus]struct{}{agent.ContainerStatusRunning: struct{}{}}
+	)
+
+	defer s.Close()
+
+	waitc := client.Wait(cfg.Hash(), cfg.Scale, running, time.Second)
+
+	hash, err := client.Schedule(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := cfg.Hash(), hash; want != have {
+		t.Errorf("want hash %s, have %s", want, have)
+	}
+
+	if result := <-waitc; result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	if _, err := client.Schedule(cfg); err == nil {
+		t.Errorf("scheduling twice: want error, have none")
+	}
+
+	registry, err := client.Registry()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := registry[hash]; !ok {
+		t.Errorf("%s not in registry", hash)
+	}
+
+	state, err := client.Proxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := cfg.Scale, len(Tasks(state, hash)); want != have {
+		t.Errorf("want %d task(s), have %d", want, have)
+	}
+
+	if err := client.UnscheduleHash(hash); err != nil {
+		t.Fatal(err)
+	}
+
+	if result := <-client.Wait(hash, 0, nil, time.Second); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	if _, err := client.Unschedule(cfg); err == nil {
+		t.Errorf("unscheduling twice: want error, have none")
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		s      = httptest.NewServer(NewMock())
+		client = MustNewClient(s.URL)
+		cfg    = configstore.JobConfig{
+			Scale: 1,
+			ContainerConfig: agent.ContainerConfig{
+				Product:     "product",
+				Environment: "testing",
+				Job:         "web",
+				Command:     agent.Command{WorkingDir: "/", Exec: []string{"./run"}},
+				Resources:   agent.Resources{CPU: 0.1, Mem: 64},
+				Grace: agent.Grace{
+					Startup:  agent.JSONDuration{Duration: time.Second},
+					Shutdown: agent.JSONDuration{Duration: time.Second},
+				},
+				Restart: agent.NoRestart,
+			},
+		}
+	)
+
+	defer s.Close()
+
+	events, stopper, err := client.Stream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopper.Stop()
+
+	if _, err := client.Schedule(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		timeout = time.After(time.Second)
+		desired bool
+		actual  bool
+	)
+
+	for !desired || !actual {
+		select {
+		case e := <-events:
+			switch e.Type {
+			case EventTypeDesired:
+				_, desired = e.Desired[cfg.Hash()]
+			case EventTypeActual:
+				actual = len(Tasks(e.Actual, cfg.Hash())) == cfg.Scale
+			default:
+				t.Fatalf("unexpected event type %q", e.Type)
+			}
+
+		case <-timeout:
+			t.Fatalf("timeout waiting for events (desired %v, actual %v)", desired, actual)
+		}
+	}
+}
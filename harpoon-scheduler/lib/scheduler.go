@@ -0,0 +1,49 @@
+// Package scheduler provides a client for the scheduler API, and an
+// in-process mock scheduler for tests.
+package scheduler
+
+import (
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+)
+
+// Scheduler describes the scheduler API.
+type Scheduler interface {
+	Endpoint() string
+	Schedule(configstore.JobConfig) (jobConfigHash string, err error)                                                     // PUT /schedule
+	ScheduleRef(ref string) error                                                                                         // PUT /schedule?ref={ref}
+	Unschedule(configstore.JobConfig) (jobConfigHash string, err error)                                                   // PUT /unschedule
+	UnscheduleHash(jobConfigHash string) error                                                                            // PUT /unschedule/{hash}
+	Registry() (map[string]configstore.JobConfig, error)                                                                  // GET /registry
+	Proxy() (map[string]agent.StateEvent, error)                                                                          // GET /proxy
+	Events() (<-chan map[string]agent.StateEvent, agent.Stopper, error)                                                   // GET /proxy with request header Accept: text/event-stream
+	Stream() (<-chan Event, agent.Stopper, error)                                                                         // GET /events with request header Accept: text/event-stream
+	Wait(jobConfigHash string, n int, statuses map[agent.ContainerStatus]struct{}, timeout time.Duration) chan WaitResult // Waits asynchronously for n tasks with one of the statuses
+}
+
+// WaitResult carries the result of a client.Wait() call.
+type WaitResult struct {
+	Tasks map[string]agent.ContainerInstance // by container ID
+	Err   error
+}
+
+const (
+	// EventTypeDesired is the type of events carrying the desired state of
+	// the scheduling domain.
+	EventTypeDesired = "desired"
+
+	// EventTypeActual is the type of events carrying the actual state of the
+	// scheduling domain.
+	EventTypeActual = "actual"
+)
+
+// Event is emitted by the scheduler event stream whenever the desired or the
+// actual state of the scheduling domain changes. Each event carries the
+// complete state of one kind, according to its type.
+type Event struct {
+	Type    string                           // EventTypeDesired or EventTypeActual
+	Desired map[string]configstore.JobConfig // job configs by hash, for desired events
+	Actual  map[string]agent.StateEvent      // agent states by endpoint, for actual events
+}
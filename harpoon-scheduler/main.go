@@ -12,8 +12,10 @@ import (
 	"syscall"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
 	"github.com/soundcloud/harpoon/harpoon-scheduler/agentrepr"
 	"github.com/soundcloud/harpoon/harpoon-scheduler/api"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/migrate"
 	"github.com/soundcloud/harpoon/harpoon-scheduler/registry"
 	"github.com/soundcloud/harpoon/harpoon-scheduler/reprproxy"
 	"github.com/soundcloud/harpoon/harpoon-scheduler/xf"
@@ -40,6 +42,7 @@ func main() {
 		listen  = flag.String("listen", ":4444", "HTTP listen address")
 		version = flag.Bool("version", false, "print version")
 		persist = flag.String("persist", "scheduler-registry.json", "filename to persist registry state")
+		store   = flag.String("configstore", "", "config store endpoint, to schedule jobs by reference (optional)")
 		agents  = multiagent{}
 	)
 	flag.Var(&agents, "agent", "repeatable list of agent endpoints")
@@ -53,11 +56,27 @@ func main() {
 	if *debug {
 		agentrepr.Debugf = log.Printf
 		xf.Debugf = log.Printf
+		migrate.Debugf = log.Printf
 		reprproxy.Debugf = log.Printf
 	}
 
 	log.Printf("%d agent(s)", len(agents.slice()))
 
+	var c configstore.ConfigStore
+	if *store != "" {
+		if !strings.HasPrefix(strings.ToLower(*store), "http") {
+			*store = "http://" + *store
+		}
+
+		client, err := configstore.NewClient(*store)
+		if err != nil {
+			log.Fatalf("invalid config store endpoint: %s", err)
+		}
+
+		log.Printf("config store: %s", client.Endpoint())
+		c = client
+	}
+
 	var (
 		r = registry.New(*persist)
 		d = reprproxy.StaticAgentDiscovery(agents.slice())
@@ -66,9 +85,10 @@ func main() {
 	)
 
 	go xf.Transform(r, p, p)
+	go migrate.Drive(r, p)
 
 	http.Handle("/metrics", api.Log(w, prometheus.Handler()))
-	http.Handle("/api/v0/", api.Log(w, api.NewHandler(p, r)))
+	http.Handle("/api/v0/", api.Log(w, api.NewHandler(p, r, c)))
 	http.Handle("/favicon.ico", http.NotFoundHandler())
 	http.Handle("/", http.RedirectHandler("/api/v0/snapshot/", http.StatusTemporaryRedirect))
 
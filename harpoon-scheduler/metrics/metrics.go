@@ -16,6 +16,8 @@ import (
 var (
 	expvarJobScheduleRequests         = expvar.NewInt("job_schedule_requests")
 	expvarJobUnscheduleRequests       = expvar.NewInt("job_unschedule_requests")
+	expvarJobMigrateRequests          = expvar.NewInt("job_migrate_requests")
+	expvarMigrationsCompleted         = expvar.NewInt("migrations_completed")
 	expvarTransformsExecuted          = expvar.NewInt("transforms_executed")
 	expvarTransformsSkipped           = expvar.NewInt("transforms_skipped")
 	expvarTransactionsCreated         = expvar.NewInt("transactions_created")
@@ -43,6 +45,18 @@ var (
 		Name:      "job_unschedule_requests",
 		Help:      "Number of job unschedule requests received by the scheduler.",
 	})
+	prometheusJobMigrateRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "job_migrate_requests",
+		Help:      "Number of job migrate requests received by the scheduler.",
+	})
+	prometheusMigrationsCompleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "migrations_completed",
+		Help:      "Number of job migrations that replaced all tasks of the old job.",
+	})
 	prometheusTransformsExecuted = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "harpoon",
 		Subsystem: "scheduler",
@@ -131,6 +145,20 @@ func IncJobUnscheduleRequests(n int) {
 	prometheusJobUnscheduleRequests.Add(float64(n))
 }
 
+// IncJobMigrateRequests increments the number of requests to migrate a job
+// to a new configuration.
+func IncJobMigrateRequests(n int) {
+	expvarJobMigrateRequests.Add(int64(n))
+	prometheusJobMigrateRequests.Add(float64(n))
+}
+
+// IncMigrationsCompleted increments the number of job migrations that
+// completed successfully.
+func IncMigrationsCompleted(n int) {
+	expvarMigrationsCompleted.Add(int64(n))
+	prometheusMigrationsCompleted.Add(float64(n))
+}
+
 // IncTransformsExecuted increments the number of transforms executed.
 func IncTransformsExecuted(n int) {
 	expvarTransformsExecuted.Add(int64(n))
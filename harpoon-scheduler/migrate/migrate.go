@@ -0,0 +1,162 @@
+// Package migrate drives the rolling migrations recorded in the registry, by
+// gradually shifting the desired scale from the old to the new job config as
+// the actual state of the scheduling domain allows.
+package migrate
+
+import (
+	"log"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/metrics"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/registry"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/xf"
+)
+
+var (
+	// Debugf may be set from a controlling package.
+	Debugf = func(string, ...interface{}) {}
+
+	// tickInterval is how often migrations are advanced, absent an actual
+	// state change.
+	tickInterval = 3 * time.Second
+)
+
+// Migrator records the progress of migrations.
+type Migrator interface {
+	Migrations() map[string]registry.Migration
+	ScaleMigration(job string, fromScale, toScale int) error
+	CompleteMigration(job string) error
+}
+
+// Drive continuously monitors the actual state of the scheduling domain, and
+// advances all running migrations. It never returns.
+//
+// All progress is recorded by the migrator, so migrations are resumed from
+// where they left off if the scheduler restarts.
+func Drive(target Migrator, actual xf.ActualBroadcaster) {
+	var (
+		actualc = make(chan map[string]agent.StateEvent)
+		have    = map[string]agent.StateEvent{}
+		tick    = time.Tick(tickInterval)
+	)
+
+	actual.Subscribe(actualc)
+	defer actual.Unsubscribe(actualc)
+
+	for {
+		select {
+		case have = <-actualc:
+			Debugf("actual state change")
+		case <-tick:
+			Debugf("tick")
+		}
+
+		advance(target, have)
+	}
+}
+
+// advance moves every running migration one step forward.
+func advance(target Migrator, have map[string]agent.StateEvent) {
+	available := availableTasks(have)
+
+	for job, m := range target.Migrations() {
+		if m.State != registry.MigrationStateRunning {
+			continue
+		}
+
+		fromScale, toScale, done := step(m, available)
+
+		if fromScale != m.FromScale || toScale != m.ToScale {
+			if err := target.ScaleMigration(job, fromScale, toScale); err != nil {
+				log.Printf("migrate %s: %s", job, err)
+				continue
+			}
+
+			log.Printf(
+				"migrate %s: %s %d -> %d, %s %d -> %d",
+				job,
+				m.From, m.FromScale, fromScale,
+				m.To.Hash(), m.ToScale, toScale,
+			)
+		}
+
+		if done {
+			if err := target.CompleteMigration(job); err != nil {
+				log.Printf("migrate %s: %s", job, err)
+				continue
+			}
+
+			metrics.IncMigrationsCompleted(1)
+			log.Printf("migrate %s: complete (from %s to %s)", job, m.From, m.To.Hash())
+		}
+	}
+}
+
+// step computes the next desired scales of the old (from) and new (to) job
+// configs of a migration, given the set of available tasks in the scheduling
+// domain. Old tasks are removed as long as at least the target scale less
+// max unavailable tasks remain available, and new tasks are added as long as
+// no more than the target scale plus max surge tasks are desired. done is
+// true once the old job config is scaled to zero, and all new tasks are
+// available.
+func step(m registry.Migration, available map[string]struct{}) (fromScale, toScale int, done bool) {
+	var (
+		target       = m.To.Scale
+		minAvailable = target - m.MaxUnavailable
+		maxDesired   = target + m.MaxSurge
+		toAvailable  = count(available, m.To.Hash(), m.ToScale)
+	)
+
+	fromScale, toScale = m.FromScale, m.ToScale
+
+	// Tasks with the highest indices are removed first.
+	for fromScale > 0 && count(available, m.From, fromScale-1)+toAvailable >= minAvailable {
+		fromScale--
+	}
+
+	if n := maxDesired - fromScale; n > toScale {
+		toScale = n
+	}
+
+	if toScale > target {
+		toScale = target
+	}
+
+	done = fromScale == 0 && toScale == target && toAvailable == target
+
+	return fromScale, toScale, done
+}
+
+// count returns the number of available tasks of the job config hash, among
+// its first scale tasks.
+func count(available map[string]struct{}, hash string, scale int) (n int) {
+	for i := 0; i < scale; i++ {
+		if _, ok := available[xf.MakeContainerID(hash, i)]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// availableTasks returns the IDs of all tasks in the scheduling domain that
+// are running and, if they declare health checks, healthy.
+func availableTasks(have map[string]agent.StateEvent) map[string]struct{} {
+	available := map[string]struct{}{}
+
+	for _, state := range have {
+		for id, instance := range state.Containers {
+			if instance.ContainerStatus != agent.ContainerStatusRunning || !instance.Up {
+				continue
+			}
+
+			if len(instance.HealthChecks) > 0 && instance.HealthStatus != agent.HealthStatusHealthy {
+				continue
+			}
+
+			available[id] = struct{}{}
+		}
+	}
+
+	return available
+}
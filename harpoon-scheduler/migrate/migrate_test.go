@@ -0,0 +1,129 @@
+package migrate
+
+import (
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/registry"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/xf"
+)
+
+func TestStep(t *testing.T) {
+	var (
+		from = configstore.JobConfig{Scale: 3, ContainerConfig: agent.ContainerConfig{Job: "a", ArtifactURL: "old"}}
+		to   = configstore.JobConfig{Scale: 3, ContainerConfig: agent.ContainerConfig{Job: "a", ArtifactURL: "new"}}
+	)
+
+	for i, tc := range []struct {
+		maxSurge, maxUnavailable int
+	}{
+		{1, 0},
+		{0, 1},
+		{2, 2},
+		{5, 0},
+	} {
+		var (
+			m = registry.Migration{
+				From:           from.Hash(),
+				To:             to,
+				MaxSurge:       tc.maxSurge,
+				MaxUnavailable: tc.maxUnavailable,
+				FromScale:      from.Scale,
+			}
+			done  bool
+			steps int
+		)
+
+		for !done {
+			if steps++; steps > 10 {
+				t.Fatalf("%d: migration never completed", i)
+			}
+
+			// Every desired task becomes available between steps.
+			available := tasks(from.Hash(), m.FromScale)
+			for id := range tasks(to.Hash(), m.ToScale) {
+				available[id] = struct{}{}
+			}
+
+			if desired := m.FromScale + m.ToScale; desired > to.Scale+tc.maxSurge {
+				t.Errorf("%d: %d tasks desired, exceeding max surge %d", i, desired, tc.maxSurge)
+			}
+
+			if len(available) < to.Scale-tc.maxUnavailable {
+				t.Errorf("%d: %d tasks available, exceeding max unavailable %d", i, len(available), tc.maxUnavailable)
+			}
+
+			m.FromScale, m.ToScale, done = step(m, available)
+		}
+
+		if want, have := 0, m.FromScale; want != have {
+			t.Errorf("%d: want old scale %d, have %d", i, want, have)
+		}
+
+		if want, have := to.Scale, m.ToScale; want != have {
+			t.Errorf("%d: want new scale %d, have %d", i, want, have)
+		}
+	}
+}
+
+func TestStepWaitsForAvailableTasks(t *testing.T) {
+	var (
+		from = configstore.JobConfig{Scale: 2, ContainerConfig: agent.ContainerConfig{Job: "a", ArtifactURL: "old"}}
+		to   = configstore.JobConfig{Scale: 2, ContainerConfig: agent.ContainerConfig{Job: "a", ArtifactURL: "new"}}
+		m    = registry.Migration{
+			From:      from.Hash(),
+			To:        to,
+			MaxSurge:  1,
+			FromScale: 2,
+			ToScale:   1,
+		}
+	)
+
+	// The new task isn't available yet, so nothing may change.
+	fromScale, toScale, done := step(m, tasks(from.Hash(), 2))
+
+	if fromScale != 2 || toScale != 1 || done {
+		t.Errorf("want (2, 1, false), have (%d, %d, %v)", fromScale, toScale, done)
+	}
+}
+
+func TestAvailableTasks(t *testing.T) {
+	var (
+		up        = agent.ContainerProcessState{Up: true}
+		unhealthy = agent.ContainerInstance{
+			ContainerStatus:       agent.ContainerStatusRunning,
+			ContainerConfig:       agent.ContainerConfig{HealthChecks: []agent.HealthCheck{{}}},
+			ContainerHealth:       agent.ContainerHealth{HealthStatus: agent.HealthStatusUnhealthy},
+			ContainerProcessState: up,
+		}
+		have = map[string]agent.StateEvent{
+			"agent": agent.StateEvent{
+				Containers: map[string]agent.ContainerInstance{
+					"running":   {ContainerStatus: agent.ContainerStatusRunning, ContainerProcessState: up},
+					"down":      {ContainerStatus: agent.ContainerStatusRunning},
+					"created":   {ContainerStatus: agent.ContainerStatusCreated},
+					"unhealthy": unhealthy,
+				},
+			},
+		}
+	)
+
+	available := availableTasks(have)
+
+	if want, have := 1, len(available); want != have {
+		t.Fatalf("want %d available task(s), have %d (%v)", want, have, available)
+	}
+
+	if _, ok := available["running"]; !ok {
+		t.Errorf("running task not available")
+	}
+}
+
+func tasks(hash string, scale int) map[string]struct{} {
+	m := map[string]struct{}{}
+	for i := 0; i < scale; i++ {
+		m[xf.MakeContainerID(hash, i)] = struct{}{}
+	}
+	return m
+}
@@ -0,0 +1,42 @@
+package registry
+
+import (
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+)
+
+// Migration records the rolling replacement of the tasks of one scheduled job
+// config by the tasks of another config of the same job. While a migration is
+// running, the registry reports both job configs with the desired scales
+// recorded here, rather than the scales they were scheduled with.
+type Migration struct {
+	From           string                `json:"from"` // hash of the job config being replaced
+	To             configstore.JobConfig `json:"to"`
+	MaxSurge       int                   `json:"max_surge"`       // tasks above the target scale
+	MaxUnavailable int                   `json:"max_unavailable"` // tasks below the target scale
+	FromScale      int                   `json:"from_scale"`      // current desired scale of From
+	ToScale        int                   `json:"to_scale"`        // current desired scale of To
+	State          MigrationState        `json:"state"`
+	Started        time.Time             `json:"started"`
+	Updated        time.Time             `json:"updated"`
+}
+
+// MigrationState describes the progress of a migration.
+type MigrationState string
+
+const (
+	// MigrationStateRunning is the state of a migration that's replacing
+	// tasks.
+	MigrationStateRunning MigrationState = "running"
+
+	// MigrationStateComplete is the state of a migration whose old job config
+	// has been unscheduled, after all tasks of the new job config became
+	// available.
+	MigrationStateComplete MigrationState = "complete"
+
+	// MigrationStateAborted is the state of a migration whose new job config
+	// has been unscheduled before the migration completed. The old job config
+	// is restored to the scale it was scheduled with.
+	MigrationStateAborted MigrationState = "aborted"
+)
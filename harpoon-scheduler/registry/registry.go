@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
 	"github.com/soundcloud/harpoon/harpoon-scheduler/metrics"
@@ -17,32 +18,44 @@ import (
 // storage. It also broadcasts all updates to any subscribers who care to
 // listen.
 type Registry struct {
-	subc      chan chan<- map[string]configstore.JobConfig
-	unsubc    chan chan<- map[string]configstore.JobConfig
-	schedc    chan scheduleRequest
-	unschedc  chan unscheduleRequest
-	snapshotc chan map[string]configstore.JobConfig
-	quitc     chan chan struct{}
+	subc        chan chan<- map[string]configstore.JobConfig
+	unsubc      chan chan<- map[string]configstore.JobConfig
+	schedc      chan scheduleRequest
+	unschedc    chan unscheduleRequest
+	migratec    chan migrateRequest
+	scalec      chan scaleMigrationRequest
+	completec   chan completeMigrationRequest
+	abortc      chan abortMigrationRequest
+	snapshotc   chan map[string]configstore.JobConfig
+	migrationsc chan map[string]Migration
+	refsc       chan map[string]string
+	quitc       chan chan struct{}
 }
 
 // New constructs a new Registry. It will restore state from the passed
 // filename, if it exists, and persist all mutations there.
 func New(filename string) *Registry {
-	scheduled, err := load(filename)
+	s, err := load(filename)
 	if err != nil {
 		panic(err)
 	}
 
 	r := &Registry{
-		subc:      make(chan chan<- map[string]configstore.JobConfig),
-		unsubc:    make(chan chan<- map[string]configstore.JobConfig),
-		schedc:    make(chan scheduleRequest),
-		unschedc:  make(chan unscheduleRequest),
-		snapshotc: make(chan map[string]configstore.JobConfig),
-		quitc:     make(chan chan struct{}),
+		subc:        make(chan chan<- map[string]configstore.JobConfig),
+		unsubc:      make(chan chan<- map[string]configstore.JobConfig),
+		schedc:      make(chan scheduleRequest),
+		unschedc:    make(chan unscheduleRequest),
+		migratec:    make(chan migrateRequest),
+		scalec:      make(chan scaleMigrationRequest),
+		completec:   make(chan completeMigrationRequest),
+		abortc:      make(chan abortMigrationRequest),
+		snapshotc:   make(chan map[string]configstore.JobConfig),
+		migrationsc: make(chan map[string]Migration),
+		refsc:       make(chan map[string]string),
+		quitc:       make(chan chan struct{}),
 	}
 
-	go r.loop(filename, scheduled)
+	go r.loop(filename, s)
 
 	return r
 }
@@ -67,6 +80,18 @@ func (r *Registry) Schedule(c configstore.JobConfig) error {
 	return <-req.err
 }
 
+// ScheduleRef implements api.JobRefScheduler. It schedules the job config,
+// and records the config store reference it was fetched from.
+func (r *Registry) ScheduleRef(ref string, c configstore.JobConfig) error {
+	req := scheduleRequest{
+		JobConfig: c,
+		ref:       ref,
+		err:       make(chan error),
+	}
+	r.schedc <- req
+	return <-req.err
+}
+
 // Unschedule implements api.JobScheduler.
 func (r *Registry) Unschedule(jobConfigHash string) error {
 	req := unscheduleRequest{
@@ -77,11 +102,78 @@ func (r *Registry) Unschedule(jobConfigHash string) error {
 	return <-req.err
 }
 
-// Snapshot implements api.JobScheduler.
+// Migrate implements api.JobMigrator. It schedules the new job config with
+// a scale of zero, and records a migration from the old job config, which
+// must be scheduled. The migration is driven by calls to ScaleMigration and
+// CompleteMigration.
+func (r *Registry) Migrate(from string, to configstore.JobConfig, maxSurge, maxUnavailable int) error {
+	req := migrateRequest{
+		from:           from,
+		to:             to,
+		maxSurge:       maxSurge,
+		maxUnavailable: maxUnavailable,
+		err:            make(chan error),
+	}
+	r.migratec <- req
+	return <-req.err
+}
+
+// ScaleMigration sets the desired scales of the old and new job configs of
+// the pending migration of job.
+func (r *Registry) ScaleMigration(job string, fromScale, toScale int) error {
+	req := scaleMigrationRequest{
+		job:       job,
+		fromScale: fromScale,
+		toScale:   toScale,
+		err:       make(chan error),
+	}
+	r.scalec <- req
+	return <-req.err
+}
+
+// CompleteMigration unschedules the old job config of the pending migration
+// of job, and marks the migration as complete.
+func (r *Registry) CompleteMigration(job string) error {
+	req := completeMigrationRequest{
+		job: job,
+		err: make(chan error),
+	}
+	r.completec <- req
+	return <-req.err
+}
+
+// AbortMigration implements api.JobMigrator. It unschedules the new job
+// config of the pending migration of job, and marks the migration as aborted.
+// The old job config is restored to the scale it was scheduled with.
+func (r *Registry) AbortMigration(job string) error {
+	req := abortMigrationRequest{
+		job: job,
+		err: make(chan error),
+	}
+	r.abortc <- req
+	return <-req.err
+}
+
+// Snapshot implements api.JobScheduler. Job configs that take part in a
+// pending migration are reported with their current desired scale. Keys are
+// always the hash of the job config as it was scheduled.
 func (r *Registry) Snapshot() map[string]configstore.JobConfig {
 	return <-r.snapshotc
 }
 
+// Migrations implements api.JobMigrator. It returns the most recent migration
+// of every job, indexed by job name.
+func (r *Registry) Migrations() map[string]Migration {
+	return <-r.migrationsc
+}
+
+// Refs implements api.JobRefScheduler. It returns the config store reference
+// of every job config that was scheduled by reference, indexed by the hash of
+// the job config.
+func (r *Registry) Refs() map[string]string {
+	return <-r.refsc
+}
+
 // Quit terminates the Registry.
 func (r *Registry) Quit() {
 	q := make(chan struct{})
@@ -89,9 +181,12 @@ func (r *Registry) Quit() {
 	<-q
 }
 
-func (r *Registry) loop(filename string, scheduled map[string]configstore.JobConfig) {
+func (r *Registry) loop(filename string, s state) {
 	var (
-		subs = map[chan<- map[string]configstore.JobConfig]struct{}{}
+		scheduled  = s.Scheduled
+		migrations = s.Migrations
+		refs       = s.Refs
+		subs       = map[chan<- map[string]configstore.JobConfig]struct{}{}
 	)
 
 	cp := func() map[string]configstore.JobConfig {
@@ -101,33 +196,221 @@ func (r *Registry) loop(filename string, scheduled map[string]configstore.JobCon
 			out[id] = spec
 		}
 
+		// Pending migrations override the scale of their job configs.
+		for _, m := range migrations {
+			if m.State != MigrationStateRunning {
+				continue
+			}
+
+			if c, ok := out[m.From]; ok {
+				c.Scale = m.FromScale
+				out[m.From] = c
+			}
+
+			if c, ok := out[m.To.Hash()]; ok {
+				c.Scale = m.ToScale
+				out[m.To.Hash()] = c
+			}
+		}
+
 		return out
 	}
 
-	schedule := func(config configstore.JobConfig) error {
-		hash := config.Hash()
+	cpMigrations := func() map[string]Migration {
+		out := make(map[string]Migration, len(migrations))
+
+		for job, m := range migrations {
+			out[job] = m
+		}
+
+		return out
+	}
+
+	cpRefs := func() map[string]string {
+		out := make(map[string]string, len(refs))
+
+		for hash, ref := range refs {
+			out[hash] = ref
+		}
+
+		return out
+	}
+
+	migrating := func(hash string) bool {
+		for _, m := range migrations {
+			if m.State == MigrationStateRunning && (m.From == hash || m.To.Hash() == hash) {
+				return true
+			}
+		}
+
+		return false
+	}
 
+	// lookup returns the key under which the job config with the given hash
+	// is scheduled. Job configs persisted before hashes were made stable
+	// remain scheduled under their legacy hash, so that their tasks keep
+	// running undisturbed, but may be addressed by either hash.
+	lookup := func(hash string) (string, bool) {
 		if _, ok := scheduled[hash]; ok {
-			return fmt.Errorf("%s already scheduled", hash)
+			return hash, true
+		}
+
+		if configstore.IsLegacyHash(hash) {
+			return "", false
+		}
+
+		for key, config := range scheduled {
+			if configstore.IsLegacyHash(key) && config.Hash() == hash {
+				return key, true
+			}
+		}
+
+		return "", false
+	}
+
+	schedule := func(config configstore.JobConfig, ref string) error {
+		hash := config.Hash()
+
+		if key, ok := lookup(hash); ok {
+			return fmt.Errorf("%s already scheduled (as %s)", hash, key)
 		}
 
 		scheduled[hash] = config
 
+		if ref != "" {
+			refs[hash] = ref
+		}
+
 		return nil
 	}
 
+	remove := func(hash string) {
+		delete(scheduled, hash)
+		delete(refs, hash)
+	}
+
 	unschedule := func(hash string) error {
-		if _, ok := scheduled[hash]; !ok {
+		key, ok := lookup(hash)
+		if !ok {
 			return fmt.Errorf("%s not scheduled", hash)
 		}
 
-		delete(scheduled, hash)
+		if migrating(key) {
+			return fmt.Errorf("%s is being migrated", key)
+		}
+
+		remove(key)
+
+		return nil
+	}
+
+	migrate := func(req migrateRequest) error {
+		fromKey, ok := lookup(req.from)
+		if !ok {
+			return fmt.Errorf("%s not scheduled", req.from)
+		}
+
+		from := scheduled[fromKey]
+
+		if from.Job != req.to.Job {
+			return fmt.Errorf("can't migrate different jobs (from %q to %q)", from.Job, req.to.Job)
+		}
+
+		if m, ok := migrations[req.to.Job]; ok && m.State == MigrationStateRunning {
+			return fmt.Errorf("%s is already being migrated (from %s to %s)", req.to.Job, m.From, m.To.Hash())
+		}
+
+		if req.maxSurge < 0 || req.maxUnavailable < 0 {
+			return fmt.Errorf("max surge (%d) and max unavailable (%d) may not be negative", req.maxSurge, req.maxUnavailable)
+		}
+
+		if req.maxSurge == 0 && req.maxUnavailable == 0 {
+			return fmt.Errorf("max surge and max unavailable may not both be zero")
+		}
+
+		// Migrating a job config scheduled under its legacy hash to the same
+		// config moves its tasks to the stable hash.
+		if toKey, ok := lookup(req.to.Hash()); ok && toKey == fromKey && toKey != req.to.Hash() {
+			scheduled[req.to.Hash()] = req.to
+		} else if err := schedule(req.to, ""); err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		migrations[req.to.Job] = Migration{
+			From:           fromKey,
+			To:             req.to,
+			MaxSurge:       req.maxSurge,
+			MaxUnavailable: req.maxUnavailable,
+			FromScale:      from.Scale,
+			ToScale:        0,
+			State:          MigrationStateRunning,
+			Started:        now,
+			Updated:        now,
+		}
+
+		return nil
+	}
+
+	scaleMigration := func(req scaleMigrationRequest) error {
+		m, ok := migrations[req.job]
+		if !ok || m.State != MigrationStateRunning {
+			return fmt.Errorf("%s not being migrated", req.job)
+		}
+
+		if req.fromScale < 0 || req.fromScale > scheduled[m.From].Scale {
+			return fmt.Errorf("scale %d of %s out of range", req.fromScale, m.From)
+		}
+
+		if req.toScale < 0 || req.toScale > m.To.Scale {
+			return fmt.Errorf("scale %d of %s out of range", req.toScale, m.To.Hash())
+		}
+
+		m.FromScale, m.ToScale, m.Updated = req.fromScale, req.toScale, time.Now()
+		migrations[req.job] = m
+
+		return nil
+	}
+
+	completeMigration := func(req completeMigrationRequest) error {
+		m, ok := migrations[req.job]
+		if !ok || m.State != MigrationStateRunning {
+			return fmt.Errorf("%s not being migrated", req.job)
+		}
+
+		if m.FromScale != 0 || m.ToScale != m.To.Scale {
+			return fmt.Errorf("%s: migration not finished (scale %d of %s, %d/%d of %s)", req.job, m.FromScale, m.From, m.ToScale, m.To.Scale, m.To.Hash())
+		}
+
+		remove(m.From)
+
+		m.State, m.Updated = MigrationStateComplete, time.Now()
+		migrations[req.job] = m
+
+		return nil
+	}
+
+	abortMigration := func(req abortMigrationRequest) error {
+		m, ok := migrations[req.job]
+		if !ok || m.State != MigrationStateRunning {
+			return fmt.Errorf("%s not being migrated", req.job)
+		}
+
+		remove(m.To.Hash())
+
+		m.State, m.Updated = MigrationStateAborted, time.Now()
+		migrations[req.job] = m
 
 		return nil
 	}
 
 	persist := func() {
-		if err := save(filename, scheduled); err != nil {
+		if err := save(filename, state{
+			Scheduled:  scheduled,
+			Migrations: migrations,
+			Refs:       refs,
+		}); err != nil {
 			panic(err) // TODO(pb): remove this before going live :)
 		}
 	}
@@ -151,7 +434,7 @@ func (r *Registry) loop(filename string, scheduled map[string]configstore.JobCon
 		case req := <-r.schedc:
 			metrics.IncJobScheduleRequests(1)
 
-			err := schedule(req.JobConfig)
+			err := schedule(req.JobConfig, req.ref)
 			if err == nil {
 				persist()
 				broadcast()
@@ -170,8 +453,50 @@ func (r *Registry) loop(filename string, scheduled map[string]configstore.JobCon
 
 			req.err <- err
 
+		case req := <-r.migratec:
+			metrics.IncJobMigrateRequests(1)
+
+			err := migrate(req)
+			if err == nil {
+				persist()
+				broadcast()
+			}
+
+			req.err <- err
+
+		case req := <-r.scalec:
+			err := scaleMigration(req)
+			if err == nil {
+				persist()
+				broadcast()
+			}
+
+			req.err <- err
+
+		case req := <-r.completec:
+			err := completeMigration(req)
+			if err == nil {
+				persist()
+				broadcast()
+			}
+
+			req.err <- err
+
+		case req := <-r.abortc:
+			err := abortMigration(req)
+			if err == nil {
+				persist()
+				broadcast()
+			}
+
+			req.err <- err
+
 		case r.snapshotc <- cp():
 
+		case r.migrationsc <- cpMigrations():
+
+		case r.refsc <- cpRefs():
+
 		case q := <-r.quitc:
 			close(q)
 			return
@@ -179,7 +504,14 @@ func (r *Registry) loop(filename string, scheduled map[string]configstore.JobCon
 	}
 }
 
-func save(filename string, scheduled map[string]configstore.JobConfig) (res error) {
+// state is the persisted form of the registry.
+type state struct {
+	Scheduled  map[string]configstore.JobConfig `json:"scheduled"`
+	Migrations map[string]Migration             `json:"migrations"`
+	Refs       map[string]string                `json:"refs"` // config store references by hash
+}
+
+func save(filename string, s state) (res error) {
 	if filename == "" {
 		return nil // no file (and no persistence) is OK
 	}
@@ -199,7 +531,7 @@ func save(filename string, scheduled map[string]configstore.JobConfig) (res erro
 
 	defer f.Close()
 
-	if err := json.NewEncoder(f).Encode(scheduled); err != nil {
+	if err := json.NewEncoder(f).Encode(s); err != nil {
 		return err
 	}
 
@@ -216,28 +548,87 @@ func save(filename string, scheduled map[string]configstore.JobConfig) (res erro
 	return nil
 }
 
-func load(filename string) (map[string]configstore.JobConfig, error) {
+func load(filename string) (state, error) {
+	s := state{
+		Scheduled:  map[string]configstore.JobConfig{},
+		Migrations: map[string]Migration{},
+		Refs:       map[string]string{},
+	}
+
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		return map[string]configstore.JobConfig{}, nil // no file is OK
+		return s, nil // no file is OK
 	} else if err != nil {
-		return map[string]configstore.JobConfig{}, err
+		return s, err
 	}
 
 	buf, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return map[string]configstore.JobConfig{}, err
+		return s, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return s, err
+	}
+
+	// Registries persisted before migrations were introduced contain only
+	// the scheduled job configs, indexed by hash.
+	if _, ok := fields["scheduled"]; !ok {
+		if err := json.Unmarshal(buf, &s.Scheduled); err != nil {
+			return s, err
+		}
+
+		return s, nil
+	}
+
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return s, err
+	}
+
+	// Fields missing from the file are decoded as nil maps.
+	if s.Scheduled == nil {
+		s.Scheduled = map[string]configstore.JobConfig{}
 	}
 
-	var scheduled map[string]configstore.JobConfig
-	if err := json.Unmarshal(buf, &scheduled); err != nil {
-		return map[string]configstore.JobConfig{}, err
+	if s.Migrations == nil {
+		s.Migrations = map[string]Migration{}
 	}
 
-	return scheduled, nil
+	if s.Refs == nil {
+		s.Refs = map[string]string{}
+	}
+
+	// The new job config of a running migration must be scheduled under its
+	// hash, which changed when hashes were made stable. Its tasks are
+	// restarted, and the migration resumes.
+	for _, m := range s.Migrations {
+		if m.State != MigrationStateRunning {
+			continue
+		}
+
+		hash, legacy := m.To.Hash(), m.To.LegacyHash()
+
+		if _, ok := s.Scheduled[hash]; ok {
+			continue
+		}
+
+		if c, ok := s.Scheduled[legacy]; ok {
+			s.Scheduled[hash] = c
+			delete(s.Scheduled, legacy)
+
+			if ref, ok := s.Refs[legacy]; ok {
+				s.Refs[hash] = ref
+				delete(s.Refs, legacy)
+			}
+		}
+	}
+
+	return s, nil
 }
 
 type scheduleRequest struct {
 	configstore.JobConfig
+	ref string
 	err chan error
 }
 
@@ -245,3 +636,28 @@ type unscheduleRequest struct {
 	hash string
 	err  chan error
 }
+
+type migrateRequest struct {
+	from           string
+	to             configstore.JobConfig
+	maxSurge       int
+	maxUnavailable int
+	err            chan error
+}
+
+type scaleMigrationRequest struct {
+	job       string
+	fromScale int
+	toScale   int
+	err       chan error
+}
+
+type completeMigrationRequest struct {
+	job string
+	err chan error
+}
+
+type abortMigrationRequest struct {
+	job string
+	err chan error
+}
@@ -111,11 +111,15 @@ func TestRegistrySaveLoad(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var fromDisk map[string]configstore.JobConfig
-	if err := json.Unmarshal(buf, &fromDisk); err != nil {
+	var persisted struct {
+		Scheduled map[string]configstore.JobConfig `json:"scheduled"`
+	}
+	if err := json.Unmarshal(buf, &persisted); err != nil {
 		t.Fatal(err)
 	}
 
+	fromDisk := persisted.Scheduled
+
 	check1c := make(chan map[string]configstore.JobConfig)
 	registry1.Subscribe(check1c)
 	defer registry1.Unsubscribe(check1c)
@@ -140,3 +144,233 @@ func TestRegistrySaveLoad(t *testing.T) {
 		t.Fatalf("want %v, have %v", want, have)
 	}
 }
+
+func TestRegistryMigrate(t *testing.T) {
+	var (
+		r    = registry.New("")
+		from = configstore.JobConfig{Scale: 2, ContainerConfig: agent.ContainerConfig{Job: "table", ArtifactURL: "old"}}
+		to   = configstore.JobConfig{Scale: 3, ContainerConfig: agent.ContainerConfig{Job: "table", ArtifactURL: "new"}}
+	)
+
+	defer r.Quit()
+
+	if err := r.Migrate(from.Hash(), to, 1, 0); err == nil {
+		t.Fatal("migrating an unscheduled job config: want error, have none")
+	}
+
+	if err := r.Schedule(from); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Migrate(from.Hash(), to, 0, 0); err == nil {
+		t.Fatal("zero max surge and max unavailable: want error, have none")
+	}
+
+	if err := r.Migrate(from.Hash(), to, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Unschedule(from.Hash()); err == nil {
+		t.Fatal("unscheduling a job config being migrated: want error, have none")
+	}
+
+	checkScales := func(fromScale, toScale int) {
+		snapshot := r.Snapshot()
+
+		if want, have := fromScale, snapshot[from.Hash()].Scale; want != have {
+			t.Errorf("want old scale %d, have %d", want, have)
+		}
+
+		if want, have := toScale, snapshot[to.Hash()].Scale; want != have {
+			t.Errorf("want new scale %d, have %d", want, have)
+		}
+	}
+
+	checkScales(2, 0)
+
+	if err := r.ScaleMigration("table", 1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	checkScales(1, 2)
+
+	if err := r.CompleteMigration("table"); err == nil {
+		t.Fatal("completing an unfinished migration: want error, have none")
+	}
+
+	if err := r.ScaleMigration("table", 0, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.CompleteMigration("table"); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := map[string]configstore.JobConfig{to.Hash(): to}, r.Snapshot(); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	if want, have := registry.MigrationStateComplete, r.Migrations()["table"].State; want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+}
+
+func TestRegistryLoadUnversioned(t *testing.T) {
+	var (
+		filename = "registry-test-load-unversioned.json"
+		job      = configstore.JobConfig{ContainerConfig: agent.ContainerConfig{Job: "π"}}
+		want     = map[string]configstore.JobConfig{job.Hash(): job}
+	)
+
+	buf, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filename, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+
+	r := registry.New(filename)
+	defer r.Quit()
+
+	if have := r.Snapshot(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+}
+
+func TestRegistryAbortMigration(t *testing.T) {
+	var (
+		r    = registry.New("")
+		from = configstore.JobConfig{Scale: 2, ContainerConfig: agent.ContainerConfig{Job: "table", ArtifactURL: "old"}}
+		to   = configstore.JobConfig{Scale: 2, ContainerConfig: agent.ContainerConfig{Job: "table", ArtifactURL: "new"}}
+	)
+
+	defer r.Quit()
+
+	if err := r.Schedule(from); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Migrate(from.Hash(), to, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.ScaleMigration("table", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.AbortMigration("table"); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := map[string]configstore.JobConfig{from.Hash(): from}, r.Snapshot(); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	if want, have := registry.MigrationStateAborted, r.Migrations()["table"].State; want != have {
+		t.Errorf("want %s, have %s", want, have)
+	}
+
+	if err := r.AbortMigration("table"); err == nil {
+		t.Errorf("aborting an aborted migration: want error, have none")
+	}
+}
+
+func TestRegistryScheduleRef(t *testing.T) {
+	var (
+		filename = "registry-test-schedule-ref.json"
+		r1       = registry.New(filename)
+		byRef    = configstore.JobConfig{ContainerConfig: agent.ContainerConfig{Job: "table"}}
+		byConfig = configstore.JobConfig{ContainerConfig: agent.ContainerConfig{Job: "chair"}}
+	)
+
+	defer os.Remove(filename)
+	defer r1.Quit()
+
+	if err := r1.ScheduleRef("table-abcdef0", byRef); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r1.Schedule(byConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{byRef.Hash(): "table-abcdef0"}
+
+	if have := r1.Refs(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+
+	r2 := registry.New(filename)
+	defer r2.Quit()
+
+	if have := r2.Refs(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("after load: want %v, have %v", want, have)
+	}
+
+	if err := r1.Unschedule(byRef.Hash()); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := map[string]string{}, r1.Refs(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("after unschedule: want %v, have %v", want, have)
+	}
+}
+
+func TestRegistryLegacyHashes(t *testing.T) {
+	var (
+		filename = "registry-test-legacy-hashes.json"
+		job      = configstore.JobConfig{Scale: 1, ContainerConfig: agent.ContainerConfig{Job: "π"}}
+		legacy   = map[string]configstore.JobConfig{job.LegacyHash(): job}
+	)
+
+	buf, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filename, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+
+	r := registry.New(filename)
+	defer r.Quit()
+
+	// Job configs stay scheduled under their legacy hash, so that their
+	// tasks aren't rescheduled.
+	if want, have := legacy, r.Snapshot(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+
+	if err := r.Schedule(job); err == nil {
+		t.Fatal("scheduling a job config scheduled under its legacy hash: want error, have none")
+	}
+
+	// Migrating to the same job config moves it to its stable hash.
+	if err := r.Migrate(job.Hash(), job, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := job.LegacyHash(), r.Migrations()["π"].From; want != have {
+		t.Errorf("want migration from %s, have %s", want, have)
+	}
+
+	if err := r.ScaleMigration("π", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.CompleteMigration("π"); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := map[string]configstore.JobConfig{job.Hash(): job}, r.Snapshot(); !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+
+	if err := r.Unschedule(job.Hash()); err != nil {
+		t.Fatal(err)
+	}
+}
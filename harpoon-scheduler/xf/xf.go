@@ -152,10 +152,13 @@ func transform(
 		toUnschedule = map[string][]string{}                           // endpoint: ids
 	)
 
-	// Expand every wanted Job to its composite tasks.
-	for _, config := range want {
+	// Expand every wanted Job to its composite tasks. Tasks are identified by
+	// the hash the job config was scheduled with, which is its key in the
+	// desired state. The scale of a job config may change while it's being
+	// migrated, but the identity of its tasks must not.
+	for hash, config := range want {
 		for i := 0; i < config.Scale; i++ {
-			wantTasks[MakeContainerID(config.Hash(), i)] = config.ContainerConfig
+			wantTasks[MakeContainerID(hash, i)] = config.ContainerConfig
 		}
 	}
 
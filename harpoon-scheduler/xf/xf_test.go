@@ -30,7 +30,7 @@ func TestRemoveDuplicates(t *testing.T) {
 	}
 
 	want := map[string]configstore.JobConfig{
-		"a": jobConfig,
+		jobConfig.Hash(): jobConfig,
 	}
 
 	have := map[string]agent.StateEvent{
@@ -60,7 +60,7 @@ func TestRespectPending(t *testing.T) {
 	}
 
 	want := map[string]configstore.JobConfig{
-		"a": jobConfig,
+		jobConfig.Hash(): jobConfig,
 	}
 
 	have := map[string]agent.StateEvent{
@@ -103,7 +103,7 @@ func TestRespectResourceReservedForPendingTasks(t *testing.T) {
 	}
 
 	want := map[string]configstore.JobConfig{
-		"a": jobConfig,
+		jobConfig.Hash(): jobConfig,
 	}
 
 	have := map[string]agent.StateEvent{
@@ -165,7 +165,7 @@ func TestPendingExpiration(t *testing.T) {
 	}
 
 	want := map[string]configstore.JobConfig{
-		"a": jobConfig,
+		jobConfig.Hash(): jobConfig,
 	}
 
 	have := map[string]agent.StateEvent{
@@ -362,7 +362,7 @@ func TestSchedulerRestartsDisappearingTasksIndefinitely(t *testing.T) {
 	// Schedule a job with scale = 3
 
 	jobConfig := configstore.JobConfig{ContainerConfig: agent.ContainerConfig{Job: "a"}, Scale: 3}
-	desire.set(map[string]configstore.JobConfig{"a": jobConfig})
+	desire.set(map[string]configstore.JobConfig{jobConfig.Hash(): jobConfig})
 	runtime.Gosched()
 
 	if want, have := int32(3), target.schedules; want != have {
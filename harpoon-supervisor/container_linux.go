@@ -8,6 +8,8 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"syscall"
 
 	"github.com/docker/libcontainer"
@@ -28,8 +30,14 @@ type container struct {
 	agentConfig         agent.ContainerConfig
 	containerConfigPath string
 	rootfs              string
+	stdout              *os.File
+	stderr              *os.File
 	args                []string
 
+	// tmpfs maps the container path of every sized tmpfs mount to the host
+	// path it's mounted at, before being bound into the container.
+	tmpfs map[string]string
+
 	err             error
 	containerConfig *libcontainer.Config
 
@@ -38,13 +46,15 @@ type container struct {
 	exitc chan error
 }
 
-func newContainer(hostname string, id string, agentConfig, containerConfig, rootfs string, args []string) Container {
+func newContainer(hostname string, id string, agentConfig, containerConfig, rootfs string, stdout, stderr *os.File, args []string) Container {
 	container := &container{
 		hostname:            hostname,
 		id:                  id,
 		agentConfigPath:     agentConfig,
 		containerConfigPath: containerConfig,
 		rootfs:              rootfs,
+		stdout:              stdout,
+		stderr:              stderr,
 		args:                args,
 		exitc:               make(chan error, 1),
 	}
@@ -80,6 +90,10 @@ func (c *container) configure() error {
 		return fmt.Errorf("rootfs %q invalid: not a directory", c.rootfs)
 	}
 
+	if c.tmpfs, err = c.tmpfsPaths(); err != nil {
+		return err
+	}
+
 	// Extract libcontainer config from harpoon config, and write it out to the filesystem.
 	c.containerConfig = c.libcontainerConfig()
 	containerConfigFile, err := os.OpenFile(c.containerConfigPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
@@ -120,6 +134,11 @@ func (c *container) Start() error {
 		return c.err
 	}
 
+	if err := c.mountTmpfs(); err != nil {
+		c.unmountTmpfs()
+		return err
+	}
+
 	var started = make(chan struct{})
 
 	startCallback := func() {
@@ -137,8 +156,8 @@ func (c *container) Start() error {
 		_, err := namespaces.Exec(
 			c.containerConfig,
 			os.Stdin,
-			os.Stdout,
-			os.Stderr,
+			c.stdout,
+			c.stderr,
 			"", // no console
 			"", // datapath handled elsewhere
 			c.args,
@@ -146,6 +165,7 @@ func (c *container) Start() error {
 			startCallback,
 		)
 
+		c.unmountTmpfs()
 		c.exitc <- err
 	}()
 
@@ -222,6 +242,10 @@ func (c *container) Metrics() agent.ContainerMetrics {
 		MemoryUsage: stats.MemoryStats.Usage,
 		MemoryLimit: stats.MemoryStats.Stats["hierarchical_memory_limit"],
 		CPUTime:     stats.CpuStats.CpuUsage.TotalUsage,
+
+		CPUPeriods:          stats.CpuStats.ThrottlingData.Periods,
+		CPUThrottledPeriods: stats.CpuStats.ThrottlingData.ThrottledPeriods,
+		CPUThrottledTime:    stats.CpuStats.ThrottlingData.ThrottledTime,
 	}
 }
 
@@ -229,6 +253,42 @@ func (c *container) Config() agent.ContainerConfig {
 	return c.agentConfig
 }
 
+const (
+	// cpuPeriod is the CFS enforcement period in microseconds. Containers
+	// may use their fraction of CPUs worth of CPU time in every period.
+	cpuPeriod = 100000
+
+	// minCPUQuota is the smallest CFS quota in microseconds the kernel
+	// accepts.
+	minCPUQuota = 1000
+
+	// sharesPerCPU is the cpu.shares weight of one CPU. Shares weight
+	// containers against each other when CPU time is contended.
+	sharesPerCPU = 1024
+
+	// minCPUShares is the smallest cpu.shares weight the kernel accepts.
+	minCPUShares = 2
+)
+
+// cpuQuota translates fractional CPUs into a hard limit of CPU time per
+// cpuPeriod.
+func cpuQuota(cpu float64) int64 {
+	quota := int64(cpu * cpuPeriod)
+	if quota < minCPUQuota {
+		quota = minCPUQuota
+	}
+	return quota
+}
+
+// cpuShares translates fractional CPUs into a relative weight.
+func cpuShares(cpu float64) int64 {
+	shares := int64(cpu * sharesPerCPU)
+	if shares < minCPUShares {
+		shares = minCPUShares
+	}
+	return shares
+}
+
 // libcontainerConfig builds a complete libcontainer.Config from an
 // agent.ContainerConfig.
 func (c *container) libcontainerConfig() *libcontainer.Config {
@@ -250,7 +310,11 @@ func (c *container) libcontainerConfig() *libcontainer.Config {
 				Name:   c.id,
 				Parent: "harpoon",
 
-				Memory: int64(c.agentConfig.Resources.Mem * 1024 * 1024),
+				Memory: int64(c.agentConfig.ReservedMem() * 1024 * 1024),
+
+				CpuShares: cpuShares(c.agentConfig.Resources.CPU),
+				CpuQuota:  cpuQuota(c.agentConfig.Resources.CPU),
+				CpuPeriod: cpuPeriod,
 
 				AllowedDevices: devices.DefaultAllowedDevices,
 			},
@@ -275,6 +339,13 @@ func (c *container) libcontainerConfig() *libcontainer.Config {
 	}
 
 	for dest := range c.agentConfig.Storage.Tmp {
+		if source, ok := c.tmpfs[dest]; ok {
+			config.MountConfig.Mounts = append(config.MountConfig.Mounts, &mount.Mount{
+				Type: "bind", Source: source, Destination: dest, Writable: true, Private: true,
+			})
+			continue
+		}
+
 		config.MountConfig.Mounts = append(config.MountConfig.Mounts, &mount.Mount{
 			Type: "tmpfs", Destination: dest, Writable: true, Private: true,
 		})
@@ -282,3 +353,59 @@ func (c *container) libcontainerConfig() *libcontainer.Config {
 
 	return config
 }
+
+// tmpfsPaths assigns a host path next to the rootfs to every sized tmpfs
+// mount. libcontainer can't pass mount options to tmpfs mounts, so sized
+// tmpfs mounts are set up on the host, and bound into the container.
+func (c *container) tmpfsPaths() (map[string]string, error) {
+	var dests []string
+
+	for dest, size := range c.agentConfig.Storage.Tmp {
+		if size > 0 {
+			dests = append(dests, dest)
+		}
+	}
+
+	sort.Strings(dests)
+
+	root, err := filepath.Abs(filepath.Join(filepath.Dir(c.rootfs), "tmpfs"))
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]string, len(dests))
+
+	for i, dest := range dests {
+		paths[dest] = filepath.Join(root, fmt.Sprint(i))
+	}
+
+	return paths, nil
+}
+
+// mountTmpfs mounts every sized tmpfs at its host path. Pages are charged to
+// the memory cgroup of the container process that first touches them.
+func (c *container) mountTmpfs() error {
+	for dest, source := range c.tmpfs {
+		if err := os.MkdirAll(source, 0755); err != nil {
+			return err
+		}
+
+		data := fmt.Sprintf("size=%dm,mode=1777", c.agentConfig.Storage.Tmp[dest])
+
+		if err := syscall.Mount("tmpfs", source, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, data); err != nil {
+			return fmt.Errorf("mounting tmpfs %q (%s): %s", dest, data, err)
+		}
+	}
+
+	return nil
+}
+
+// unmountTmpfs unmounts every sized tmpfs from its host path, discarding its
+// contents.
+func (c *container) unmountTmpfs() {
+	for dest, source := range c.tmpfs {
+		if err := syscall.Unmount(source, 0); err != nil && err != syscall.EINVAL {
+			log.Printf("unmounting tmpfs %q: %s", dest, err)
+		}
+	}
+}
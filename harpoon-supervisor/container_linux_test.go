@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestCPULimits(t *testing.T) {
+	for _, tc := range []struct {
+		cpu    float64
+		quota  int64
+		shares int64
+	}{
+		{cpu: 0.1, quota: 10000, shares: 102},
+		{cpu: 1, quota: 100000, shares: 1024},
+		{cpu: 2.5, quota: 250000, shares: 2560},
+		{cpu: 0.001, quota: minCPUQuota, shares: minCPUShares},
+	} {
+		if want, have := tc.quota, cpuQuota(tc.cpu); want != have {
+			t.Errorf("%.3f CPUs: want quota %d, have %d", tc.cpu, want, have)
+		}
+
+		if want, have := tc.shares, cpuShares(tc.cpu); want != have {
+			t.Errorf("%.3f CPUs: want shares %d, have %d", tc.cpu, want, have)
+		}
+	}
+}
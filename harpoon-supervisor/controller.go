@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 	"syscall"
 	"time"
 
@@ -16,18 +17,26 @@ import (
 type controller struct {
 	net.Listener
 	Supervisor
+	logs *logger
 }
 
-func newController(ln net.Listener, s Supervisor) *controller {
+func newController(ln net.Listener, s Supervisor, logs *logger) *controller {
 	return &controller{
 		Listener:   ln,
 		Supervisor: s,
+		logs:       logs,
 	}
 }
 
-// Run accepts and serves controller connections until the supervisor exits.
+// Run accepts and serves controller connections until the supervisor exits,
+// and returns once all connections are closed.
 func (c *controller) Run() {
-	exitedc := c.Supervisor.Exited()
+	var (
+		exitedc = c.Supervisor.Exited()
+		wg      sync.WaitGroup
+	)
+
+	defer wg.Wait()
 
 	go func() {
 		<-exitedc
@@ -47,8 +56,10 @@ func (c *controller) Run() {
 			}
 		}
 
-		c := newControllerConn(conn, c.Supervisor)
-		go c.serve()
+		c := newControllerConn(conn, c.Supervisor, c.logs)
+
+		wg.Add(1)
+		go func() { defer wg.Done(); c.serve() }()
 	}
 }
 
@@ -56,13 +67,22 @@ type controllerConn struct {
 	conn   net.Conn
 	s      Supervisor
 	writec chan agent.ContainerProcessState
+
+	logs       *logger
+	logc       chan agent.LogEntry
+	subscribec chan struct{}
+	subscribed chan struct{} // closed once subscribed to logs
 }
 
-func newControllerConn(conn net.Conn, s Supervisor) *controllerConn {
+func newControllerConn(conn net.Conn, s Supervisor, logs *logger) *controllerConn {
 	return &controllerConn{
-		conn:   conn,
-		s:      s,
-		writec: make(chan agent.ContainerProcessState),
+		conn:       conn,
+		s:          s,
+		writec:     make(chan agent.ContainerProcessState),
+		logs:       logs,
+		logc:       make(chan agent.LogEntry, logBufferSize),
+		subscribec: make(chan struct{}, 1),
+		subscribed: make(chan struct{}),
 	}
 }
 
@@ -83,18 +103,62 @@ func (c *controllerConn) readLoop() error {
 			c.s.Stop(syscall.SIGKILL)
 		case "exit":
 			c.s.Exit()
+		case "logs":
+			select {
+			case c.subscribec <- struct{}{}:
+			default: // already subscribing
+			}
+		case "log":
+			var entry agent.LogEntry
+
+			if err := json.Unmarshal(ev.Data, &entry); err != nil {
+				return err
+			}
+
+			c.logs.ingest(entry)
 		}
 	}
 }
 
+// writeLoop writes state events, and log events once subscribed to logs. It
+// returns once closed is closed, or once all entries are written after the
+// logger is done.
 func (c *controllerConn) writeLoop(closed chan struct{}) error {
-	enc := eventsource.NewEncoder(c.conn)
+	var (
+		enc        = eventsource.NewEncoder(c.conn)
+		subscribec = c.subscribec
+	)
 
 	for {
 		select {
 		case <-closed:
 			return nil
 
+		case <-subscribec:
+			// Acknowledge the subscription before the first entry, so that
+			// clients learn that the supervisor collects the logs.
+			if err := enc.Encode(eventsource.Event{Type: "logs"}); err != nil {
+				return err
+			}
+
+			c.logs.subscribe(c.logc)
+			close(c.subscribed)
+			subscribec = nil
+
+		case entry, ok := <-c.logc:
+			if !ok {
+				return nil
+			}
+
+			buf, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+
+			if err := enc.Encode(eventsource.Event{Type: "log", Data: buf}); err != nil {
+				return err
+			}
+
 		case state := <-c.writec:
 			buf, err := json.Marshal(state)
 			if err != nil {
@@ -128,6 +192,7 @@ func (c *controllerConn) serve() {
 	defer c.s.Unsubscribe(statec)
 
 	defer c.conn.Close()
+	defer c.logs.unsubscribe(c.logc)
 	defer close(closed)
 
 	go func() { errc <- c.readLoop() }()
@@ -143,7 +208,14 @@ func (c *controllerConn) serve() {
 			return
 
 		case <-exitedc:
-			return
+			// Subscribed connections are sent the entries logged until the
+			// logger is done, and closed by writeLoop then.
+			select {
+			case <-c.subscribed:
+				exitedc = nil
+			default:
+				return
+			}
 
 		case state = <-statec:
 			writec = c.writec
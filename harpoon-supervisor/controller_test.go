@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"syscall"
 	"testing"
 	"time"
@@ -16,15 +17,17 @@ import (
 
 func TestController(t *testing.T) {
 	var (
-		s     = newTestSupervisor()
-		ln, _ = net.Listen("tcp", ":0")
-		addr  = ln.Addr().String()
-		c     = newController(ln, s)
+		s          = newTestSupervisor()
+		logs, stop = startTestLogger(t)
+		ln, _      = net.Listen("tcp", ":0")
+		addr       = ln.Addr().String()
+		c          = newController(ln, s, logs)
 
 		done = make(chan struct{})
 	)
 
 	defer ln.Close()
+	defer stop()
 
 	go func() { c.Run(); done <- struct{}{} }()
 
@@ -117,6 +120,93 @@ func TestController(t *testing.T) {
 	}
 }
 
+func TestControllerLogs(t *testing.T) {
+	var (
+		s          = newTestSupervisor()
+		logs, stop = startTestLogger(t)
+		ln, _      = net.Listen("tcp", ":0")
+		c          = newController(ln, s, logs)
+
+		done = make(chan struct{})
+	)
+
+	defer ln.Close()
+
+	go func() { c.Run(); close(done) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("unable to dial: ", err)
+	}
+	defer conn.Close()
+
+	<-s.subscribec
+
+	var (
+		enc = eventsource.NewEncoder(conn)
+		dec = eventsource.NewDecoder(conn)
+	)
+
+	if err := enc.Encode(eventsource.Event{Type: "logs"}); err != nil {
+		t.Fatal("error sending logs command: ", err)
+	}
+
+	var ev eventsource.Event
+
+	if err := dec.Decode(&ev); err != nil || ev.Type != "logs" {
+		t.Fatalf("want logs event, have %q (%v)", ev.Type, err)
+	}
+
+	if err := enc.Encode(eventsource.Event{Type: "log", Data: []byte(`{"stream":"stderr","line":"m1"}`)}); err != nil {
+		t.Fatal("error sending log command: ", err)
+	}
+
+	if err := dec.Decode(&ev); err != nil || ev.Type != "log" {
+		t.Fatalf("want log event, have %q (%v)", ev.Type, err)
+	}
+
+	var entry agent.LogEntry
+
+	if err := json.Unmarshal(ev.Data, &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := (agent.LogEntry{Stream: agent.LogStreamStderr, ContainerID: "123", Seq: 1, Line: "m1"}), entry; want != have {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+
+	// The supervisor exits, and the connection is closed once the logger is
+	// done.
+	close(s.exited)
+	go stop()
+
+	if err := dec.Decode(&ev); err != io.EOF {
+		t.Errorf("want connection closed, have %q (%v)", ev.Type, err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("controller did not terminate after supervisor exit")
+	}
+}
+
+// startTestLogger runs a logger, and returns a function that stops it.
+func startTestLogger(t *testing.T) (*logger, func()) {
+	var (
+		l, dir = newTestLogger(t)
+		s      = newTestSupervisor()
+	)
+
+	go l.run(s)
+
+	return l, func() {
+		close(s.exited)
+		l.close()
+		os.RemoveAll(dir)
+	}
+}
+
 func readStateEvent(r io.Reader) (agent.ContainerProcessState, error) {
 	var (
 		ev    eventsource.Event
@@ -38,10 +38,6 @@ func init() {
 		os.Exit(2)
 	}
 
-	// redirect stderr to stdout; harpoon-container will not write to stderr from
-	// this point on.
-	syscall.Dup2(syscall.Stdout, syscall.Stderr)
-
 	defer func() {
 		if e := recover(); e != nil {
 			syncPipe.ReportChildError(fmt.Errorf("panic: %s", e))
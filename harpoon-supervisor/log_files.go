@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+const (
+	// maxLogFileSize is the size of the current log at which it's rotated.
+	maxLogFileSize = 5242880
+
+	// maxLogFiles is the number of rotated logs retained, which together
+	// with the current log fit into agent.LogStorage.
+	maxLogFiles = agent.LogStorage/maxLogFileSize - 1
+
+	// maxLogFileAge is the age of the current log at which it's rotated.
+	maxLogFileAge = 30 * time.Minute
+)
+
+// logFiles writes entries to the current log file in dir, as JSON, one per
+// line. Once the current log grows beyond maxSize, or is older than maxAge,
+// it's rotated: it's renamed after the TAI64N timestamp of the rotation, and
+// all but the newest maxFiles rotated logs are removed. The layout of the
+// directory is the one svlogd produces.
+type logFiles struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	maxAge   time.Duration
+
+	current *os.File
+	size    int64
+	opened  time.Time
+}
+
+func openLogFiles(dir string, maxSize int64, maxFiles int, maxAge time.Duration) (*logFiles, error) {
+	f := &logFiles{
+		dir:      dir,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		maxAge:   maxAge,
+	}
+
+	if err := f.open(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *logFiles) open(now time.Time) error {
+	current, err := os.OpenFile(filepath.Join(f.dir, "current"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := current.Stat()
+	if err != nil {
+		current.Close()
+		return err
+	}
+
+	f.current, f.size, f.opened = current, fi.Size(), now
+
+	return nil
+}
+
+func (f *logFiles) write(entry agent.LogEntry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	buf = append(buf, '\n')
+
+	if f.size > 0 && f.size+int64(len(buf)) > f.maxSize {
+		if err := f.rotate(entry.Time); err != nil {
+			return err
+		}
+	}
+
+	if f.current == nil {
+		if err := f.open(entry.Time); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.current.Write(buf)
+	f.size += int64(n)
+
+	return err
+}
+
+func (f *logFiles) rotateIfOld(now time.Time) error {
+	if f.size <= 0 || now.Sub(f.opened) < f.maxAge {
+		return nil
+	}
+
+	return f.rotate(now)
+}
+
+// rotate renames the current log, and opens a new one. If the current log
+// can't be renamed, it's kept.
+func (f *logFiles) rotate(now time.Time) error {
+	if f.current != nil {
+		f.current.Close()
+		f.current = nil
+
+		current := filepath.Join(f.dir, "current")
+
+		if err := os.Rename(current, filepath.Join(f.dir, tai64n(now)+".s")); err != nil {
+			f.open(now)
+			return err
+		}
+	}
+
+	if err := f.open(now); err != nil {
+		return err
+	}
+
+	return f.prune()
+}
+
+// prune removes all but the newest maxFiles rotated logs.
+func (f *logFiles) prune() error {
+	d, err := os.Open(f.dir)
+	if err != nil {
+		return err
+	}
+
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+
+	var rotated []string
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "@") && (strings.HasSuffix(name, ".s") || strings.HasSuffix(name, ".u")) {
+			rotated = append(rotated, name)
+		}
+	}
+
+	sort.Strings(rotated) // oldest first
+
+	for len(rotated) > f.maxFiles {
+		if err := os.Remove(filepath.Join(f.dir, rotated[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		rotated = rotated[1:]
+	}
+
+	return nil
+}
+
+func (f *logFiles) close() {
+	if f.current != nil {
+		f.current.Close()
+		f.current = nil
+	}
+}
+
+// tai64n returns the external TAI64N label of t, which sorts
+// chronologically, as svlogd names rotated logs.
+func tai64n(t time.Time) string {
+	return fmt.Sprintf("@%016x%08x", uint64(0x400000000000000a)+uint64(t.Unix()), t.Nanosecond())
+}
+
+// lockLogDir locks the log files in dir against other writers, waiting for
+// at most timeout for the writer holding the lock to exit: the supervisor
+// that ran the container before, or svlogd, which collected the output of
+// containers started by earlier agents, and holds the same lock file. The
+// lock is held until the returned file is closed.
+func lockLogDir(dir string, timeout time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	for deadline := time.Now().Add(timeout); ; time.Sleep(50 * time.Millisecond) {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("lock %s: %s", f.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestLogFilesRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpoon-supervisor-log-files-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files, err := openLogFiles(dir, 100, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files.close()
+
+	now := time.Now()
+
+	// Every line is longer than half of the max size, so each one after the
+	// first rotates the current log.
+	for i := 0; i < 5; i++ {
+		if err := files.write(agent.LogEntry{Time: now.Add(time.Duration(i) * time.Second), Line: strings.Repeat("x", 60)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want, have := 2, len(rotatedLogs(t, dir)); want != have {
+		t.Errorf("want %d rotated logs, have %d", want, have)
+	}
+
+	// The current log is rotated once it's older than the max age, unless
+	// it's empty.
+	if err := files.rotateIfOld(now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	before := rotatedLogs(t, dir)
+
+	if err := files.rotateIfOld(now.Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	after := rotatedLogs(t, dir)
+
+	if want, have := before[1], after[0]; want != have {
+		t.Errorf("want oldest rotated log %s, have %s", want, have)
+	}
+
+	if err := files.rotateIfOld(now.Add(4 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := after, rotatedLogs(t, dir); strings.Join(want, ",") != strings.Join(have, ",") {
+		t.Errorf("want empty current log not to be rotated, have rotated logs %v", have)
+	}
+}
+
+func TestLockLogDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpoon-supervisor-log-files-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// svlogd holds the lock file while it runs.
+	svlogd, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svlogd.Close()
+
+	if err := syscall.Flock(int(svlogd.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := lockLogDir(dir, 100*time.Millisecond); err == nil {
+		t.Fatal("while locked: want error, have none")
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() { svlogd.Close() })
+
+	lock, err := lockLogDir(dir, time.Second)
+	if err != nil {
+		t.Fatalf("after svlogd exited: want no error, have %s", err)
+	}
+	defer lock.Close()
+
+	if _, err := lockLogDir(dir, 0); err == nil {
+		t.Error("while locked by a supervisor: want error, have none")
+	}
+}
+
+func rotatedLogs(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "@*.s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return names
+}
@@ -0,0 +1,295 @@
+package main
+
+// The supervisor collects the output of its container, whether or not an
+// agent is attached to it, so that the container never blocks on its output.
+// The container writes its stdout and its stderr to two pipes, which the
+// logger reads line by line. Every line is written as a log entry to the log
+// files of the container, see log_files.go, and sent to the control
+// connections subscribed to the log, see controller.go. Entries logged while
+// no connection is subscribed are buffered, and sent to the next one. Log
+// producers may add entries to the log over control connections, too.
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+const (
+	maxLogLineLength = 50000
+
+	// logBufferSize is the number of entries buffered for every subscribed
+	// connection, and while no connection is subscribed.
+	logBufferSize = 10000
+
+	// logLockTimeout is how long the supervisor waits for the previous
+	// writer of the log files to exit.
+	logLockTimeout = 5 * time.Second
+
+	// logDrainTimeout is how long the lines left in the pipes are read once
+	// the supervisor exits, in case processes left behind by the container
+	// keep the pipes open.
+	logDrainTimeout = time.Second
+)
+
+type logger struct {
+	id    string
+	files *logFiles
+	lock  *os.File
+
+	stdout, stderr logPipe
+
+	entryc       chan agent.LogEntry
+	subscribec   chan chan agent.LogEntry
+	unsubscribec chan chan agent.LogEntry
+	readc        chan struct{} // closed once the pipes are drained
+	done         chan struct{}
+}
+
+type logPipe struct {
+	r, w *os.File
+}
+
+// newLogger locks the log files in dir, and starts reading the output of
+// the container with the given ID. Entries are written once the logger runs.
+func newLogger(id, dir string) (*logger, error) {
+	lock, err := lockLogDir(dir, logLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := openLogFiles(dir, maxLogFileSize, maxLogFiles, maxLogFileAge)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	l := &logger{
+		id:           id,
+		files:        files,
+		lock:         lock,
+		entryc:       make(chan agent.LogEntry),
+		subscribec:   make(chan chan agent.LogEntry),
+		unsubscribec: make(chan chan agent.LogEntry),
+		readc:        make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	for _, p := range []*logPipe{&l.stdout, &l.stderr} {
+		if p.r, p.w, err = os.Pipe(); err != nil {
+			l.stdout.close()
+			files.close()
+			lock.Close()
+			return nil, err
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() { defer wg.Done(); l.read(l.stdout.r, agent.LogStreamStdout) }()
+	go func() { defer wg.Done(); l.read(l.stderr.r, agent.LogStreamStderr) }()
+	go func() { wg.Wait(); close(l.readc) }()
+
+	return l, nil
+}
+
+// output returns the write ends of the pipes, which the container writes its
+// stdout and stderr to.
+func (l *logger) output() (stdout, stderr *os.File) {
+	return l.stdout.w, l.stderr.w
+}
+
+// ingest adds an entry sent by a log producer to the log.
+func (l *logger) ingest(entry agent.LogEntry) {
+	select {
+	case l.entryc <- entry:
+	case <-l.done:
+	}
+}
+
+// subscribe sends the entries buffered while no connection was subscribed,
+// and all further entries, to c, which must be buffered for logBufferSize
+// entries. Entries which don't fit into c are counted as dropped with the next
+// entry sent. c is closed once the logger is done.
+func (l *logger) subscribe(c chan agent.LogEntry) {
+	select {
+	case l.subscribec <- c:
+	case <-l.done:
+		close(c)
+	}
+}
+
+func (l *logger) unsubscribe(c chan agent.LogEntry) {
+	select {
+	case l.unsubscribec <- c:
+	case <-l.done:
+	}
+}
+
+// close stops collecting the output once the container exited, i.e. the
+// supervisor exited. It waits for the lines left in the pipes to be written.
+func (l *logger) close() {
+	l.stdout.w.Close()
+	l.stderr.w.Close()
+
+	select {
+	case <-l.readc:
+	case <-time.After(logDrainTimeout):
+		l.stdout.r.Close()
+		l.stderr.r.Close()
+	}
+
+	<-l.done
+}
+
+func (l *logger) read(r *os.File, stream agent.LogStream) {
+	br := bufio.NewReaderSize(r, maxLogLineLength)
+
+	for {
+		line, err := readLogLine(br)
+		if err != nil {
+			return
+		}
+
+		l.entryc <- agent.LogEntry{Time: time.Now().UTC(), Stream: stream, Line: line}
+	}
+}
+
+// run writes the entries, and sends them to subscribers, until the pipes
+// are drained. Entries are numbered, and tagged with the restarts of the
+// container, which s reports.
+func (l *logger) run(s Supervisor) {
+	defer close(l.done)
+	defer l.lock.Close()
+	defer l.files.close()
+
+	var (
+		statec      = make(chan agent.ContainerProcessState)
+		rotate      = time.NewTicker(time.Minute)
+		subscribers = map[chan agent.LogEntry]uint64{} // dropped entries
+		pending     []agent.LogEntry                   // while not subscribed
+		generation  uint
+		seq         uint64
+		failed      = false // writing the log files, to log the failure once
+	)
+
+	defer rotate.Stop()
+
+	defer func() {
+		for c := range subscribers {
+			close(c)
+		}
+	}()
+
+	go s.Subscribe(statec)
+	defer s.Unsubscribe(statec)
+
+	for {
+		select {
+		case <-l.readc:
+			return
+
+		case entry := <-l.entryc:
+			seq++
+			entry.ContainerID = l.id
+			entry.Generation = generation
+			entry.Seq = seq
+
+			err := l.files.write(entry)
+			if err != nil && !failed {
+				log.Printf("logs: %s: %s", l.files.dir, err)
+			}
+			failed = err != nil
+
+			if len(subscribers) == 0 {
+				if len(pending) >= logBufferSize {
+					pending[1].Dropped += pending[0].Dropped + 1
+					pending = pending[1:]
+				}
+
+				pending = append(pending, entry)
+				continue
+			}
+
+			for c, dropped := range subscribers {
+				e := entry
+				e.Dropped += dropped
+
+				select {
+				case c <- e:
+					subscribers[c] = 0
+				default:
+					subscribers[c] = e.Dropped + 1
+				}
+			}
+
+		case c := <-l.subscribec:
+			subscribers[c] = 0
+
+			for _, entry := range pending {
+				c <- entry // fits, as pending is no larger than the buffer of c
+			}
+
+			pending = nil
+
+		case c := <-l.unsubscribec:
+			delete(subscribers, c)
+
+		case state := <-statec:
+			generation = state.Restarts
+
+		case now := <-rotate.C:
+			if err := l.files.rotateIfOld(now); err != nil {
+				log.Printf("logs: %s: %s", l.files.dir, err)
+			}
+		}
+	}
+}
+
+func (p logPipe) close() {
+	if p.r != nil {
+		p.r.Close()
+		p.w.Close()
+	}
+}
+
+// readLogLine returns the next line read from r, without its line break.
+// Lines longer than the buffer of r are truncated. A last line without line
+// break is returned, too.
+func readLogLine(r *bufio.Reader) (string, error) {
+	buf, err := r.ReadSlice('\n')
+
+	switch err {
+	case nil:
+		return string(buf[:len(buf)-1]), nil
+
+	case bufio.ErrBufferFull:
+		line := string(buf)
+
+		for err == bufio.ErrBufferFull {
+			_, err = r.ReadSlice('\n')
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		return line, nil
+
+	case io.EOF:
+		if len(buf) > 0 {
+			return string(buf), nil
+		}
+
+		return "", err
+
+	default:
+		return "", err
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestLogger(t *testing.T) {
+	var (
+		l, dir = newTestLogger(t)
+		s      = newTestSupervisor()
+		long   = strings.Repeat("x", maxLogLineLength+10)
+	)
+
+	defer os.RemoveAll(dir)
+
+	go l.run(s)
+
+	var states chan<- agent.ContainerProcessState
+	select {
+	case states = <-s.subscribec:
+	case <-time.After(time.Second):
+		t.Fatal("logger did not subscribe to supervisor")
+	}
+
+	stdout, stderr := l.output()
+
+	// Lines are logged while no connection is subscribed, and buffered.
+	if _, err := stdout.WriteString("m1\n" + long + "\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForLogFile(t, dir, 2)
+
+	logc := make(chan agent.LogEntry, logBufferSize)
+	l.subscribe(logc)
+
+	states <- agent.ContainerProcessState{Up: true, Restarts: 1}
+
+	if _, err := stderr.WriteString("e1\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForLogFile(t, dir, 3)
+
+	l.ingest(agent.LogEntry{Time: time.Now(), Stream: agent.LogStreamStdout, Dropped: 2, Line: "p1"})
+
+	// The container exits, with its last line still in the pipe.
+	if _, err := stdout.WriteString("m2"); err != nil {
+		t.Fatal(err)
+	}
+
+	close(s.exited)
+	l.close()
+
+	var entries []agent.LogEntry
+	for entry := range logc {
+		entries = append(entries, entry)
+	}
+
+	want := []agent.LogEntry{
+		{Stream: agent.LogStreamStdout, Generation: 0, Seq: 1, Line: "m1"},
+		{Stream: agent.LogStreamStdout, Generation: 0, Seq: 2, Line: long[:maxLogLineLength]},
+		{Stream: agent.LogStreamStderr, Generation: 1, Seq: 3, Line: "e1"},
+		{Stream: agent.LogStreamStdout, Generation: 1, Seq: 4, Dropped: 2, Line: "p1"},
+		{Stream: agent.LogStreamStdout, Generation: 1, Seq: 5, Line: "m2"},
+	}
+
+	if len(want) != len(entries) {
+		t.Fatalf("want %d entries, have %d", len(want), len(entries))
+	}
+
+	lines := readLogFile(t, dir)
+
+	if len(want) != len(lines) {
+		t.Fatalf("want %d lines in current log, have %d", len(want), len(lines))
+	}
+
+	for i, want := range want {
+		want.ContainerID = "123"
+
+		for _, have := range []agent.LogEntry{entries[i], lines[i]} {
+			have.Time = time.Time{}
+
+			if want != have {
+				t.Errorf("entry %d: want %.60v, have %.60v", i, want, have)
+			}
+		}
+	}
+}
+
+func TestLoggerDropsEntries(t *testing.T) {
+	var (
+		l, dir = newTestLogger(t)
+		s      = newTestSupervisor()
+		logc   = make(chan agent.LogEntry, logBufferSize)
+		slow   = make(chan agent.LogEntry, 1)
+	)
+
+	defer os.RemoveAll(dir)
+
+	go l.run(s)
+	<-s.subscribec
+
+	l.subscribe(logc)
+	l.subscribe(slow)
+
+	for i := 0; i < 3; i++ {
+		l.ingest(agent.LogEntry{Line: "m"})
+	}
+
+	// Once the logger takes the next request, it has sent the entries.
+	l.unsubscribe(make(chan agent.LogEntry))
+
+	// The slow connection catches up.
+	<-slow
+
+	l.ingest(agent.LogEntry{Line: "m"})
+
+	close(s.exited)
+	l.close()
+
+	if want, have := uint64(2), (<-slow).Dropped; want != have {
+		t.Errorf("want %d dropped entries, have %d", want, have)
+	}
+
+	for entry := range logc {
+		if entry.Dropped != 0 {
+			t.Errorf("want no dropped entries, have %+v", entry)
+		}
+	}
+}
+
+func newTestLogger(t *testing.T) (*logger, string) {
+	dir, err := ioutil.TempDir("", "harpoon-supervisor-logger-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := newLogger("123", dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return l, dir
+}
+
+func readLogFile(t *testing.T, dir string) []agent.LogEntry {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []agent.LogEntry
+
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		var entry agent.LogEntry
+
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// waitForLogFile waits for n entries to be written to the current log.
+func waitForLogFile(t *testing.T, dir string, n int) {
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if buf, _ := ioutil.ReadFile(filepath.Join(dir, "current")); strings.Count(string(buf), "\n") >= n {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d entries in current log", n)
+		}
+	}
+}
@@ -16,6 +16,7 @@ const (
 	agentFileName     = "./agent.json"
 	containerFileName = "./container.json"
 	rootfsFileName    = "./rootfs"
+	logDirName        = "./log"
 
 	containerInitName = "harpoon-container-init"
 )
@@ -48,6 +49,13 @@ func main() {
 		log.Fatal("container ID not supplied")
 	}
 
+	logs, err := newLogger(*id, logDirName)
+	if err != nil {
+		log.Fatalf("unable to collect the output of the container: %s", err)
+	}
+
+	stdout, stderr := logs.output()
+
 	ln, err := net.Listen("unix", controlFileName)
 	if err != nil {
 		log.Fatalf("unable to listen on %q: %s", controlFileName, err)
@@ -64,19 +72,33 @@ func main() {
 			agentFileName,
 			containerFileName,
 			rootfsFileName,
+			stdout,
+			stderr,
 			flag.Args(),
 		)
 		supervisor    = newSupervisor(container)
 		signalHandler = newSignalHandler(sigc, supervisor)
-		controller    = newController(ln, supervisor)
+		controller    = newController(ln, supervisor, logs)
+		controlled    = make(chan struct{})
 	)
 
+	go logs.run(supervisor)
 	go signalHandler.Run()
-	go controller.Run()
+	go func() { controller.Run(); close(controlled) }()
 
 	restartTimer := func() <-chan time.Time {
 		return time.After(time.Second)
 	}
 
 	supervisor.Run(time.Tick(3*time.Second), restartTimer)
+
+	// The container exited, but the last lines it wrote may still be in the
+	// pipes. Connections subscribed to the logs are sent them, unless they
+	// don't keep up.
+	logs.close()
+
+	select {
+	case <-controlled:
+	case <-time.After(logDrainTimeout):
+	}
 }
@@ -21,6 +21,7 @@ var Command = cli.Command{
 	Description: "Interact with Harpoon agents directly.",
 	Subcommands: []cli.Command{
 		resourcesCommand,
+		artifactsCommand,
 		psCommand,
 		dumpCommand,
 		createCommand,
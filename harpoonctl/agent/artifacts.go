@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoonctl/log"
+)
+
+var artifactsCommand = cli.Command{
+	Name:        "artifacts",
+	Usage:       "Display the artifact cache of agent(s)",
+	Description: artifactsUsage,
+	Action:      artifactsAction,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "purge",
+			Usage: "remove artifacts that aren't used by any container, and display them",
+		},
+	},
+}
+
+const artifactsUsage = "artifacts [--purge]"
+
+func artifactsAction(c *cli.Context) {
+	var (
+		w     = tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+		purge = c.Bool("purge")
+		ch    = make(chan []string, len(endpoints))
+	)
+
+	for _, u := range endpoints {
+		go func(u *url.URL) {
+			var rows []string
+			defer func() { ch <- rows }()
+
+			c, err := agent.NewClient(u.String())
+			if err != nil {
+				log.Warnf("%s: %s", u.Host, err)
+				return
+			}
+
+			var artifacts []agent.Artifact
+			if purge {
+				artifacts, err = c.PurgeArtifacts()
+			} else {
+				artifacts, err = c.Artifacts()
+			}
+			if err != nil {
+				log.Warnf("%s: %s", u.Host, err)
+				return
+			}
+
+			for _, a := range artifacts {
+				rows = append(rows, fmt.Sprintf(
+					"%s\t%s\t%d\t%s\t%s\n",
+					u.Host,
+					a.URL,
+					a.Size/1024/1024,
+					a.Used.Format("2006-01-02 15:04:05"),
+					strings.Join(a.Containers, ", "),
+				))
+			}
+		}(u)
+	}
+
+	var a []string
+	for i := 0; i < cap(ch); i++ {
+		a = append(a, <-ch...)
+	}
+
+	// Don't display header if we didn't have any rows.
+	if len(a) <= 0 {
+		log.Verbosef("no artifacts")
+		return
+	}
+
+	sort.StringSlice(a).Sort()
+
+	fmt.Fprint(w, "AGENT\tURL\tMB\tUSED\tCONTAINERS\n")
+
+	for _, s := range a {
+		fmt.Fprint(w, s)
+	}
+
+	w.Flush()
+}
@@ -1,10 +1,12 @@
 package agent
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/codegangsta/cli"
 
@@ -21,32 +23,75 @@ var logCommand = cli.Command{
 		cli.IntFlag{
 			Name:  "n, history",
 			Value: 0,
-			Usage: "historical log lines to include",
+			Usage: "historical log lines to include, all of them with --since or --until",
+		},
+		cli.StringFlag{
+			Name:  "since",
+			Value: "",
+			Usage: "include log lines since this time (RFC 3339, or a duration ago, e.g. 1h)",
+		},
+		cli.StringFlag{
+			Name:  "until",
+			Value: "",
+			Usage: "include log lines until this time (RFC 3339, or a duration ago), and stop",
+		},
+		cli.StringFlag{
+			Name:  "filter",
+			Value: "",
+			Usage: "only include log lines containing this string",
+		},
+		cli.StringFlag{
+			Name:  "regexp",
+			Value: "",
+			Usage: "only include log lines matching this regular expression",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print log entries as JSON, one per line, with their timestamp, stream and generation",
 		},
 	},
 }
 
-const logUsage = "log <ID>"
+const logUsage = "log [--since <time>] [--until <time>] <ID>"
 
 func logAction(c *cli.Context) {
 	var (
-		id = c.Args().First()
-		n  = c.Int("history")
-		ch = make(chan (<-chan string), len(endpoints))
-		wg = sync.WaitGroup{}
+		id    = c.Args().First()
+		query = agent.LogQuery{
+			History: c.Int("history"),
+			Filter:  c.String("filter"),
+			Regexp:  c.String("regexp"),
+		}
+		asJSON    = c.Bool("json")
+		checkSeqs = c.String("filter") == "" && c.String("regexp") == "" // every entry is streamed
+		ch        = make(chan (<-chan agent.LogEntry), len(endpoints))
+		wg        = sync.WaitGroup{}
+		err       error
 	)
 
 	if id == "" {
 		log.Fatalf("usage: %s", logUsage)
 	}
 
+	if query.Since, err = parseLogTime(c.String("since")); err != nil {
+		log.Fatalf("invalid --since: %s", err)
+	}
+
+	if query.Until, err = parseLogTime(c.String("until")); err != nil {
+		log.Fatalf("invalid --until: %s", err)
+	}
+
+	if (!query.Since.IsZero() || !query.Until.IsZero()) && !c.IsSet("n") && !c.IsSet("history") {
+		query.History = agent.MaxLogHistory
+	}
+
 	// Non-graceful termination, as the agent.Log's Stopper is nonresponsive
 	// if the container doesn't output a steady stream of log lines. We should
 	// probably fix that.
 
 	for _, u := range endpoints {
 		go func(u *url.URL) {
-			var c <-chan string
+			var c <-chan agent.LogEntry
 			defer func() { ch <- c }()
 
 			client, err := agent.NewClient(u.String())
@@ -57,7 +102,7 @@ func logAction(c *cli.Context) {
 
 			log.Verbosef("%s: checking %s...", u.Host, id)
 
-			c, _, err = client.Log(id, n)
+			c, _, err = client.Log(id, query)
 			if err == agent.ErrContainerNotExist {
 				log.Verbosef("%s: %s doesn't exist", u.Host, id)
 				return
@@ -79,11 +124,95 @@ func logAction(c *cli.Context) {
 		wg.Add(1)
 
 		go func() {
-			for line := range c {
-				fmt.Fprintf(os.Stdout, line)
+			defer wg.Done()
+
+			seqs := logSeqs{}
+
+			for entry := range c {
+				var missing uint64
+				if checkSeqs {
+					missing = seqs.missing(entry)
+				}
+
+				printLogEntry(entry, missing, asJSON)
 			}
 		}()
 	}
 
 	wg.Wait()
 }
+
+// logSeqs tracks the Seq of the last entry of every container and
+// generation of a log stream.
+type logSeqs map[logSeqKey]uint64
+
+type logSeqKey struct {
+	containerID string
+	generation  uint
+}
+
+// missing returns the number of entries missing from the stream right before
+// entry, judging by its Seq. Unnumbered entries, and entries whose Seq starts
+// over, e.g. after the agent restarted, don't count as missing any.
+func (s logSeqs) missing(entry agent.LogEntry) uint64 {
+	if entry.Seq == 0 {
+		return 0
+	}
+
+	key := logSeqKey{entry.ContainerID, entry.Generation}
+
+	last, ok := s[key]
+	s[key] = entry.Seq
+
+	if !ok || entry.Seq <= last {
+		return 0
+	}
+
+	return entry.Seq - last - 1
+}
+
+// printLogEntry prints the line of entry to the stream it was written to, or
+// the entry as JSON to stdout. Lines dropped before the entry are reported:
+// the lines the agent counted, or the missing entries, if more are missing.
+// The agent counts the entries a stream skipped, too, so they aren't added.
+func printLogEntry(entry agent.LogEntry, missing uint64, asJSON bool) {
+	dropped := entry.Dropped
+	if missing > dropped {
+		dropped = missing
+	}
+
+	if dropped > 0 {
+		log.Warnf("%s: %d log lines dropped", entry.ContainerID, dropped)
+	}
+	if asJSON {
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			log.Warnf("%s", err)
+			return
+		}
+
+		fmt.Fprintf(os.Stdout, "%s\n", buf)
+		return
+	}
+
+	if entry.Stream == agent.LogStreamStderr {
+		fmt.Fprintln(os.Stderr, entry.Line)
+		return
+	}
+
+	fmt.Fprintln(os.Stdout, entry.Line)
+}
+
+// parseLogTime parses an RFC 3339 time, or a duration before now. The empty
+// string is the zero time.
+func parseLogTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, s)
+}
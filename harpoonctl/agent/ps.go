@@ -90,13 +90,13 @@ func WriteContainerPS(w writeFlusher, m map[string]map[string]agent.ContainerIns
 					"%s\t%s\t%s\t%ds\t%dM\t%d\t%d\t%d\t%s\t%d\t%s\n",
 					host,
 					id,
-					ci.ContainerStatus,
+					renderStatus(ci),
 					ci.ContainerMetrics.CPUTime/1e9,           // ns -> s
 					ci.ContainerMetrics.MemoryUsage/1024/1024, // B -> MB
 					ci.FD,
 					ci.Restarts,
 					ci.OOMs,
-					ci.Command.Exec[0],
+					renderCommand(ci.Command),
 					ci.ExitStatus,
 					renderPorts(host, ci.Ports),
 				))
@@ -110,8 +110,8 @@ func WriteContainerPS(w writeFlusher, m map[string]map[string]agent.ContainerIns
 					"%s\t%s\t%s\t%s\n",
 					host,
 					id,
-					ci.ContainerStatus,
-					ci.Command.Exec[0],
+					renderStatus(ci),
+					renderCommand(ci.Command),
 				))
 			}
 		}
@@ -125,6 +125,33 @@ func WriteContainerPS(w writeFlusher, m map[string]map[string]agent.ContainerIns
 	w.Flush()
 }
 
+// renderStatus renders the status of the container, with the progress of its
+// creation, unless it's ready.
+func renderStatus(ci agent.ContainerInstance) string {
+	switch ci.CreationPhase {
+	case agent.CreationPhaseDownloading:
+		if ci.BytesTotal > 0 {
+			return fmt.Sprintf("%s (%s %dM/%dM)", ci.ContainerStatus, ci.CreationPhase, ci.BytesTransferred/1024/1024, ci.BytesTotal/1024/1024)
+		}
+		return fmt.Sprintf("%s (%s %dM)", ci.ContainerStatus, ci.CreationPhase, ci.BytesTransferred/1024/1024)
+
+	case agent.CreationPhaseExtracting, agent.CreationPhaseFailed:
+		return fmt.Sprintf("%s (%s)", ci.ContainerStatus, ci.CreationPhase)
+	}
+
+	return string(ci.ContainerStatus)
+}
+
+// renderCommand renders the command of the container, which images declare
+// only once they've been fetched.
+func renderCommand(c agent.Command) string {
+	if len(c.Exec) <= 0 {
+		return "-"
+	}
+
+	return c.Exec[0]
+}
+
 func renderPorts(host string, ports map[string]uint16) string {
 	var a []string
 	for _, port := range ports {
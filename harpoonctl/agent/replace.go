@@ -1,46 +1,123 @@
 package agent
 
 import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"time"
+
 	"github.com/codegangsta/cli"
 
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 	"github.com/soundcloud/harpoon/harpoonctl/log"
 )
 
 var replaceCommand = cli.Command{
 	Name:        "replace",
-	Usage:       "Create-or-update and start a container",
+	Usage:       "Replace a running container with a new one",
 	Description: replaceUsage,
 	Action:      replaceAction,
 	Flags:       []cli.Flag{waitTimeoutFlag, downloadTimeoutFlag},
 }
 
-const replaceUsage = "replace <old ID> <new manifest.json>"
+const replaceUsage = "replace <old ID> <new ID> <new manifest.json>"
 
 func replaceAction(c *cli.Context) {
-	if len(c.Args()) != 2 {
+	if len(c.Args()) != 3 {
 		log.Fatalf("usage: %s", replaceUsage)
 	}
 
 	var (
-		id              = c.Args()[0]
-		filename        = c.Args()[1]
+		oldID           = c.Args()[0]
+		newID           = c.Args()[1]
+		filename        = c.Args()[2]
 		waitTimeout     = c.Duration("wait-timeout")
 		downloadTimeout = c.Duration("download-timeout")
 	)
 
-	// Most-naïve implementation.
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Fatalf("%s: %s", filename, err)
+	}
+	defer f.Close()
+
+	var cfg agent.ContainerConfig
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		log.Fatalf("%s: %s", filename, err)
+	}
+
+	if err := cfg.Valid(); err != nil {
+		log.Fatalf("%s: %s", filename, err)
+	}
+
+	u := findEndpoint(oldID)
+
+	client, err := agent.NewClient(u.String())
+	if err != nil {
+		log.Fatalf("%s: %s", u.Host, err)
+	}
 
-	log.Verbosef("stopping existing %s, if any", id)
-	stop(id, waitTimeout)
+	// The agent deletes the old container if the replacement succeeds, and
+	// the new container if it fails. The agent sends the current state first,
+	// once later changes are subscribed to, so waiting for it before issuing
+	// the Replace call makes sure no deletion is missed.
+	events, stopper, err := client.Events()
+	if err != nil {
+		log.Fatalf("%s: %s", u.Host, err)
+	}
+	defer stopper.Stop()
 
-	log.Verbosef("destroying existing %s, if any", id)
-	destroy(id, waitTimeout)
+	if _, ok := <-events; !ok {
+		log.Fatalf("%s: event stream closed", u.Host)
+	}
 
-	log.Verbosef("creating %s with %s", id, filename)
-	create(id, filename, downloadTimeout, false)
+	if err := client.Replace(newID, oldID, cfg); err != nil {
+		log.Fatalf("%s: %s", u.Host, err)
+	}
 
-	log.Verbosef("starting %s", id)
-	start(id, waitTimeout)
+	log.Printf("%s: replace %s with %s (%s) requested", u.Host, oldID, newID, filename)
+
+	timeoutc := time.After(downloadTimeout + waitTimeout)
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				log.Fatalf("%s: while waiting for replacement: event stream closed", u.Host)
+			}
+
+			if instance, ok := event.Containers[oldID]; ok && instance.ContainerStatus == agent.ContainerStatusDeleted {
+				log.Printf("%s: replace %s with %s OK", u.Host, oldID, newID)
+				return
+			}
+
+			if instance, ok := event.Containers[newID]; ok && instance.ContainerStatus == agent.ContainerStatusDeleted {
+				log.Fatalf("%s: %s failed to start; %s left unchanged", u.Host, newID, oldID)
+			}
+
+		case <-timeoutc:
+			log.Fatalf("%s: while waiting for replacement: %s", u.Host, agent.ErrTimeout)
+		}
+	}
+}
+
+// findEndpoint returns the endpoint of the agent running the container.
+func findEndpoint(id string) *url.URL {
+	for _, u := range endpoints {
+		c, err := agent.NewClient(u.String())
+		if err != nil {
+			log.Warnf("%s: %s", u.Host, err)
+			continue
+		}
+
+		if _, err := c.Get(id); err != nil {
+			log.Verbosef("%s: %s", u.Host, err)
+			continue
+		}
+
+		return u
+	}
 
-	log.Printf("successfully replaced %s", id)
+	log.Fatalf("%s: not found on any agent", id)
+	return nil
 }
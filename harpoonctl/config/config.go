@@ -41,6 +41,11 @@ var Command = cli.Command{
 			Value: "http://ent.int.s-cloud.net/iss/simpleweb.tar.gz",
 			Usage: "artifact URL",
 		},
+		cli.StringFlag{
+			Name:  "artifact_sha256",
+			Value: "",
+			Usage: "hex-encoded SHA-256 digest of the artifact, verified by the agent (optional)",
+		},
 		cli.StringSliceFlag{
 			Name:  "port",
 			Value: &cli.StringSlice{},
@@ -181,12 +186,13 @@ func configAction(c *cli.Context) {
 	}
 
 	cfg := agent.ContainerConfig{
-		Product:     c.String("product"),
-		Environment: c.String("environment"),
-		Job:         c.String("job"),
-		ArtifactURL: c.String("artifact_url"),
-		Ports:       ports,
-		Env:         env,
+		Product:        c.String("product"),
+		Environment:    c.String("environment"),
+		Job:            c.String("job"),
+		ArtifactURL:    c.String("artifact_url"),
+		ArtifactSHA256: c.String("artifact_sha256"),
+		Ports:          ports,
+		Env:            env,
 		Command: agent.Command{
 			WorkingDir: c.String("working_dir"),
 			Exec:       strings.Split(c.String("exec"), " "), // TODO(pb): maybe something nicer
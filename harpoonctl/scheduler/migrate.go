@@ -1,11 +1,14 @@
 package scheduler
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -13,39 +16,67 @@ import (
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	schedulerapi "github.com/soundcloud/harpoon/harpoon-scheduler/api"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/registry"
 	"github.com/soundcloud/harpoon/harpoon-scheduler/xf"
 	"github.com/soundcloud/harpoon/harpoonctl/log"
 )
 
 var migrateCommand = cli.Command{
 	Name:        "migrate",
-	Usage:       "migrate old.json new.json",
-	Description: "Interactively migrate an existing job (old.json) to a new configuration (new.json).",
+	Usage:       "migrate <old.json / hash> new.json",
+	Description: "Migrate an existing job (old.json or its hash) to a new configuration (new.json), and watch its progress. If new tasks fail, the migration times out, or it's interrupted, the migration is rolled back: the new job is unscheduled, and the old job is restored.",
 	Action:      migrateAction,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "max-surge",
+			Value: 1,
+			Usage: "max number of tasks above the new scale during the migration",
+		},
+		cli.IntFlag{
+			Name:  "max-unavailable",
+			Value: 0,
+			Usage: "max number of unavailable tasks below the new scale during the migration",
+		},
+		cli.IntFlag{
+			Name:  "max-restarts",
+			Value: 0,
+			Usage: "max number of restarts of any new task before the migration is rolled back",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: 10 * time.Minute,
+			Usage: "max duration of the migration before it's rolled back",
+		},
+	},
 }
 
 func migrateAction(c *cli.Context) {
 	if len(c.Args()) != 2 {
-		log.Fatalf("usage: migrate old.json new.json")
+		log.Fatalf("usage: migrate <old.json / hash> new.json")
 	}
 
 	var (
-		oldFilename = c.Args().Get(0)
+		oldArg      = c.Args().Get(0)
 		newFilename = c.Args().Get(1)
+		oldHash     = oldArg
 	)
 
-	oldJobBuf, err := ioutil.ReadFile(oldFilename)
-	if err != nil {
-		log.Fatalf("%s: %s", oldFilename, err)
-	}
+	if oldJobBuf, err := ioutil.ReadFile(oldArg); err == nil {
+		log.Verbosef("interpreting %s as a config file", oldArg)
 
-	var oldJob configstore.JobConfig
-	if err := json.Unmarshal(oldJobBuf, &oldJob); err != nil {
-		log.Fatalf("%s: %s", oldFilename, err)
-	}
+		var oldJob configstore.JobConfig
+		if err := json.Unmarshal(oldJobBuf, &oldJob); err != nil {
+			log.Fatalf("%s: %s", oldArg, err)
+		}
 
-	if err := oldJob.Valid(); err != nil {
-		log.Fatalf("%s: %s", oldFilename, err)
+		if err := oldJob.Valid(); err != nil {
+			log.Fatalf("%s: %s", oldArg, err)
+		}
+
+		oldHash = oldJob.Hash()
+	} else {
+		log.Verbosef("interpreting %s as job config hash", oldArg)
 	}
 
 	newJobBuf, err := ioutil.ReadFile(newFilename)
@@ -62,182 +93,343 @@ func migrateAction(c *cli.Context) {
 		log.Fatalf("%s: %s", newFilename, err)
 	}
 
-	if oldJob.Job != newJob.Job {
-		log.Fatalf("can't migrate different jobs (from %q to %q)", oldJob.Job, newJob.Job)
+	if err := migrate(schedulerapi.MigrateRequest{
+		From:           oldHash,
+		To:             newJob,
+		MaxSurge:       c.Int("max-surge"),
+		MaxUnavailable: c.Int("max-unavailable"),
+	}); err != nil {
+		log.Fatalf("%s: %s", endpoint.Host, err)
 	}
 
 	// Migrate is a stateful action, so we need to be more careful.
 
 	var (
-		signalc    = make(chan os.Signal) // ctrl-C
-		interruptc = make(chan struct{})  // into migrate goroutine
-		errc       = make(chan error)     // out of migrate goroutine
+		signalc    = make(chan os.Signal, 1) // ctrl-C
+		interruptc = make(chan struct{})     // into watch goroutine
+		errc       = make(chan error)        // out of watch goroutine
+		w          = migrationWatch{
+			job:         newJob.Job,
+			from:        oldHash,
+			to:          newJob.Hash(),
+			timeout:     c.Duration("timeout"),
+			maxRestarts: uint(c.Int("max-restarts")),
+		}
 	)
 
 	signal.Notify(signalc, syscall.SIGINT, syscall.SIGTERM)
-	go func() { errc <- migrate(oldJob, newJob, interruptc) }()
+	go func() { errc <- w.watch(interruptc) }()
 
 	select {
 	case sig := <-signalc:
 		log.Errorf("received %s, terminating migration...", sig)
 		close(interruptc)
-		log.Fatalf("migration failed: %s", <-errc)
+		err = <-errc
 
-	case err := <-errc:
-		if err != nil {
-			log.Fatalf("migration failed: %s", err)
-		}
+	case err = <-errc:
 	}
 
-	log.Printf("migration complete")
-}
+	if err == nil {
+		log.Printf("migration complete")
+		return
+	}
 
-func migrate(oldJob, newJob configstore.JobConfig, interruptc chan struct{}) error {
-	abortable := func(f func() error) error {
-		errc := make(chan error, 1)
+	log.Errorf("migration failed: %s", err)
 
-		go func() { errc <- f() }()
+	if err := rollback(w.job, w.from, c.Duration("timeout")); err != nil {
+		log.Fatalf("rollback failed: %s", err)
+	}
 
-		select {
-		case <-interruptc:
-			return fmt.Errorf("interrupted")
-		case err := <-errc:
-			return err
-		}
+	log.Fatalf("migration rolled back")
+}
+
+func migrate(req schedulerapi.MigrateRequest) error {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
 	}
 
-	var (
-		scheduleTimeout   = newJob.Grace.Startup.Duration * 2
-		unscheduleTimeout = oldJob.Grace.Shutdown.Duration * 2
+	httpReq, err := http.NewRequest(
+		"PUT",
+		endpoint.String()+schedulerapi.APIVersionPrefix+schedulerapi.APIMigratePath,
+		bytes.NewReader(buf),
 	)
-
-	// Schedule new job.
-	if err := abortable(func() error { return schedule(newJob) }); err != nil {
-		return fmt.Errorf("request to schedule new job failed: %s", err)
+	if err != nil {
+		return err
 	}
 
-	// Wait for all new tasks to be running.
-	if err := abortable(func() error { return waitForRunning(tasksFor(newJob), scheduleTimeout) }); err != nil {
-		return fmt.Errorf("when waiting for new tasks: %s", err)
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	// Unschedule old job.
-	if err := abortable(func() error { return unscheduleConfig(oldJob) }); err != nil {
-		return fmt.Errorf("request to unschedule old job failed: %s", err)
+	var r schedulerapi.Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
 	}
 
-	// Wait for all old tasks to be terminated.
-	if err := abortable(func() error { return waitForDeleted(tasksFor(oldJob), unscheduleTimeout) }); err != nil {
-		return fmt.Errorf("when waiting for old tasks: %s", err)
+	if r.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("%s - %s", http.StatusText(r.StatusCode), r.Message)
 	}
 
+	log.Printf("%s: %s - %s", endpoint.Host, http.StatusText(r.StatusCode), r.Message)
 	return nil
 }
 
-func tasksFor(c configstore.JobConfig) []string {
-	var (
-		hash    = c.Hash()
-		taskIDs = []string{}
-	)
-
-	for i := 0; i < c.Scale; i++ {
-		taskIDs = append(taskIDs, xf.MakeContainerID(hash, i))
-	}
-
-	return taskIDs
+// migrationWatch follows the migration of job from one job config (by hash)
+// to another.
+type migrationWatch struct {
+	job         string
+	from        string
+	to          string
+	timeout     time.Duration
+	maxRestarts uint
 }
 
-func waitForRunning(taskIDs []string, timeout time.Duration) error {
+// watch prints the progress of the migration, and returns once it's complete.
+// It returns an error, summarizing all failures, if any new task fails, the
+// timeout elapses, or interruptc is closed.
+func (w migrationWatch) watch(interruptc <-chan struct{}) error {
 	var (
 		begin    = time.Now()
-		deadline = begin.Add(timeout)
-		interval = 250 * time.Millisecond
-		want     = map[string]struct{}{}
+		deadline = time.After(w.timeout)
+		tick     = time.Tick(250 * time.Millisecond)
+		last     registry.Migration
 	)
 
-	for _, id := range taskIDs {
-		want[id] = struct{}{}
-	}
+	for {
+		select {
+		case <-interruptc:
+			return fmt.Errorf("interrupted")
+
+		case <-deadline:
+			return fmt.Errorf("timeout (%s) exceeded", w.timeout)
 
-	for _ = range time.Tick(interval) {
-		if time.Now().After(deadline) {
-			return fmt.Errorf("timeout (%s) exceeded", timeout)
+		case <-tick:
 		}
 
-		m, err := currentState()
+		migrations, err := currentMigrations()
 		if err != nil {
 			log.Warnf("%s: %s", endpoint.Host, err)
 			continue
 		}
 
-		have := map[string]struct{}{}
+		m, ok := migrations[w.job]
+		// The old job config may be scheduled under its legacy hash, so
+		// the migration is identified by its new job config.
+		if !ok || m.To.Hash() != w.to {
+			return fmt.Errorf("migration of %s from %s to %s not found", w.job, w.from, w.to)
+		}
+
+		if m.FromScale != last.FromScale || m.ToScale != last.ToScale {
+			log.Printf("%s: %d old task(s) (%s), %d/%d new task(s) (%s) desired", w.job, m.FromScale, m.From, m.ToScale, m.To.Scale, w.to)
+		}
 
-		for _, e := range m {
-			for id, ci := range e.Containers {
-				if _, ok := want[id]; ok && ci.ContainerStatus == agent.ContainerStatusRunning {
-					have[id] = struct{}{}
-				}
-			}
+		switch m.State {
+		case registry.MigrationStateComplete:
+			log.Printf("%s migrated in %s", w.job, time.Since(begin))
+			return nil
+
+		case registry.MigrationStateAborted:
+			return fmt.Errorf("migration aborted on the scheduler")
 		}
 
-		if len(have) < len(want) {
-			log.Verbosef("waiting for %d task(s) to be started: %d started, %d still pending", len(want), len(have), len(want)-len(have))
+		last = m
+
+		state, err := currentState()
+		if err != nil {
+			log.Warnf("%s: %s", endpoint.Host, err)
 			continue
 		}
 
-		log.Printf("%d task(s) started in %s", len(taskIDs), time.Since(begin))
-		return nil
+		if failures := taskFailures(state, w.to, m.ToScale, w.maxRestarts); len(failures) > 0 {
+			return fmt.Errorf("%d new task failure(s): %s", len(failures), strings.Join(failures, "; "))
+		}
 	}
+}
 
-	panic("unreachable")
+// taskFailures inspects the process state of the first scale tasks of the
+// job config hash, and describes every task that failed.
+func taskFailures(state map[string]agent.StateEvent, hash string, scale int, maxRestarts uint) []string {
+	var failures []string
+
+	for i := 0; i < scale; i++ {
+		id := xf.MakeContainerID(hash, i)
+
+		for endpoint, e := range state {
+			instance, ok := e.Containers[id]
+			if !ok {
+				continue
+			}
+
+			if reason := taskFailure(instance, maxRestarts); reason != "" {
+				failures = append(failures, fmt.Sprintf("%s on %s: %s", id, endpoint2host(endpoint), reason))
+			}
+		}
+	}
+
+	return failures
 }
 
-func waitForDeleted(taskIDs []string, timeout time.Duration) error {
+// taskFailure returns a description of why the task failed, or the empty
+// string if it didn't.
+func taskFailure(instance agent.ContainerInstance, maxRestarts uint) string {
 	var (
-		begin    = time.Now()
-		deadline = begin.Add(timeout)
-		interval = 250 * time.Millisecond
-		want     = map[string]struct{}{}
+		s       = instance.ContainerProcessState
+		reasons []string
 	)
 
-	for _, id := range taskIDs {
-		want[id] = struct{}{}
+	if s.OOMs > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d OOM(s)", s.OOMs))
 	}
 
-	for _ = range time.Tick(interval) {
-		if time.Now().After(deadline) {
-			return fmt.Errorf("timeout (%s) exceeded", timeout)
+	if s.Restarts > maxRestarts {
+		reasons = append(reasons, fmt.Sprintf("%d restart(s)", s.Restarts))
+	}
+
+	if s.Err != "" {
+		reasons = append(reasons, s.Err)
+	}
+
+	switch {
+	case s.Up:
+	case s.Exited && s.ExitStatus != 0:
+		reasons = append(reasons, fmt.Sprintf("exit status %d", s.ExitStatus))
+	case s.Signaled:
+		reasons = append(reasons, fmt.Sprintf("killed by signal %d", s.Signal))
+	}
+
+	switch instance.ContainerStatus {
+	case agent.ContainerStatusFailed, agent.ContainerStatusFinished:
+		reasons = append(reasons, fmt.Sprintf("container %s", instance.ContainerStatus))
+	}
+
+	return strings.Join(reasons, ", ")
+}
+
+// rollback aborts the migration of job on the scheduler, which unschedules
+// the new job config and restores the old one, and waits until all tasks of
+// the old job config are running.
+func rollback(job, from string, timeout time.Duration) error {
+	migrations, err := currentMigrations()
+	if err != nil {
+		return err
+	}
+
+	switch m := migrations[job]; m.State {
+	case registry.MigrationStateRunning:
+		if err := abortMigration(job); err != nil {
+			return err
+		}
+
+	case registry.MigrationStateComplete:
+		return fmt.Errorf("migration of %s already completed", job)
+	}
+
+	scheduled, err := client.Registry()
+	if err != nil {
+		return err
+	}
+
+	// Tasks are named after the key of their job config in the registry,
+	// which may be its legacy hash.
+	if _, ok := scheduled[from]; !ok {
+		for key, cfg := range scheduled {
+			if cfg.Hash() == from {
+				from = key
+				break
+			}
+		}
+	}
+
+	cfg, ok := scheduled[from]
+	if !ok {
+		return fmt.Errorf("old job %s is no longer scheduled", from)
+	}
+
+	var (
+		deadline = time.After(timeout)
+		tick     = time.Tick(250 * time.Millisecond)
+	)
+
+	for {
+		select {
+		case <-deadline:
+			return fmt.Errorf("timeout (%s) exceeded when waiting for old tasks", timeout)
+		case <-tick:
 		}
 
-		m, err := currentState()
+		state, err := currentState()
 		if err != nil {
 			log.Warnf("%s: %s", endpoint.Host, err)
 			continue
 		}
 
-		for wantID := range want {
-			if found := func() bool {
-				for _, e := range m {
-					for foundID := range e.Containers {
-						if wantID == foundID {
-							return true
-						}
-					}
+		running := 0
+
+		for i := 0; i < cfg.Scale; i++ {
+			id := xf.MakeContainerID(from, i)
+
+			for _, e := range state {
+				if instance, ok := e.Containers[id]; ok && instance.ContainerStatus == agent.ContainerStatusRunning {
+					running++
+					break
 				}
-				return false
-			}(); found {
-				delete(want, wantID)
 			}
 		}
 
-		if len(want) > 0 {
-			log.Verbosef("waiting for %d task(s) to be stopped: %d stopped, %d still pending", len(taskIDs), len(taskIDs)-len(want), len(want))
+		if running < cfg.Scale {
+			log.Verbosef("waiting for old tasks: %d/%d running", running, cfg.Scale)
 			continue
 		}
 
-		log.Printf("%d task(s) stopped in %s", len(taskIDs), time.Since(begin))
+		log.Printf("old job %s intact: %d/%d task(s) running", from, running, cfg.Scale)
 		return nil
 	}
+}
+
+func abortMigration(job string) error {
+	req, err := http.NewRequest(
+		"DELETE",
+		endpoint.String()+schedulerapi.APIVersionPrefix+schedulerapi.APIMigratePath+"/"+job,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r schedulerapi.Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+
+	log.Printf("%s: %s - %s", endpoint.Host, http.StatusText(r.StatusCode), r.Message)
+
+	if r.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("%s - %s", http.StatusText(r.StatusCode), r.Message)
+	}
+
+	return nil
+}
+
+func currentMigrations() (map[string]registry.Migration, error) {
+	resp, err := http.Get(endpoint.String() + schedulerapi.APIVersionPrefix + schedulerapi.APIMigratePath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var m map[string]registry.Migration
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("when parsing response: %s", err)
+	}
 
-	panic("unreachable")
+	return m, nil
 }
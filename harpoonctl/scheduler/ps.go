@@ -1,9 +1,6 @@
 package scheduler
 
 import (
-	"encoding/json"
-	"fmt"
-	"net/http"
 	"net/url"
 	"os"
 	"text/tabwriter"
@@ -11,7 +8,6 @@ import (
 	"github.com/codegangsta/cli"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
-	schedulerapi "github.com/soundcloud/harpoon/harpoon-scheduler/api"
 	agentcmd "github.com/soundcloud/harpoon/harpoonctl/agent"
 	"github.com/soundcloud/harpoon/harpoonctl/log"
 )
@@ -43,18 +39,7 @@ func psAction(c *cli.Context) {
 }
 
 func currentState() (map[string]agent.StateEvent, error) {
-	resp, err := http.Get(endpoint.String() + schedulerapi.APIVersionPrefix + schedulerapi.APIProxyPath)
-	if err != nil {
-		return map[string]agent.StateEvent{}, err
-	}
-	defer resp.Body.Close()
-
-	var m map[string]agent.StateEvent
-	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
-		return map[string]agent.StateEvent{}, fmt.Errorf("when parsing response: %s", err)
-	}
-
-	return m, nil
+	return client.Proxy()
 }
 
 func se2ci(m map[string]agent.StateEvent) map[string]map[string]agent.ContainerInstance {
@@ -10,7 +10,6 @@ import (
 
 	"github.com/codegangsta/cli"
 
-	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
 	schedulerapi "github.com/soundcloud/harpoon/harpoon-scheduler/api"
 	"github.com/soundcloud/harpoon/harpoonctl/log"
 )
@@ -23,20 +22,14 @@ var registryCommand = cli.Command{
 }
 
 func registryAction(c *cli.Context) {
-	var (
-		m = map[string]configstore.JobConfig{}
-		w = tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
-	)
+	w := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
 
-	resp, err := http.Get(endpoint.String() + schedulerapi.APIVersionPrefix + schedulerapi.APIRegistryPath)
+	m, err := client.Registry()
 	if err != nil {
-		log.Fatalf("%s", err)
+		log.Fatalf("%s: %s", endpoint.Host, err)
 	}
-	defer resp.Body.Close()
 
-	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
-		log.Fatalf("%s: when parsing response: %s", endpoint.Host, err)
-	}
+	refs := registryRefs()
 
 	// Don't display header if we didn't have any rows.
 	if len(m) <= 0 {
@@ -46,11 +39,17 @@ func registryAction(c *cli.Context) {
 
 	a := []string{}
 
-	fmt.Fprint(w, "HASH\tJOB\tENV\tPROD\tSCALE\tCMD\tARTIFACT\n")
-	for _, c := range m {
+	fmt.Fprint(w, "HASH\tREF\tJOB\tENV\tPROD\tSCALE\tCMD\tARTIFACT\n")
+	for hash, c := range m {
+		ref, ok := refs[hash]
+		if !ok {
+			ref = "-"
+		}
+
 		a = append(a, fmt.Sprintf(
-			"%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
-			c.Hash(),
+			"%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			hash,
+			ref,
 			c.Job,
 			c.Environment,
 			c.Product,
@@ -68,3 +67,27 @@ func registryAction(c *cli.Context) {
 
 	w.Flush()
 }
+
+// registryRefs returns the config store references of the scheduled jobs. Jobs
+// that weren't scheduled by reference, or schedulers that don't support
+// references, yield no entries.
+func registryRefs() map[string]string {
+	refs := map[string]string{}
+
+	resp, err := http.Get(endpoint.String() + schedulerapi.APIVersionPrefix + schedulerapi.APIRefsPath)
+	if err != nil {
+		log.Verbosef("%s: refs: %s", endpoint.Host, err)
+		return refs
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return refs
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&refs); err != nil {
+		log.Verbosef("%s: when parsing refs: %s", endpoint.Host, err)
+	}
+
+	return refs
+}
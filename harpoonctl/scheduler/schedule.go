@@ -1,15 +1,12 @@
 package scheduler
 
 import (
-	"bytes"
 	"encoding/json"
 	"io/ioutil"
-	"net/http"
 
 	"github.com/codegangsta/cli"
 
 	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
-	schedulerapi "github.com/soundcloud/harpoon/harpoon-scheduler/api"
 	"github.com/soundcloud/harpoon/harpoonctl/log"
 )
 
@@ -17,14 +14,34 @@ var scheduleCommand = cli.Command{
 	Name:        "schedule",
 	ShortName:   "sched",
 	Usage:       "schedule jobconfig.json",
-	Description: "Schedules a job, as specified by jobconfig.json.",
+	Description: "Schedules a job, as specified by jobconfig.json, or by a reference to a job config in the scheduler's config store.",
 	Action:      scheduleAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "ref",
+			Value: "",
+			Usage: "schedule the job config stored under this reference in the config store",
+		},
+	},
 }
 
 func scheduleAction(c *cli.Context) {
+	if ref := c.String("ref"); ref != "" {
+		if len(c.Args()) != 0 {
+			log.Fatalf("usage: schedule --ref <ref>")
+		}
+
+		if err := client.ScheduleRef(ref); err != nil {
+			log.Fatalf("%s: %s", endpoint.Host, err)
+		}
+
+		log.Printf("%s: scheduled %s", endpoint.Host, ref)
+		return
+	}
+
 	filename := c.Args().First()
 	if filename == "" {
-		log.Fatalf("usage: schedule <jobconfig.json>")
+		log.Fatalf("usage: schedule <jobconfig.json> | --ref <ref>")
 	}
 
 	buf, err := ioutil.ReadFile(filename)
@@ -41,39 +58,10 @@ func scheduleAction(c *cli.Context) {
 		log.Fatalf("%s: %s", filename, err)
 	}
 
-	if err := schedule(cfg); err != nil {
-		log.Fatalf("%s: %s", endpoint.Host, err)
-	}
-
-	log.Verbosef("schedule %s OK", cfg.Job)
-}
-
-func schedule(cfg configstore.JobConfig) error {
-	buf, err := json.Marshal(cfg)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest(
-		"PUT",
-		endpoint.String()+schedulerapi.APIVersionPrefix+schedulerapi.APISchedulePath,
-		bytes.NewReader(buf),
-	)
+	hash, err := client.Schedule(cfg)
 	if err != nil {
-		return err
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	var r schedulerapi.Response
-	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		return err
+		log.Fatalf("%s: %s", endpoint.Host, err)
 	}
 
-	log.Printf("%s: %s - %s", endpoint.Host, http.StatusText(r.StatusCode), r.Message)
-	return nil
+	log.Printf("%s: scheduled %s (%s)", endpoint.Host, cfg.Job, hash)
 }
@@ -10,6 +10,7 @@ import (
 
 	"github.com/codegangsta/cli"
 
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
 	"github.com/soundcloud/harpoon/harpoonctl/log"
 )
 
@@ -40,7 +41,10 @@ var (
 	defaultScheduler = filepath.Join(schedulerPath, "default")
 )
 
-var endpoint *url.URL
+var (
+	endpoint *url.URL
+	client   scheduler.Scheduler
+)
 
 func parseEndpoint(c *cli.Context) error {
 	// By default, connect to the scheduler on localhost.
@@ -80,6 +84,7 @@ func parseEndpoint(c *cli.Context) error {
 
 	log.Verbosef("using scheduler endpoint %s", u.String())
 	endpoint = u
+	client = scheduler.MustNewClient(u.String())
 
 	return nil
 }
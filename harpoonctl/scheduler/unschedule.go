@@ -1,15 +1,12 @@
 package scheduler
 
 import (
-	"bytes"
 	"encoding/json"
 	"io/ioutil"
-	"net/http"
 
 	"github.com/codegangsta/cli"
 
 	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
-	schedulerapi "github.com/soundcloud/harpoon/harpoon-scheduler/api"
 	"github.com/soundcloud/harpoon/harpoonctl/log"
 )
 
@@ -36,66 +33,23 @@ func unscheduleAction(c *cli.Context) {
 			log.Fatalf("%s: %s", arg, err)
 		}
 
-		if err := unscheduleConfig(cfg); err != nil {
+		if err := cfg.Valid(); err != nil {
 			log.Fatalf("%s: %s", arg, err)
 		}
-	} else {
-		log.Verbosef("interpreting %s as job config hash", arg)
 
-		if err := unscheduleHash(arg); err != nil {
-			log.Fatalf("%s: %s", arg, err)
+		hash, err := client.Unschedule(cfg)
+		if err != nil {
+			log.Fatalf("%s: %s", endpoint.Host, err)
 		}
-	}
-}
-
-func unscheduleConfig(cfg configstore.JobConfig) error {
-	if err := cfg.Valid(); err != nil {
-		return err
-	}
-
-	buf, err := json.Marshal(cfg)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest(
-		"PUT",
-		endpoint.String()+schedulerapi.APIVersionPrefix+schedulerapi.APIUnschedulePath,
-		bytes.NewReader(buf),
-	)
-	if err != nil {
-		return err
-	}
 
-	return unscheduleRequest(req)
-}
-
-func unscheduleHash(jobConfigHash string) error {
-	req, err := http.NewRequest(
-		"PUT",
-		endpoint.String()+schedulerapi.APIVersionPrefix+schedulerapi.APIUnschedulePath+"/"+jobConfigHash,
-		nil,
-	)
-	if err != nil {
-		log.Fatalf("%s", err)
-	}
-
-	return unscheduleRequest(req)
-}
+		log.Printf("%s: unscheduled %s (%s)", endpoint.Host, cfg.Job, hash)
+	} else {
+		log.Verbosef("interpreting %s as job config hash", arg)
 
-func unscheduleRequest(req *http.Request) error {
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+		if err := client.UnscheduleHash(arg); err != nil {
+			log.Fatalf("%s: %s", endpoint.Host, err)
+		}
 
-	var r schedulerapi.Response
-	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		return err
+		log.Printf("%s: unscheduled %s", endpoint.Host, arg)
 	}
-
-	log.Printf("%s: %s - %s", endpoint.Host, http.StatusText(r.StatusCode), r.Message)
-
-	return nil
 }